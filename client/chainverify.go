@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
 	"github.com/mit-dci/go-bverify/utils"
 
 	"github.com/mit-dci/go-bverify/logging"
 
-	btcwire "github.com/mit-dci/go-bverify/bitcoin/wire"
 	"github.com/mit-dci/go-bverify/wire"
 	"github.com/tidwall/buntdb"
 )
@@ -53,8 +54,8 @@ func (c *Client) getCommitment(hash []byte) (*wire.Commitment, error) {
 			return err
 		}
 
-		comm = wire.CommitmentFromBytes([]byte(b))
-		return nil
+		comm, err = wire.CommitmentFromBytes([]byte(b))
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -64,66 +65,50 @@ func (c *Client) getCommitment(hash []byte) (*wire.Commitment, error) {
 }
 
 // verifyCommitment will check a commitment's validity. It will verify the
-// validity of the commitment transaction
+// commitment transaction is in our header chain, and that it is a valid
+// commitment by the server that continues the chain of its commitments.
 func (c *Client) verifyCommitment(comm *wire.Commitment) error {
+	if comm.TxHash == nil || comm.IncludedInBlock == nil {
+		return invalidError{fmt.Errorf("Commitment %x is not included in a block", comm.Commitment)}
+	}
 	logging.Debugf("Verifying commitment %x (block %s)", comm.Commitment, comm.IncludedInBlock.String())
 	logging.Debugf("Transaction is %s", comm.TxHash.String())
 
 	// First and foremost, check if the block specified by the server is actually
-	// known to us in the header chain.
-	retry := 3
-	var header *btcwire.BlockHeader
-	var err error
-
-	// Start a retry loop. If the block isn't found right away, ask for headers
-	// and try again
-	for {
-		header, err = c.GetBlockHeaderByHash(comm.IncludedInBlock)
-		if err != nil {
-			retry--
-			if retry == 0 {
-				return err
-			}
-			// First try to sync headers and then try again
-			c.SPVAskHeaders()
-
-			for {
-				if c.SPVSynced() {
-					break
-				}
-				time.Sleep(1 * time.Second)
-			}
-		} else {
-			break
-		}
+	// known to us in the header chain. If it isn't, we may be missing headers,
+	// or the commitment transaction reorged and the server will tell us the
+	// new block once it has processed the reorg. The headers we ask for wake
+	// up the verification loop when they come in.
+	header, err := c.GetBlockHeaderByHash(comm.IncludedInBlock)
+	if err != nil {
+		c.SPVAskHeaders()
+		return fmt.Errorf("The server says commitment %x is in block %s (tx %s), but we don't have that: %s", comm.Commitment[:], comm.IncludedInBlock.String(), comm.TxHash.String(), err.Error())
 	}
 
 	logging.Debugf("Found the block specified in the commitment in our header chain")
 
-	// Now that we've found the header, we should verify the provided merkle proof
-	// actually checks out with the block's merkle root.
-	checksOut := comm.MerkleProof.Check(comm.TxHash, &header.MerkleRoot)
-	if !checksOut {
-		return fmt.Errorf("Merkle proof is incorrect")
-	} else {
-		logging.Debugf("Merkle proof is correct")
+	serverKey, err := c.pinServerKey(comm)
+	if err != nil {
+		return err
 	}
 
-	// This already looks very good, but in order to prove non-equivocation (the server
-	// might have made _more_ commitments than just this one. In order to check that,
-	// we check that the first input to the transaction is actually output 1 (the change)
-	// of the last commitment transaction. This is not needed for the "maiden" commitment
-	// which always has the hash 523e59cfc5235b915dc89de188d87449453b083a8b7d97c1ee64d875da403361
-	tx := btcwire.NewMsgTx(1)
-	tx.Deserialize(bytes.NewBuffer(comm.RawTx))
-
+	// In order to prove non-equivocation (the server might have made _more_
+	// commitments than just this one), the transaction has to spend the
+	// change of the last commitment. This is not possible for the "maiden"
+	// commitment which always has the hash
+	// 523e59cfc5235b915dc89de188d87449453b083a8b7d97c1ee64d875da403361
+	var prev *wire.Commitment
 	if bytes.Equal(comm.Commitment[:], utils.MaidenHash()) {
 		logging.Debugf("Skipping the TXO chain check since this is the first commitment")
+	} else if c.lastServerCommitment == nil {
+		return invalidError{fmt.Errorf("Commitment %x does not follow a commitment we know", comm.Commitment)}
 	} else {
-		logging.Debugf("Previous outpoint expected: [%x/1] - First input: [%x/%d]", c.lastServerCommitment.TxHash[:], tx.TxIn[0].PreviousOutPoint.Hash[:], tx.TxIn[0].PreviousOutPoint.Index)
-		if tx.TxIn[0].PreviousOutPoint.Index != 1 || !tx.TxIn[0].PreviousOutPoint.Hash.IsEqual(c.lastServerCommitment.TxHash) {
-			return fmt.Errorf("Commitment transaction's first input is not the change output of the last commitment. This breaks the chain and is invalid.")
-		}
+		prev = c.lastServerCommitment
+	}
+
+	err = validateCommitment(comm, header, prev, serverKey)
+	if err != nil {
+		return err
 	}
 	logging.Debugf("Everything checks out, this commitment is valid!")
 
@@ -158,22 +143,76 @@ func (c *Client) ClearCommitments() error {
 func (c *Client) getAllCommitments() ([]*wire.Commitment, error) {
 	returnVal := make([]*wire.Commitment, 0)
 	err := c.db.View(func(tx *buntdb.Tx) error {
-		return tx.AscendRange("", "commitment-", "commitment.", func(key, value string) bool {
+		var decodeErr error
+		err := tx.AscendRange("", "commitment-", "commitment.", func(key, value string) bool {
 			if key != "commitment-last" {
-				returnVal = append(returnVal, wire.CommitmentFromBytes([]byte(value)))
+				comm, err := wire.CommitmentFromBytes([]byte(value))
+				if err != nil {
+					decodeErr = fmt.Errorf("Could not read %s: %s", key, err.Error())
+					return false
+				}
+				returnVal = append(returnVal, comm)
 			}
 			return true
 		})
+		if err != nil {
+			return err
+		}
+		return decodeErr
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(returnVal, func(i, j int) bool {
-		return returnVal[i].TriggeredAtBlockHeight < returnVal[j].TriggeredAtBlockHeight
+	return orderCommitments(returnVal), nil
+}
+
+// orderCommitments puts commitments in the order the server made them. The
+// server can make several commitments before the first is mined, at the same
+// height, but each spends the change of the one before it.
+func orderCommitments(comms []*wire.Commitment) []*wire.Commitment {
+	sort.SliceStable(comms, func(i, j int) bool {
+		return comms[i].TriggeredAtBlockHeight < comms[j].TriggeredAtBlockHeight
 	})
 
-	return returnVal, nil
+	byTx := map[chainhash.Hash]*wire.Commitment{}
+	prev := map[*wire.Commitment]*wire.Commitment{}
+	next := map[*wire.Commitment]*wire.Commitment{}
+	for _, comm := range comms {
+		if comm.TxHash != nil {
+			byTx[*comm.TxHash] = comm
+		}
+	}
+	for _, comm := range comms {
+		tx, err := commitmentTx(comm)
+		if err != nil || len(tx.TxIn) == 0 {
+			continue
+		}
+		if p, ok := byTx[tx.TxIn[0].PreviousOutPoint.Hash]; ok && p != comm {
+			prev[comm] = p
+			next[p] = comm
+		}
+	}
+
+	ordered := make([]*wire.Commitment, 0, len(comms))
+	done := map[*wire.Commitment]bool{}
+	for _, comm := range comms {
+		// Start at the first commitment of its chain we did not order yet,
+		// and follow the chain from there
+		first := comm
+		for i := 0; i < len(comms); i++ {
+			p, ok := prev[first]
+			if !ok || done[p] {
+				break
+			}
+			first = p
+		}
+		for c := first; c != nil && !done[c]; c = next[c] {
+			done[c] = true
+			ordered = append(ordered, c)
+		}
+	}
+	return ordered
 }
 
 // saveCommitment writes the details of a commitment to our client-side database
@@ -207,64 +246,212 @@ func (c *Client) saveCommitment(comm *wire.Commitment) error {
 }
 
 // verifyLoop is the full-client's main loop that will check validity of both the
-// commitment transaction and the commitment proofs. It does this every 20 seconds
+// commitment transaction and the commitment proofs. It runs when new headers
+// come in, when the server tells us about a new commitment or sends proof
+// updates, and otherwise every VerifyInterval. Errors that kept it from
+// verifying are retried with an increasing delay.
 func (c *Client) verifyLoop() {
+	retry := verifyRetryMin
 	for {
-		if c.SPVSynced() {
-			lastCommitHash := [32]byte{}
-			if c.lastServerCommitment != nil {
-				copy(lastCommitHash[:], c.lastServerCommitment.Commitment[:])
-			}
+		wait := c.VerifyInterval
+		if !c.features.Has(wire.FeatureCommitmentNotify) {
+			// The server won't tell us about new commitments
+			wait = legacyVerifyInterval
+		}
 
-			// Fetch server commitments since our last known commitment
-			hist, err := c.GetCommitmentHistory(lastCommitHash)
-			if err != nil {
-				panic(err)
+		err := c.verify()
+		if err == nil {
+			retry = verifyRetryMin
+			c.setVerifyState(VerifyStateVerifying, nil)
+		} else if isInvalid(err) {
+			logging.Errorf("The server's commitments do not check out: %s", err.Error())
+			c.setVerifyState(VerifyStateInvalid, err)
+		} else {
+			logging.Warnf("Could not verify the server's commitments, retrying in %s: %s", retry, err.Error())
+			c.setVerifyState(VerifyStateBehind, err)
+			if retry < wait {
+				wait = retry
+				retry *= 2
 			}
+		}
+
+		select {
+		case <-c.verifyEvents:
+		case <-time.After(wait):
+		}
+	}
+}
 
-			logging.Debugf("Got %d commitments", len(hist))
+// verify checks the commitments the server made since the last one we
+// verified, and updates the proofs of our logs when there are new ones
+func (c *Client) verify() error {
+	if !c.SPVSynced() {
+		return fmt.Errorf("Block headers are not synced yet")
+	}
 
-			// For each commitment, verify if it's correct and then save it
-			retry := false
-			for _, comm := range hist {
-				err = c.verifyCommitment(comm)
-				if err != nil {
-					// If the block is not found, it could mean the commitment
-					// transaction reorged. We'll get the updated blockhash
-					// when we ask the server again - once the server has
-					// processed the reorg.
-					if err.Error() == "Block not found" {
-
-						logging.Warnf("The server says commitment %x is in block %s (tx %s), but we don't have that. Retry (could be reorg-related)", comm.Commitment[:], comm.IncludedInBlock.String(), comm.TxHash.String())
-						time.Sleep(time.Second * 20)
-						retry = true
-						break
-					}
-					panic(err)
-				}
+	// Forget about commitments in blocks that were reorged out of our
+	// chain. The server tells us which block they are in now.
+	err := c.rollbackOrphaned()
+	if err != nil {
+		return err
+	}
 
-				err = c.saveCommitment(comm)
-				if err != nil {
-					panic(err)
-				}
-			}
+	lastCommitHash := [32]byte{}
+	if c.lastServerCommitment != nil {
+		copy(lastCommitHash[:], c.lastServerCommitment.Commitment[:])
+	}
+
+	// Fetch server commitments since our last known commitment
+	hist, err := c.GetCommitmentHistory(lastCommitHash)
+	if err != nil {
+		return fmt.Errorf("Could not fetch commitment history: %s", err.Error())
+	}
 
-			if retry {
-				continue
+	logging.Debugf("Got %d commitments", len(hist))
+
+	// For each commitment, verify if it's correct and then save it. We
+	// stop at the first one that is not deep enough in the chain yet, the
+	// next headers will wake us up to check it again.
+	for _, comm := range hist {
+		confirmed, err := c.commitmentConfirmed(comm)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			break
+		}
+
+		err = c.verifyCommitment(comm)
+		if err != nil {
+			return err
+		}
+
+		err = c.saveCommitment(comm)
+		if err != nil {
+			return err
+		}
+		c.proofsOutdated = true
+	}
+
+	// If we got new commitments, we should also update proofs
+	if c.proofsOutdated {
+		err = c.updateProofs()
+		if err != nil {
+			return err
+		}
+		c.proofsOutdated = false
+	}
+	return nil
+}
+
+// commitmentConfirmed returns true when the block the commitment is in has at
+// least MinConfirmations confirmations in our header chain
+func (c *Client) commitmentConfirmed(comm *wire.Commitment) (bool, error) {
+	if comm.IncludedInBlock == nil {
+		return false, nil
+	}
+	height, err := c.GetBlockHeightByHash(comm.IncludedInBlock)
+	if err != nil {
+		c.SPVAskHeaders()
+		return false, fmt.Errorf("The server says commitment %x is in block %s, but we don't have that: %s", comm.Commitment[:], comm.IncludedInBlock.String(), err.Error())
+	}
+	confirmations := int(c.SPVHeight()-height) + 1
+	if confirmations < c.MinConfirmations {
+		logging.Debugf("Commitment %x has %d confirmations, waiting for %d", comm.Commitment, confirmations, c.MinConfirmations)
+		return false, nil
+	}
+	return true, nil
+}
+
+// rollbackOrphaned removes the commitments in blocks that are no longer in our
+// header chain, together with the proofs for them and the statements of our
+// logs we considered committed by them. The last commitment that is still in
+// the chain becomes our last commitment again, and the server sends us the
+// orphaned ones again once they are mined in the new chain.
+func (c *Client) rollbackOrphaned() error {
+	if c.lastServerCommitment == nil || c.inHeaderChain(c.lastServerCommitment) {
+		return nil
+	}
+
+	comms, err := c.getAllCommitments()
+	if err != nil {
+		return err
+	}
+	keep := len(comms)
+	for keep > 0 && !c.inHeaderChain(comms[keep-1]) {
+		keep--
+	}
+	orphaned := map[string]bool{}
+	for _, comm := range comms[keep:] {
+		orphaned[string(comm.Commitment[:])] = true
+	}
+	logging.Warnf("Rolling back %d commitments in blocks that were reorged out of the chain", len(orphaned))
+
+	// Statements we considered committed by the orphaned commitments. The
+	// commitment of a foreign log's statement came with the statement, so we
+	// keep it.
+	logCommitments := make([]string, 0)
+	err = c.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendRange("", "logcommitment-", "logcommitment.", func(key, value string) bool {
+			if orphaned[value] && !strings.HasSuffix(key, "-999999999") {
+				logCommitments = append(logCommitments, key)
 			}
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
 
-			// If we got new commitments, we should also update proofs
-			if len(hist) > 0 {
-				err = c.updateProofs()
-				if err != nil {
-					panic(err)
-				}
+	var last *wire.Commitment
+	if keep > 0 {
+		last = comms[keep-1]
+	}
+	err = c.db.Update(func(tx *buntdb.Tx) error {
+		keys := logCommitments
+		for _, comm := range comms[keep:] {
+			keys = append(keys,
+				fmt.Sprintf("commitment-%x", comm.Commitment),
+				fmt.Sprintf("block-%x", comm.IncludedInBlock[:]),
+				fmt.Sprintf("proof-%x", comm.Commitment))
+		}
+		for _, k := range keys {
+			_, err := tx.Delete(k)
+			if err != nil && err != buntdb.ErrNotFound {
+				return err
 			}
+		}
 
-			time.Sleep(time.Second * 20)
-		} else {
-			time.Sleep(time.Second * 1)
+		if last == nil {
+			_, err := tx.Delete("commitment-last")
+			return err
 		}
+		_, _, err := tx.Set("commitment-last", string(last.Commitment[:]), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	c.lastServerCommitment = last
+	return nil
+}
+
+// inHeaderChain returns true if the block a commitment is in is part of our
+// header chain
+func (c *Client) inHeaderChain(comm *wire.Commitment) bool {
+	if comm.IncludedInBlock == nil {
+		return false
+	}
+	_, err := c.GetBlockHeightByHash(comm.IncludedInBlock)
+	return err == nil
+}
 
+// wakeVerifier makes the verification loop run now, or right after the run it
+// is busy with
+func (c *Client) wakeVerifier() {
+	select {
+	case c.verifyEvents <- struct{}{}:
+	default:
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/mit-dci/go-bverify/logging"
@@ -42,25 +43,73 @@ type Client struct {
 	// The SPV connection to the blockchain
 	spv *uspv.SPVCon
 
-	// Channels for receiving replies from the server from
-	// the receive loop
-	ack           chan bool
-	errChan       chan error
-	proof         chan *mpt.PartialMPT
-	commitDetails chan *wire.Commitment
-	commitHistory chan []*wire.Commitment
+	// Requests sent to the server that are waiting for a response, by
+	// request ID. The receive loop hands them the response.
+	pending     map[uint32]chan response
+	pendingLock sync.Mutex
+	nextRequest uint32
+
+	// The logical sessions opened on the connection, by session ID
+	sessions     map[uint32]*Session
+	sessionsLock sync.Mutex
+
+	// Closed when the receive loop on the connection the client was created
+	// with returns
+	loopDone chan bool
+
+	// The proof tree of our logs, which the full client keeps up to date
+	// with the proof updates from the server, and the trees it had at the
+	// last few commitments serialized by commitment, oldest first in
+	// proofRoots
+	proofTree     *mpt.PartialMPT
+	proofTrees    map[[32]byte][]byte
+	proofRoots    [][32]byte
+	proofTreeLock sync.Mutex
 
 	// You can set these function pointers to receive events
 	// from the client (errors and proof updates)
 	OnError       func(error, *Client)
 	OnProofUpdate func([]byte, *Client)
 
+	// OnVerifyState is called when the state of the full client's
+	// verification of the server changes, with the error that caused it
+	OnVerifyState func(VerifyState, error, *Client)
+
+	// The state of the verification of the server, and the channel that
+	// wakes up the verification loop when something happened
+	verifyState  VerifyState
+	verifyErr    error
+	verifyLock   sync.Mutex
+	verifyEvents chan struct{}
+
+	// Set when we verified new commitments, but did not update the proofs of
+	// our logs for them yet
+	proofsOutdated bool
+
 	// The local data stored by the client
 	db *buntdb.DB
 
+	// The domain we sign statements in, as negotiated with the server. When
+	// nil, we use legacy signatures without domain separation.
+	signatureDomain *wire.SignatureDomain
+
+	// The server's reply to our version message, and the features we can use
+	// on the connection
+	serverVersion *wire.VersionMessage
+	features      wire.FeatureFlags
+
 	// The address we connected to when NewClient() was used
 	addr string
 
+	// When connected using NewSecureClient(), the server's transport key we
+	// require on reconnects
+	secure       bool
+	transportKey *[33]byte
+
+	// Opens a new connection to the server when reconnecting, set by the
+	// constructor that was used
+	dial func() (net.Conn, error)
+
 	// The simple HTTP RPC server you can use to write
 	// new logs and statements
 	rpcServer *RpcServer
@@ -92,6 +141,19 @@ type Client struct {
 
 	AckTimeout   time.Duration
 	ProofTimeout time.Duration
+
+	// The client pings the server every PingInterval, and reconnects when
+	// the server does not answer within PongTimeout. Zero disables pings.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// The full client checks for new commitments every VerifyInterval, in
+	// case it missed a notification from the server
+	VerifyInterval time.Duration
+
+	// The full client only accepts a commitment once the block it is in
+	// has MinConfirmations confirmations
+	MinConfirmations int
 }
 
 // NewClientWithConnection creates a new b_verify client using the provided
@@ -107,25 +169,99 @@ func NewClientWithConnection(key []byte, c net.Conn) (*Client, error) {
 
 	// Create the Client struct we're going to return
 	cli := &Client{
-		conn:          wire.NewConnection(c),
-		spv:           new(uspv.SPVCon),
-		keyBytes:      key,
-		key:           priv,
-		pubKey:        pk,
-		commitDetails: make(chan *wire.Commitment),
-		commitHistory: make(chan []*wire.Commitment),
-		proof:         make(chan *mpt.PartialMPT),
-		ack:           make(chan bool),
-		errChan:       make(chan error),
-		fullClient:    false,
-	}
-
-	// Start the loop that processes incoming response messages
-	go cli.ReceiveLoop()
+		conn:         wire.NewConnection(c),
+		spv:          new(uspv.SPVCon),
+		keyBytes:     key,
+		key:          priv,
+		pubKey:       pk,
+		pending:      make(map[uint32]chan response),
+		sessions:     make(map[uint32]*Session),
+		verifyEvents: make(chan struct{}, 1),
+		fullClient:   false,
+		AckTimeout:   time.Second * 10,
+		ProofTimeout: time.Second * 10,
+		PingInterval: time.Second * 30,
+		PongTimeout:  time.Second * 10,
+
+		VerifyInterval:   time.Minute * 10,
+		MinConfirmations: 1,
+	}
+
+	// The server won't talk to us before we exchanged versions
+	cli.conn.SetTimeouts(0, cli.AckTimeout)
+	err := cli.handshake()
+	if err != nil {
+		cli.conn.Close()
+		return nil, err
+	}
+
+	// Start the loop that processes incoming response messages, and keep
+	// checking the server is still there
+	cli.loopDone = make(chan bool)
+	go func() {
+		cli.ReceiveLoop()
+		close(cli.loopDone)
+	}()
+	go cli.keepalive(cli.conn)
 
 	return cli, nil
 }
 
+// handshake exchanges version messages with the server. This has to be done
+// before any other message is sent, and before the receive loop is started.
+func (c *Client) handshake() error {
+	msg := wire.NewVersionMessage(wire.SupportedFeatures, [32]byte{}, [32]byte{})
+	err := c.conn.WriteMessage(wire.MessageTypeVersion, msg.Bytes())
+	if err != nil {
+		return err
+	}
+
+	t, p, err := c.conn.ReadNextMessage()
+	if err != nil {
+		return err
+	}
+	if t == wire.MessageTypeError {
+		return fmt.Errorf("Server rejected version handshake: %s", string(p))
+	}
+	if t != wire.MessageTypeVersionAck {
+		return fmt.Errorf("Expected version acknowledgement, got message type %x", byte(t))
+	}
+
+	ack, err := wire.NewVersionMessageFromBytes(p)
+	if err != nil {
+		return err
+	}
+	if ack.ProtocolVersion < wire.MinProtocolVersion {
+		return fmt.Errorf("Server protocol version %d is no longer supported", ack.ProtocolVersion)
+	}
+
+	// We need request IDs to match the server's responses to our requests
+	if !ack.Features.Has(wire.FeatureRequestIDs) {
+		return fmt.Errorf("Server does not support request IDs")
+	}
+	c.conn.EnableRequestIDs()
+
+	c.serverVersion = ack
+	c.features = ack.Features & wire.SupportedFeatures
+
+	// The network and server identity make up the domain we sign in
+	if c.features.Has(wire.FeatureSignatureDomain) {
+		c.signatureDomain = wire.NewSignatureDomain(ack.Network, ack.ServerID)
+	}
+	return nil
+}
+
+// ServerVersion returns the version message the server replied with during
+// the handshake
+func (c *Client) ServerVersion() *wire.VersionMessage {
+	return c.serverVersion
+}
+
+// Features returns the protocol features negotiated with the server
+func (c *Client) Features() wire.FeatureFlags {
+	return c.features
+}
+
 // NewClient will create a new Client that connects to the server and port
 // specified in addr
 func NewClient(key []byte, addr string) (*Client, error) {
@@ -139,11 +275,78 @@ func NewClient(key []byte, addr string) (*Client, error) {
 	}
 	cli.ReconnectOnFailure = true
 	cli.addr = addr
-	cli.AckTimeout = time.Second * 10
-	cli.ProofTimeout = time.Second * 10
+	cli.dial = func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	return cli, nil
+}
+
+// NewWebSocketClient will create a new Client that connects to the WebSocket
+// endpoint of the server at url, for instance ws://localhost:9101/
+func NewWebSocketClient(key []byte, url string) (*Client, error) {
+	c, err := wire.DialWebSocket(url)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := NewClientWithConnection(key, c)
+	if err != nil {
+		return nil, err
+	}
+	cli.ReconnectOnFailure = true
+	cli.addr = url
+	cli.dial = func() (net.Conn, error) {
+		return wire.DialWebSocket(url)
+	}
+	return cli, nil
+}
+
+// NewSecureClient will create a new Client that connects to the server and
+// port specified in addr over the encrypted transport. When serverKey is not
+// nil, the connection fails unless the server holds the private key to it.
+// Otherwise, the key the server presents is pinned for reconnects and can be
+// read with ServerTransportKey.
+func NewSecureClient(key []byte, addr string, serverKey *[33]byte) (*Client, error) {
+	c, err := dialSecure(addr, serverKey)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := NewClientWithConnection(key, c)
+	if err != nil {
+		return nil, err
+	}
+	remoteKey := c.RemoteKey()
+	cli.ReconnectOnFailure = true
+	cli.addr = addr
+	cli.secure = true
+	cli.transportKey = &remoteKey
+	cli.dial = func() (net.Conn, error) {
+		return dialSecure(addr, cli.transportKey)
+	}
 	return cli, nil
 }
 
+func dialSecure(addr string, serverKey *[33]byte) (*wire.SecureConn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := wire.NewSecureClientConn(c, serverKey)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ServerTransportKey returns the key the server proved to hold when connected
+// over the encrypted transport, and false if the connection is not encrypted
+func (c *Client) ServerTransportKey() ([33]byte, bool) {
+	if !c.secure {
+		return [33]byte{}, false
+	}
+	return *c.transportKey, true
+}
+
 // UsesKey return true if this client is using the key passed in. We don't
 // want to expose the key as a public variable but if you know the key
 // yourself, we can tell you if it matches.
@@ -175,8 +378,12 @@ func (c *Client) SPVAskHeaders() error {
 }
 
 func (c *Client) Reconnect() {
+	if c.dial == nil {
+		logging.Errorf("Cannot reconnect a client that was created with an existing connection")
+		return
+	}
 	logging.Debug("Reconnecting to server")
-	newConn, err := net.Dial("tcp", c.addr)
+	newConn, err := c.dial()
 	if err != nil {
 		logging.Errorf("Could not reconnect to server: %s", err.Error())
 		go func(cli *Client) {
@@ -186,130 +393,152 @@ func (c *Client) Reconnect() {
 		return
 	}
 	c.conn = wire.NewConnection(newConn)
+	c.conn.SetTimeouts(0, c.AckTimeout)
+	err = c.handshake()
+	if err != nil {
+		logging.Errorf("Could not complete handshake with server: %s", err.Error())
+		c.conn.Close()
+		go func(cli *Client) {
+			time.Sleep(5 * time.Second)
+			cli.Reconnect()
+		}(c)
+		return
+	}
 	go c.ReceiveLoop()
+	go c.keepalive(c.conn)
+
+	if c.fullClient {
+		err = c.followProofs()
+		if err != nil {
+			logging.Warnf("Could not follow proofs: %s", err.Error())
+		}
+	}
+}
+
+// keepalive pings the server every PingInterval for as long as conn is the
+// connection in use. When the server does not answer in time, the connection
+// is closed, which makes the receive loop reconnect.
+func (c *Client) keepalive(conn *wire.Connection) {
+	if c.PingInterval == 0 || !c.features.Has(wire.FeatureKeepalive) {
+		return
+	}
+	for {
+		time.Sleep(c.PingInterval)
+		if c.conn != conn {
+			return
+		}
+
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+		p, err := c.requestExpect(wire.MessageTypePing, nonce, wire.MessageTypePong, c.PongTimeout)
+		if err == nil && !bytes.Equal(p, nonce) {
+			err = fmt.Errorf("Pong does not match our ping")
+		}
+		if err != nil {
+			logging.Warnf("Server did not answer ping, dropping connection: %s", err.Error())
+			conn.Close()
+			return
+		}
+	}
 }
 
 // ReceiveLoop will fetch new messages as they come in on the wire (from the server)
 // and try to process them accordingly.
 func (c *Client) ReceiveLoop() {
 	for {
-		t, p, err := c.conn.ReadNextMessage()
+		t, id, p, err := c.conn.ReadNextFrame()
 		if err != nil {
 			logging.Debugf("Error reading message from server connection: %s", err.Error())
 			// If we can't read from this transport anymore, or we receive invalid
-			// data, we should close the connection and exit the receive loop
+			// data, we should close the connection and exit the receive loop.
+			// Nobody is going to answer the requests still in flight.
 			c.conn.Close()
+			c.failPending(fmt.Errorf("Connection to server lost: %s", err.Error()))
 			if c.ReconnectOnFailure {
 				c.Reconnect()
 			}
 			return
 		}
 
-		// If we receive an Ack message, send a boolean over the ack channel.
-		// client functions that expect an ack will wait by reading from this
-		// channel
-		if t == wire.MessageTypeAck {
-			select {
-			case c.ack <- true:
-			case <-time.After(time.Second * 5):
-				logging.Warnf("[%p] Nobody was waiting for ACK on [%p]", c, c.ack)
+		// The server should not send us anything we did not negotiate
+		if !c.features.Allows(t) {
+			logging.Warnf("Ignoring message type %x that requires a feature we did not negotiate", byte(t))
+			continue
+		}
+
+		// Messages in a logical session are unwrapped and handed to the
+		// request or session they belong to
+		if t == wire.MessageTypeSession {
+			msg, err := wire.NewSessionMessageFromBytes(p)
+			if err != nil {
+				logging.Warnf("Ignoring invalid session message: %s", err.Error())
+				continue
 			}
+			c.receiveSessionMessage(id, msg)
 			continue
 		}
 
 		// If we receive an error from the server, we should call the OnError
-		// hook if it's set, and then exit the receive loop
+		// hook if it's set and hand it to the request that caused it. When the
+		// error is fatal, we exit the receive loop since the server disconnects
+		// us.
 		if t == wire.MessageTypeError {
-			err := fmt.Errorf("%s", string(p))
+			err := c.newServerError(p)
 			logging.Debugf("Received error on wire: %s", err.Error())
 			if c.OnError != nil {
 				go c.OnError(err, c)
 			}
-			select {
-			case c.errChan <- err:
-			case <-time.After(time.Second * 5):
+			if id == 0 {
+				id = err.RequestID
+			}
+			if id != 0 && !c.deliver(id, response{t: t, p: p}) {
 				logging.Warnf("Nobody was able to receive error")
 			}
+			if !err.Fatal {
+				continue
+			}
 			c.conn.Close()
+			c.failPending(err)
 			if c.ReconnectOnFailure {
 				c.Reconnect()
 			}
 			return
 		}
 
+		// The server checks if we are still there
+		if t == wire.MessageTypePing {
+			c.conn.WriteFrame(wire.MessageTypePong, id, p)
+			continue
+		}
+
 		// MessageTypeProofUpdate is an automatic message with the
 		// delta since the last proof update, provided we have subscribed using
 		// SubscribeProofUpdates. We will call the OnProofUpdate hook with the
 		// message body.
 		if t == wire.MessageTypeProofUpdate {
+			if c.fullClient {
+				c.processProofUpdate(p)
+				c.wakeVerifier()
+			}
 			if c.OnProofUpdate != nil {
 				go c.OnProofUpdate(p, c)
 			}
 			continue
 		}
 
-		// MessageTypeProof is a full proof that's been requested
-		// by the client. Hence, we try to parse it as a MPT and then send it over the
-		// proof channel. This channel is read from in the RequestProof method.
-		if t == wire.MessageTypeProof {
-			buf := bytes.NewBuffer(p)
-			mpt, err := mpt.DeserializeNewPartialMPT(buf)
-			if err != nil {
-				logging.Debugf("Error while receiving proof: [%x] %s", p, err.Error())
-				// Something wrong parsing the returned MPT data. Close the connection
-				// and exit the loop.
-				c.conn.Close()
-				return
-			}
-
-			// Whoever requested the proof is listening on c.proof for the result
-			// so send it there
-			select {
-			case c.proof <- mpt:
-			default:
-			}
-			continue
-		}
-
-		// MessageTypeCommitmentDetails contains the details of a single commitment.
-		// This is requested by the client using GetCommitmentDetails
-		if t == wire.MessageTypeCommitmentDetails {
-			msg, err := wire.NewCommitmentDetailsMessageFromBytes(p)
-			if err != nil {
-				// Something wrong parsing the returned commitment details.
-				// Close the connection and exit the loop.
-				c.conn.Close()
-				return
-			}
-
-			// Whoever requested the commitment details is listening on
-			// c.commitDetails for the result so send it there
-			select {
-			case c.commitDetails <- msg.Commitment:
-			default:
+		// The server tells us a commitment was included in a block, which
+		// the full client verifies right away
+		if t == wire.MessageTypeNewCommitment {
+			if c.fullClient {
+				c.wakeVerifier()
 			}
 			continue
 		}
 
-		// MessageTypeCommitmentHistory contains the details of all commitments
-		// (optionally since a particular commitment). This is requested by the
-		// client using GetCommitmentHistory. The server returns this as  a
-		// collection of Commitment objects.
-		if t == wire.MessageTypeCommitmentHistory {
-			msg, err := wire.NewCommitmentHistoryMessageFromBytes(p)
-			if err != nil {
-				// Something wrong parsing the returned commitment details.
-				// Close the connection and exit the loop.
-				c.conn.Close()
-				return
-			}
-			// Whoever requested the commitments is listening on
-			// c.commitHistory for the result so send it there
-			select {
-			case c.commitHistory <- msg.Commitments:
-			default:
-			}
-			continue
+		// Everything else is a response to one of our requests. Whoever sent
+		// it is waiting for the response with the same request ID.
+		if !c.deliver(id, response{t: t, p: p}) {
+			logging.Warnf("Nobody was waiting for message type %x with request ID %d", byte(t), id)
 		}
 	}
 }
@@ -382,7 +611,12 @@ func (c *Client) Run(resync bool) error {
 		}
 	}
 
-	// Start the SPV process that downloads headers from the blockchain
+	// Start the SPV process that downloads headers from the blockchain, and
+	// verify commitments as soon as new headers come in
+	c.spv.OnHeaders = c.wakeVerifier
+	c.spv.OnReorg = func(height int32) {
+		logging.Warnf("Block headers above height %d were reorged", height)
+	}
 	go func() {
 		err := c.StartSPV()
 		if err != nil {
@@ -393,6 +627,12 @@ func (c *Client) Run(resync bool) error {
 	// Load things into memory from our database
 	c.loadStuff()
 
+	// Make sure the server commits to the chain we follow
+	network := [32]byte(*coinparam.TestNet3Params.GenesisHash)
+	if c.serverVersion != nil && c.serverVersion.Network != [32]byte{} && c.serverVersion.Network != network {
+		return fmt.Errorf("Server commits to network [%x], we follow [%x]", c.serverVersion.Network, network)
+	}
+
 	// Start the RPC server as a means to create and append to logs
 	c.rpcServer = NewRpcServer(c)
 	go func() {
@@ -402,6 +642,12 @@ func (c *Client) Run(resync bool) error {
 		}
 	}()
 
+	// Have the server send us proof updates for our logs
+	err = c.followProofs()
+	if err != nil {
+		logging.Warnf("Could not follow proofs: %s", err.Error())
+	}
+
 	c.Ready = true
 
 	// Start the verification loop that checks server commitments against
@@ -416,10 +662,22 @@ func (c *Client) Run(resync bool) error {
 // care of hashing it before passing it to StartLog. It will also keep the
 // clear text (preimage) in our database for future verification purposes.
 func (c *Client) StartLogText(initialStatement string) ([32]byte, error) {
+	return c.startLogText(initialStatement, c.StartLog)
+}
+
+// StartLogTextWithMetadata is the same as StartLogText, but starts the log
+// using StartLogWithMetadata
+func (c *Client) StartLogTextWithMetadata(initialStatement string, metadata map[string]string) ([32]byte, error) {
+	return c.startLogText(initialStatement, func(statement []byte) ([32]byte, error) {
+		return c.StartLogWithMetadata(statement, metadata)
+	})
+}
+
+func (c *Client) startLogText(initialStatement string, start func([]byte) ([32]byte, error)) ([32]byte, error) {
 	statementHash := fastsha256.Sum256([]byte(initialStatement))
 
 	// Create the log using the hash
-	logId, err := c.StartLog(statementHash[:])
+	logId, err := start(statementHash[:])
 	if err != nil {
 		return [32]byte{}, err
 	}
@@ -444,18 +702,30 @@ func (c *Client) StartLogText(initialStatement string) ([32]byte, error) {
 // with the client's key and then send it to the server. It will wait for the
 // server to have acknowledged the log.
 func (c *Client) StartLog(initialStatement []byte) ([32]byte, error) {
-	var err error
+	return c.startLog(wire.NewSignedCreateLogStatement(c.pubKey, initialStatement))
+}
 
-	// Create the message
-	l := wire.NewSignedCreateLogStatement(c.pubKey, initialStatement)
+// StartLogWithMetadata is the same as StartLog, but attaches the metadata to
+// the log. It also adds a random nonce, so the LogID is unique even when the
+// same initial statement was used before.
+func (c *Client) StartLogWithMetadata(initialStatement []byte, metadata map[string]string) ([32]byte, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return c.startLog(wire.NewSignedCreateLogStatementWithMetadata(c.pubKey, initialStatement, nonce, metadata))
+}
+
+func (c *Client) startLog(l *wire.SignedCreateLogStatement) ([32]byte, error) {
+	var err error
 
 	// Calculate the Log ID
 	logId := fastsha256.Sum256(l.CreateStatement.Bytes())
 
-	// Coincidentally, the logID is the same as the hash we need to sign.
-	// So here we sign that, and add the signature to the outgoing message
+	// Sign the create statement in our signature domain, and add the
+	// signature to the outgoing message
+	domain := c.signatureDomain
 	if !c.DummySignatures {
-		sig, err := c.key.Sign(logId[:])
+		hash := fastsha256.Sum256(domain.SigningPayload(l.CreateStatement.Bytes()))
+		sig, err := c.key.Sign(hash[:])
 		if err != nil {
 			return [32]byte{}, err
 		}
@@ -466,28 +736,8 @@ func (c *Client) StartLog(initialStatement []byte) ([32]byte, error) {
 		l.Signature = csig
 	}
 
-	result := make(chan error, 1)
-
-	go func() {
-		// Wait for ack
-		select {
-		case <-c.ack:
-			result <- nil
-		case err = <-c.errChan:
-			result <- err
-		case <-time.After(10 * time.Second):
-			result <- fmt.Errorf("Timeout waiting for ACK")
-		}
-	}()
-
-	go func() {
-		// Send the message to the server
-		err = c.conn.WriteMessage(wire.MessageTypeCreateLog, l.Bytes())
-		if err != nil {
-			result <- err
-		}
-	}()
-	err = <-result
+	// Send the message to the server
+	err = c.sendAndWaitForAck(wire.MessageTypeCreateLog, l.Bytes())
 	if err != nil {
 		return [32]byte{}, err
 	}
@@ -511,6 +761,29 @@ func (c *Client) StartLog(initialStatement []byte) ([32]byte, error) {
 				return err
 			}
 
+			err = c.setSignatureDomain(dtx, logId, 0, domain)
+			if err != nil {
+				return err
+			}
+
+			// Store the nonce and metadata, which we need to export the
+			// initial statement
+			cls := l.CreateStatement
+			if len(cls.Nonce) > 0 || len(cls.Metadata) > 0 {
+				var ext bytes.Buffer
+				wire.WriteCreateLogExtension(&ext, cls.Nonce, cls.Metadata)
+				key = fmt.Sprintf("logcreate-%x", logId[:])
+				_, _, err = dtx.Set(key, ext.String(), nil)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = c.setLogMetadata(dtx, logId, cls.Metadata)
+			if err != nil {
+				return err
+			}
+
 			// Write this marker key to allow us to enumerate all logs
 			key = fmt.Sprintf("log-%x", logId[:])
 			_, _, err = dtx.Set(key, string("1"), nil)
@@ -630,20 +903,16 @@ func (c *Client) GetLogPreimage(logId [32]byte, idx uint64) (string, error) {
 func (c *Client) RequestProof(logIds [][32]byte) (*mpt.PartialMPT, error) {
 	// Create the wire message and send it to the server
 	msg := wire.NewRequestProofMessage(logIds)
-	err := c.conn.WriteMessage(wire.MessageTypeRequestProof, msg.Bytes())
+	p, err := c.requestExpect(wire.MessageTypeRequestProof, msg.Bytes(), wire.MessageTypeProof, c.ProofTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	var proof *mpt.PartialMPT
-	// Wait for the proof response and return it to the client
-
-	select {
-	case proof = <-c.proof:
-	case err = <-c.errChan:
+	// Parse the proof and return it to the client
+	proof, err := mpt.DeserializeNewPartialMPT(bytes.NewBuffer(p))
+	if err != nil {
+		logging.Debugf("Error while receiving proof: [%x] %s", p, err.Error())
 		return nil, err
-	case <-time.After(c.ProofTimeout):
-		return nil, fmt.Errorf("Timeout waiting for proof")
 	}
 
 	return proof, nil
@@ -683,55 +952,74 @@ func (c *Client) GetLogCommitment(logId [32]byte, idx uint64) ([32]byte, error)
 // will then send us a ProofUpdate message automatically, which the client can
 // read out by setting a function pointer to OnProofUpdate
 func (c *Client) SubscribeProofUpdates() error {
-
-	result := make(chan error, 1)
-
-	go func() {
-		// Wait for ack
-		select {
-		case <-c.ack:
-			result <- nil
-		case err := <-c.errChan:
-			result <- err
-		case <-time.After(10 * time.Second):
-			result <- fmt.Errorf("Timeout waiting for ACK")
-		}
-	}()
-
 	// Create the wire message and send it to the server
-	err := c.conn.WriteMessage(wire.MessageTypeSubscribeProofUpdates, []byte{})
-	if err != nil {
-		return err
-	}
-
-	return <-result
+	return c.sendAndWaitForAck(wire.MessageTypeSubscribeProofUpdates, []byte{})
 }
 
 // UnsubscribeProofUpdates will tell the server to stop sending us automatic
 // proof updates. In that case, the proofs will have to be requested manually
 func (c *Client) UnsubscribeProofUpdates() error {
+	// Create the wire message and send it to the server
+	return c.sendAndWaitForAck(wire.MessageTypeUnsubscribeProofUpdates, []byte{})
+}
 
-	result := make(chan error, 1)
+// WatchLogs will tell the server to include the given logs in the proof
+// updates it sends us, also when they are written by other clients. This is
+// used to follow foreign logs without polling for their proofs.
+func (c *Client) WatchLogs(logIds [][32]byte) error {
+	return c.sendWatchLogs(wire.MessageTypeWatchLogs, logIds)
+}
 
-	go func() {
-		// Wait for ack
-		select {
-		case <-c.ack:
-			result <- nil
-		case err := <-c.errChan:
-			result <- err
-		case <-time.After(10 * time.Second):
-			result <- fmt.Errorf("Timeout waiting for ACK")
+// UnwatchLogs will tell the server to stop including the given logs in the
+// proof updates it sends us
+func (c *Client) UnwatchLogs(logIds [][32]byte) error {
+	return c.sendWatchLogs(wire.MessageTypeUnwatchLogs, logIds)
+}
+
+func (c *Client) sendWatchLogs(t wire.MessageType, logIds [][32]byte) error {
+	if !c.features.Has(wire.FeatureWatchLogs) {
+		return fmt.Errorf("Server does not support watching logs")
+	}
+
+	// Split the logs over as many messages as needed
+	for len(logIds) > 0 {
+		n := len(logIds)
+		if n > wire.MaxWatchLogIDs {
+			n = wire.MaxWatchLogIDs
 		}
-	}()
+		msg := wire.NewWatchLogsMessage(logIds[:n])
+		err := c.sendAndWaitForAck(t, msg.Bytes())
+		if err != nil {
+			return err
+		}
+		logIds = logIds[n:]
+	}
+	return nil
+}
 
-	// Create the wire message and send it to the server
-	err := c.conn.WriteMessage(wire.MessageTypeUnsubscribeProofUpdates, []byte{})
+// followProofs asks the server to send us proof updates for the logs we write
+// and the foreign logs we follow, which keep our proof tree up to date. Since
+// the server forgets about this when the connection is lost, it has to be done
+// again after reconnecting.
+func (c *Client) followProofs() error {
+	err := c.SubscribeProofUpdates()
 	if err != nil {
 		return err
 	}
 
-	return <-result
+	// The server only includes the logs we write on this connection, so
+	// watch the ones we wrote before and the foreign ones
+	if !c.features.Has(wire.FeatureWatchLogs) {
+		return nil
+	}
+	logIds, err := c.GetAllLogIDs()
+	if err != nil {
+		return err
+	}
+	if len(logIds) == 0 {
+		return nil
+	}
+	return c.WatchLogs(logIds)
 }
 
 // AppendLogText is a convenience function called by the RPC server to append
@@ -783,16 +1071,63 @@ func (c *Client) GetForeignLogIDAndHash(statement *wire.ForeignStatement) ([32]b
 	statementHash := fastsha256.Sum256([]byte(statement.StatementPreimage))
 	hash := [32]byte{}
 	logId := [32]byte{}
-	if statement.InitialStatement {
+
+	// A statement signed for another server or network cannot be witnessed
+	// by ours. Legacy statements carry no domain, so they are accepted.
+	domain := statement.SignatureDomain
+	if domain != nil && c.signatureDomain != nil && !domain.Equal(c.signatureDomain) {
+		return logId, hash, fmt.Errorf("Statement was signed for a different server or network")
+	}
+	if statement.Batch != nil && !statement.InitialStatement {
+		batch := statement.Batch
+		if statement.BatchPosition < 0 || statement.BatchPosition >= len(batch.Statements) {
+			return logId, hash, fmt.Errorf("Batch position %d out of range", statement.BatchPosition)
+		}
+
+		// The statement has to be in the batch at the given position
+		s := batch.Statements[statement.BatchPosition]
+		if s.LogID != statement.LogID || s.Index != statement.Index || !bytes.Equal(s.Statement, statementHash[:]) {
+			return logId, hash, fmt.Errorf("Statement is not part of the batch")
+		}
+
+		err := batch.VerifySignature(statement.Signature, statement.PubKey, domain)
+		if err != nil {
+			return logId, hash, err
+		}
+
+		logId = statement.LogID
+		hash = batch.Witness(statement.BatchPosition, statement.Signature)
+	} else if statement.Sealed && !statement.InitialStatement {
+		s := &wire.SignedSealLogStatement{
+			Statement: &wire.LogStatement{
+				Index:     statement.Index,
+				LogID:     statement.LogID,
+				Statement: statementHash[:],
+			},
+			Signature: statement.Signature,
+		}
+
+		// Only the controlling key can seal a log, so delegations do not
+		// apply here
+		err := s.VerifySignatureInDomain(statement.PubKey, domain)
+		if err != nil {
+			return logId, hash, err
+		}
+
+		logId = statement.LogID
+		hash = s.Witness()
+	} else if statement.InitialStatement {
 		s := &wire.SignedCreateLogStatement{
 			CreateStatement: &wire.CreateLogStatement{
 				ControllingKey:   statement.PubKey,
 				InitialStatement: statementHash[:],
+				Nonce:            statement.Nonce,
+				Metadata:         statement.Metadata,
 			},
 			Signature: statement.Signature,
 		}
 
-		err := s.VerifySignature()
+		err := s.VerifySignatureInDomain(domain)
 		if err != nil {
 			return logId, hash, err
 		}
@@ -809,7 +1144,14 @@ func (c *Client) GetForeignLogIDAndHash(statement *wire.ForeignStatement) ([32]b
 			Signature: statement.Signature,
 		}
 
-		err := s.VerifySignature(statement.PubKey)
+		var err error
+		if statement.Delegation != nil {
+			// The statement was signed by a delegate, so check the delegation
+			// chain back to the controlling key
+			err = s.VerifyDelegatedSignature(statement.PubKey, statement.Delegation, domain)
+		} else {
+			err = s.VerifySignatureInDomain(statement.PubKey, domain)
+		}
 		if err != nil {
 			return logId, hash, err
 		}
@@ -826,7 +1168,7 @@ func (c *Client) AddForeignLog(statement *wire.ForeignStatement) error {
 	if err != nil {
 		return err
 	}
-	return c.db.Update(func(dtx *buntdb.Tx) error {
+	err = c.db.Update(func(dtx *buntdb.Tx) error {
 
 		// Store the hash of the log
 		key := fmt.Sprintf("loghash-%x-999999999", logId[:])
@@ -860,6 +1202,23 @@ func (c *Client) AddForeignLog(statement *wire.ForeignStatement) error {
 
 		}
 
+		// The metadata is only included in the initial statement
+		if statement.InitialStatement {
+			err = c.setLogMetadata(dtx, logId, statement.Metadata)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Remember the log was sealed, and at which index
+		if statement.Sealed {
+			key = fmt.Sprintf("sealed-%x", logId[:])
+			_, _, err = dtx.Set(key, fmt.Sprintf("%d", statement.Index), nil)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Store the preimage of the log
 		key = fmt.Sprintf("logpreimage-%x-999999999", logId[:])
 		_, _, err = dtx.Set(key, statement.StatementPreimage, nil)
@@ -872,6 +1231,15 @@ func (c *Client) AddForeignLog(statement *wire.ForeignStatement) error {
 		_, _, err = dtx.Set(key, string("1"), nil)
 		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	// Have the server send us updates for this log from now on
+	if c.features.Has(wire.FeatureWatchLogs) {
+		return c.WatchLogs([][32]byte{logId})
+	}
+	return nil
 }
 
 // IsFollowingLog returns true when the passed LogID is merely being followed
@@ -892,6 +1260,11 @@ func (c *Client) IsForeignLog(logId [32]byte) bool {
 
 func (c *Client) AppendLog(idx uint64, logId [32]byte, statement []byte) error {
 	if c.fullClient {
+		sealedIdx, sealed := c.GetSealedIndex(logId)
+		if sealed {
+			return fmt.Errorf("Log [%x] was sealed at index %d", logId, sealedIdx)
+		}
+
 		lastIdx, lastHash, err := c.GetLastHash(logId)
 		if err != nil {
 			return err
@@ -919,30 +1292,11 @@ func (c *Client) AppendLog(idx uint64, logId [32]byte, statement []byte) error {
 		return err
 	}
 
-	result := make(chan error, 1)
-
-	go func() {
-		// Wait for ack
-		select {
-		case <-c.ack:
-			result <- nil
-		case err = <-c.errChan:
-			result <- err
-		case <-time.After(10 * time.Second):
-			result <- fmt.Errorf("Timeout waiting for ACK")
-		}
-	}()
-
 	// Calculate the hash the server will write to the log
 	serverHash := fastsha256.Sum256(l.Bytes())
 
 	// Send the message to the server
-	err = c.conn.WriteMessage(wire.MessageTypeAppendLog, l.Bytes())
-	if err != nil {
-		return err
-	}
-
-	err = <-result
+	err = c.sendAndWaitForAck(wire.MessageTypeAppendLog, l.Bytes())
 	if err != nil {
 		return err
 	}
@@ -959,7 +1313,100 @@ func (c *Client) AppendLog(idx uint64, logId [32]byte, statement []byte) error {
 			// Store the hash as "last one for this log"
 			key = fmt.Sprintf("lastidx-%x", logId[:])
 			_, _, err = dtx.Set(key, fmt.Sprintf("%d", idx), nil)
+			if err != nil {
+				return err
+			}
+
+			return c.setSignatureDomain(dtx, logId, idx, c.signatureDomain)
+		})
+		if err != nil {
 			return err
+		}
+	}
+
+	return nil
+}
+
+// SignBatch signs the hash of the batch with the key in this client. Every
+// controlling key of a log in the batch has to do this before it can be sent
+// using BatchAppendLog.
+func (c *Client) SignBatch(batch *wire.BatchLogStatement) ([64]byte, error) {
+	batchHash := batch.Hash()
+	hash := fastsha256.Sum256(c.signatureDomain.SigningPayload(batchHash[:]))
+	sig, err := c.key.Sign(hash[:])
+	if err != nil {
+		return [64]byte{}, err
+	}
+	return sig64.SigCompress(sig.Serialize())
+}
+
+// BatchAppendLog sends a batch of statements on different logs to the server,
+// which will append either all or none of them. Statements on logs we control
+// are stored like with AppendLog, including the batch so we can prove the
+// statement was part of it.
+func (c *Client) BatchAppendLog(sb *wire.SignedBatchLogStatement) error {
+	if c.fullClient {
+		for _, s := range sb.Batch.Statements {
+			if !c.isOwnLog(s.LogID) {
+				continue
+			}
+			sealedIdx, sealed := c.GetSealedIndex(s.LogID)
+			if sealed {
+				return fmt.Errorf("Log [%x] was sealed at index %d", s.LogID, sealedIdx)
+			}
+			lastIdx, _, err := c.GetLastHash(s.LogID)
+			if err != nil {
+				return err
+			}
+			if s.Index != uint64(lastIdx+1) {
+				return fmt.Errorf("Received out-of-sync index for log [%x]: expected %d, got %d", s.LogID, lastIdx+1, s.Index)
+			}
+		}
+	}
+
+	err := c.sendAndWaitForAck(wire.MessageTypeBatchAppendLog, sb.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if c.fullClient {
+		err := c.db.Update(func(dtx *buntdb.Tx) error {
+			for i, s := range sb.Batch.Statements {
+				if !c.isOwnLogTx(dtx, s.LogID) {
+					continue
+				}
+
+				// Store the log statement hash in our data
+				serverHash := sb.Batch.Witness(i, sb.Signatures[i])
+				key := fmt.Sprintf("loghash-%x-%09d", s.LogID[:], s.Index)
+				_, _, err := dtx.Set(key, string(serverHash[:]), nil)
+				if err != nil {
+					return err
+				}
+
+				// Store the hash as "last one for this log"
+				key = fmt.Sprintf("lastidx-%x", s.LogID[:])
+				_, _, err = dtx.Set(key, fmt.Sprintf("%d", s.Index), nil)
+				if err != nil {
+					return err
+				}
+
+				err = c.setSignatureDomain(dtx, s.LogID, s.Index, c.signatureDomain)
+				if err != nil {
+					return err
+				}
+
+				// Store the batch and our position in it
+				var batch bytes.Buffer
+				wire.WriteVarInt(&batch, uint64(i))
+				batch.Write(sb.Batch.Bytes())
+				key = fmt.Sprintf("batch-%x-%09d", s.LogID[:], s.Index)
+				_, _, err = dtx.Set(key, batch.String(), nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
 		})
 		if err != nil {
 			return err
@@ -969,14 +1416,87 @@ func (c *Client) AppendLog(idx uint64, logId [32]byte, statement []byte) error {
 	return nil
 }
 
+// BatchAppendLogText is the same as BatchAppendLog, but also keeps the clear
+// text (preimage) of the statements on the logs we control, keyed by LogID
+func (c *Client) BatchAppendLogText(sb *wire.SignedBatchLogStatement, preimages map[[32]byte]string) error {
+	err := c.BatchAppendLog(sb)
+	if err != nil {
+		return err
+	}
+
+	if c.fullClient {
+		err := c.db.Update(func(dtx *buntdb.Tx) error {
+			for _, s := range sb.Batch.Statements {
+				preimage, ok := preimages[s.LogID]
+				if !ok || !c.isOwnLogTx(dtx, s.LogID) {
+					continue
+				}
+				key := fmt.Sprintf("logpreimage-%x-%09d", s.LogID[:], s.Index)
+				_, _, err := dtx.Set(key, preimage, nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBatch returns the batch the statement at idx in the log was appended in,
+// and its position in the batch
+func (c *Client) getBatch(logId [32]byte, idx uint64) (*wire.BatchLogStatement, int, error) {
+	var batch *wire.BatchLogStatement
+	position := 0
+	err := c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf("batch-%x-%09d", logId[:], idx))
+		if err != nil {
+			return err
+		}
+		buf := bytes.NewBufferString(val)
+		pos, err := wire.ReadVarInt(buf)
+		if err != nil {
+			return err
+		}
+		position = int(pos)
+		batch, err = wire.NewBatchLogStatementFromBytes(buf.Bytes())
+		return err
+	})
+	return batch, position, err
+}
+
+// isOwnLog returns true if we created or appended to the log ourselves, as
+// opposed to following it as a foreign log
+func (c *Client) isOwnLog(logId [32]byte) bool {
+	own := false
+	c.db.View(func(tx *buntdb.Tx) error {
+		own = c.isOwnLogTx(tx, logId)
+		return nil
+	})
+	return own
+}
+
+func (c *Client) isOwnLogTx(tx *buntdb.Tx, logId [32]byte) bool {
+	_, err := tx.Get(fmt.Sprintf("lastidx-%x", logId[:]))
+	if err != nil {
+		return false
+	}
+	_, err = tx.Get(fmt.Sprintf("loghash-%x-999999999", logId[:]))
+	return err != nil
+}
+
 // SignedAppendLog is a convenience function to generate a SignedLogStatement
 // message using the key in this client
 func (c *Client) SignedAppendLog(idx uint64, logId [32]byte, statement []byte) (*wire.SignedLogStatement, error) {
 	// Create the message
 	l := wire.NewSignedLogStatement(idx, logId, statement)
 
-	// Hash the statement, which is what we'll sign
-	hash := fastsha256.Sum256(l.Statement.Bytes())
+	// Hash the statement in our signature domain, which is what we'll sign
+	hash := fastsha256.Sum256(c.signatureDomain.SigningPayload(l.Statement.Bytes()))
 
 	if !c.DummySignatures {
 		// Sign the hash
@@ -995,21 +1515,484 @@ func (c *Client) SignedAppendLog(idx uint64, logId [32]byte, statement []byte) (
 	return l, nil
 }
 
+// SealLogText is a convenience function called by the RPC server to seal a log
+// with a final clear text statement. It hashes the statement before passing it
+// to SealLog and keeps the preimage for future verification purposes.
+func (c *Client) SealLogText(idx uint64, logId [32]byte, statement string) error {
+	statementHash := fastsha256.Sum256([]byte(statement))
+
+	err := c.SealLog(idx, logId, statementHash[:])
+	if err != nil {
+		return err
+	}
+
+	if c.fullClient {
+		// Store the preimage in our database
+		err := c.db.Update(func(dtx *buntdb.Tx) error {
+			key := fmt.Sprintf("logpreimage-%x-%09d", logId[:], idx)
+			_, _, err := dtx.Set(key, statement, nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SealLog appends a final statement to the log at index idx. After the server
+// acknowledged it, no more statements can be appended to the log. Only the
+// controlling key of a log can seal it.
+func (c *Client) SealLog(idx uint64, logId [32]byte, statement []byte) error {
+	if c.fullClient {
+		sealedIdx, sealed := c.GetSealedIndex(logId)
+		if sealed {
+			return fmt.Errorf("Log [%x] was already sealed at index %d", logId, sealedIdx)
+		}
+
+		lastIdx, _, err := c.GetLastHash(logId)
+		if err != nil {
+			return err
+		}
+		if idx != uint64(lastIdx+1) {
+			return fmt.Errorf("Received out-of-sync index for log [%x]: expected %d, got %d", logId, lastIdx+1, idx)
+		}
+	}
+
+	l, err := c.SignedSealLog(idx, logId, statement)
+	if err != nil {
+		return err
+	}
+
+	err = c.sendAndWaitForAck(wire.MessageTypeSealLog, l.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if c.fullClient {
+		serverHash := l.Witness()
+		err := c.db.Update(func(dtx *buntdb.Tx) error {
+			// Store the log statement hash in our data
+			key := fmt.Sprintf("loghash-%x-%09d", logId[:], idx)
+			_, _, err := dtx.Set(key, string(serverHash[:]), nil)
+			if err != nil {
+				return err
+			}
+
+			// Store the hash as "last one for this log"
+			key = fmt.Sprintf("lastidx-%x", logId[:])
+			_, _, err = dtx.Set(key, fmt.Sprintf("%d", idx), nil)
+			if err != nil {
+				return err
+			}
+
+			err = c.setSignatureDomain(dtx, logId, idx, c.signatureDomain)
+			if err != nil {
+				return err
+			}
+
+			key = fmt.Sprintf("sealed-%x", logId[:])
+			_, _, err = dtx.Set(key, fmt.Sprintf("%d", idx), nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SignedSealLog is a convenience function to generate a
+// SignedSealLogStatement message using the key in this client
+func (c *Client) SignedSealLog(idx uint64, logId [32]byte, statement []byte) (*wire.SignedSealLogStatement, error) {
+	l := wire.NewSignedSealLogStatement(idx, logId, statement)
+
+	// Hash the seal payload, which is what we'll sign
+	hash := fastsha256.Sum256(c.signatureDomain.SigningPayload(l.Statement.SealBytes()))
+
+	if !c.DummySignatures {
+		sig, err := c.key.Sign(hash[:])
+		if err != nil {
+			return nil, err
+		}
+		csig, err := sig64.SigCompress(sig.Serialize())
+		if err != nil {
+			return nil, err
+		}
+		l.Signature = csig
+	}
+	return l, nil
+}
+
+// GetSealedIndex returns the index at which the given log was sealed, and
+// false if we do not know of the log being sealed
+func (c *Client) GetSealedIndex(logId [32]byte) (uint64, bool) {
+	idx := uint64(0)
+	sealed := false
+	c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf("sealed-%x", logId[:]))
+		if err != nil {
+			return err
+		}
+		idx, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		sealed = true
+		return nil
+	})
+	return idx, sealed
+}
+
+// DelegateLog will authorize the key delegateKey to append statements to the
+// given log, which is controlled by this client's key. The index range and
+// expiry height are optional and can be set to 0 for no limit. The returned
+// SignedDelegation should be handed to the delegate, who can pass it to
+// AddDelegation.
+func (c *Client) DelegateLog(logId [32]byte, delegateKey [33]byte, firstIndex, lastIndex, expiryHeight uint64) (*wire.SignedDelegation, error) {
+	// Create the message
+	d := wire.NewSignedDelegation(logId, delegateKey, firstIndex, lastIndex, expiryHeight)
+
+	// Hash the delegation, which is what we'll sign
+	hash := fastsha256.Sum256(c.signatureDomain.SigningPayload(d.Delegation.Bytes()))
+	sig, err := c.key.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	d.Signature, err = sig64.SigCompress(sig.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.sendAndWaitForAck(wire.MessageTypeDelegateLog, d.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// RevokeDelegation will withdraw an earlier delegation made with DelegateLog.
+// The server will refuse statements signed by the delegate from now on.
+func (c *Client) RevokeDelegation(d *wire.Delegation) error {
+	// Create the message
+	r := wire.NewSignedDelegationRevocation(d.LogID, d.Hash())
+
+	// Hash the revocation, which is what we'll sign
+	hash := fastsha256.Sum256(c.signatureDomain.SigningPayload(r.Revocation.Bytes()))
+	sig, err := c.key.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+	r.Signature, err = sig64.SigCompress(sig.Serialize())
+	if err != nil {
+		return err
+	}
+
+	return c.sendAndWaitForAck(wire.MessageTypeRevokeDelegation, r.Bytes())
+}
+
+// AddDelegation stores a delegation received from the controlling key of a
+// log, so that statements this client appends to that log can be exported
+// including the delegation chain. A log can have several delegations for our
+// key, for instance covering different ranges of indexes.
+func (c *Client) AddDelegation(controllingKey [33]byte, sd *wire.SignedDelegation) error {
+	if !bytes.Equal(sd.Delegation.DelegateKey[:], c.pubKey[:]) {
+		return fmt.Errorf("Delegation is not for our key")
+	}
+
+	// The controlling key signed it in the domain of our server, or without
+	// a domain when the server doesn't have one
+	err := sd.VerifySignatureInDomain(controllingKey, c.signatureDomain)
+	if err != nil {
+		return err
+	}
+
+	return c.db.Update(func(dtx *buntdb.Tx) error {
+		hash := sd.Delegation.Hash()
+		key := fmt.Sprintf("delegation-%x-%x", sd.Delegation.LogID[:], hash[:])
+		_, _, err := dtx.Set(key, string(sd.Bytes()), nil)
+		if err != nil {
+			return err
+		}
+
+		key = fmt.Sprintf("delegationkey-%x", sd.Delegation.LogID[:])
+		_, _, err = dtx.Set(key, string(controllingKey[:]), nil)
+		return err
+	})
+}
+
+// GetDelegation returns the controlling key and a delegation stored for the
+// given log with AddDelegation that allows us to append at index
+func (c *Client) GetDelegation(logId [32]byte, index uint64) ([33]byte, *wire.SignedDelegation, error) {
+	controllingKey := [33]byte{}
+	var sd *wire.SignedDelegation
+	err := c.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendKeys(fmt.Sprintf("delegation-%x-*", logId[:]), func(key, value string) bool {
+			d, derr := wire.NewSignedDelegationFromBytes([]byte(value))
+			if derr != nil {
+				err = derr
+				return false
+			}
+			// We don't know the block height, the server checks expiry
+			if d.Delegation.Covers(index, 0) {
+				sd = d
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if sd == nil {
+			return buntdb.ErrNotFound
+		}
+
+		val, err := tx.Get(fmt.Sprintf("delegationkey-%x", logId[:]))
+		if err != nil {
+			return err
+		}
+		copy(controllingKey[:], []byte(val))
+		return nil
+	})
+	return controllingKey, sd, err
+}
+
+// NegotiateSignatureDomain asks the server which domain statements should be
+// signed in, and uses it for all statements signed from then on
+func (c *Client) NegotiateSignatureDomain() error {
+	if !c.features.Has(wire.FeatureSignatureDomain) {
+		return fmt.Errorf("Server does not support signature domains")
+	}
+
+	p, err := c.requestExpect(wire.MessageTypeRequestSignatureDomain, []byte{}, wire.MessageTypeSignatureDomain, c.AckTimeout)
+	if err != nil {
+		return err
+	}
+
+	msg, err := wire.NewSignatureDomainMessageFromBytes(p)
+	if err != nil {
+		return err
+	}
+	c.signatureDomain = msg.Domain
+	return nil
+}
+
+// SignatureDomain returns the domain this client signs statements in, or nil
+// if it uses legacy signatures
+func (c *Client) SignatureDomain() *wire.SignatureDomain {
+	return c.signatureDomain
+}
+
+// setSignatureDomain records the domain the statement at idx in the log was
+// signed in. Nothing is recorded for legacy signatures.
+func (c *Client) setSignatureDomain(dtx *buntdb.Tx, logId [32]byte, idx uint64, d *wire.SignatureDomain) error {
+	if d == nil {
+		return nil
+	}
+	key := fmt.Sprintf("sigdomain-%x-%09d", logId[:], idx)
+	_, _, err := dtx.Set(key, string(d.Bytes()), nil)
+	return err
+}
+
+// getSignatureDomain returns the domain the statement at idx in the log was
+// signed in, or nil if it was signed without domain separation
+func (c *Client) getSignatureDomain(logId [32]byte, idx uint64) *wire.SignatureDomain {
+	var d *wire.SignatureDomain
+	c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf("sigdomain-%x-%09d", logId[:], idx))
+		if err != nil {
+			return err
+		}
+		d, err = wire.NewSignatureDomainFromBytes([]byte(val))
+		return err
+	})
+	return d
+}
+
+// GetLogInfo requests the controlling key and metadata of a log from the
+// server
+func (c *Client) GetLogInfo(logId [32]byte) (*wire.LogInfoMessage, error) {
+	msg := wire.NewRequestLogInfoMessage(logId)
+	p, err := c.requestExpect(wire.MessageTypeRequestLogInfo, msg.Bytes(), wire.MessageTypeLogInfo, c.AckTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.NewLogInfoMessageFromBytes(p)
+}
+
+// RequestLogStatus requests the state of a log as the server knows it: the
+// index it expects the next statement at, the controlling key, the value it
+// witnessed for the last statement and the last commitment that included it
+func (c *Client) RequestLogStatus(logId [32]byte) (*wire.LogStatusMessage, error) {
+	if !c.features.Has(wire.FeatureLogStatus) {
+		return nil, fmt.Errorf("Server does not support log status requests")
+	}
+
+	msg := wire.NewRequestLogStatusMessage(logId)
+	p, err := c.requestExpect(wire.MessageTypeRequestLogStatus, msg.Bytes(), wire.MessageTypeLogStatus, c.AckTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.NewLogStatusMessageFromBytes(p)
+}
+
+// ResyncLog repairs our local state of a log from the state the server has.
+// Our last index can drift from the server's when we crash between the server
+// acknowledging a statement and us storing it, or when we lose our data and
+// start over with the same key. Statements we stored that the server does not
+// know are dropped. ResyncLog fails when the log is not controlled by our key
+// or a delegation we hold, or when the server witnessed a different statement
+// than we stored at its last index.
+func (c *Client) ResyncLog(logId [32]byte) error {
+	if !c.fullClient {
+		return fmt.Errorf("Only full clients keep the state of logs")
+	}
+
+	status, err := c.RequestLogStatus(logId)
+	if err != nil {
+		return err
+	}
+	if status.NextIndex == 0 {
+		return fmt.Errorf("Server has no statements for log [%x]", logId)
+	}
+
+	if status.ControllingKey != c.pubKey {
+		controllingKey, _, err := c.GetDelegation(logId, status.NextIndex-1)
+		if err != nil || controllingKey != status.ControllingKey {
+			return fmt.Errorf("Log [%x] is not controlled by our key", logId)
+		}
+	}
+
+	lastIdx, _, err := c.GetLastHash(logId)
+	if err != nil {
+		return err
+	}
+	serverIdx := status.NextIndex - 1
+
+	return c.db.Update(func(dtx *buntdb.Tx) error {
+		key := fmt.Sprintf("loghash-%x-%09d", logId[:], serverIdx)
+		val, err := dtx.Get(key)
+		if err == nil && !bytes.Equal([]byte(val), status.LastValue[:]) {
+			return fmt.Errorf("Log [%x] diverged from the server at index %d", logId, serverIdx)
+		} else if err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+
+		// Store the hash the server witnessed, which we need to continue the
+		// hash chain in FastMode even if we lost the statement itself
+		_, _, err = dtx.Set(key, string(status.LastValue[:]), nil)
+		if err != nil {
+			return err
+		}
+
+		// Drop the statements the server never accepted
+		for idx := int64(serverIdx) + 1; idx <= lastIdx; idx++ {
+			for _, prefix := range []string{"loghash", "logpreimage", "logcommitment", "sigdomain", "batch"} {
+				_, err = dtx.Delete(fmt.Sprintf("%s-%x-%09d", prefix, logId[:], idx))
+				if err != nil && err != buntdb.ErrNotFound {
+					return err
+				}
+			}
+		}
+
+		key = fmt.Sprintf("lastidx-%x", logId[:])
+		_, _, err = dtx.Set(key, fmt.Sprintf("%d", serverIdx), nil)
+		if err != nil {
+			return err
+		}
+
+		key = fmt.Sprintf("sealed-%x", logId[:])
+		if status.Sealed {
+			_, _, err = dtx.Set(key, fmt.Sprintf("%d", serverIdx), nil)
+		} else {
+			_, err = dtx.Delete(key)
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// Write this marker key to allow us to enumerate all logs, which is
+		// missing when we start over without our data
+		key = fmt.Sprintf("log-%x", logId[:])
+		_, _, err = dtx.Set(key, string("1"), nil)
+		return err
+	})
+}
+
+// GetLogMetadata returns the metadata of a log. If we don't know it yet, it
+// is requested from the server and stored for later use.
+func (c *Client) GetLogMetadata(logId [32]byte) (map[string]string, error) {
+	var metadata map[string]string
+	err := c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf("logmeta-%x", logId[:]))
+		if err != nil {
+			return err
+		}
+		_, metadata, err = wire.ReadCreateLogExtension(bytes.NewBufferString(val))
+		return err
+	})
+	if err == nil {
+		return metadata, nil
+	}
+
+	info, err := c.GetLogInfo(logId)
+	if err != nil {
+		return nil, err
+	}
+	err = c.db.Update(func(dtx *buntdb.Tx) error {
+		return c.setLogMetadata(dtx, logId, info.Metadata)
+	})
+	return info.Metadata, err
+}
+
+func (c *Client) setLogMetadata(dtx *buntdb.Tx, logId [32]byte, metadata map[string]string) error {
+	var buf bytes.Buffer
+	wire.WriteCreateLogExtension(&buf, nil, metadata)
+	key := fmt.Sprintf("logmeta-%x", logId[:])
+	_, _, err := dtx.Set(key, buf.String(), nil)
+	return err
+}
+
+// getCreateLogExtension returns the nonce and metadata we created the log
+// with, both of which are nil for logs created without them
+func (c *Client) getCreateLogExtension(logId [32]byte) ([]byte, map[string]string) {
+	var nonce []byte
+	var metadata map[string]string
+	c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf("logcreate-%x", logId[:]))
+		if err != nil {
+			return err
+		}
+		nonce, metadata, err = wire.ReadCreateLogExtension(bytes.NewBufferString(val))
+		return err
+	})
+	return nonce, metadata
+}
+
 // GetCommitmentHistory will request the server to send over commitment details
 // for every commitment since sinceCommitment. If sinceCommitment is an empty
 // byte array, all commitments will be returned.
 func (c *Client) GetCommitmentHistory(sinceCommitment [32]byte) ([]*wire.Commitment, error) {
 	// Create the message and send it to the server
 	msg := wire.NewRequestCommitmentHistoryMessage(sinceCommitment)
-	err := c.conn.WriteMessage(wire.MessageTypeRequestCommitmentHistory, msg.Bytes())
+	p, err := c.requestExpect(wire.MessageTypeRequestCommitmentHistory, msg.Bytes(), wire.MessageTypeCommitmentHistory, c.AckTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	// Read from the response channel and return to the client
-	// TODO: timeout?
-	hist := <-c.commitHistory
-	return hist, nil
+	hist, err := wire.NewCommitmentHistoryMessageFromBytes(p)
+	if err != nil {
+		return nil, err
+	}
+	return hist.Commitments, nil
 }
 
 // GetCommitmentDetails will request the server to send over commitment details
@@ -1018,15 +2001,22 @@ func (c *Client) GetCommitmentHistory(sinceCommitment [32]byte) ([]*wire.Commitm
 func (c *Client) GetCommitmentDetails(commitment [32]byte) (*wire.Commitment, error) {
 	// Create the message and send it to the server
 	msg := wire.NewRequestCommitmentDetailsMessage(commitment)
-	err := c.conn.WriteMessage(wire.MessageTypeRequestCommitmentDetails, msg.Bytes())
+	p, err := c.requestExpect(wire.MessageTypeRequestCommitmentDetails, msg.Bytes(), wire.MessageTypeCommitmentDetails, c.AckTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	// Read from the response channel and return to the client
-	// TODO: timeout?
-	details := <-c.commitDetails
-	return details, nil
+	details, err := wire.NewCommitmentDetailsMessageFromBytes(p)
+	if err != nil {
+		return nil, err
+	}
+	return details.Commitment, nil
+}
+
+// GetBlockHeightByHash will return the height of a block in the SPV header
+// chain based on its hash
+func (c *Client) GetBlockHeightByHash(hash *chainhash.Hash) (int32, error) {
+	return c.spv.GetHeightByBlockHash(hash)
 }
 
 // GetBlockHeaderByHash will return a single block header from the SPV data based on
@@ -1057,6 +2047,21 @@ func (c *Client) ExportLog(logId [32]byte) (*wire.ForeignStatement, error) {
 	}
 	fs.PubKey = c.pubKey
 
+	sealedIdx, sealed := c.GetSealedIndex(logId)
+	fs.Sealed = sealed && sealedIdx == uint64(idx) && !fs.InitialStatement
+
+	// If we are appending to this log as a delegate, the statement needs to
+	// carry the delegation and refer to the controlling key
+	controllingKey, delegation, err := c.GetDelegation(logId, uint64(idx))
+	if err == nil && !fs.InitialStatement && !fs.Sealed {
+		fs.PubKey = controllingKey
+		fs.Delegation = delegation
+	}
+
+	// The statement has to be signed in the same domain as it was originally,
+	// otherwise the recreated signature doesn't match the witnessed one
+	fs.SignatureDomain = c.getSignatureDomain(logId, uint64(idx))
+
 	commitment, err := c.GetLogCommitment(logId, uint64(idx))
 	if err != nil {
 		return nil, fmt.Errorf("Error fetching commitment hash for last committed statement: %s", err.Error())
@@ -1073,11 +2078,23 @@ func (c *Client) ExportLog(logId [32]byte) (*wire.ForeignStatement, error) {
 	statementHash := fastsha256.Sum256([]byte(fs.StatementPreimage))
 	signaturePayload := []byte{}
 	if fs.InitialStatement {
-		signaturePayload = wire.NewSignedCreateLogStatement(fs.PubKey, statementHash[:]).CreateStatement.Bytes()
+		fs.Nonce, fs.Metadata = c.getCreateLogExtension(logId)
+		signaturePayload = wire.NewSignedCreateLogStatementWithMetadata(fs.PubKey, statementHash[:], fs.Nonce, fs.Metadata).CreateStatement.Bytes()
+	} else if batch, position, err := c.getBatch(logId, uint64(idx)); err == nil {
+		// The batch signature is checked against the key that signed it,
+		// without a delegation, so that has to be ours
+		fs.PubKey = c.pubKey
+		fs.Delegation = nil
+		fs.Batch = batch
+		fs.BatchPosition = position
+		batchHash := batch.Hash()
+		signaturePayload = batchHash[:]
+	} else if fs.Sealed {
+		signaturePayload = wire.NewSignedSealLogStatement(uint64(fs.Index), logId, statementHash[:]).Statement.SealBytes()
 	} else {
 		signaturePayload = wire.NewSignedLogStatement(uint64(fs.Index), logId, statementHash[:]).Statement.Bytes()
 	}
-	signatureHash := fastsha256.Sum256(signaturePayload)
+	signatureHash := fastsha256.Sum256(fs.SignatureDomain.SigningPayload(signaturePayload))
 	sig, err := c.key.Sign(signatureHash[:])
 	if err != nil {
 		return nil, fmt.Errorf("Could not recreate signature: %s", err.Error())
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mit-dci/go-bverify/bitcoin/btcutil"
+	"github.com/mit-dci/go-bverify/bitcoin/txscript"
+	btcwire "github.com/mit-dci/go-bverify/bitcoin/wire"
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+	"github.com/mit-dci/go-bverify/logging"
+	"github.com/mit-dci/go-bverify/utils"
+	"github.com/mit-dci/go-bverify/wire"
+	"github.com/tidwall/buntdb"
+)
+
+// validateCommitment checks that a commitment was included in the block with
+// the given header, and that its transaction is the one the server with public
+// key serverKey created for it:
+//
+//   - the raw transaction hashes to the transaction ID of the commitment
+//   - its first output is an OP_RETURN with exactly the commitment
+//   - its second output pays the change back to the server's key
+//   - its first input spends the change of prev, and is signed by the server
+//
+// The last check proves the server did not make other commitments in between.
+// prev is nil for the first commitment, whose first input can only be checked
+// to carry the server's key since we don't know the output it spends.
+func validateCommitment(comm *wire.Commitment, header *btcwire.BlockHeader, prev *wire.Commitment, serverKey []byte) error {
+	if comm.TxHash == nil || comm.IncludedInBlock == nil {
+		return invalidError{fmt.Errorf("Commitment %x is not included in a block", comm.Commitment)}
+	}
+
+	// The merkle proof shows the transaction ID is in the block
+	if !comm.MerkleProof.Check(comm.TxHash, &header.MerkleRoot) {
+		return invalidError{fmt.Errorf("Merkle proof is incorrect")}
+	}
+
+	// The transaction we check has to be the one in the block
+	tx, err := commitmentTx(comm)
+	if err != nil {
+		return err
+	}
+	txHash := tx.TxHash()
+	if !txHash.IsEqual(comm.TxHash) {
+		return invalidError{fmt.Errorf("Commitment transaction hashes to %s, not to %s", txHash.String(), comm.TxHash.String())}
+	}
+
+	// It has to commit to exactly our commitment, and keep the change
+	// with the server to continue the chain
+	if len(tx.TxOut) < 2 {
+		return invalidError{fmt.Errorf("Commitment transaction has %d outputs, expected an OP_RETURN and change", len(tx.TxOut))}
+	}
+	opReturn := append([]byte{txscript.OP_RETURN, txscript.OP_DATA_32}, comm.Commitment[:]...)
+	if !bytes.Equal(tx.TxOut[0].PkScript, opReturn) {
+		return invalidError{fmt.Errorf("First output of the commitment transaction is not an OP_RETURN with commitment %x", comm.Commitment)}
+	}
+	changeScript := serverChangeScript(serverKey)
+	if !bytes.Equal(tx.TxOut[1].PkScript, changeScript) {
+		return invalidError{fmt.Errorf("Second output of the commitment transaction does not pay the change to the server")}
+	}
+
+	if len(tx.TxIn) == 0 {
+		return invalidError{fmt.Errorf("Commitment transaction has no inputs")}
+	}
+	if prev == nil {
+		// We can't verify the signature without the output it spends, but
+		// can check the key it was made with
+		witness := tx.TxIn[0].Witness
+		if len(witness) != 2 || !bytes.Equal(witness[1], serverKey) {
+			return invalidError{fmt.Errorf("First input of the commitment transaction is not signed by the server")}
+		}
+		return nil
+	}
+
+	// The first input has to spend the change of the previous commitment,
+	// and the server has to have signed it
+	if tx.TxIn[0].PreviousOutPoint.Index != 1 || !tx.TxIn[0].PreviousOutPoint.Hash.IsEqual(prev.TxHash) {
+		return invalidError{fmt.Errorf("Commitment transaction's first input is not the change output of the last commitment. This breaks the chain and is invalid.")}
+	}
+	prevTx, err := commitmentTx(prev)
+	if err != nil {
+		return err
+	}
+	if len(prevTx.TxOut) < 2 || !bytes.Equal(prevTx.TxOut[1].PkScript, changeScript) {
+		return invalidError{fmt.Errorf("The last commitment did not pay the change to the server")}
+	}
+	engine, err := txscript.NewEngine(prevTx.TxOut[1].PkScript, tx, 0, txscript.StandardVerifyFlags, nil,
+		txscript.NewTxSigHashes(tx), prevTx.TxOut[1].Value)
+	if err == nil {
+		err = engine.Execute()
+	}
+	if err != nil {
+		return invalidError{fmt.Errorf("First input of the commitment transaction is not signed by the server: %s", err.Error())}
+	}
+	return nil
+}
+
+// commitmentTx deserializes the raw transaction of a commitment
+func commitmentTx(comm *wire.Commitment) (*btcwire.MsgTx, error) {
+	tx := btcwire.NewMsgTx(1)
+	r := bytes.NewReader(comm.RawTx)
+	err := tx.Deserialize(r)
+	if err == nil && r.Len() > 0 {
+		err = fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	if err != nil {
+		return nil, invalidError{fmt.Errorf("Could not read the transaction of commitment %x: %s", comm.Commitment, err.Error())}
+	}
+	return tx, nil
+}
+
+// serverChangeScript returns the script the server pays its change to, which
+// the next commitment spends
+func serverChangeScript(serverKey []byte) []byte {
+	var pkh [20]byte
+	copy(pkh[:], btcutil.Hash160(serverKey))
+	return utils.DirectWPKHScriptFromPKH(pkh)
+}
+
+// pinServerKey returns the public key the server commits with. The first time,
+// it is taken from the first input of the commitment transaction and has to
+// match the identity the server announced in the version handshake. We then
+// pin it in our database, and no longer accept commitments or servers with
+// another key.
+func (c *Client) pinServerKey(comm *wire.Commitment) ([]byte, error) {
+	var serverKey []byte
+	err := c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get("serverkey")
+		if err != nil {
+			return err
+		}
+		serverKey = []byte(val)
+		return nil
+	})
+	if err != nil && err != buntdb.ErrNotFound {
+		return nil, err
+	}
+
+	var serverID [32]byte
+	if c.serverVersion != nil {
+		serverID = c.serverVersion.ServerID
+	}
+
+	if serverKey != nil {
+		if serverID != [32]byte{} && fastsha256.Sum256(serverKey) != serverID {
+			return nil, invalidError{fmt.Errorf("Server identity [%x] does not match the key we pinned [%x]", serverID, serverKey)}
+		}
+		return serverKey, nil
+	}
+
+	tx, err := commitmentTx(comm)
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.TxIn) == 0 || len(tx.TxIn[0].Witness) != 2 || len(tx.TxIn[0].Witness[1]) != 33 {
+		return nil, invalidError{fmt.Errorf("Could not find the server's key in commitment transaction %s", comm.TxHash.String())}
+	}
+	serverKey = tx.TxIn[0].Witness[1]
+	if serverID != [32]byte{} && fastsha256.Sum256(serverKey) != serverID {
+		return nil, invalidError{fmt.Errorf("Commitment transaction is signed with key [%x], which is not the server's identity [%x]", serverKey, serverID)}
+	}
+
+	logging.Infof("Pinning server key [%x]", serverKey)
+	err = c.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("serverkey", string(serverKey), nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serverKey, nil
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/go-bverify/bitcoin/blockchain"
+	"github.com/mit-dci/go-bverify/bitcoin/btcutil"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/txscript"
+	btcwire "github.com/mit-dci/go-bverify/bitcoin/wire"
+	"github.com/mit-dci/go-bverify/crypto/btcec"
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+	"github.com/mit-dci/go-bverify/utils"
+	"github.com/mit-dci/go-bverify/wire"
+	"github.com/tidwall/buntdb"
+)
+
+// commitmentTestChain fabricates commitment transactions the way the server's
+// wallet creates them, and blocks to include them in
+type commitmentTestChain struct {
+	t   *testing.T
+	key *btcec.PrivateKey
+}
+
+func newCommitmentTestChain(t *testing.T) *commitmentTestChain {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &commitmentTestChain{t: t, key: key}
+}
+
+func (tc *commitmentTestChain) pubKey() []byte {
+	return tc.key.PubKey().SerializeCompressed()
+}
+
+// commitmentTx creates a transaction committing to commitment, spending
+// output 1 of prevTx with the given key
+func (tc *commitmentTestChain) commitmentTx(commitment [32]byte, prevTx *btcwire.MsgTx, key *btcec.PrivateKey) *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx(1)
+	prevHash := prevTx.TxHash()
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&prevHash, 1), nil, nil))
+	tx.AddTxOut(btcwire.NewTxOut(0, append([]byte{0x6A, 0x20}, commitment[:]...)))
+	tx.AddTxOut(btcwire.NewTxOut(prevTx.TxOut[1].Value-1000, serverChangeScript(tc.pubKey())))
+
+	witness, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx), 0,
+		prevTx.TxOut[1].Value, prevTx.TxOut[1].PkScript, txscript.SigHashAll, key, true)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	tx.TxIn[0].Witness = witness
+	return tx
+}
+
+// fundingTx creates a transaction paying to the server's key in output 1,
+// which the maiden commitment spends
+func (tc *commitmentTestChain) fundingTx() *btcwire.MsgTx {
+	tx := btcwire.NewMsgTx(1)
+	tx.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&chainhash.Hash{0x01}, 0), nil, nil))
+	tx.AddTxOut(btcwire.NewTxOut(0, []byte{0x6A}))
+	tx.AddTxOut(btcwire.NewTxOut(100000000, serverChangeScript(tc.pubKey())))
+	return tx
+}
+
+// mine creates a block header for a block with a coinbase and the given
+// transactions, and returns it with a commitment for the transaction at idx
+func (tc *commitmentTestChain) mine(commitment [32]byte, idx int, txs ...*btcwire.MsgTx) (*wire.Commitment, *btcwire.BlockHeader) {
+	coinbase := btcwire.NewMsgTx(1)
+	coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(&chainhash.Hash{}, 0xffffffff), []byte{0x51, 0x51}, nil))
+	coinbase.AddTxOut(btcwire.NewTxOut(5000000000, []byte{0x51}))
+
+	block := []*btcutil.Tx{btcutil.NewTx(coinbase)}
+	for _, tx := range txs {
+		block = append(block, btcutil.NewTx(tx))
+	}
+	tree := blockchain.BuildMerkleTreeStore(block, false)
+	header := &btcwire.BlockHeader{MerkleRoot: *tree[len(tree)-1]}
+	blockHash := header.BlockHash()
+
+	var buf bytes.Buffer
+	txs[idx].Serialize(&buf)
+	txHash := txs[idx].TxHash()
+	return &wire.Commitment{
+		Commitment:      commitment,
+		TxHash:          &txHash,
+		IncludedInBlock: &blockHash,
+		MerkleProof:     utils.NewMerkleProof(tree, uint64(idx+1)),
+		RawTx:           buf.Bytes(),
+	}, header
+}
+
+func TestValidateCommitment(t *testing.T) {
+	tc := newCommitmentTestChain(t)
+	otherKey, _ := btcec.NewPrivateKey(btcec.S256())
+
+	var maidenCommitment, commitment [32]byte
+	copy(maidenCommitment[:], utils.MaidenHash())
+	commitment[0] = 0x42
+
+	maidenTx := tc.commitmentTx(maidenCommitment, tc.fundingTx(), tc.key)
+	maiden, maidenHeader := tc.mine(maidenCommitment, 0, maidenTx)
+
+	err := validateCommitment(maiden, maidenHeader, nil, tc.pubKey())
+	if err != nil {
+		t.Fatalf("Maiden commitment should be valid, got: %s", err.Error())
+	}
+
+	// A valid commitment spending the change of the maiden commitment
+	tx := tc.commitmentTx(commitment, maidenTx, tc.key)
+	comm, header := tc.mine(commitment, 1, tc.fundingTx(), tx)
+	err = validateCommitment(comm, header, maiden, tc.pubKey())
+	if err != nil {
+		t.Fatalf("Commitment should be valid, got: %s", err.Error())
+	}
+
+	otherCommitment := commitment
+	otherCommitment[0] = 0x43
+
+	tests := []struct {
+		name   string
+		mutate func() (*wire.Commitment, *btcwire.BlockHeader)
+		prev   *wire.Commitment
+		errMsg string
+	}{
+		{"wrong header", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			return comm, maidenHeader
+		}, maiden, "Merkle proof"},
+		{"other mined transaction", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			// The proof is for the funding transaction, but the server
+			// sends us the raw commitment transaction
+			c, h := tc.mine(commitment, 0, tc.fundingTx(), tx)
+			c.RawTx = comm.RawTx
+			return c, h
+		}, maiden, "hashes to"},
+		{"trailing bytes", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			c, h := tc.mine(commitment, 1, tc.fundingTx(), tx)
+			c.RawTx = append(c.RawTx, 0x00)
+			return c, h
+		}, maiden, "trailing bytes"},
+		{"wrong OP_RETURN", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			return tc.mine(commitment, 0, tc.commitmentTx(otherCommitment, maidenTx, tc.key))
+		}, maiden, "OP_RETURN"},
+		{"change to other key", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			tx := tc.commitmentTx(commitment, maidenTx, tc.key)
+			tx.TxOut[1].PkScript = serverChangeScript(otherKey.PubKey().SerializeCompressed())
+			return tc.mine(commitment, 0, tx)
+		}, maiden, "change"},
+		{"not spending the last commitment", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			return tc.mine(commitment, 0, tc.commitmentTx(commitment, tc.fundingTx(), tc.key))
+		}, maiden, "breaks the chain"},
+		{"signed by other key", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			return tc.mine(commitment, 0, tc.commitmentTx(commitment, maidenTx, otherKey))
+		}, maiden, "not signed by the server"},
+		{"maiden signed by other key", func() (*wire.Commitment, *btcwire.BlockHeader) {
+			return tc.mine(maidenCommitment, 0, tc.commitmentTx(maidenCommitment, tc.fundingTx(), otherKey))
+		}, nil, "not signed by the server"},
+	}
+
+	for _, test := range tests {
+		c, h := test.mutate()
+		err := validateCommitment(c, h, test.prev, tc.pubKey())
+		if err == nil {
+			t.Errorf("%s: expected commitment to be invalid", test.name)
+			continue
+		}
+		if !isInvalid(err) {
+			t.Errorf("%s: expected an invalid commitment error, got: %s", test.name, err.Error())
+		}
+		if !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("%s: expected error containing [%s], got: %s", test.name, test.errMsg, err.Error())
+		}
+	}
+}
+
+func TestPinServerKey(t *testing.T) {
+	tc := newCommitmentTestChain(t)
+	other := newCommitmentTestChain(t)
+
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var maidenCommitment [32]byte
+	copy(maidenCommitment[:], utils.MaidenHash())
+	maiden, _ := tc.mine(maidenCommitment, 0, tc.commitmentTx(maidenCommitment, tc.fundingTx(), tc.key))
+	otherMaiden, _ := other.mine(maidenCommitment, 0, other.commitmentTx(maidenCommitment, other.fundingTx(), other.key))
+
+	c := &Client{db: db, serverVersion: &wire.VersionMessage{ServerID: fastsha256.Sum256(tc.pubKey())}}
+
+	// A commitment signed by a key other than the server's identity
+	_, err = c.pinServerKey(otherMaiden)
+	if !isInvalid(err) {
+		t.Fatalf("Expected a key that does not match the server identity to be invalid, got: %v", err)
+	}
+
+	key, err := c.pinServerKey(maiden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, tc.pubKey()) {
+		t.Fatalf("Pinned key [%x], expected [%x]", key, tc.pubKey())
+	}
+
+	// Once pinned, the key no longer comes from the commitment
+	key, err = c.pinServerKey(otherMaiden)
+	if err != nil || !bytes.Equal(key, tc.pubKey()) {
+		t.Fatalf("Expected the pinned key [%x], got [%x] (%v)", tc.pubKey(), key, err)
+	}
+
+	// A server with another identity is refused
+	c.serverVersion.ServerID = fastsha256.Sum256(other.pubKey())
+	_, err = c.pinServerKey(maiden)
+	if !isInvalid(err) {
+		t.Fatalf("Expected a changed server identity to be invalid, got: %v", err)
+	}
+}
+
+func TestOrderCommitments(t *testing.T) {
+	tc := newCommitmentTestChain(t)
+
+	// Three commitments the server made before the first was mined, all
+	// triggered at the same height and mined in one block
+	txs := make([]*btcwire.MsgTx, 3)
+	prevTx := tc.fundingTx()
+	for i := range txs {
+		var commitment [32]byte
+		commitment[0] = byte(i + 1)
+		txs[i] = tc.commitmentTx(commitment, prevTx, tc.key)
+		prevTx = txs[i]
+	}
+	comms := make([]*wire.Commitment, 0)
+	for i := range txs {
+		comm, _ := tc.mine([32]byte{byte(i + 1)}, i, txs...)
+		comms = append(comms, comm)
+	}
+
+	// And one made before them
+	var earlier [32]byte
+	earlier[0] = 0x42
+	earlierComm, _ := tc.mine(earlier, 0, tc.commitmentTx(earlier, tc.fundingTx(), tc.key))
+	earlierComm.TriggeredAtBlockHeight = 0
+	for _, comm := range comms {
+		comm.TriggeredAtBlockHeight = 1
+	}
+
+	ordered := orderCommitments([]*wire.Commitment{comms[2], comms[0], earlierComm, comms[1]})
+	expected := []*wire.Commitment{earlierComm, comms[0], comms[1], comms[2]}
+	if len(ordered) != len(expected) {
+		t.Fatalf("Expected %d commitments, got %d", len(expected), len(ordered))
+	}
+	for i := range expected {
+		if ordered[i] != expected[i] {
+			t.Errorf("Expected commitment %x at %d, got %x", expected[i].Commitment, i, ordered[i].Commitment)
+		}
+	}
+}
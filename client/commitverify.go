@@ -12,9 +12,15 @@ import (
 	"github.com/tidwall/buntdb"
 )
 
+// maxProofTrees is the number of commitments we remember the proof tree for.
+// Proof updates arrive when the server commits, which can be a few
+// commitments ahead of the last one we verified on chain.
+const maxProofTrees = 16
+
 // updateProofs will be called after a new commitment has been properly verified
-// and committted. We will request an updated proof for our logIDs and verify
-// if the proofs are correct.
+// and committted. When the proof updates the server sent us brought our proof
+// tree to that commitment we use it, otherwise we request an updated proof for
+// our logIDs. Either way we verify if the proofs are correct.
 func (c *Client) updateProofs() error {
 	logging.Debugf("Updating proofs")
 
@@ -29,18 +35,68 @@ func (c *Client) updateProofs() error {
 		return nil
 	}
 
-	// Request the proofs from the server
-	proof, err := c.RequestProof(logIds)
-	if err != nil {
-		return err
+	var proof *mpt.PartialMPT
+	var logIdxes map[[32]byte]uint64
+	if c.lastServerCommitment != nil {
+		proof = c.proofTreeAt(c.lastServerCommitment.Commitment)
+	}
+	if proof != nil {
+		logIdxes, err = c.checkProof(proof, logIds)
+		if err != nil {
+			logging.Debugf("Proof tree from proof updates does not check out, requesting full proof: %s", err.Error())
+			proof = nil
+		}
 	}
 
-	// Calculate the commitment from the partial tree we got from the
-	// server and check if it is a known commitment
+	if proof == nil {
+		// Request the proofs from the server
+		proof, err = c.RequestProof(logIds)
+		if err != nil {
+			return err
+		}
+		logIdxes, err = c.checkProof(proof, logIds)
+		if err != nil {
+			return err
+		}
+
+		// Apply the next proof updates to this proof
+		c.setProofTree(proof)
+	}
+
+	logging.Debugf("Proof checks out, storing it in database")
+
+	// Store the proof in our database
 	rootHash := proof.Commitment()
-	_, err = c.getCommitment(rootHash)
+	return c.db.Update(func(tx *buntdb.Tx) error {
+		key := fmt.Sprintf("proof-%x", rootHash)
+		_, _, err := tx.Set(key, string(proof.Bytes()), nil)
+		if err != nil {
+			return fmt.Errorf("Error saving proof: %s", err)
+		}
+
+		for _, l := range logIds {
+			idx, ok := logIdxes[l]
+			if ok {
+				key = fmt.Sprintf("logcommitment-%x-%09d", l[:], idx)
+				_, _, err := tx.Set(key, string(rootHash), nil)
+				if err != nil {
+					return fmt.Errorf("Error saving logcommitment: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// checkProof verifies a proof for our logs, and returns the index of the
+// statement of each log that it includes
+func (c *Client) checkProof(proof *mpt.PartialMPT, logIds [][32]byte) (map[[32]byte]uint64, error) {
+	// Calculate the commitment from the partial tree and check if it is a
+	// known commitment
+	rootHash := proof.Commitment()
+	_, err := c.getCommitment(rootHash)
 	if err != nil {
-		return fmt.Errorf("Error fetching commitment: %s", err.Error())
+		return nil, fmt.Errorf("Error fetching commitment: %s", err.Error())
 	}
 
 	logging.Debugf("Commitment %x is known to us and valid", rootHash)
@@ -62,7 +118,7 @@ func (c *Client) updateProofs() error {
 				logging.Debugf("Key is absent in proof [%x], but no commitments known yet so it's probably pending its first commitment", l)
 				continue
 			}
-			return fmt.Errorf("Error getting Log ID %x from the proof: %s", l, err)
+			return nil, invalidError{fmt.Errorf("Error getting Log ID %x from the proof: %s", l, err)}
 		}
 		if val == nil {
 			if !hasCommitment {
@@ -92,34 +148,89 @@ func (c *Client) updateProofs() error {
 				continue
 			}
 
-			return fmt.Errorf("The value in the proof does not match any of the values we know. Not good.")
+			return nil, invalidError{fmt.Errorf("The value in the proof does not match any of the values we know. Not good.")}
 		} else {
 			logIdxes[l] = uint64(valueIdx)
 		}
 	}
 
-	logging.Debugf("Proof checks out, storing it in database")
+	return logIdxes, nil
+}
 
-	// Store the proof in our database
-	return c.db.Update(func(tx *buntdb.Tx) error {
-		key := fmt.Sprintf("proof-%x", rootHash)
-		_, _, err := tx.Set(key, string(proof.Bytes()), nil)
-		if err != nil {
-			return fmt.Errorf("Error saving proof: %s", err)
-		}
+// processProofUpdate applies a proof update the server sent us to our proof
+// tree. Updates have to be applied in the order they were sent, and an update
+// we missed leaves the tree at a commitment that does not exist, which
+// updateProofs detects.
+func (c *Client) processProofUpdate(p []byte) {
+	delta, err := mpt.DeserializeNewDeltaMPT(bytes.NewBuffer(p))
+	if err != nil {
+		logging.Warnf("Ignoring invalid proof update: %s", err.Error())
+		return
+	}
 
-		for _, l := range logIds {
-			idx, ok := logIdxes[l]
-			if ok {
-				key = fmt.Sprintf("logcommitment-%x-%09d", l[:], idx)
-				_, _, err := tx.Set(key, string(rootHash), nil)
-				if err != nil {
-					return fmt.Errorf("Error saving logcommitment: %s", err)
-				}
-			}
-		}
+	c.proofTreeLock.Lock()
+	defer c.proofTreeLock.Unlock()
+
+	// We need a full proof to apply updates to
+	if c.proofTree == nil {
+		return
+	}
+	err = c.proofTree.ProcessUpdates(delta)
+	if err != nil {
+		logging.Warnf("Could not apply proof update: %s", err.Error())
+		c.proofTree = nil
+		return
+	}
+	c.rememberProofTree()
+}
+
+// setProofTree replaces our proof tree with a full proof from the server
+func (c *Client) setProofTree(proof *mpt.PartialMPT) {
+	tree, err := mpt.DeserializeNewPartialMPT(bytes.NewBuffer(proof.Bytes()))
+	if err != nil {
+		logging.Warnf("Could not copy proof tree: %s", err.Error())
+		return
+	}
+
+	c.proofTreeLock.Lock()
+	defer c.proofTreeLock.Unlock()
+	c.proofTree = tree
+	c.proofTrees = map[[32]byte][]byte{}
+	c.proofRoots = nil
+	c.rememberProofTree()
+}
+
+// rememberProofTree stores the proof tree as it is at its current commitment.
+// The caller holds proofTreeLock.
+func (c *Client) rememberProofTree() {
+	root := [32]byte{}
+	copy(root[:], c.proofTree.Commitment())
+	if _, ok := c.proofTrees[root]; !ok {
+		c.proofRoots = append(c.proofRoots, root)
+	}
+	c.proofTrees[root] = c.proofTree.Bytes()
+
+	for len(c.proofRoots) > maxProofTrees {
+		delete(c.proofTrees, c.proofRoots[0])
+		c.proofRoots = c.proofRoots[1:]
+	}
+}
+
+// proofTreeAt returns our proof tree as it was at the given commitment, or nil
+// when the proof updates did not bring it there
+func (c *Client) proofTreeAt(commitment [32]byte) *mpt.PartialMPT {
+	c.proofTreeLock.Lock()
+	b, ok := c.proofTrees[commitment]
+	c.proofTreeLock.Unlock()
+	if !ok {
 		return nil
-	})
+	}
+
+	tree, err := mpt.DeserializeNewPartialMPT(bytes.NewBuffer(b))
+	if err != nil {
+		return nil
+	}
+	return tree
 }
 
 func (c *Client) LogHasCommitment(logId [32]byte) bool {
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/crypto/btcec"
+	"github.com/mit-dci/go-bverify/server"
+	"github.com/mit-dci/go-bverify/wire"
+	"github.com/tidwall/buntdb"
+)
+
+// countingConn counts the messages the client sends by type. A frame is
+// always written in a single call, starting with its type.
+type countingConn struct {
+	net.Conn
+	lock   sync.Mutex
+	counts map[wire.MessageType]int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		c.lock.Lock()
+		c.counts[wire.MessageType(b[0])]++
+		c.lock.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *countingConn) count(t wire.MessageType) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[t]
+}
+
+// proofTestClient is a full client connected to an in-memory server, with
+// its data in an in-memory database
+type proofTestClient struct {
+	t    *testing.T
+	srv  *server.Server
+	c    *Client
+	conn *countingConn
+}
+
+func newProofTestClient(t *testing.T) *proofTestClient {
+	srv, err := server.NewServer("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connectProofTestClient(t, srv)
+}
+
+// connectProofTestClient connects another full client to srv
+func connectProofTestClient(t *testing.T, srv *server.Server) *proofTestClient {
+	serverConn, clientConn := net.Pipe()
+	processDone := make(chan bool)
+	go func() {
+		server.NewLogProcessor(serverConn, srv).Process()
+		close(processDone)
+	}()
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &countingConn{Conn: clientConn, counts: map[wire.MessageType]int{}}
+	c, err := NewClientWithConnection(key.Serialize(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.db, err = buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.fullClient = true
+
+	// Both ends log until they stop, which must not overlap with the next
+	// test setting the log level
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+		<-c.loopDone
+		<-processDone
+		c.db.Close()
+	})
+	return &proofTestClient{t: t, srv: srv, c: c, conn: conn}
+}
+
+// commit makes the server commit, and has the client accept the commitment
+// as if it verified it on chain
+func (pt *proofTestClient) commit() [32]byte {
+	commitment := [32]byte{}
+	copy(commitment[:], pt.srv.Commitment())
+	err := pt.srv.Commit()
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+
+	block := chainhash.Hash(commitment)
+	comm := &wire.Commitment{Commitment: commitment, IncludedInBlock: &block}
+	err = pt.c.saveCommitment(comm)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	pt.c.lastServerCommitment = comm
+	return commitment
+}
+
+// waitForProofTree waits until the proof updates brought the client's proof
+// tree to commitment
+func (pt *proofTestClient) waitForProofTree(commitment [32]byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pt.c.proofTreeAt(commitment) == nil {
+		if time.Now().After(deadline) {
+			pt.t.Fatalf("Proof updates did not bring the proof tree to %x", commitment)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProofUpdatesWithoutFullProof(t *testing.T) {
+	pt := newProofTestClient(t)
+
+	logId, err := pt.c.StartLogText("Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pt.c.SubscribeProofUpdates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a proof tree, the first proof has to be requested
+	pt.commit()
+	err = pt.c.updateProofs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pt.conn.count(wire.MessageTypeRequestProof); n != 1 {
+		t.Fatalf("Expected the first proof to be requested, got %d requests", n)
+	}
+
+	// From then on, the proof updates keep the tree up to date
+	for i := uint64(1); i <= 3; i++ {
+		err = pt.c.AppendLogText(i, logId, "Hello again")
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitment := pt.commit()
+		pt.waitForProofTree(commitment)
+
+		err = pt.c.updateProofs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pt.c.IsCommitted(logId, i) {
+			t.Fatalf("Statement %d is not committed after applying the proof update", i)
+		}
+	}
+	if n := pt.conn.count(wire.MessageTypeRequestProof); n != 1 {
+		t.Fatalf("Expected no more full proofs to be requested, got %d requests", n)
+	}
+}
+
+func TestMissedProofUpdate(t *testing.T) {
+	pt := newProofTestClient(t)
+
+	logId, err := pt.c.StartLogText("Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pt.c.SubscribeProofUpdates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt.commit()
+	err = pt.c.updateProofs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The update for the next commitment never arrives
+	err = pt.c.UnsubscribeProofUpdates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pt.c.AppendLogText(1, logId, "Hello again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment := pt.commit()
+	if pt.c.proofTreeAt(commitment) != nil {
+		t.Fatal("Expected no proof tree for a commitment we got no update for")
+	}
+
+	err = pt.c.updateProofs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pt.conn.count(wire.MessageTypeRequestProof); n != 2 {
+		t.Fatalf("Expected a full proof to be requested after missing an update, got %d requests", n)
+	}
+	if !pt.c.IsCommitted(logId, 1) {
+		t.Fatal("Statement 1 is not committed after requesting the full proof")
+	}
+
+	// The full proof is the new base for proof updates
+	err = pt.c.SubscribeProofUpdates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pt.c.AppendLogText(2, logId, "Hello once more")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment = pt.commit()
+	pt.waitForProofTree(commitment)
+	err = pt.c.updateProofs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pt.conn.count(wire.MessageTypeRequestProof); n != 2 {
+		t.Fatalf("Expected no full proof to be requested after resubscribing, got %d requests", n)
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+	"github.com/mit-dci/go-bverify/wire"
+)
+
+func TestAddDelegation(t *testing.T) {
+	owner := newProofTestClient(t)
+	delegate := connectProofTestClient(t, owner.srv)
+
+	if owner.c.SignatureDomain() == nil {
+		t.Fatal("Expected the server to have a signature domain")
+	}
+
+	logId, err := owner.c.StartLogText("Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := owner.c.DelegateLog(logId, delegate.c.pubKey, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = delegate.c.AddDelegation(delegate.c.pubKey, sd)
+	if err == nil {
+		t.Fatal("Expected a delegation not signed by the given controlling key to be rejected")
+	}
+	err = delegate.c.AddDelegation(owner.c.pubKey, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controllingKey, _, err := delegate.c.GetDelegation(logId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controllingKey != owner.c.pubKey {
+		t.Fatalf("Expected controlling key %x, got %x", owner.c.pubKey, controllingKey)
+	}
+}
+
+func TestExportDelegatedLog(t *testing.T) {
+	owner := newProofTestClient(t)
+	delegate := connectProofTestClient(t, owner.srv)
+
+	// The server only accepts batches signed by the controlling key, but the
+	// statement we export has to verify no matter who appended it
+	owner.srv.CheckSignatures = false
+
+	logId, err := owner.c.StartLogText("Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := owner.c.DelegateLog(logId, delegate.c.pubKey, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delegate.c.AddDelegation(owner.c.pubKey, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delegate.c.ResyncLog(logId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(idx uint64) *wire.ForeignStatement {
+		delegate.commit()
+		err := delegate.c.updateProofs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !delegate.c.IsCommitted(logId, idx) {
+			t.Fatalf("Statement %d is not committed", idx)
+		}
+		fs, err := delegate.c.ExportLog(logId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fs.Index != idx {
+			t.Fatalf("Expected statement %d to be exported, got %d", idx, fs.Index)
+		}
+		fs, err = wire.ForeignStatementFromBytes(fs.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		foreignLogId, _, err := owner.c.GetForeignLogIDAndHash(fs)
+		if err != nil {
+			t.Fatalf("Exported statement %d does not verify: %s", idx, err.Error())
+		}
+		if foreignLogId != logId {
+			t.Fatalf("Exported statement %d is for log %x instead of %x", idx, foreignLogId, logId)
+		}
+		return fs
+	}
+
+	preimage := "Hello from the delegate"
+	hash := fastsha256.Sum256([]byte(preimage))
+	batch := wire.NewBatchLogStatement([]*wire.LogStatement{{LogID: logId, Index: 1, Statement: hash[:]}})
+	sb := wire.NewSignedBatchLogStatement(batch)
+	sb.Signatures[0], err = delegate.c.SignBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delegate.c.BatchAppendLogText(sb, map[[32]byte]string{logId: preimage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := export(1)
+	if fs.Batch == nil || fs.PubKey != delegate.c.pubKey {
+		t.Fatal("Expected the batch to be exported with the key that signed it")
+	}
+
+	err = delegate.c.AppendLogText(2, logId, "Hello again from the delegate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = export(2)
+	if fs.Delegation == nil || fs.PubKey != owner.c.pubKey {
+		t.Fatal("Expected the statement to be exported with the delegation from the controlling key")
+	}
+}
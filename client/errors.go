@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/go-bverify/wire"
+)
+
+// ServerError is returned when the server refused one of our requests. Unless
+// it is Fatal, the connection is still usable and the application can react
+// to the error, for instance by resyncing a log on ErrIndexMismatch.
+type ServerError struct {
+	Code      wire.ErrorCode
+	Fatal     bool
+	RequestID uint32
+	Message   string
+}
+
+// Errors the server can return, which can be compared to a returned error
+// with IsServerError or errors.Is
+var (
+	ErrInvalidSignature = &ServerError{Code: wire.ErrorCodeInvalidSignature, Message: "invalid signature"}
+	ErrUnknownLog       = &ServerError{Code: wire.ErrorCodeUnknownLog, Message: "unknown log"}
+	ErrIndexMismatch    = &ServerError{Code: wire.ErrorCodeIndexMismatch, Message: "index mismatch"}
+	ErrDuplicate        = &ServerError{Code: wire.ErrorCodeDuplicate, Message: "duplicate"}
+	ErrLogSealed        = &ServerError{Code: wire.ErrorCodeLogSealed, Message: "log sealed"}
+	ErrInvalidRequest   = &ServerError{Code: wire.ErrorCodeInvalidRequest, Message: "invalid request"}
+	ErrNotFound         = &ServerError{Code: wire.ErrorCodeNotFound, Message: "not found"}
+	ErrNotReady         = &ServerError{Code: wire.ErrorCodeNotReady, Message: "not ready"}
+	ErrProtocol         = &ServerError{Code: wire.ErrorCodeProtocol, Message: "protocol violation", Fatal: true}
+)
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Is returns true if target is a ServerError with the same code, which makes
+// errors.Is(err, ErrIndexMismatch) work
+func (e *ServerError) Is(target error) bool {
+	t, ok := target.(*ServerError)
+	return ok && t.Code == e.Code
+}
+
+// IsServerError returns true if err is a ServerError with the same code as
+// target
+func IsServerError(err error, target *ServerError) bool {
+	e, ok := err.(*ServerError)
+	return ok && e.Is(target)
+}
+
+// newServerError parses the payload of a MessageTypeError. Servers that don't
+// support error codes send plain text, which is always fatal.
+func (c *Client) newServerError(p []byte) *ServerError {
+	if !c.features.Has(wire.FeatureErrorCodes) {
+		return &ServerError{Code: wire.ErrorCodeUnknown, Fatal: true, Message: string(p)}
+	}
+	msg, err := wire.NewErrorMessageFromBytes(p)
+	if err != nil {
+		return &ServerError{Code: wire.ErrorCodeUnknown, Fatal: true, Message: fmt.Sprintf("Unparseable error from server: %x", p)}
+	}
+	return &ServerError{Code: msg.Code, Fatal: msg.Fatal, RequestID: msg.RequestID, Message: msg.Message}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mit-dci/go-bverify/wire"
+)
+
+// response is what the receive loop hands to a request waiting for the
+// server's reply. When err is set, the connection was lost before the reply
+// came in.
+type response struct {
+	t   wire.MessageType
+	p   []byte
+	err error
+}
+
+// request sends a message to the server and waits for the response carrying
+// the same request ID. Any number of requests can be in flight at once, each
+// with its own timeout. An error message from the server is returned as a
+// *ServerError.
+func (c *Client) request(t wire.MessageType, m []byte, timeout time.Duration) (wire.MessageType, []byte, error) {
+	// Request ID 0 is reserved for messages the server sends on its own
+	// accord, so skip it when the counter wraps
+	id := atomic.AddUint32(&c.nextRequest, 1)
+	if id == 0 {
+		id = atomic.AddUint32(&c.nextRequest, 1)
+	}
+
+	res := make(chan response, 1)
+	c.pendingLock.Lock()
+	c.pending[id] = res
+	c.pendingLock.Unlock()
+
+	defer func() {
+		c.pendingLock.Lock()
+		delete(c.pending, id)
+		c.pendingLock.Unlock()
+	}()
+
+	err := c.conn.WriteFrame(t, id, m)
+	if err != nil {
+		return 0x00, nil, err
+	}
+
+	select {
+	case r := <-res:
+		if r.err != nil {
+			return 0x00, nil, r.err
+		}
+		if r.t == wire.MessageTypeError {
+			return 0x00, nil, c.newServerError(r.p)
+		}
+		return r.t, r.p, nil
+	case <-time.After(timeout):
+		return 0x00, nil, fmt.Errorf("Timeout waiting for response to message type %x", byte(t))
+	}
+}
+
+// requestExpect sends a request like request does, and returns the payload of
+// the response when it is of the expected type
+func (c *Client) requestExpect(t wire.MessageType, m []byte, expected wire.MessageType, timeout time.Duration) ([]byte, error) {
+	rt, p, err := c.request(t, m, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if rt != expected {
+		return nil, fmt.Errorf("Expected message type %x in response, got %x", byte(expected), byte(rt))
+	}
+	return p, nil
+}
+
+// sendAndWaitForAck sends a message to the server and waits for it to be
+// acknowledged
+func (c *Client) sendAndWaitForAck(t wire.MessageType, m []byte) error {
+	_, err := c.requestExpect(t, m, wire.MessageTypeAck, c.AckTimeout)
+	return err
+}
+
+// deliver hands a response to the request with the given ID. It returns false
+// if nobody is waiting for it, for instance because the request timed out.
+func (c *Client) deliver(id uint32, r response) bool {
+	c.pendingLock.Lock()
+	res, ok := c.pending[id]
+	delete(c.pending, id)
+	c.pendingLock.Unlock()
+	if !ok {
+		return false
+	}
+	res <- r
+	return true
+}
+
+// failPending makes all requests in flight return err, which is used when the
+// connection is lost and no more responses will come in
+func (c *Client) failPending(err error) {
+	c.pendingLock.Lock()
+	pending := c.pending
+	c.pending = make(map[uint32]chan response)
+	c.pendingLock.Unlock()
+	for _, res := range pending {
+		res <- response{err: err}
+	}
+}
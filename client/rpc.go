@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 
@@ -27,7 +28,8 @@ func NewRpcServer(c *Client) *RpcServer {
 }
 
 type StartLogParameters struct {
-	InitialStatement string // The statement (in clear text) you wish to start the log with
+	InitialStatement string            // The statement (in clear text) you wish to start the log with
+	Metadata         map[string]string // Optional metadata, such as name, content-type and retention
 }
 
 type StartLogReply struct {
@@ -46,7 +48,7 @@ func (s *RpcServer) StartLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Start the log
-	logId, err := s.cli.StartLogText(params.InitialStatement)
+	logId, err := s.cli.StartLogTextWithMetadata(params.InitialStatement, params.Metadata)
 	if err != nil {
 		s.writeError(w, fmt.Errorf("Error decoding json: %s", err.Error()))
 		return
@@ -101,6 +103,39 @@ func (s *RpcServer) AppendLog(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(reply)
 }
 
+// SealLog is an RPC method to seal an existing log with a final statement
+func (s *RpcServer) SealLog(w http.ResponseWriter, r *http.Request) {
+	// Decode the passed in parameters
+	decoder := json.NewDecoder(r.Body)
+	var params AppendLogParameters
+	err := decoder.Decode(&params)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("Error decoding json: %s", err.Error()))
+		return
+	}
+
+	// Decode the passed in LogID
+	hexLogID, err := hex.DecodeString(params.LogID)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("Error decoding hex: %s", err.Error()))
+		return
+	}
+	logId32 := [32]byte{}
+	copy(logId32[:], hexLogID)
+
+	// Seal the log
+	err = s.cli.SealLogText(params.Index, logId32, params.Statement)
+	if err != nil {
+		s.writeError(w, fmt.Errorf("Error sealing log: %s", err.Error()))
+		return
+	}
+
+	// Generate a reply and send it back to the caller
+	reply := AppendLogReply{}
+	reply.Success = true
+	json.NewEncoder(w).Encode(reply)
+}
+
 type ErrorResponse struct {
 	Error        bool
 	ErrorDetails string
@@ -114,8 +149,10 @@ func (s *RpcServer) writeError(w http.ResponseWriter, err error) {
 }
 
 type StatusReply struct {
-	BlockHeight int32 `json:"blockHeight"`
-	Synced      bool  `json:"synced"`
+	BlockHeight int32  `json:"blockHeight"`
+	Synced      bool   `json:"synced"`
+	VerifyState string `json:"verifyState"`           // Behind, Verifying or Invalid
+	VerifyError string `json:"verifyError,omitempty"` // Why we are behind or the server is invalid
 }
 
 // Status is an RPC method to fetch the status of the server
@@ -123,28 +160,50 @@ func (s *RpcServer) Status(w http.ResponseWriter, r *http.Request) {
 	reply := StatusReply{}
 	reply.BlockHeight = s.cli.SPVHeight()
 	reply.Synced = s.cli.SPVSynced()
+	state, err := s.cli.GetVerifyState()
+	reply.VerifyState = state.String()
+	if err != nil {
+		reply.VerifyError = err.Error()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	json.NewEncoder(w).Encode(reply)
 }
 
-// AddForeignLog is an RPC method to instruct this client to keep updated
-// proofs for the given log statement
-func (s *RpcServer) AddForeignLog(w http.ResponseWriter, r *http.Request) {
-	// The passed in bytes should be deserializable as a ForeignStatement
-	b, err := ioutil.ReadAll(r.Body)
+// readForeignStatement reads a base64 encoded ForeignStatement from the body
+// of a request. Bodies that are larger than the largest possible statement
+// are rejected without reading them in full.
+func readForeignStatement(r *http.Request) (*wire.ForeignStatement, error) {
+	maxLength := int64(base64.StdEncoding.EncodedLen(wire.MaxForeignStatementSize))
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLength+1))
 	if err != nil {
-		s.writeError(w, fmt.Errorf("Could not read proof from request body: %s", err.Error()))
-		return
+		return nil, fmt.Errorf("Could not read proof from request body: %s", err.Error())
+	}
+	if int64(len(b)) > maxLength {
+		return nil, fmt.Errorf("Request body is too large")
 	}
 
 	dec, err := base64.StdEncoding.DecodeString(string(b))
 	if err != nil {
-		s.writeError(w, fmt.Errorf("Request body is not valid base64: %s", err.Error()))
-		return
+		return nil, fmt.Errorf("Request body is not valid base64: %s", err.Error())
 	}
 
-	fs := wire.ForeignStatementFromBytes(dec)
+	fs, err := wire.ForeignStatementFromBytes(dec)
+	if err != nil {
+		return nil, fmt.Errorf("Request body is not a valid foreign statement: %s", err.Error())
+	}
+	return fs, nil
+}
+
+// AddForeignLog is an RPC method to instruct this client to keep updated
+// proofs for the given log statement
+func (s *RpcServer) AddForeignLog(w http.ResponseWriter, r *http.Request) {
+	// The passed in bytes should be deserializable as a ForeignStatement
+	fs, err := readForeignStatement(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
 
 	err = s.cli.AddForeignLog(fs)
 	if err != nil {
@@ -165,6 +224,8 @@ type VerificationResult struct {
 	BlockHash      string
 	TxHash         string
 	BlockTimestamp int64
+	Sealed         bool
+	SealedAtIndex  uint64
 }
 
 func (s *RpcServer) VerifyOnce(w http.ResponseWriter, r *http.Request) {
@@ -172,21 +233,13 @@ func (s *RpcServer) VerifyOnce(w http.ResponseWriter, r *http.Request) {
 		v := VerificationResult{}
 
 		// The passed in bytes should be deserializable as a ForeignStatement
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			v.Valid = false
-			v.Error = fmt.Sprintf("Could not read proof from request body: %s", err.Error())
-			return v
-		}
-
-		dec, err := base64.StdEncoding.DecodeString(string(b))
+		fs, err := readForeignStatement(r)
 		if err != nil {
 			v.Valid = false
-			v.Error = fmt.Sprintf("Request body is not valid base64: %s", err.Error())
+			v.Error = err.Error()
 			return v
 		}
 
-		fs := wire.ForeignStatementFromBytes(dec)
 		logId, hash, err := s.cli.GetForeignLogIDAndHash(fs)
 		if err != nil {
 			v.Valid = false
@@ -195,6 +248,11 @@ func (s *RpcServer) VerifyOnce(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// TODO: Get proof from server if it's nil?
+		if fs.Proof == nil {
+			v.Valid = false
+			v.Error = "Foreign statement does not contain a proof"
+			return v
+		}
 
 		val, err := fs.Proof.Get(logId[:])
 		if err != nil || !bytes.Equal(val, hash[:]) {
@@ -226,6 +284,10 @@ func (s *RpcServer) VerifyOnce(w http.ResponseWriter, r *http.Request) {
 		v.Statement = fs.StatementPreimage
 		v.TxHash = c.TxHash.String()
 		v.BlockTimestamp = block.Timestamp.Unix()
+		if fs.Sealed {
+			v.Sealed = true
+			v.SealedAtIndex = fs.Index
+		}
 		return v
 	}
 
@@ -245,6 +307,9 @@ type LogInfo struct {
 	LastCommitmentProof     string
 	LastCommitmentBlock     string
 	LastCommitmentTimestamp int64
+	Metadata                map[string]string
+	Sealed                  bool
+	SealedAtIndex           uint64
 	Valid                   bool
 	Error                   string
 }
@@ -261,11 +326,20 @@ func (s *RpcServer) Logs(w http.ResponseWriter, r *http.Request) {
 	for i, l := range logIds {
 		logs[i].Foreign = s.cli.IsForeignLog(l)
 		logs[i].LogID = hex.EncodeToString(l[:])
+		logs[i].Metadata, _ = s.cli.GetLogMetadata(l)
 
 		idx, _, err := s.cli.GetLastCommittedLog(l)
 		if err == nil {
 			logs[i].Valid = true
 			logs[i].LastIndex = idx
+
+			// Only report the log as sealed once the seal itself is
+			// committed. Foreign logs only track their last statement.
+			sealedIdx, sealed := s.cli.GetSealedIndex(l)
+			if sealed && (logs[i].Foreign || uint64(idx) == sealedIdx) {
+				logs[i].Sealed = true
+				logs[i].SealedAtIndex = sealedIdx
+			}
 			logs[i].LastStatement, err = s.cli.GetLogPreimage(l, uint64(idx))
 			if err != nil {
 				logs[i].Valid = false
@@ -368,6 +442,7 @@ func (s *RpcServer) Start() error {
 
 	r.HandleFunc("/start", s.StartLog).Methods("POST")
 	r.HandleFunc("/append", s.AppendLog).Methods("POST")
+	r.HandleFunc("/seal", s.SealLog).Methods("POST")
 	r.HandleFunc("/status", s.Status).Methods("GET")
 	r.HandleFunc("/addforeignlog", s.AddForeignLog).Methods("POST")
 	r.HandleFunc("/verifyonce", s.VerifyOnce).Methods("POST")
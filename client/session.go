@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/go-bverify/logging"
+	"github.com/mit-dci/go-bverify/wire"
+)
+
+// Session is a logical session on the connection to the server. Every session
+// has its own subscriptions and receives its own proof updates, which allows a
+// gateway to serve many devices over a single connection. The server opens a
+// session when the first message in it arrives, and forgets about it after a
+// fatal error in it, when it is closed, or when the connection is lost.
+type Session struct {
+	ID     uint32
+	client *Client
+
+	// OnProofUpdate is called with the proof updates the server sends in
+	// this session
+	OnProofUpdate func([]byte, *Session)
+}
+
+// OpenSession returns a new logical session with the given ID on the
+// connection to the server
+func (c *Client) OpenSession(id uint32) (*Session, error) {
+	if !c.features.Has(wire.FeatureSessions) {
+		return nil, fmt.Errorf("Server does not support sessions")
+	}
+
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	if _, ok := c.sessions[id]; ok {
+		return nil, fmt.Errorf("Session %d is already open", id)
+	}
+	s := &Session{ID: id, client: c}
+	c.sessions[id] = s
+	return s, nil
+}
+
+// Request sends a message of type t in the session and waits for the server's
+// response, which is returned when it is of the expected type
+func (s *Session) Request(t wire.MessageType, m []byte, expected wire.MessageType) ([]byte, error) {
+	msg := wire.NewSessionMessage(s.ID, t, m)
+	return s.client.requestExpect(wire.MessageTypeSession, msg.Bytes(), expected, s.client.AckTimeout)
+}
+
+// SubscribeProofUpdates will tell the server to send proof updates for the
+// logs written in this session to its OnProofUpdate hook
+func (s *Session) SubscribeProofUpdates() error {
+	_, err := s.Request(wire.MessageTypeSubscribeProofUpdates, []byte{}, wire.MessageTypeAck)
+	return err
+}
+
+// WatchLogs will tell the server to include the given logs in the proof
+// updates of this session
+func (s *Session) WatchLogs(logIds [][32]byte) error {
+	if !s.client.features.Has(wire.FeatureWatchLogs) {
+		return fmt.Errorf("Server does not support watching logs")
+	}
+	msg := wire.NewWatchLogsMessage(logIds)
+	_, err := s.Request(wire.MessageTypeWatchLogs, msg.Bytes(), wire.MessageTypeAck)
+	return err
+}
+
+// Close ends the session, after which the server forgets its subscriptions
+func (s *Session) Close() error {
+	c := s.client
+	c.sessionsLock.Lock()
+	delete(c.sessions, s.ID)
+	c.sessionsLock.Unlock()
+
+	msg := wire.NewCloseSessionMessage(s.ID)
+	return c.sendAndWaitForAck(wire.MessageTypeCloseSession, msg.Bytes())
+}
+
+// receiveSessionMessage hands a message the server sent in a session to the
+// request waiting for it, or to the session's OnProofUpdate hook. A fatal error
+// closes the session.
+func (c *Client) receiveSessionMessage(id uint32, msg *wire.SessionMessage) {
+	if msg.Type == wire.MessageTypeProofUpdate {
+		c.sessionsLock.Lock()
+		s, ok := c.sessions[msg.SessionID]
+		c.sessionsLock.Unlock()
+		if ok && s.OnProofUpdate != nil {
+			go s.OnProofUpdate(msg.Payload, s)
+		}
+		return
+	}
+
+	// The server forgets about the session after a fatal error in it, so a
+	// new one can be opened with the same ID
+	if msg.Type == wire.MessageTypeError && c.newServerError(msg.Payload).Fatal {
+		c.sessionsLock.Lock()
+		delete(c.sessions, msg.SessionID)
+		c.sessionsLock.Unlock()
+	}
+
+	if !c.deliver(id, response{t: msg.Type, p: msg.Payload}) {
+		logging.Warnf("Nobody was waiting for message type %x in session %d with request ID %d", byte(msg.Type), msg.SessionID, id)
+	}
+}
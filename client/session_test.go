@@ -0,0 +1,43 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/mit-dci/go-bverify/wire"
+)
+
+func TestSessionFatalError(t *testing.T) {
+	pt := newProofTestClient(t)
+
+	s, err := pt.c.OpenSession(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Request(wire.MessageTypePing, []byte{0x01}, wire.MessageTypePong)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions can't be nested, which the server treats as fatal for the
+	// session, but not for the connection
+	nested := wire.NewSessionMessage(1, wire.MessageTypePing, []byte{0x01})
+	_, err = s.Request(wire.MessageTypeSession, nested.Bytes(), wire.MessageTypeAck)
+	if !IsServerError(err, ErrProtocol) {
+		t.Fatalf("Expected a protocol error, got %v", err)
+	}
+	pt.c.sessionsLock.Lock()
+	_, open := pt.c.sessions[1]
+	pt.c.sessionsLock.Unlock()
+	if open {
+		t.Fatal("Session still open after a fatal error")
+	}
+
+	s, err = pt.c.OpenSession(1)
+	if err != nil {
+		t.Fatalf("Could not open the session again: %s", err.Error())
+	}
+	_, err = s.Request(wire.MessageTypePing, []byte{0x01}, wire.MessageTypePong)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,14 +10,18 @@ import (
 )
 
 func (s *SPVCon) Start(params *coinparam.Params) error {
+	return s.StartWithHeaderFile(params, path.Join(utils.ClientDataDirectory(), "header.bin"))
+}
 
+// StartWithHeaderFile connects like Start, but keeps the headers in the
+// given file
+func (s *SPVCon) StartWithHeaderFile(params *coinparam.Params, headerFilePath string) error {
 	s.Param = params
 
 	s.inMsgQueue = make(chan wire.Message)
 	s.outMsgQueue = make(chan wire.Message)
 	s.syncHeight = 0
 
-	headerFilePath := path.Join(utils.ClientDataDirectory(), "header.bin")
 	// open header file
 	err := s.openHeaderFile(headerFilePath)
 	if err != nil {
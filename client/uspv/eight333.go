@@ -81,15 +81,24 @@ func (s *SPVCon) IngestHeaders(m *wire.MsgHeaders) (bool, error) {
 		return true, err
 	}
 
-	// truncate header file if reorg happens
+	// truncate header file if reorg happens, keeping the header at the
+	// reorg height that the new headers attach to
 	if reorgHeight != 0 {
-		fileHeight := reorgHeight - s.Param.StartHeight
+		fileHeight := reorgHeight - s.Param.StartHeight + 1
 		err = s.headerFile.Truncate(int64(fileHeight) * 80)
 		if err != nil {
 			return false, err
 		}
 
+		// Forget where the orphaned headers were
+		for hash, pos := range headerIndex {
+			if pos >= int64(fileHeight)*80 {
+				delete(headerIndex, hash)
+			}
+		}
+
 		s.syncHeight = reorgHeight
+		s.reorgHeight = reorgHeight
 	}
 
 	// a header message is all or nothing; if we think there's something
@@ -247,3 +256,26 @@ func (s *SPVCon) AskForBlocks() error {
 	}
 	return nil
 }
+
+// AskForBlock requests the block with the given hash, including witnesses.
+// It arrives at OnBlock.
+func (s *SPVCon) AskForBlock(hash *chainhash.Hash) error {
+	gdataMsg := wire.NewMsgGetData()
+	err := gdataMsg.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, hash))
+	if err != nil {
+		return err
+	}
+	s.outMsgQueue <- gdataMsg
+	return nil
+}
+
+// SendTx relays a transaction to the remote node
+func (s *SPVCon) SendTx(tx *wire.MsgTx) {
+	s.outMsgQueue <- tx
+}
+
+// SendHeaders asks the remote node to announce new blocks by sending us their
+// headers (BIP 130), which arrive at OnHeaders
+func (s *SPVCon) SendHeaders() {
+	s.outMsgQueue <- wire.NewMsgSendHeaders()
+}
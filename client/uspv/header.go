@@ -214,6 +214,23 @@ func (s *SPVCon) IndexHeaders() error {
 }
 
 func (s *SPVCon) GetHeaderByBlockHash(hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	hdr, _, err := s.findHeader(hash)
+	return hdr, err
+}
+
+// GetHeightByBlockHash returns the height of the block with the given hash in
+// our header chain
+func (s *SPVCon) GetHeightByBlockHash(hash *chainhash.Hash) (int32, error) {
+	_, pos, err := s.findHeader(hash)
+	if err != nil {
+		return 0, err
+	}
+	return int32(pos/80) + s.Param.StartHeight, nil
+}
+
+// findHeader returns the header with the given hash and its position in the
+// header file
+func (s *SPVCon) findHeader(hash *chainhash.Hash) (*wire.BlockHeader, int64, error) {
 	var err error
 
 	numBlocks := s.GetHeaderTipHeight() // This does some nice sanity checks
@@ -222,7 +239,7 @@ func (s *SPVCon) GetHeaderByBlockHash(hash *chainhash.Hash) (*wire.BlockHeader,
 		headerIndex = map[[32]byte]int64{}
 		err = s.IndexHeaders()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 	}
 
@@ -237,38 +254,42 @@ func (s *SPVCon) GetHeaderByBlockHash(hash *chainhash.Hash) (*wire.BlockHeader,
 		err = cur.Deserialize(s.headerFile)
 		if err != nil {
 			logging.Error(err)
-			return nil, err
+			return nil, 0, err
+		}
+		curhash := cur.BlockHash()
+		if hash.IsEqual(&curhash) {
+			return &cur, pos, nil
 		}
-		return &cur, nil
+		// The header file changed since we indexed it
+		delete(headerIndex, *hash)
 	}
 
 	for tries := 1; tries < utils.Min(1000, int(numBlocks)); tries++ {
-		_, err = s.headerFile.Seek(int64(-80*tries), os.SEEK_END)
+		pos, err = s.headerFile.Seek(int64(-80*tries), os.SEEK_END)
 		if err != nil {
 			logging.Error(err)
-			return nil, err
+			return nil, 0, err
 		}
 
 		//	for blkhash.IsEqual(&target) {
 		err = cur.Deserialize(s.headerFile)
 		if err != nil {
 			logging.Error(err)
-			return nil, err
+			return nil, 0, err
 		}
 		curhash := cur.BlockHash()
 
 		_, ok := headerIndex[curhash]
 		if !ok {
-			pos, _ := s.headerFile.Seek(0, os.SEEK_CUR)
 			headerIndex[curhash] = pos
 		}
 
 		if hash.IsEqual(&curhash) {
-			return &cur, nil
+			return &cur, pos, nil
 		}
 	}
 
-	return nil, fmt.Errorf("Block not found")
+	return nil, 0, fmt.Errorf("Block not found")
 }
 
 // CheckHeaderChain takes in the headers message and sees if they all validate.
@@ -405,13 +426,14 @@ func CheckHeaderChain(
 		logging.Infof("reorg from height %d to %d",
 			height-1, attachHeight+int32(len(inHeaders)))
 
-		// reorg is go, snip to attach height
-		reorgDepth := height - attachHeight
+		// reorg is go, snip the headers above the attach height
+		reorgDepth := height - 1 - attachHeight
 		if reorgDepth > numheaders {
 			logging.Info("Reorg depth is greater than the number of headers received, exiting!")
 			return 0, fmt.Errorf("Reorg depth is greater than the number of headers received, exiting!")
 		}
 		oldHeaders = oldHeaders[:numheaders-reorgDepth]
+		height = attachHeight + 1
 	}
 
 	prevHeaders := oldHeaders
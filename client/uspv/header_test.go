@@ -3,6 +3,8 @@ package uspv
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
@@ -94,3 +96,81 @@ func TestMoreWork(t *testing.T) {
 		logging.Info("Test Passed!")
 	}
 }
+
+// testHeaderChain creates n headers building on prev
+func testHeaderChain(prev chainhash.Hash, n int, nonce uint32) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, n)
+	for i := range headers {
+		headers[i] = &wire.BlockHeader{
+			Version:   32,
+			PrevBlock: prev,
+			Timestamp: time.Unix(0x495fab29+int64(i), 0),
+			Bits:      uint32(0x1d00ffff),
+			Nonce:     nonce,
+		}
+		prev = headers[i].BlockHash()
+	}
+	return headers
+}
+
+func TestReorgHeaders(t *testing.T) {
+	f, err := ioutil.TempFile("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Don't check proof of work on our made up headers
+	p := coinparam.TestNet3Params
+	p.StartHeight = 0
+	p.AssumeDiffBefore = 1 << 30
+	headerIndex = nil
+
+	s := &SPVCon{headerFile: f, Param: &p}
+
+	headers := testHeaderChain(chainhash.Hash{}, 10, 0)
+	err = headers[0].Serialize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.IngestHeaders(&wire.MsgHeaders{Headers: headers[1:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetHeaderTipHeight() != 9 {
+		t.Fatalf("Expected tip height 9, got %d", s.GetHeaderTipHeight())
+	}
+
+	// Index the orphaned header before it is reorged out
+	orphan := headers[9].BlockHash()
+	height, err := s.GetHeightByBlockHash(&orphan)
+	if err != nil || height != 9 {
+		t.Fatalf("Expected header at height 9, got %d (%v)", height, err)
+	}
+
+	// Replace the header at height 9
+	fork := testHeaderChain(headers[8].BlockHash(), 2, 1)
+	_, err = s.IngestHeaders(&wire.MsgHeaders{Headers: fork})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.reorgHeight != 8 {
+		t.Fatalf("Expected a reorg above height 8, got %d", s.reorgHeight)
+	}
+	if s.GetHeaderTipHeight() != 10 {
+		t.Fatalf("Expected tip height 10, got %d", s.GetHeaderTipHeight())
+	}
+
+	_, err = s.GetHeightByBlockHash(&orphan)
+	if err == nil {
+		t.Fatalf("Expected the orphaned header to be gone")
+	}
+	for i, hdr := range append(headers[:9], fork...) {
+		hash := hdr.BlockHash()
+		height, err := s.GetHeightByBlockHash(&hash)
+		if err != nil || height != int32(i) {
+			t.Fatalf("Expected header %s at height %d, got %d (%v)", hash.String(), i, height, err)
+		}
+	}
+}
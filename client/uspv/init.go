@@ -187,8 +187,6 @@ func (s *SPVCon) Handshake(listOfNodes []string) error {
 	return nil
 }
 
-var listOfNodes []string
-
 // Connect dials out and connects to full nodes. Calls GetListOfNodes to get the
 // list of nodes if the user has specified a YupString. Else, moves on to dial
 // the node to see if its up and establishes a connection followed by Handshake()
@@ -196,8 +194,11 @@ var listOfNodes []string
 func (s *SPVCon) Connect() error {
 	var err error
 
-	if len(listOfNodes) == 0 {
-		listOfNodes, err = s.GetListOfNodes()
+	if len(s.listOfNodes) == 0 && s.RemoteNode != "" {
+		s.listOfNodes = []string{s.RemoteNode}
+	}
+	if len(s.listOfNodes) == 0 {
+		s.listOfNodes, err = s.GetListOfNodes()
 		if err != nil {
 			logging.Error(err)
 			return err
@@ -207,28 +208,28 @@ func (s *SPVCon) Connect() error {
 
 	handShakeFailed := false // need to be in this scope to access it here
 	connEstablished := false
-	for len(listOfNodes) != 0 && !connEstablished {
-		err = s.DialNode(listOfNodes)
+	for len(s.listOfNodes) != 0 && !connEstablished {
+		err = s.DialNode(s.listOfNodes)
 		if err != nil {
 			logging.Error(err)
-			logging.Infof("Couldn't dial node %s, Moving on", listOfNodes[0])
-			listOfNodes = listOfNodes[1:]
+			logging.Infof("Couldn't dial node %s, Moving on", s.listOfNodes[0])
+			s.listOfNodes = s.listOfNodes[1:]
 			continue
 		}
-		err = s.Handshake(listOfNodes)
+		err = s.Handshake(s.listOfNodes)
 		if err != nil {
 			// spam node or some other problem. Delete node from list and try again
 			handShakeFailed = true
-			logging.Infof("Handshake with %s failed. Moving on. Error: %s", listOfNodes[0], err.Error())
-			if len(listOfNodes) == 1 { // this is the last node, error out
+			logging.Infof("Handshake with %s failed. Moving on. Error: %s", s.listOfNodes[0], err.Error())
+			if len(s.listOfNodes) == 1 { // this is the last node, error out
 				return fmt.Errorf("Couldn't establish connection with any remote node. Exiting.")
 			}
 			logging.Error("Couldn't establish connection with node. Proceeding to the next one")
-			listOfNodes = listOfNodes[1:]
+			s.listOfNodes = s.listOfNodes[1:]
 			connEstablished = false
 		} else {
 			connEstablished = true
-			listOfNodes = listOfNodes[1:]
+			s.listOfNodes = s.listOfNodes[1:]
 		}
 	}
 
@@ -33,6 +33,10 @@ func (s *SPVCon) incomingMessageHandler() {
 			logging.Infof("Got a pong response. OK.\n")
 		case *wire.MsgHeaders: // concurrent because we keep asking for blocks
 			go s.HeaderHandler(m)
+		case *wire.MsgBlock:
+			if s.OnBlock != nil {
+				go s.OnBlock(m)
+			}
 		case *wire.MsgReject:
 			logging.Infof("Rejected! cmd: %s code: %s tx: %s reason: %s",
 				m.Cmd, m.Code.String(), m.Hash.String(), m.Reason)
@@ -69,13 +73,21 @@ func (s *SPVCon) outgoingMessageHandler() {
 	}
 }
 
-// REORG TODO: how to detect reorgs and send them up to wallet layer
-
 // HeaderHandler ...
 func (s *SPVCon) HeaderHandler(m *wire.MsgHeaders) {
 	moar, err := s.IngestHeaders(m)
 	if err != nil {
 		logging.Errorf("Header error: %s\n", err.Error())
+	} else {
+		// Tell the layer above about reorgs before the new headers
+		reorgHeight := s.reorgHeight
+		s.reorgHeight = 0
+		if reorgHeight != 0 && s.OnReorg != nil {
+			s.OnReorg(reorgHeight)
+		}
+		if s.OnHeaders != nil {
+			s.OnHeaders()
+		}
 	}
 	// more to get? if so, ask for them and return
 	if moar {
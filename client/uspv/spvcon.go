@@ -20,6 +20,11 @@ type SPVCon struct {
 	Ironman  bool   // ironman only gets blocks, never requests txs.
 	ProxyURL string // Optionally the URL of a SOCKS5 proxy to use
 
+	// RemoteNode is the node we connect to. When empty, we ask the DNS seeds
+	// for nodes.
+	RemoteNode  string
+	listOfNodes []string
+
 	headerMutex       sync.Mutex
 	headerFile        *os.File // file for SPV headers
 	headerStartHeight int32    // first header on disk is nth header in chain
@@ -65,4 +70,16 @@ type SPVCon struct {
 	inWaitState chan bool
 
 	Synced bool
+
+	// OnHeaders is called after a batch of headers was processed, which can
+	// extend the chain or tell us we are synced
+	OnHeaders func()
+
+	// OnReorg is called before OnHeaders when a batch of headers replaced
+	// the headers on top of the given height
+	OnReorg     func(height int32)
+	reorgHeight int32
+
+	// OnBlock is called with the blocks we asked for with AskForBlock
+	OnBlock func(block *wire.MsgBlock)
 }
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"time"
+)
+
+const (
+	// The first delay before retrying after an error kept us from verifying,
+	// which doubles on every failure up to VerifyInterval
+	verifyRetryMin = time.Second
+
+	// How often we check for new commitments when the server does not
+	// notify us about them
+	legacyVerifyInterval = 20 * time.Second
+)
+
+// VerifyState is the state of the full client's verification of the server
+type VerifyState int
+
+const (
+	// VerifyStateBehind means we have not verified the server's latest
+	// commitments yet, for instance because we are still syncing headers or
+	// can't reach the server. We keep retrying.
+	VerifyStateBehind VerifyState = iota
+
+	// VerifyStateVerifying means the server's commitments and the proofs of
+	// our logs checked out, and we keep verifying new ones as they come in
+	VerifyStateVerifying
+
+	// VerifyStateInvalid means the server made a commitment or sent a proof
+	// that does not check out
+	VerifyStateInvalid
+)
+
+func (s VerifyState) String() string {
+	switch s {
+	case VerifyStateBehind:
+		return "Behind"
+	case VerifyStateVerifying:
+		return "Verifying"
+	case VerifyStateInvalid:
+		return "Invalid"
+	}
+	return "Unknown"
+}
+
+// invalidError is returned by the verification when the server's commitments
+// or proofs are wrong, as opposed to errors that kept us from checking them
+type invalidError struct {
+	error
+}
+
+func isInvalid(err error) bool {
+	_, ok := err.(invalidError)
+	return ok
+}
+
+// GetVerifyState returns the state of the verification of the server, and the
+// error that caused it when it is not VerifyStateVerifying
+func (c *Client) GetVerifyState() (VerifyState, error) {
+	c.verifyLock.Lock()
+	defer c.verifyLock.Unlock()
+	return c.verifyState, c.verifyErr
+}
+
+// setVerifyState sets the state of the verification, and calls the
+// OnVerifyState hook when it changed
+func (c *Client) setVerifyState(state VerifyState, err error) {
+	c.verifyLock.Lock()
+	changed := state != c.verifyState
+	c.verifyState = state
+	c.verifyErr = err
+	c.verifyLock.Unlock()
+
+	if changed && c.OnVerifyState != nil {
+		go c.OnVerifyState(state, err, c)
+	}
+}
@@ -35,22 +35,57 @@ func BenchmarkProxyClient(conn net.Conn) net.Conn {
 	go func(client, server *wire.Connection) {
 		// Intercept messages from client, forward to server - measure processing time
 		for {
-			t, p, err := client.ReadNextMessage()
+			t, id, p, err := client.ReadNextFrame()
 			if err != nil {
 				return
 			}
 
+			// The version handshake is not an operation, just pass it on
+			if t == wire.MessageTypeVersion {
+				err = server.WriteMessage(t, p)
+				if err != nil {
+					return
+				}
+				t2, p, err := server.ReadNextMessage()
+				if err != nil {
+					return
+				}
+				client.WriteMessage(t2, p)
+
+				// Both sides switch to frames with request IDs if they agreed on it
+				ack, err := wire.NewVersionMessageFromBytes(p)
+				if t2 == wire.MessageTypeVersionAck && err == nil && ack.Features.Has(wire.FeatureRequestIDs) {
+					client.EnableRequestIDs()
+					server.EnableRequestIDs()
+				}
+				continue
+			}
+
+			// Only the operations we measure go below, pass on anything else
+			if int(t) > len(clientFirstOperation) {
+				err = server.WriteFrame(t, id, p)
+				if err != nil {
+					return
+				}
+				t2, id2, p, err := server.ReadNextFrame()
+				if err != nil {
+					return
+				}
+				client.WriteFrame(t2, id2, p)
+				continue
+			}
+
 			if clientFirstOperation[int(t)-1].Year() == 2000 {
 				clientFirstOperation[int(t)-1] = time.Now()
 			}
 
 			start := time.Now()
-			err = server.WriteMessage(t, p)
+			err = server.WriteFrame(t, id, p)
 			if err != nil {
 				return
 			}
 
-			t2, p, err := server.ReadNextMessage()
+			t2, id2, p, err := server.ReadNextFrame()
 			if err != nil {
 				return
 			}
@@ -59,7 +94,7 @@ func BenchmarkProxyClient(conn net.Conn) net.Conn {
 			atomic.AddInt64(&(clientOperationCounts[int(t)-1]), 1)
 
 			clientOperationRunningTime[int(t)-1] = time.Since(clientFirstOperation[int(t)-1]).Nanoseconds()
-			client.WriteMessage(t2, p)
+			client.WriteFrame(t2, id2, p)
 		}
 	}(client, server)
 
@@ -28,22 +28,57 @@ func BenchmarkProxy(conn net.Conn, srv *server.Server) {
 
 	// Intercept messages from client, forward to server - measure processing time
 	for {
-		t, p, err := client.ReadNextMessage()
+		t, id, p, err := client.ReadNextFrame()
 		if err != nil {
 			return
 		}
 
+		// The version handshake is not an operation, just pass it on
+		if t == wire.MessageTypeVersion {
+			err = server.WriteMessage(t, p)
+			if err != nil {
+				return
+			}
+			t2, p, err := server.ReadNextMessage()
+			if err != nil {
+				return
+			}
+			client.WriteMessage(t2, p)
+
+			// Both sides switch to frames with request IDs if they agreed on it
+			ack, err := wire.NewVersionMessageFromBytes(p)
+			if t2 == wire.MessageTypeVersionAck && err == nil && ack.Features.Has(wire.FeatureRequestIDs) {
+				client.EnableRequestIDs()
+				server.EnableRequestIDs()
+			}
+			continue
+		}
+
+		// Only the operations we measure go below, pass on anything else
+		if int(t) > len(firstOperation) {
+			err = server.WriteFrame(t, id, p)
+			if err != nil {
+				return
+			}
+			t2, id2, p, err := server.ReadNextFrame()
+			if err != nil {
+				return
+			}
+			client.WriteFrame(t2, id2, p)
+			continue
+		}
+
 		if firstOperation[int(t)-1].Year() == 2000 {
 			firstOperation[int(t)-1] = time.Now()
 		}
 
 		start := time.Now()
-		err = server.WriteMessage(t, p)
+		err = server.WriteFrame(t, id, p)
 		if err != nil {
 			return
 		}
 
-		t2, p, err := server.ReadNextMessage()
+		t2, id2, p, err := server.ReadNextFrame()
 		if err != nil {
 			return
 		}
@@ -52,7 +87,7 @@ func BenchmarkProxy(conn net.Conn, srv *server.Server) {
 		atomic.AddInt64(&(operationCounts[int(t)-1]), 1)
 
 		operationRunningTime[int(t)-1] = time.Since(firstOperation[int(t)-1]).Nanoseconds()
-		client.WriteMessage(t2, p)
+		client.WriteFrame(t2, id2, p)
 	}
 }
 
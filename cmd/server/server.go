@@ -8,9 +8,13 @@ import (
 
 func main() {
 	rescanBlocks := flag.Int("rescan", 0, "Rescan this number of blocks on startup")
+	secure := flag.Bool("secure", false, "Encrypt connections with clients")
+	webSocket := flag.String("websocket", "", "Also accept WebSocket connections on this address, for instance :9101")
 	flag.Parse()
 
 	srv, _ := server.NewServer(":9100", *rescanBlocks)
 	srv.Full = true
+	srv.SecureTransport = *secure
+	srv.WebSocketAddr = *webSocket
 	srv.Run()
 }
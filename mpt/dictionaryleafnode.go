@@ -181,9 +181,12 @@ func DeserializeNewDictionaryLeafNode(r io.Reader) (*DictionaryLeafNode, error)
 	if err != nil {
 		return nil, err
 	}
+	if iLen > MaxNodeDataSize {
+		return nil, fmt.Errorf("Specified length of key too large: %d", iLen)
+	}
 	if iLen > 0 {
 		key = make([]byte, iLen)
-		i, err := r.Read(key)
+		i, err := io.ReadFull(r, key)
 		if err != nil {
 			return nil, err
 		}
@@ -198,9 +201,12 @@ func DeserializeNewDictionaryLeafNode(r io.Reader) (*DictionaryLeafNode, error)
 	if err != nil {
 		return nil, err
 	}
+	if iLen > MaxNodeDataSize {
+		return nil, fmt.Errorf("Specified length of value too large: %d", iLen)
+	}
 	if iLen > 0 {
 		value = make([]byte, iLen)
-		i, err := r.Read(value)
+		i, err := io.ReadFull(r, value)
 		if err != nil {
 			return nil, err
 		}
@@ -28,6 +28,11 @@ const (
 	NodeTypeSetLeaf NodeType = 0x04
 )
 
+// MaxNodeDataSize is the maximum length of the keys, values and hashes in a
+// serialized node, which protects against huge allocations when
+// deserializing untrusted input
+const MaxNodeDataSize = 1024
+
 // Node is the building blocks of the MPT data structure.
 // A node is MUTABLE - the children of interior nodes can change
 // and the value stored at a leaf node can change. Nodes track
@@ -144,9 +144,12 @@ func DeserializeNewStub(r io.Reader) (*Stub, error) {
 	if err != nil {
 		return nil, err
 	}
+	if iLen > MaxNodeDataSize {
+		return nil, fmt.Errorf("Specified length of stub too large: %d", iLen)
+	}
 	if iLen > 0 {
 		stub = make([]byte, iLen)
-		i, err := r.Read(stub)
+		i, err := io.ReadFull(r, stub)
 		if err != nil {
 			return nil, err
 		}
@@ -1,8 +1,8 @@
 package server
 
 import (
-	"fmt"
 	"net"
+	"sync"
 
 	"github.com/mit-dci/go-bverify/crypto/fastsha256"
 	"github.com/mit-dci/go-bverify/logging"
@@ -23,55 +23,190 @@ type LogProcessor interface {
 }
 
 type ServerLogProcessor struct {
-	conn        *wire.Connection
+	conn   *wire.Connection
+	server *Server
+
+	// The logs the client wrote to, and whether it subscribed to proof
+	// updates for them. Logs the client asked to follow with
+	// MessageTypeWatchLogs are included in every proof update regardless of
+	// autoUpdates. SendProofs runs on the server's commit goroutine, so
+	// watchLock guards all of them.
 	logIDMap    map[[32]byte]struct{}
 	logIDs      [][]byte
-	server      *Server
 	autoUpdates bool
+	watched     map[[32]byte]struct{}
+	watchLock   sync.Mutex
+
+	// The features negotiated in the version handshake, which has to happen
+	// before anything else. They are set once the acknowledgement is sent and
+	// request IDs are enabled, so messages sent on our own accord are framed
+	// like the client expects. Only the Process goroutine sets them, other
+	// goroutines read them holding handshakeLock.
+	handshakeDone bool
+	features      wire.FeatureFlags
+	handshakeLock sync.Mutex
+
+	// The ID of the request that is being processed, which the response
+	// has to carry
+	request uint32
+
+	// The logical sessions on the connection, which each have their own
+	// processor. A session processor has no sessions of its own, but a
+	// parent: the processor of the connection it writes its messages to.
+	sessions map[uint32]*ServerLogProcessor
+	parent   *ServerLogProcessor
+	session  uint32
 }
 
 func NewLogProcessor(c net.Conn, srv *Server) LogProcessor {
-	proc := &ServerLogProcessor{conn: wire.NewConnection(c), server: srv, logIDs: make([][]byte, 0), logIDMap: make(map[[32]byte]struct{})}
+	proc := &ServerLogProcessor{conn: wire.NewConnection(c), server: srv, logIDs: make([][]byte, 0), logIDMap: make(map[[32]byte]struct{}), watched: make(map[[32]byte]struct{}), sessions: make(map[uint32]*ServerLogProcessor)}
+	proc.conn.SetTimeouts(srv.IdleTimeout, srv.WriteTimeout)
 	srv.registerProcessor(proc)
 	return proc
 }
 
 func (lp *ServerLogProcessor) Process() {
 	for {
-		t, m, e := lp.conn.ReadNextMessage()
+		t, id, m, e := lp.conn.ReadNextFrame()
 		if e != nil {
-			lp.server.unregisterProcessor(lp)
-			lp.conn.Close()
+			lp.disconnect()
 			return
 		}
 
+		lp.request = id
 		e = lp.ProcessMessage(t, m)
-		if e != nil {
-			logging.Warnf("Error processing message [%x]: %s", m, e.Error())
-			lp.conn.WriteMessage(wire.MessageTypeError, []byte(e.Error()))
-			lp.server.unregisterProcessor(lp)
-			lp.conn.Close()
+		if e != nil && lp.reportError(m, e) {
+			lp.disconnect()
 			return
 		}
 	}
 }
 
+// reportError sends the error that occurred processing message m to the
+// client, and returns true if it was fatal
+func (lp *ServerLogProcessor) reportError(m []byte, e error) bool {
+	logging.Warnf("Error processing message [%x]: %s", m, e.Error())
+
+	// Clients that understand error codes can carry on after errors that
+	// don't break the protocol. Other clients get plain text and are
+	// disconnected like before.
+	if lp.features.Has(wire.FeatureErrorCodes) {
+		msg := wire.NewErrorMessage(wire.ErrorCodeOf(e), lp.request, e.Error())
+		lp.reply(wire.MessageTypeError, msg.Bytes())
+		return msg.Fatal
+	}
+	lp.reply(wire.MessageTypeError, []byte(e.Error()))
+	return true
+}
+
+// disconnect closes the connection, and makes the server forget about this
+// processor and the sessions on its connection
+func (lp *ServerLogProcessor) disconnect() {
+	for id := range lp.sessions {
+		lp.closeSession(id)
+	}
+	lp.server.unregisterProcessor(lp)
+	lp.conn.Close()
+}
+
 func (lp *ServerLogProcessor) SendProofs(delta *mpt.DeltaMPT) error {
-	if lp.autoUpdates && len(lp.logIDs) > 0 {
-		clientDelta, err := delta.GetUpdatesForKeys(lp.logIDs)
+	keys := lp.proofKeys()
+	if len(keys) > 0 {
+		clientDelta, err := delta.GetUpdatesForKeys(keys)
 		if err != nil {
 			return err
 		}
 
-		return lp.conn.WriteMessage(wire.MessageTypeProofUpdate, clientDelta.Bytes())
+		err = lp.write(wire.MessageTypeProofUpdate, 0, clientDelta.Bytes())
+		if err != nil {
+			// The client is gone. Closing the connection stops Process, which
+			// will clean up after us.
+			lp.conn.Close()
+		}
+		return err
 	}
 	return nil
 }
 
+// proofKeys returns the logs to include in a proof update: the ones the client
+// wrote to when it subscribed to proof updates, and the ones it watches
+func (lp *ServerLogProcessor) proofKeys() [][]byte {
+	lp.watchLock.Lock()
+	defer lp.watchLock.Unlock()
+
+	keys := make([][]byte, 0)
+	if lp.autoUpdates {
+		keys = append(keys, lp.logIDs...)
+	}
+	for logID := range lp.watched {
+		if _, ok := lp.logIDMap[logID]; ok && lp.autoUpdates {
+			continue
+		}
+		id := logID
+		keys = append(keys, id[:])
+	}
+	return keys
+}
+
+// NotifyCommitment tells the client that a commitment was included in a block,
+// when it negotiated FeatureCommitmentNotify
+func (lp *ServerLogProcessor) NotifyCommitment(commitment [32]byte) error {
+	lp.handshakeLock.Lock()
+	notify := lp.handshakeDone && lp.features.Has(wire.FeatureCommitmentNotify)
+	lp.handshakeLock.Unlock()
+	if !notify {
+		return nil
+	}
+	msg := wire.NewNewCommitmentMessage(commitment)
+	return lp.write(wire.MessageTypeNewCommitment, 0, msg.Bytes())
+}
+
+// reply sends a response to the request that is being processed
+func (lp *ServerLogProcessor) reply(t wire.MessageType, m []byte) error {
+	return lp.write(t, lp.request, m)
+}
+
+// write sends a message with request ID id to the client. Messages of a session
+// are wrapped in a MessageTypeSession.
+func (lp *ServerLogProcessor) write(t wire.MessageType, id uint32, m []byte) error {
+	if lp.parent != nil {
+		msg := wire.NewSessionMessage(lp.session, t, m)
+		return lp.conn.WriteFrame(wire.MessageTypeSession, id, msg.Bytes())
+	}
+	return lp.conn.WriteFrame(t, id, m)
+}
+
 func (lp *ServerLogProcessor) Stop() {
 	lp.conn.Close()
 }
 func (lp *ServerLogProcessor) ProcessMessage(t wire.MessageType, m []byte) error {
+	if t == wire.MessageTypeVersion {
+		if lp.handshakeDone {
+			return wire.NewError(wire.ErrorCodeProtocol, "Received duplicate version message")
+		}
+		pm, err := wire.NewVersionMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessVersion(pm)
+	}
+
+	if !lp.handshakeDone {
+		return wire.NewError(wire.ErrorCodeProtocol, "Expected version message before message type %x", byte(t))
+	}
+
+	if !lp.features.Allows(t) {
+		return wire.NewError(wire.ErrorCodeProtocol, "Message type %x requires a feature that was not negotiated", byte(t))
+	}
+
+	if t == wire.MessageTypePing {
+		return lp.reply(wire.MessageTypePong, m)
+	}
+
+	if t == wire.MessageTypePong {
+		return nil
+	}
+
 	if t == wire.MessageTypeCreateLog {
 		pm, err := wire.NewSignedCreateLogStatementFromBytes(m)
 		if err != nil {
@@ -88,6 +223,38 @@ func (lp *ServerLogProcessor) ProcessMessage(t wire.MessageType, m []byte) error
 		return lp.ProcessAppendLog(pm)
 	}
 
+	if t == wire.MessageTypeSealLog {
+		pm, err := wire.NewSignedSealLogStatementFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessSealLog(pm)
+	}
+
+	if t == wire.MessageTypeBatchAppendLog {
+		pm, err := wire.NewSignedBatchLogStatementFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessBatchAppendLog(pm)
+	}
+
+	if t == wire.MessageTypeDelegateLog {
+		pm, err := wire.NewSignedDelegationFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessDelegateLog(pm)
+	}
+
+	if t == wire.MessageTypeRevokeDelegation {
+		pm, err := wire.NewSignedDelegationRevocationFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessRevokeDelegation(pm)
+	}
+
 	if t == wire.MessageTypeRequestProof {
 		pm, err := wire.NewRequestProofMessageFromBytes(m)
 		if err != nil {
@@ -120,20 +287,108 @@ func (lp *ServerLogProcessor) ProcessMessage(t wire.MessageType, m []byte) error
 		return lp.ProcessRequestCommitmentHistory(pm)
 	}
 
+	if t == wire.MessageTypeRequestSignatureDomain {
+		msg := wire.NewSignatureDomainMessage(lp.server.SignatureDomain(), lp.server.AcceptLegacySignatures)
+		return lp.reply(wire.MessageTypeSignatureDomain, msg.Bytes())
+	}
+
+	if t == wire.MessageTypeRequestLogInfo {
+		pm, err := wire.NewRequestLogInfoMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessRequestLogInfo(pm)
+	}
+
+	if t == wire.MessageTypeRequestLogStatus {
+		pm, err := wire.NewRequestLogStatusMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessRequestLogStatus(pm)
+	}
+
+	if t == wire.MessageTypeWatchLogs {
+		pm, err := wire.NewWatchLogsMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessWatchLogs(pm)
+	}
+
+	if t == wire.MessageTypeUnwatchLogs {
+		pm, err := wire.NewWatchLogsMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessUnwatchLogs(pm)
+	}
+
+	if t == wire.MessageTypeSession {
+		pm, err := wire.NewSessionMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessSession(pm)
+	}
+
+	if t == wire.MessageTypeCloseSession {
+		pm, err := wire.NewCloseSessionMessageFromBytes(m)
+		if err != nil {
+			return err
+		}
+		return lp.ProcessCloseSession(pm)
+	}
+
 	if t == wire.MessageTypeSubscribeProofUpdates {
+		lp.watchLock.Lock()
 		lp.autoUpdates = true
-		lp.conn.WriteMessage(wire.MessageTypeAck, []byte{})
+		lp.watchLock.Unlock()
+		lp.reply(wire.MessageTypeAck, []byte{})
 		return nil
 	}
 
 	if t == wire.MessageTypeUnsubscribeProofUpdates {
+		lp.watchLock.Lock()
 		lp.autoUpdates = false
+		lp.watchLock.Unlock()
 		logging.Debugf("Received unsubscription to proof updates, sending ACK...")
-		lp.conn.WriteMessage(wire.MessageTypeAck, []byte{})
+		lp.reply(wire.MessageTypeAck, []byte{})
 		return nil
 	}
 
-	return fmt.Errorf("Unrecognized message type received: %x", byte(t))
+	return wire.NewError(wire.ErrorCodeProtocol, "Unrecognized message type received: %x", byte(t))
+}
+
+// ProcessVersion completes the version handshake. The features used on the
+// connection are the ones both sides support.
+func (lp *ServerLogProcessor) ProcessVersion(pm *wire.VersionMessage) error {
+	if pm.ProtocolVersion < wire.MinProtocolVersion {
+		return wire.NewError(wire.ErrorCodeProtocol, "Protocol version %d is no longer supported", pm.ProtocolVersion)
+	}
+
+	domain := lp.server.SignatureDomain()
+	if pm.Network != [32]byte{} && pm.Network != domain.Network {
+		return wire.NewError(wire.ErrorCodeProtocol, "Client expects network [%x], server is on [%x]", pm.Network, domain.Network)
+	}
+
+	features := pm.Features & wire.SupportedFeatures
+	msg := wire.NewVersionMessage(features, domain.Network, domain.ServerID)
+	err := lp.reply(wire.MessageTypeVersionAck, msg.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Everything after the acknowledgement is framed with request IDs
+	if features.Has(wire.FeatureRequestIDs) {
+		lp.conn.EnableRequestIDs()
+	}
+
+	lp.handshakeLock.Lock()
+	lp.features = features
+	lp.handshakeDone = true
+	lp.handshakeLock.Unlock()
+	return nil
 }
 
 func (lp *ServerLogProcessor) ProcessRequestProof(msg *wire.RequestProofMessage) error {
@@ -156,7 +411,7 @@ func (lp *ServerLogProcessor) ProcessRequestProof(msg *wire.RequestProofMessage)
 	if err != nil {
 		return err
 	}
-	return lp.conn.WriteMessage(wire.MessageTypeProof, proof.Bytes())
+	return lp.reply(wire.MessageTypeProof, proof.Bytes())
 }
 
 func (lp *ServerLogProcessor) ProcessRequestDeltaProof(msg *wire.RequestProofMessage) error {
@@ -176,14 +431,14 @@ func (lp *ServerLogProcessor) ProcessRequestDeltaProof(msg *wire.RequestProofMes
 	if err != nil {
 		return err
 	}
-	return lp.conn.WriteMessage(wire.MessageTypeDeltaProof, proof.Bytes())
+	return lp.reply(wire.MessageTypeDeltaProof, proof.Bytes())
 }
 
 func (lp *ServerLogProcessor) ProcessCreateLog(scls *wire.SignedCreateLogStatement) error {
 	var err error
 
 	if lp.server.CheckSignatures {
-		err = scls.VerifySignature()
+		err = lp.verifyInDomain(scls.VerifySignatureInDomain)
 		if err != nil {
 			return err
 		}
@@ -196,6 +451,11 @@ func (lp *ServerLogProcessor) ProcessCreateLog(scls *wire.SignedCreateLogStateme
 		return err
 	}
 
+	err = lp.server.RegisterLogMetadata(hash, scls.CreateStatement.Metadata)
+	if err != nil {
+		return err
+	}
+
 	witness := fastsha256.Sum256(scls.Bytes())
 
 	// The only possible error is a wrong index. Given we _just_ created the log,
@@ -204,7 +464,7 @@ func (lp *ServerLogProcessor) ProcessCreateLog(scls *wire.SignedCreateLogStateme
 	_ = lp.server.RegisterLogStatement(hash, 0, witness[:])
 
 	lp.SubscribeToLog(hash)
-	lp.conn.WriteMessage(wire.MessageTypeAck, []byte{})
+	lp.reply(wire.MessageTypeAck, []byte{})
 	return nil
 }
 
@@ -232,12 +492,50 @@ func (lp *ServerLogProcessor) VerifyAppendLog(sls *wire.SignedLogStatement) erro
 		return err
 	}
 
-	err = sls.VerifySignature(pk)
+	err = lp.verifyInDomain(func(d *wire.SignatureDomain) error {
+		return sls.VerifySignatureInDomain(pk, d)
+	})
+	if err == nil {
+		return nil
+	}
+
+	// The statement is not signed by the controlling key, so check if it was
+	// signed by a delegate that is allowed to append at this index and height
+	height := uint64(lp.server.Height())
+	for _, d := range lp.server.GetDelegationsForLogID(sls.Statement.LogID) {
+		if d.ExpiryHeight != 0 && !lp.server.Full {
+			// We don't know the height, so treat it as expired
+			continue
+		}
+		if !d.Covers(sls.Statement.Index, height) {
+			continue
+		}
+		delegateKey := d.DelegateKey
+		if lp.verifyInDomain(func(d *wire.SignatureDomain) error {
+			return sls.VerifySignatureInDomain(delegateKey, d)
+		}) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyInDomain runs the signature check verify against the server's
+// signature domain. While the server accepts legacy signatures, it falls back
+// to checking the signature without domain separation.
+func (lp *ServerLogProcessor) verifyInDomain(verify func(d *wire.SignatureDomain) error) error {
+	err := verify(lp.server.SignatureDomain())
+	if err != nil && lp.server.AcceptLegacySignatures {
+		if verify(nil) == nil {
+			return nil
+		}
+	}
 	if err != nil {
-		return err
+		return wire.NewError(wire.ErrorCodeInvalidSignature, "%s", err.Error())
 	}
 	return nil
 }
+
 func (lp *ServerLogProcessor) CommitAppendLog(sls *wire.SignedLogStatement) error {
 	witness := fastsha256.Sum256(sls.Bytes())
 	err := lp.server.RegisterLogStatement(sls.Statement.LogID, sls.Statement.Index, witness[:])
@@ -249,10 +547,119 @@ func (lp *ServerLogProcessor) CommitAppendLog(sls *wire.SignedLogStatement) erro
 
 func (lp *ServerLogProcessor) AckAppendLog(sls *wire.SignedLogStatement) error {
 	lp.SubscribeToLog(sls.Statement.LogID)
-	return lp.conn.WriteMessage(wire.MessageTypeAck, []byte{})
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+// ProcessSealLog appends the final statement to a log. Only the controlling
+// key of the log can seal it, delegates cannot.
+func (lp *ServerLogProcessor) ProcessSealLog(ssls *wire.SignedSealLogStatement) error {
+	pk, err := lp.server.GetPubKeyForLogID(ssls.Statement.LogID)
+	if err != nil {
+		return err
+	}
+
+	if lp.server.CheckSignatures {
+		err = lp.verifyInDomain(func(d *wire.SignatureDomain) error {
+			return ssls.VerifySignatureInDomain(pk, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	witness := ssls.Witness()
+	err = lp.server.SealLog(ssls.Statement.LogID, ssls.Statement.Index, witness[:])
+	if err != nil {
+		return err
+	}
+
+	lp.SubscribeToLog(ssls.Statement.LogID)
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+// ProcessBatchAppendLog appends all statements in the batch atomically. Every
+// statement has to be signed over the batch hash by the controlling key of its
+// log.
+func (lp *ServerLogProcessor) ProcessBatchAppendLog(sb *wire.SignedBatchLogStatement) error {
+	witnesses := make([][]byte, len(sb.Batch.Statements))
+	for i, s := range sb.Batch.Statements {
+		pk, err := lp.server.GetPubKeyForLogID(s.LogID)
+		if err != nil {
+			return err
+		}
+
+		sig := sb.Signatures[i]
+		if lp.server.CheckSignatures {
+			err = lp.verifyInDomain(func(d *wire.SignatureDomain) error {
+				return sb.Batch.VerifySignature(sig, pk, d)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		witness := sb.Batch.Witness(i, sig)
+		witnesses[i] = witness[:]
+	}
+
+	err := lp.server.RegisterBatch(sb.Batch.Statements, witnesses)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sb.Batch.Statements {
+		lp.SubscribeToLog(s.LogID)
+	}
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+func (lp *ServerLogProcessor) ProcessDelegateLog(sd *wire.SignedDelegation) error {
+	pk, err := lp.server.GetPubKeyForLogID(sd.Delegation.LogID)
+	if err != nil {
+		return err
+	}
+
+	if lp.server.CheckSignatures {
+		err = lp.verifyInDomain(func(d *wire.SignatureDomain) error {
+			return sd.VerifySignatureInDomain(pk, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = lp.server.RegisterDelegation(sd.Delegation)
+	if err != nil {
+		return err
+	}
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+func (lp *ServerLogProcessor) ProcessRevokeDelegation(sdr *wire.SignedDelegationRevocation) error {
+	pk, err := lp.server.GetPubKeyForLogID(sdr.Revocation.LogID)
+	if err != nil {
+		return err
+	}
+
+	if lp.server.CheckSignatures {
+		err = lp.verifyInDomain(func(d *wire.SignatureDomain) error {
+			return sdr.VerifySignatureInDomain(pk, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = lp.server.RevokeDelegation(sdr.Revocation.LogID, sdr.Revocation.DelegationHash)
+	if err != nil {
+		return err
+	}
+	return lp.reply(wire.MessageTypeAck, []byte{})
 }
 
 func (lp *ServerLogProcessor) SubscribeToLog(logID [32]byte) {
+	lp.watchLock.Lock()
+	defer lp.watchLock.Unlock()
 	_, ok := lp.logIDMap[logID]
 	if ok {
 		return
@@ -267,11 +674,161 @@ func (lp *ServerLogProcessor) ProcessRequestCommitmentDetails(pm *wire.RequestCo
 		return err
 	}
 	msg := wire.NewCommitmentDetailsMessage(c)
-	return lp.conn.WriteMessage(wire.MessageTypeCommitmentDetails, msg.Bytes())
+	return lp.reply(wire.MessageTypeCommitmentDetails, msg.Bytes())
 }
 
 func (lp *ServerLogProcessor) ProcessRequestCommitmentHistory(pm *wire.RequestCommitmentHistoryMessage) error {
 	c := lp.server.GetCommitmentHistory(pm.SinceCommitment)
 	msg := wire.NewCommitmentHistoryMessage(c)
-	return lp.conn.WriteMessage(wire.MessageTypeCommitmentHistory, msg.Bytes())
+	return lp.reply(wire.MessageTypeCommitmentHistory, msg.Bytes())
+}
+
+func (lp *ServerLogProcessor) ProcessRequestLogInfo(pm *wire.RequestLogInfoMessage) error {
+	pk, err := lp.server.GetPubKeyForLogID(pm.LogID)
+	if err != nil {
+		return err
+	}
+	msg := wire.NewLogInfoMessage(pm.LogID, pk, lp.server.GetLogMetadata(pm.LogID))
+	return lp.reply(wire.MessageTypeLogInfo, msg.Bytes())
+}
+
+func (lp *ServerLogProcessor) ProcessRequestLogStatus(pm *wire.RequestLogStatusMessage) error {
+	msg, err := lp.server.GetLogStatus(pm.LogID)
+	if err != nil {
+		return err
+	}
+	return lp.reply(wire.MessageTypeLogStatus, msg.Bytes())
+}
+
+// ProcessWatchLogs adds logs to the set the client follows. Either all logs in
+// the message are watched, or none are when one of them is unknown or the
+// connection would exceed the server's limit. The limit counts the logs
+// watched in all sessions on the connection.
+func (lp *ServerLogProcessor) ProcessWatchLogs(pm *wire.WatchLogsMessage) error {
+	for _, logID := range pm.LogIDs {
+		_, err := lp.server.GetPubKeyForLogID(logID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only this connection's Process goroutine changes what is watched on
+	// it, so the others can't grow until we're done
+	watchedElsewhere := lp.watchedElsewhere()
+
+	lp.watchLock.Lock()
+	newLogs := 0
+	for _, logID := range pm.LogIDs {
+		if _, ok := lp.watched[logID]; !ok {
+			newLogs++
+		}
+	}
+	if watchedElsewhere+len(lp.watched)+newLogs > lp.server.MaxWatchedLogs {
+		lp.watchLock.Unlock()
+		return wire.NewError(wire.ErrorCodeInvalidRequest, "Cannot watch more than %d logs", lp.server.MaxWatchedLogs)
+	}
+	for _, logID := range pm.LogIDs {
+		lp.watched[logID] = struct{}{}
+	}
+	lp.watchLock.Unlock()
+
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+// watchedElsewhere returns the number of logs watched on the connection
+// outside of this processor: outside of any session, and in the other sessions
+func (lp *ServerLogProcessor) watchedElsewhere() int {
+	conn := lp
+	if lp.parent != nil {
+		conn = lp.parent
+	}
+	procs := []*ServerLogProcessor{conn}
+	for _, sess := range conn.sessions {
+		procs = append(procs, sess)
+	}
+
+	n := 0
+	for _, p := range procs {
+		if p == lp {
+			continue
+		}
+		p.watchLock.Lock()
+		n += len(p.watched)
+		p.watchLock.Unlock()
+	}
+	return n
+}
+
+// ProcessUnwatchLogs removes logs from the set the client follows. Logs that
+// were not watched are ignored.
+func (lp *ServerLogProcessor) ProcessUnwatchLogs(pm *wire.WatchLogsMessage) error {
+	lp.watchLock.Lock()
+	for _, logID := range pm.LogIDs {
+		delete(lp.watched, logID)
+	}
+	lp.watchLock.Unlock()
+
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+// ProcessSession processes a message in one of the sessions on the connection,
+// which is opened when this is the first message in it. An error in a session
+// is reported in that session, and when it is fatal only closes the session.
+func (lp *ServerLogProcessor) ProcessSession(pm *wire.SessionMessage) error {
+	if lp.parent != nil {
+		return wire.NewError(wire.ErrorCodeProtocol, "Sessions cannot be nested")
+	}
+
+	sess, ok := lp.sessions[pm.SessionID]
+	if !ok {
+		if len(lp.sessions) >= lp.server.MaxSessions {
+			return wire.NewError(wire.ErrorCodeInvalidRequest, "Cannot open more than %d sessions", lp.server.MaxSessions)
+		}
+		sess = lp.openSession(pm.SessionID)
+	}
+
+	sess.request = lp.request
+	err := sess.ProcessMessage(pm.Type, pm.Payload)
+	if err != nil && sess.reportError(pm.Payload, err) {
+		lp.closeSession(pm.SessionID)
+	}
+	return nil
+}
+
+// ProcessCloseSession forgets about a session on the connection. Closing a
+// session that is not open is not an error.
+func (lp *ServerLogProcessor) ProcessCloseSession(pm *wire.CloseSessionMessage) error {
+	if lp.parent != nil {
+		return wire.NewError(wire.ErrorCodeProtocol, "Sessions cannot be nested")
+	}
+	lp.closeSession(pm.SessionID)
+	return lp.reply(wire.MessageTypeAck, []byte{})
+}
+
+// openSession creates the processor for a new session on the connection. It
+// shares the connection and the features negotiated on it.
+func (lp *ServerLogProcessor) openSession(id uint32) *ServerLogProcessor {
+	sess := &ServerLogProcessor{
+		conn:          lp.conn,
+		server:        lp.server,
+		logIDs:        make([][]byte, 0),
+		logIDMap:      make(map[[32]byte]struct{}),
+		watched:       make(map[[32]byte]struct{}),
+		handshakeDone: true,
+		features:      lp.features,
+		parent:        lp,
+		session:       id,
+	}
+	lp.sessions[id] = sess
+	lp.server.registerSession(sess)
+	return sess
+}
+
+func (lp *ServerLogProcessor) closeSession(id uint32) {
+	sess, ok := lp.sessions[id]
+	if !ok {
+		return
+	}
+	delete(lp.sessions, id)
+	lp.server.unregisterProcessor(sess)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"crypto/rand"
 
@@ -32,6 +33,15 @@ func sendMessageTest(title string, c *wire.Connection, tSend, tExpected wire.Mes
 }
 
 func newDummyClient(srv *Server) *wire.Connection {
+	c := newDummyClientNoHandshake(srv)
+	msg := wire.NewVersionMessage(wire.SupportedFeatures, [32]byte{}, [32]byte{})
+	c.WriteMessage(wire.MessageTypeVersion, msg.Bytes())
+	c.ReadNextMessage()
+	c.EnableRequestIDs()
+	return c
+}
+
+func newDummyClientNoHandshake(srv *Server) *wire.Connection {
 	server, client := net.Pipe()
 	p := NewLogProcessor(server, srv)
 	go p.Process()
@@ -181,3 +191,1231 @@ func generateCreateAppendMessages() ([]byte, []byte, []byte, error) {
 
 	return l.Bytes(), l2.Bytes(), l3.Bytes(), nil
 }
+
+// signForTest signs the hash of b with priv and returns the compact signature
+func signForTest(priv *btcec.PrivateKey, b []byte) [64]byte {
+	hash := fastsha256.Sum256(b)
+	sig, _ := priv.Sign(hash[:])
+	csig, _ := sig64.SigCompress(sig.Serialize())
+	return csig
+}
+
+func TestDelegatedAppend(t *testing.T) {
+	ownerKey := [32]byte{}
+	rand.Read(ownerKey[:])
+	ownerPriv, ownerPub := btcec.PrivKeyFromBytes(btcec.S256(), ownerKey[:])
+	var ownerPk [33]byte
+	copy(ownerPk[:], ownerPub.SerializeCompressed())
+
+	deviceKey := [32]byte{}
+	rand.Read(deviceKey[:])
+	devicePriv, devicePub := btcec.PrivKeyFromBytes(btcec.S256(), deviceKey[:])
+	var devicePk [33]byte
+	copy(devicePk[:], devicePub.SerializeCompressed())
+
+	l := wire.NewSignedCreateLogStatement(ownerPk, []byte("Hello World"))
+	logId := fastsha256.Sum256(l.CreateStatement.Bytes())
+	l.Signature = signForTest(ownerPriv, l.CreateStatement.Bytes())
+
+	appendAt := func(priv *btcec.PrivateKey, idx uint64) []byte {
+		a := wire.NewSignedLogStatement(idx, logId, []byte(fmt.Sprintf("Hello World %d", idx)))
+		a.Signature = signForTest(priv, a.Statement.Bytes())
+		return a.Bytes()
+	}
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	if !sendMessageTest("Create log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l.Bytes(), t) {
+		return
+	}
+
+	if !sendMessageTest("Append by device before delegation", c, wire.MessageTypeAppendLog, wire.MessageTypeError, appendAt(devicePriv, 1), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	d := wire.NewSignedDelegation(logId, devicePk, 1, 2, 0)
+	d.Signature = signForTest(devicePriv, d.Delegation.Bytes())
+	if !sendMessageTest("Delegation signed by device", c, wire.MessageTypeDelegateLog, wire.MessageTypeError, d.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	d.Signature = signForTest(ownerPriv, d.Delegation.Bytes())
+	if !sendMessageTest("Delegation", c, wire.MessageTypeDelegateLog, wire.MessageTypeAck, d.Bytes(), t) {
+		return
+	}
+
+	if !sendMessageTest("Append 1 by device", c, wire.MessageTypeAppendLog, wire.MessageTypeAck, appendAt(devicePriv, 1), t) {
+		return
+	}
+
+	if !sendMessageTest("Append 2 by owner", c, wire.MessageTypeAppendLog, wire.MessageTypeAck, appendAt(ownerPriv, 2), t) {
+		return
+	}
+
+	if !sendMessageTest("Append 3 by device outside range", c, wire.MessageTypeAppendLog, wire.MessageTypeError, appendAt(devicePriv, 3), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	d2 := wire.NewSignedDelegation(logId, devicePk, 0, 0, 0)
+	d2.Signature = signForTest(ownerPriv, d2.Delegation.Bytes())
+	if !sendMessageTest("Unbounded delegation", c, wire.MessageTypeDelegateLog, wire.MessageTypeAck, d2.Bytes(), t) {
+		return
+	}
+
+	if !sendMessageTest("Append 3 by device", c, wire.MessageTypeAppendLog, wire.MessageTypeAck, appendAt(devicePriv, 3), t) {
+		return
+	}
+
+	r := wire.NewSignedDelegationRevocation(logId, d2.Delegation.Hash())
+	r.Signature = signForTest(ownerPriv, r.Revocation.Bytes())
+	if !sendMessageTest("Revoke delegation", c, wire.MessageTypeRevokeDelegation, wire.MessageTypeAck, r.Bytes(), t) {
+		return
+	}
+
+	if !sendMessageTest("Append 4 by device after revocation", c, wire.MessageTypeAppendLog, wire.MessageTypeError, appendAt(devicePriv, 4), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	if !sendMessageTest("Replay revoked delegation", c, wire.MessageTypeDelegateLog, wire.MessageTypeError, d2.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	// This server has no wallet, so it doesn't know when the delegation expires
+	d3 := wire.NewSignedDelegation(logId, devicePk, 0, 0, 100)
+	d3.Signature = signForTest(ownerPriv, d3.Delegation.Bytes())
+	if !sendMessageTest("Delegation with expiry height", c, wire.MessageTypeDelegateLog, wire.MessageTypeError, d3.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+}
+
+func TestRevokeOtherLogsDelegation(t *testing.T) {
+	newLog := func() (*btcec.PrivateKey, [32]byte, *wire.SignedCreateLogStatement) {
+		key := [32]byte{}
+		rand.Read(key[:])
+		priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), key[:])
+		var pk [33]byte
+		copy(pk[:], pub.SerializeCompressed())
+		l := wire.NewSignedCreateLogStatement(pk, []byte("Hello World"))
+		l.Signature = signForTest(priv, l.CreateStatement.Bytes())
+		return priv, fastsha256.Sum256(l.CreateStatement.Bytes()), l
+	}
+	attackerPriv, attackerLogId, attackerLog := newLog()
+	ownerPriv, ownerLogId, ownerLog := newLog()
+
+	deviceKey := [32]byte{}
+	rand.Read(deviceKey[:])
+	devicePriv, devicePub := btcec.PrivKeyFromBytes(btcec.S256(), deviceKey[:])
+	var devicePk [33]byte
+	copy(devicePk[:], devicePub.SerializeCompressed())
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+	defer func() { c.Close() }()
+
+	if !sendMessageTest("Create attacker's log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, attackerLog.Bytes(), t) {
+		return
+	}
+	if !sendMessageTest("Create owner's log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, ownerLog.Bytes(), t) {
+		return
+	}
+
+	d := wire.NewSignedDelegation(ownerLogId, devicePk, 0, 0, 0)
+	d.Signature = signForTest(ownerPriv, d.Delegation.Bytes())
+	if !sendMessageTest("Delegation", c, wire.MessageTypeDelegateLog, wire.MessageTypeAck, d.Bytes(), t) {
+		return
+	}
+
+	// Signed correctly for the attacker's own log, but naming the owner's
+	// delegation
+	r := wire.NewSignedDelegationRevocation(attackerLogId, d.Delegation.Hash())
+	r.Signature = signForTest(attackerPriv, r.Revocation.Bytes())
+	if !sendMessageTest("Revoke other log's delegation", c, wire.MessageTypeRevokeDelegation, wire.MessageTypeError, r.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	if len(srv.GetDelegationsForLogID(ownerLogId)) != 1 {
+		t.Fatal("Delegation of the owner's log was revoked")
+	}
+	a := wire.NewSignedLogStatement(1, ownerLogId, []byte("Hello World 1"))
+	a.Signature = signForTest(devicePriv, a.Statement.Bytes())
+	if !sendMessageTest("Append by device", c, wire.MessageTypeAppendLog, wire.MessageTypeAck, a.Bytes(), t) {
+		return
+	}
+	if !sendMessageTest("Register delegation again", c, wire.MessageTypeDelegateLog, wire.MessageTypeError, d.Bytes(), t) {
+		return
+	}
+}
+
+func TestSealLog(t *testing.T) {
+	key := [32]byte{}
+	rand.Read(key[:])
+	priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), key[:])
+	var pk [33]byte
+	copy(pk[:], pub.SerializeCompressed())
+
+	l := wire.NewSignedCreateLogStatement(pk, []byte("Hello World"))
+	logId := fastsha256.Sum256(l.CreateStatement.Bytes())
+	l.Signature = signForTest(priv, l.CreateStatement.Bytes())
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	if !sendMessageTest("Create log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l.Bytes(), t) {
+		return
+	}
+
+	// A seal signed as a regular append must be rejected
+	s := wire.NewSignedSealLogStatement(1, logId, []byte("Goodbye World"))
+	s.Signature = signForTest(priv, s.Statement.Bytes())
+	if !sendMessageTest("Seal with append signature", c, wire.MessageTypeSealLog, wire.MessageTypeError, s.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	s.Signature = signForTest(priv, s.Statement.SealBytes())
+	if !sendMessageTest("Seal", c, wire.MessageTypeSealLog, wire.MessageTypeAck, s.Bytes(), t) {
+		return
+	}
+
+	idx, sealed := srv.GetSealedIndex(logId)
+	if !sealed || idx != 1 {
+		t.Errorf("Expected log to be sealed at index 1, got %d (sealed: %v)", idx, sealed)
+		return
+	}
+
+	err := srv.Commit()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	proof, err := srv.GetProofForKeys([][]byte{logId[:]})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	witness := s.Witness()
+	val, err := proof.Get(logId[:])
+	if err != nil || !bytes.Equal(val, witness[:]) {
+		t.Errorf("Expected seal witness [%x] in the tree, got [%x]", witness, val)
+		return
+	}
+
+	a := wire.NewSignedLogStatement(2, logId, []byte("Hello again"))
+	a.Signature = signForTest(priv, a.Statement.Bytes())
+	if !sendMessageTest("Append after seal", c, wire.MessageTypeAppendLog, wire.MessageTypeError, a.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	s2 := wire.NewSignedSealLogStatement(2, logId, []byte("Goodbye again"))
+	s2.Signature = signForTest(priv, s2.Statement.SealBytes())
+	if !sendMessageTest("Seal after seal", c, wire.MessageTypeSealLog, wire.MessageTypeError, s2.Bytes(), t) {
+		return
+	}
+}
+
+func TestSignatureDomain(t *testing.T) {
+	key := [32]byte{}
+	rand.Read(key[:])
+	priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), key[:])
+	var pk [33]byte
+	copy(pk[:], pub.SerializeCompressed())
+
+	srv, _ := NewServer("", 0)
+	srv.SetSignatureDomain([32]byte{0x01}, [32]byte{0x02})
+	srv.AcceptLegacySignatures = false
+	c := newDummyClient(srv)
+
+	c.WriteMessage(wire.MessageTypeRequestSignatureDomain, []byte{})
+	mt, m, err := c.ReadNextMessage()
+	if err != nil || mt != wire.MessageTypeSignatureDomain {
+		t.Errorf("Expected signature domain, got [%x]: %v", byte(mt), err)
+		return
+	}
+	msg, err := wire.NewSignatureDomainMessageFromBytes(m)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !msg.Domain.Equal(srv.SignatureDomain()) || msg.AcceptsLegacy {
+		t.Errorf("Unexpected signature domain received: [%x]", m)
+		return
+	}
+
+	l := wire.NewSignedCreateLogStatement(pk, []byte("Hello World"))
+	l.Signature = signForTest(priv, l.CreateStatement.Bytes())
+	if !sendMessageTest("Legacy signed create", c, wire.MessageTypeCreateLog, wire.MessageTypeError, l.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	otherDomain := wire.NewSignatureDomain([32]byte{0x01}, [32]byte{0x03})
+	l.Signature = signForTest(priv, otherDomain.SigningPayload(l.CreateStatement.Bytes()))
+	if !sendMessageTest("Create signed for other server", c, wire.MessageTypeCreateLog, wire.MessageTypeError, l.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	l.Signature = signForTest(priv, msg.Domain.SigningPayload(l.CreateStatement.Bytes()))
+	if !sendMessageTest("Create signed in domain", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l.Bytes(), t) {
+		return
+	}
+
+	logId := fastsha256.Sum256(l.CreateStatement.Bytes())
+	a := wire.NewSignedLogStatement(1, logId, []byte("Hello again"))
+	a.Signature = signForTest(priv, a.Statement.Bytes())
+	if !sendMessageTest("Legacy signed append", c, wire.MessageTypeAppendLog, wire.MessageTypeError, a.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	// While migrating, legacy signatures are still accepted
+	srv.AcceptLegacySignatures = true
+	if !sendMessageTest("Legacy signed append during migration", c, wire.MessageTypeAppendLog, wire.MessageTypeAck, a.Bytes(), t) {
+		return
+	}
+}
+
+func TestLogMetadata(t *testing.T) {
+	key := [32]byte{}
+	rand.Read(key[:])
+	priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), key[:])
+	var pk [33]byte
+	copy(pk[:], pub.SerializeCompressed())
+
+	create := func(nonce []byte, metadata map[string]string) *wire.SignedCreateLogStatement {
+		l := wire.NewSignedCreateLogStatementWithMetadata(pk, []byte("Hello World"), nonce, metadata)
+		l.Signature = signForTest(priv, l.CreateStatement.Bytes())
+		return l
+	}
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	metadata := map[string]string{wire.MetadataKeyName: "Test log", wire.MetadataKeyContentType: "text/plain"}
+	l1 := create([]byte{0x01}, metadata)
+	if !sendMessageTest("Create log with nonce 1", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l1.Bytes(), t) {
+		return
+	}
+
+	// The same key and initial statement with another nonce is another log
+	l2 := create([]byte{0x02}, nil)
+	if !sendMessageTest("Create log with nonce 2", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l2.Bytes(), t) {
+		return
+	}
+
+	logId := fastsha256.Sum256(l1.CreateStatement.Bytes())
+	c.WriteMessage(wire.MessageTypeRequestLogInfo, wire.NewRequestLogInfoMessage(logId).Bytes())
+	mt, m, err := c.ReadNextMessage()
+	if err != nil || mt != wire.MessageTypeLogInfo {
+		t.Errorf("Expected log info, got [%x]: %v", byte(mt), err)
+		return
+	}
+	info, err := wire.NewLogInfoMessageFromBytes(m)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if info.ControllingKey != pk || len(info.Metadata) != 2 || info.Metadata[wire.MetadataKeyName] != "Test log" {
+		t.Errorf("Unexpected log info received: %v", info)
+		return
+	}
+
+	if !sendMessageTest("Duplicate create", c, wire.MessageTypeCreateLog, wire.MessageTypeError, l1.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	// The signature covers the metadata
+	l3 := create([]byte{0x03}, metadata)
+	l3.CreateStatement.Metadata = map[string]string{wire.MetadataKeyName: "Other log"}
+	if !sendMessageTest("Create with altered metadata", c, wire.MessageTypeCreateLog, wire.MessageTypeError, l3.Bytes(), t) {
+		return
+	}
+}
+
+func TestBatchAppend(t *testing.T) {
+	type party struct {
+		priv  *btcec.PrivateKey
+		logId [32]byte
+	}
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	parties := make([]party, 2)
+	for i := range parties {
+		key := [32]byte{}
+		rand.Read(key[:])
+		priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), key[:])
+		var pk [33]byte
+		copy(pk[:], pub.SerializeCompressed())
+
+		l := wire.NewSignedCreateLogStatement(pk, []byte("Hello World"))
+		l.Signature = signForTest(priv, l.CreateStatement.Bytes())
+		if !sendMessageTest("Create log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l.Bytes(), t) {
+			return
+		}
+		parties[i] = party{priv: priv, logId: fastsha256.Sum256(l.CreateStatement.Bytes())}
+	}
+
+	newBatch := func(idx0, idx1 uint64) *wire.SignedBatchLogStatement {
+		batch := wire.NewBatchLogStatement([]*wire.LogStatement{
+			wire.NewSignedLogStatement(idx0, parties[0].logId, []byte("Sent 1 coin")).Statement,
+			wire.NewSignedLogStatement(idx1, parties[1].logId, []byte("Received 1 coin")).Statement,
+		})
+		sb := wire.NewSignedBatchLogStatement(batch)
+		hash := batch.Hash()
+		for i, p := range parties {
+			sb.Signatures[i] = signForTest(p.priv, hash[:])
+		}
+		return sb
+	}
+
+	// One of the statements has the wrong index, so neither may be applied
+	if !sendMessageTest("Batch with wrong index", c, wire.MessageTypeBatchAppendLog, wire.MessageTypeError, newBatch(1, 2).Bytes(), t) {
+		return
+	}
+	for _, p := range parties {
+		if srv.GetNextLogIndex(p.logId) != 1 {
+			t.Errorf("Log [%x] was changed by a rejected batch", p.logId)
+			return
+		}
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	sb := newBatch(1, 1)
+	sb.Signatures[1] = sb.Signatures[0]
+	if !sendMessageTest("Batch signed by one party", c, wire.MessageTypeBatchAppendLog, wire.MessageTypeError, sb.Bytes(), t) {
+		return
+	}
+
+	c.Close()
+	c = newDummyClient(srv)
+
+	sb = newBatch(1, 1)
+	if !sendMessageTest("Batch", c, wire.MessageTypeBatchAppendLog, wire.MessageTypeAck, sb.Bytes(), t) {
+		return
+	}
+
+	err := srv.Commit()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	for i, p := range parties {
+		proof, err := srv.GetProofForKeys([][]byte{p.logId[:]})
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		witness := sb.Batch.Witness(i, sb.Signatures[i])
+		val, err := proof.Get(p.logId[:])
+		if err != nil || !bytes.Equal(val, witness[:]) {
+			t.Errorf("Expected batch witness [%x] for log %d, got [%x]", witness, i, val)
+			return
+		}
+	}
+}
+
+func TestVersionHandshake(t *testing.T) {
+	srv, _ := NewServer("", 0)
+	srv.SetSignatureDomain([32]byte{0x01}, [32]byte{0x02})
+
+	// Nothing but a version message is accepted before the handshake
+	c := newDummyClientNoHandshake(srv)
+	if !sendMessageTest("Message before handshake", c, wire.MessageTypeRequestSignatureDomain, wire.MessageTypeError, []byte{}, t) {
+		return
+	}
+	c.Close()
+
+	// A client expecting another network is rejected
+	c = newDummyClientNoHandshake(srv)
+	v := wire.NewVersionMessage(wire.SupportedFeatures, [32]byte{0x03}, [32]byte{})
+	if !sendMessageTest("Network mismatch", c, wire.MessageTypeVersion, wire.MessageTypeError, v.Bytes(), t) {
+		return
+	}
+	c.Close()
+
+	// A client that does not support sealing cannot seal
+	c = newDummyClientNoHandshake(srv)
+	v = wire.NewVersionMessage(wire.SupportedFeatures&^wire.FeatureSealing, [32]byte{0x01}, [32]byte{})
+	c.WriteMessage(wire.MessageTypeVersion, v.Bytes())
+	mt, m, err := c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mt != wire.MessageTypeVersionAck {
+		t.Errorf("Expected version acknowledgement, got message type [%x]", byte(mt))
+		return
+	}
+	ack, err := wire.NewVersionMessageFromBytes(m)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ack.Features.Has(wire.FeatureSealing) {
+		t.Error("Server acknowledged a feature the client does not support")
+		return
+	}
+	if ack.Network != [32]byte{0x01} || ack.ServerID != [32]byte{0x02} {
+		t.Error("Server returned the wrong network or identity")
+		return
+	}
+
+	c.EnableRequestIDs()
+
+	// A second version message is not allowed
+	if !sendMessageTest("Duplicate version", c, wire.MessageTypeVersion, wire.MessageTypeError, v.Bytes(), t) {
+		return
+	}
+	c.Close()
+
+	c = newDummyClientNoHandshake(srv)
+	c.WriteMessage(wire.MessageTypeVersion, v.Bytes())
+	c.ReadNextMessage()
+	c.EnableRequestIDs()
+	s := wire.NewSignedSealLogStatement(1, [32]byte{}, []byte("Goodbye World"))
+	if !sendMessageTest("Seal without feature", c, wire.MessageTypeSealLog, wire.MessageTypeError, s.Bytes(), t) {
+		return
+	}
+	c.Close()
+}
+
+func TestKeepalive(t *testing.T) {
+	srv, _ := NewServer("", 0)
+	srv.IdleTimeout = 200 * time.Millisecond
+	c := newDummyClient(srv)
+
+	c.WriteMessage(wire.MessageTypePing, []byte{0x01, 0x02, 0x03})
+	mt, p, err := c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mt != wire.MessageTypePong || !bytes.Equal(p, []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("Expected pong with the ping's payload, got message type [%x]", byte(mt))
+		return
+	}
+
+	if srv.ProcessorCount() != 1 {
+		t.Errorf("Expected one connected client, got %d", srv.ProcessorCount())
+		return
+	}
+
+	// A client that stays silent is disconnected and forgotten
+	time.Sleep(500 * time.Millisecond)
+	if srv.ProcessorCount() != 0 {
+		t.Errorf("Expected idle client to be cleaned up, but there are still %d", srv.ProcessorCount())
+		return
+	}
+	_, _, err = c.ReadNextMessage()
+	if err == nil {
+		t.Error("Expected idle connection to be closed")
+		return
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	createLog, _, appendLog2, err := generateCreateAppendMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	if !sendMessageTest("Create log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, createLog, t) {
+		return
+	}
+
+	// Skipping an index is a request error, after which we can carry on
+	c.WriteMessage(wire.MessageTypeAppendLog, appendLog2)
+	mt, p, err := c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mt != wire.MessageTypeError {
+		t.Errorf("Expected error, got message type [%x]", byte(mt))
+		return
+	}
+	msg, err := wire.NewErrorMessageFromBytes(p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if msg.Code != wire.ErrorCodeIndexMismatch || msg.Fatal {
+		t.Errorf("Expected non-fatal index mismatch, got code %d (fatal: %t)", msg.Code, msg.Fatal)
+		return
+	}
+	if !sendMessageTest("Ping after request error", c, wire.MessageTypePing, wire.MessageTypePong, []byte{}, t) {
+		return
+	}
+
+	// Unknown message types break the protocol, which is fatal
+	c.WriteMessage(wire.MessageType(0xFF), []byte{})
+	mt, p, err = c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	msg, err = wire.NewErrorMessageFromBytes(p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mt != wire.MessageTypeError || msg.Code != wire.ErrorCodeProtocol || !msg.Fatal {
+		t.Errorf("Expected fatal protocol error, got message type [%x] code %d", byte(mt), msg.Code)
+		return
+	}
+	_, _, err = c.ReadNextMessage()
+	if err == nil {
+		t.Error("Expected connection to be closed after fatal error")
+		return
+	}
+
+	// Clients that don't support error codes get plain text and are
+	// disconnected after any error
+	c = newDummyClientNoHandshake(srv)
+	v := wire.NewVersionMessage(wire.SupportedFeatures&^wire.FeatureErrorCodes, [32]byte{}, [32]byte{})
+	c.WriteMessage(wire.MessageTypeVersion, v.Bytes())
+	c.ReadNextMessage()
+	c.EnableRequestIDs()
+	c.WriteMessage(wire.MessageTypeAppendLog, appendLog2)
+	mt, p, err = c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mt != wire.MessageTypeError || string(p) != "Unexpected log index 2 - expected 1" {
+		t.Errorf("Expected plain text error, got [%s]", string(p))
+		return
+	}
+	_, _, err = c.ReadNextMessage()
+	if err == nil {
+		t.Error("Expected connection to be closed after error")
+		return
+	}
+}
+
+func TestLogStatus(t *testing.T) {
+	createLog, appendLog, _, err := generateCreateAppendMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	scls, err := wire.NewSignedCreateLogStatementFromBytes(createLog)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logId := fastsha256.Sum256(scls.CreateStatement.Bytes())
+
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	requestStatus := func(title string, logId [32]byte) *wire.LogStatusMessage {
+		c.WriteMessage(wire.MessageTypeRequestLogStatus, wire.NewRequestLogStatusMessage(logId).Bytes())
+		mt, m, err := c.ReadNextMessage()
+		if err != nil || mt != wire.MessageTypeLogStatus {
+			t.Errorf("%s: Expected log status, got [%x]: %v", title, byte(mt), err)
+			return nil
+		}
+		status, err := wire.NewLogStatusMessageFromBytes(m)
+		if err != nil {
+			t.Errorf("%s: %s", title, err.Error())
+			return nil
+		}
+		return status
+	}
+
+	// Unknown logs have no status
+	c.WriteMessage(wire.MessageTypeRequestLogStatus, wire.NewRequestLogStatusMessage(logId).Bytes())
+	mt, p, err := c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	msg, err := wire.NewErrorMessageFromBytes(p)
+	if mt != wire.MessageTypeError || err != nil || msg.Code != wire.ErrorCodeUnknownLog {
+		t.Errorf("Expected unknown log error, got message type [%x]", byte(mt))
+		return
+	}
+
+	if !sendMessageTest("Create log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, createLog, t) {
+		return
+	}
+	status := requestStatus("After create", logId)
+	if status == nil {
+		return
+	}
+	witness := fastsha256.Sum256(createLog)
+	if status.NextIndex != 1 || status.ControllingKey != scls.CreateStatement.ControllingKey || status.LastValue != witness || status.Committed || status.Sealed {
+		t.Errorf("Unexpected log status after create: %v", status)
+		return
+	}
+
+	commitment := [32]byte{}
+	copy(commitment[:], srv.Commitment())
+	err = srv.Commit()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !sendMessageTest("Append log", c, wire.MessageTypeAppendLog, wire.MessageTypeAck, appendLog, t) {
+		return
+	}
+	status = requestStatus("After commit and append", logId)
+	if status == nil {
+		return
+	}
+	witness = fastsha256.Sum256(appendLog)
+	if status.NextIndex != 2 || status.LastValue != witness {
+		t.Errorf("Unexpected log status after append: %v", status)
+		return
+	}
+	if !status.Committed || status.Commitment != commitment || status.CommittedIndex != 0 {
+		t.Errorf("Expected log to be committed at index 0 in %x, got %v", commitment, status)
+		return
+	}
+
+	// Statements appended in a batch are committed like any other
+	privs := make([]*btcec.PrivateKey, 2)
+	logIds := make([][32]byte, 2)
+	for i := range privs {
+		privs[i], _ = btcec.NewPrivateKey(btcec.S256())
+		var pk [33]byte
+		copy(pk[:], privs[i].PubKey().SerializeCompressed())
+		l := wire.NewSignedCreateLogStatement(pk, []byte("Hello World"))
+		l.Signature = signForTest(privs[i], l.CreateStatement.Bytes())
+		if !sendMessageTest("Create batch log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, l.Bytes(), t) {
+			return
+		}
+		logIds[i] = fastsha256.Sum256(l.CreateStatement.Bytes())
+	}
+	err = srv.Commit()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	batch := wire.NewBatchLogStatement([]*wire.LogStatement{
+		wire.NewSignedLogStatement(1, logIds[0], []byte("Sent 1 coin")).Statement,
+		wire.NewSignedLogStatement(1, logIds[1], []byte("Received 1 coin")).Statement,
+	})
+	sb := wire.NewSignedBatchLogStatement(batch)
+	hash := batch.Hash()
+	for i, priv := range privs {
+		sb.Signatures[i] = signForTest(priv, hash[:])
+	}
+	if !sendMessageTest("Batch append", c, wire.MessageTypeBatchAppendLog, wire.MessageTypeAck, sb.Bytes(), t) {
+		return
+	}
+
+	copy(commitment[:], srv.Commitment())
+	err = srv.Commit()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i, id := range logIds {
+		status = requestStatus("After batch append and commit", id)
+		if status == nil {
+			return
+		}
+		witness = sb.Batch.Witness(i, sb.Signatures[i])
+		if status.NextIndex != 2 || status.LastValue != witness {
+			t.Errorf("Unexpected log status after batch append: %v", status)
+			return
+		}
+		if !status.Committed || status.Commitment != commitment || status.CommittedIndex != 1 {
+			t.Errorf("Expected log to be committed at index 1 in %x, got %v", commitment, status)
+			return
+		}
+	}
+}
+
+func TestWatchLogs(t *testing.T) {
+	createLog, _, _, err := generateCreateAppendMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	scls, err := wire.NewSignedCreateLogStatementFromBytes(createLog)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logId := fastsha256.Sum256(scls.CreateStatement.Bytes())
+
+	srv, _ := NewServer("", 0)
+	srv.MaxWatchedLogs = 1
+	writer := newDummyClient(srv)
+	watcher := newDummyClient(srv)
+
+	expectError := func(title string, c *wire.Connection, code wire.ErrorCode) bool {
+		mt, p, err := c.ReadNextMessage()
+		if err != nil {
+			t.Errorf("%s: %s", title, err.Error())
+			return false
+		}
+		msg, err := wire.NewErrorMessageFromBytes(p)
+		if mt != wire.MessageTypeError || err != nil || msg.Code != code {
+			t.Errorf("%s: Expected error code %d, got message type [%x]", title, code, byte(mt))
+			return false
+		}
+		return true
+	}
+
+	// Logs that don't exist can't be watched
+	watcher.WriteMessage(wire.MessageTypeWatchLogs, wire.NewWatchLogsMessage([][32]byte{logId}).Bytes())
+	if !expectError("Watch unknown log", watcher, wire.ErrorCodeUnknownLog) {
+		return
+	}
+
+	if !sendMessageTest("Create log", writer, wire.MessageTypeCreateLog, wire.MessageTypeAck, createLog, t) {
+		return
+	}
+	if !sendMessageTest("Watch log", watcher, wire.MessageTypeWatchLogs, wire.MessageTypeAck, wire.NewWatchLogsMessage([][32]byte{logId}).Bytes(), t) {
+		return
+	}
+	if !sendMessageTest("Watch log again", watcher, wire.MessageTypeWatchLogs, wire.MessageTypeAck, wire.NewWatchLogsMessage([][32]byte{logId}).Bytes(), t) {
+		return
+	}
+
+	// Watching is limited per connection, so a second log is refused. The
+	// log only needs to exist for this.
+	otherLogId := [32]byte{0x01}
+	srv.RegisterLogID(otherLogId, [33]byte{})
+	watcher.WriteMessage(wire.MessageTypeWatchLogs, wire.NewWatchLogsMessage([][32]byte{otherLogId}).Bytes())
+	if !expectError("Watch beyond limit", watcher, wire.ErrorCodeInvalidRequest) {
+		return
+	}
+
+	// The watcher did not write to the log or subscribe to proof updates, but
+	// should receive the update for the log it watches. The writer did not
+	// subscribe, so it receives nothing.
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Commit()
+	}()
+	mt, p, err := watcher.ReadNextMessage()
+	if err != nil || mt != wire.MessageTypeProofUpdate {
+		t.Errorf("Expected proof update, got [%x]: %v", byte(mt), err)
+		return
+	}
+	err = <-done
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	delta, err := srv.GetDeltaProofForKeys([][]byte{logId[:]})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(p, delta.Bytes()) {
+		t.Errorf("Proof update does not contain the watched log")
+		return
+	}
+
+	// After unwatching, the limit allows watching the other log
+	if !sendMessageTest("Unwatch log", watcher, wire.MessageTypeUnwatchLogs, wire.MessageTypeAck, wire.NewWatchLogsMessage([][32]byte{logId}).Bytes(), t) {
+		return
+	}
+	if !sendMessageTest("Watch other log", watcher, wire.MessageTypeWatchLogs, wire.MessageTypeAck, wire.NewWatchLogsMessage([][32]byte{otherLogId}).Bytes(), t) {
+		return
+	}
+}
+
+// TestAppendWhileCommitting appends on a connection that gets proof updates
+// while the server commits. Run it with -race to check the processor's state
+// is not read by the commit without holding its lock.
+func TestAppendWhileCommitting(t *testing.T) {
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	createLog, _, _, err := generateCreateAppendMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	scls, err := wire.NewSignedCreateLogStatementFromBytes(createLog)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logId := fastsha256.Sum256(scls.CreateStatement.Bytes())
+
+	if !sendMessageTest("Create log", c, wire.MessageTypeCreateLog, wire.MessageTypeAck, createLog, t) {
+		return
+	}
+	if !sendMessageTest("Watch log", c, wire.MessageTypeWatchLogs, wire.MessageTypeAck, wire.NewWatchLogsMessage([][32]byte{logId}).Bytes(), t) {
+		return
+	}
+	if !sendMessageTest("Subscribe", c, wire.MessageTypeSubscribeProofUpdates, wire.MessageTypeAck, []byte{}, t) {
+		return
+	}
+
+	creates := make([][]byte, 50)
+	for i := range creates {
+		creates[i], _, _, err = generateCreateAppendMessages()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// Proof updates arrive in between the acknowledgements
+	done := make(chan error)
+	go func() {
+		acks := 0
+		for acks < len(creates) {
+			mt, _, err := c.ReadNextMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if mt == wire.MessageTypeAck {
+				acks++
+			} else if mt != wire.MessageTypeProofUpdate {
+				done <- fmt.Errorf("Unexpected message type [%x]", byte(mt))
+				return
+			}
+		}
+		done <- nil
+	}()
+	go func() {
+		for _, m := range creates {
+			c.WriteMessage(wire.MessageTypeCreateLog, m)
+		}
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+			c.Close()
+			return
+		default:
+		}
+		err := srv.Commit()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	createLog, _, _, err := generateCreateAppendMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	scls, err := wire.NewSignedCreateLogStatementFromBytes(createLog)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	logId := fastsha256.Sum256(scls.CreateStatement.Bytes())
+
+	srv, _ := NewServer("", 0)
+	srv.MaxSessions = 2
+	c := newDummyClient(srv)
+
+	// sessionTest sends a message in a session and checks the type of the
+	// response, and the session it came in
+	sessionTest := func(title string, session uint32, tSend, tExpected wire.MessageType, m []byte) *wire.SessionMessage {
+		c.WriteMessage(wire.MessageTypeSession, wire.NewSessionMessage(session, tSend, m).Bytes())
+		mt, p, err := c.ReadNextMessage()
+		if err != nil || mt != wire.MessageTypeSession {
+			t.Errorf("%s: Expected session message, got [%x]: %v", title, byte(mt), err)
+			return nil
+		}
+		msg, err := wire.NewSessionMessageFromBytes(p)
+		if err != nil {
+			t.Errorf("%s: %s", title, err.Error())
+			return nil
+		}
+		if msg.SessionID != session || msg.Type != tExpected {
+			t.Errorf("%s: Expected message type [%x] in session %d, got [%x] in session %d", title, byte(tExpected), session, byte(msg.Type), msg.SessionID)
+			return nil
+		}
+		return msg
+	}
+
+	if sessionTest("Create log in session", 1, wire.MessageTypeCreateLog, wire.MessageTypeAck, createLog) == nil {
+		return
+	}
+	if sessionTest("Subscribe in session", 1, wire.MessageTypeSubscribeProofUpdates, wire.MessageTypeAck, []byte{}) == nil {
+		return
+	}
+	if sessionTest("Ping in other session", 2, wire.MessageTypePing, wire.MessageTypePong, []byte{0x01}) == nil {
+		return
+	}
+
+	// Only two sessions are allowed, and the error is reported on the
+	// connection
+	c.WriteMessage(wire.MessageTypeSession, wire.NewSessionMessage(3, wire.MessageTypePing, []byte{0x01}).Bytes())
+	mt, p, err := c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	errMsg, err := wire.NewErrorMessageFromBytes(p)
+	if mt != wire.MessageTypeError || err != nil || errMsg.Code != wire.ErrorCodeInvalidRequest {
+		t.Errorf("Expected invalid request error for too many sessions, got message type [%x]", byte(mt))
+		return
+	}
+
+	// A protocol violation only closes the session it happened in
+	msg := sessionTest("Nested session", 2, wire.MessageTypeSession, wire.MessageTypeError, wire.NewSessionMessage(2, wire.MessageTypePing, []byte{}).Bytes())
+	if msg == nil {
+		return
+	}
+	errMsg, err = wire.NewErrorMessageFromBytes(msg.Payload)
+	if err != nil || errMsg.Code != wire.ErrorCodeProtocol || !errMsg.Fatal {
+		t.Errorf("Expected fatal protocol error for nested session")
+		return
+	}
+	if !sendMessageTest("Ping after session error", c, wire.MessageTypePing, wire.MessageTypePong, []byte{0x01}, t) {
+		return
+	}
+
+	// Only the session that wrote the log and subscribed receives the proof
+	// update, wrapped in a session message
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Commit()
+	}()
+	mt, p, err = c.ReadNextMessage()
+	if err != nil || mt != wire.MessageTypeSession {
+		t.Errorf("Expected session message, got [%x]: %v", byte(mt), err)
+		return
+	}
+	msg, err = wire.NewSessionMessageFromBytes(p)
+	if err != nil || msg.SessionID != 1 || msg.Type != wire.MessageTypeProofUpdate {
+		t.Errorf("Expected proof update in session 1")
+		return
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Commit did not complete, the server sent more proof updates than expected")
+		return
+	}
+	delta, err := srv.GetDeltaProofForKeys([][]byte{logId[:]})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(msg.Payload, delta.Bytes()) {
+		t.Errorf("Proof update does not contain the log written in the session")
+		return
+	}
+
+	if !sendMessageTest("Close session", c, wire.MessageTypeCloseSession, wire.MessageTypeAck, wire.NewCloseSessionMessage(1).Bytes(), t) {
+		return
+	}
+	if sessionTest("Open session after close", 3, wire.MessageTypePing, wire.MessageTypePong, []byte{0x01}) == nil {
+		return
+	}
+}
+
+func TestWatchLogsInSessions(t *testing.T) {
+	srv, _ := NewServer("", 0)
+	srv.MaxWatchedLogs = 2
+	c := newDummyClient(srv)
+	logIds := [][32]byte{{0x01}, {0x02}, {0x03}}
+	for _, logId := range logIds {
+		srv.RegisterLogID(logId, [33]byte{})
+	}
+
+	watch := func(title string, session uint32, logId [32]byte, tExpected wire.MessageType) bool {
+		msg := wire.NewWatchLogsMessage([][32]byte{logId})
+		c.WriteMessage(wire.MessageTypeSession, wire.NewSessionMessage(session, wire.MessageTypeWatchLogs, msg.Bytes()).Bytes())
+		mt, p, err := c.ReadNextMessage()
+		if err != nil || mt != wire.MessageTypeSession {
+			t.Errorf("%s: Expected session message, got [%x]: %v", title, byte(mt), err)
+			return false
+		}
+		sm, err := wire.NewSessionMessageFromBytes(p)
+		if err != nil || sm.SessionID != session || sm.Type != tExpected {
+			t.Errorf("%s: Expected message type [%x] in session %d", title, byte(tExpected), session)
+			return false
+		}
+		return true
+	}
+
+	// The limit holds for the connection, not for each session on it
+	if !watch("Watch in session 1", 1, logIds[0], wire.MessageTypeAck) {
+		return
+	}
+	if !watch("Watch in session 2", 2, logIds[1], wire.MessageTypeAck) {
+		return
+	}
+	if !watch("Watch beyond limit in session 3", 3, logIds[2], wire.MessageTypeError) {
+		return
+	}
+	c.WriteMessage(wire.MessageTypeWatchLogs, wire.NewWatchLogsMessage([][32]byte{logIds[2]}).Bytes())
+	mt, p, err := c.ReadNextMessage()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	errMsg, err := wire.NewErrorMessageFromBytes(p)
+	if mt != wire.MessageTypeError || err != nil || errMsg.Code != wire.ErrorCodeInvalidRequest {
+		t.Errorf("Expected invalid request error watching beyond the limit outside sessions, got message type [%x]", byte(mt))
+		return
+	}
+
+	// Closing a session frees what it watched
+	if !sendMessageTest("Close session", c, wire.MessageTypeCloseSession, wire.MessageTypeAck, wire.NewCloseSessionMessage(1).Bytes(), t) {
+		return
+	}
+	if !watch("Watch after close", 3, logIds[2], wire.MessageTypeAck) {
+		return
+	}
+}
+
+func TestNotifyCommitment(t *testing.T) {
+	srv, _ := NewServer("", 0)
+	c := newDummyClient(srv)
+
+	// A client that did not negotiate the feature is not notified
+	legacy := newDummyClientNoHandshake(srv)
+	msg := wire.NewVersionMessage(wire.SupportedFeatures&^wire.FeatureCommitmentNotify, [32]byte{}, [32]byte{})
+	legacy.WriteMessage(wire.MessageTypeVersion, msg.Bytes())
+	legacy.ReadNextMessage()
+	legacy.EnableRequestIDs()
+
+	// Make sure both handshakes are complete on the server side
+	if !sendMessageTest("Ping", c, wire.MessageTypePing, wire.MessageTypePong, []byte{0x01}, t) {
+		return
+	}
+	if !sendMessageTest("Ping legacy", legacy, wire.MessageTypePing, wire.MessageTypePong, []byte{0x01}, t) {
+		return
+	}
+
+	commitment := [32]byte{0x01, 0x02, 0x03}
+	srv.notifyCommitment(commitment)
+
+	mt, p, err := c.ReadNextMessage()
+	if err != nil || mt != wire.MessageTypeNewCommitment {
+		t.Errorf("Expected new commitment notification, got [%x]: %v", byte(mt), err)
+		return
+	}
+	notification, err := wire.NewNewCommitmentMessageFromBytes(p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if notification.Commitment != commitment {
+		t.Errorf("Expected notification for commitment %x, got %x", commitment, notification.Commitment)
+		return
+	}
+
+	if !sendMessageTest("Ping without notification", legacy, wire.MessageTypePing, wire.MessageTypePong, []byte{0x01}, t) {
+		return
+	}
+}
+
+func TestNotifyCommitmentDuringHandshake(t *testing.T) {
+	srv, _ := NewServer("", 0)
+	server, client := net.Pipe()
+	p := NewLogProcessor(server, srv).(*ServerLogProcessor)
+	go p.Process()
+	c := wire.NewConnection(client)
+
+	// Commitments keep being mined while the client shakes hands, but it
+	// should only be notified after the acknowledgement, in frames with
+	// request IDs
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				p.NotifyCommitment([32]byte{0x01})
+			}
+		}
+	}()
+
+	msg := wire.NewVersionMessage(wire.SupportedFeatures, [32]byte{}, [32]byte{})
+	c.WriteMessage(wire.MessageTypeVersion, msg.Bytes())
+	mt, _, err := c.ReadNextMessage()
+	if err != nil || mt != wire.MessageTypeVersionAck {
+		t.Fatalf("Expected version acknowledgement, got [%x]: %v", byte(mt), err)
+	}
+	c.EnableRequestIDs()
+	close(stop)
+
+	c.WriteFrame(wire.MessageTypePing, 7, []byte{0x01})
+	for {
+		mt, id, _, err := c.ReadNextFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt == wire.MessageTypePong && id == 7 {
+			break
+		}
+		if mt != wire.MessageTypeNewCommitment || id != 0 {
+			t.Fatalf("Expected notifications and the pong, got [%x] with request ID %d", byte(mt), id)
+		}
+	}
+
+	// A notification that is still being written fails
+	c.Close()
+	<-done
+}
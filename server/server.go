@@ -8,12 +8,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/mit-dci/go-bverify/crypto/btcec"
 	"github.com/mit-dci/go-bverify/crypto/fastsha256"
 
 	"github.com/tidwall/buntdb"
@@ -21,6 +23,9 @@ import (
 	"github.com/mit-dci/go-bverify/bitcoin/blockchain"
 	"github.com/mit-dci/go-bverify/bitcoin/btcutil"
 	"github.com/mit-dci/go-bverify/bitcoin/chaincfg"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/coinparam"
+	"github.com/mit-dci/go-bverify/bitcoin/websocket"
 	btcwire "github.com/mit-dci/go-bverify/bitcoin/wire"
 	"github.com/mit-dci/go-bverify/logging"
 	"github.com/mit-dci/go-bverify/mpt"
@@ -38,15 +43,31 @@ type Server struct {
 	// Tracks the pubkeys for LogIDs
 	logIDToPubKey map[[32]byte][33]byte
 
-	// Guards the logIDToPubKey map
+	// Tracks the metadata the LogIDs were created with
+	logIDMetadata map[[32]byte]map[string]string
+
+	// Guards the logIDToPubKey and logIDMetadata maps
 	logIDToPubKeyLock sync.Mutex
 
 	// Tracks the pubkeys for LogIDs
 	logIDIndex map[[32]byte]uint64
 
-	// Guards the logIDIndex map
+	// Tracks the index at which LogIDs were sealed
+	sealedLogs map[[32]byte]uint64
+
+	// Guards the logIDIndex and sealedLogs maps
 	logIDIndexLock sync.Mutex
 
+	// Tracks the delegations of append rights for LogIDs
+	logIDDelegations map[[32]byte][]*wire.Delegation
+
+	// Tracks the hashes of revoked delegations, which can never be
+	// registered again
+	revokedDelegations map[[32]byte]struct{}
+
+	// Guards the logIDDelegations and revokedDelegations maps
+	delegationsLock sync.Mutex
+
 	// The full MPT tracking all client logs
 	fullmpt *mpt.FullMPT
 
@@ -57,7 +78,17 @@ type Server struct {
 	// transaction)
 	LastConfirmedCommitMpt *mpt.FullMPT
 
-	// Lock guarding the MPT
+	// The state of the MPT of each commitment that is not mined yet, and of
+	// the last one that was, to become LastConfirmedCommitMpt when it is
+	pendingCommitMpts map[[32]byte]*mpt.FullMPT
+
+	// Tracks the last commitment that included a statement of each log, and
+	// the index of the last statement of each log that has not been
+	// committed yet
+	logCommitments  map[[32]byte]logCommitment
+	uncommittedLogs map[[32]byte]uint64
+
+	// Lock guarding the MPTs, logCommitments and uncommittedLogs
 	mptLock sync.Mutex
 
 	// Cache of the last root committed to the blockchain
@@ -93,6 +124,9 @@ type Server struct {
 	// Listener for clients
 	listener *net.TCPListener
 
+	// HTTP server accepting WebSocket connections from clients
+	webSocketServer *http.Server
+
 	// The commitment server automatically commits every time a block has been
 	// found. This can be turned off by switching this boolean off.
 	AutoCommit bool
@@ -117,6 +151,52 @@ type Server struct {
 	// Allow disable signature verification to save needless processing  time when
 	// initializing benchmarks
 	CheckSignatures bool
+
+	// Accept signatures that are not bound to this server's signature domain.
+	// This allows clients to migrate, and should be switched off once they
+	// have.
+	AcceptLegacySignatures bool
+
+	// Connections that send nothing for IdleTimeout are closed, so clients
+	// have to ping more often than that. Writes to clients fail after
+	// WriteTimeout. Zero means no timeout.
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Connections that don't finish the secure transport or WebSocket
+	// handshake within HandshakeTimeout are closed
+	HandshakeTimeout time.Duration
+
+	// The maximum number of logs a single connection can watch for proof
+	// updates, in all its sessions together
+	MaxWatchedLogs int
+
+	// The maximum number of logical sessions on a single connection
+	MaxSessions int
+
+	// The domain clients sign their statements in, which binds them to this
+	// server and the network it commits to
+	signatureDomain *wire.SignatureDomain
+
+	// Encrypt all connections with clients, who can pin the public part of
+	// TransportKey. When switched on without a TransportKey, a full server
+	// loads it from its data directory and other servers generate one.
+	SecureTransport bool
+	TransportKey    *btcec.PrivateKey
+
+	// When set, the server also accepts WebSocket connections carrying the
+	// same messages on this address, so browsers can talk to it directly
+	WebSocketAddr string
+
+	// The chain a full server's wallet follows and commits to. When nil, it
+	// is configured by environment variables: BITCOINBACKEND selects bitcoind's
+	// RPC interface ("rpc"), btcd's RPC interface over a websocket, which
+	// notifies us of blocks ("websocket"), or the peer-to-peer protocol ("p2p").
+	ChainBackend wallet.ChainBackend
+
+	// How often the wallet checks for new blocks. When zero, the wallet's
+	// default is used.
+	BlockPollInterval time.Duration
 }
 
 func NewServer(addr string, rescanBlocks int) (*Server, error) {
@@ -125,6 +205,13 @@ func NewServer(addr string, rescanBlocks int) (*Server, error) {
 	srv := new(Server)
 	srv.RescanBlocks = rescanBlocks
 	srv.CheckSignatures = true
+	srv.AcceptLegacySignatures = true
+	srv.IdleTimeout = 2 * time.Minute
+	srv.WriteTimeout = 10 * time.Second
+	srv.HandshakeTimeout = 10 * time.Second
+	srv.MaxWatchedLogs = 1000
+	srv.MaxSessions = 10000
+	srv.signatureDomain = wire.NewSignatureDomain([32]byte{}, [32]byte{})
 	srv.AutoCommit = true
 	srv.KeepCommitmentTree = true
 	srv.CommitEveryNBlocks = 1 // every hour (well, on bitcoin at least)
@@ -135,11 +222,19 @@ func NewServer(addr string, rescanBlocks int) (*Server, error) {
 	}
 
 	srv.fullmpt, _ = mpt.NewFullMPT()
+	srv.logCommitments = map[[32]byte]logCommitment{}
+	srv.uncommittedLogs = map[[32]byte]uint64{}
+	srv.pendingCommitMpts = map[[32]byte]*mpt.FullMPT{}
 	srv.mptLock = sync.Mutex{}
 	srv.logIDToPubKey = map[[32]byte][33]byte{}
+	srv.logIDMetadata = map[[32]byte]map[string]string{}
 	srv.logIDToPubKeyLock = sync.Mutex{}
 	srv.logIDIndex = map[[32]byte]uint64{}
+	srv.sealedLogs = map[[32]byte]uint64{}
 	srv.logIDIndexLock = sync.Mutex{}
+	srv.logIDDelegations = map[[32]byte][]*wire.Delegation{}
+	srv.revokedDelegations = map[[32]byte]struct{}{}
+	srv.delegationsLock = sync.Mutex{}
 
 	srv.lastCommitment = [32]byte{}
 	srv.allProcessors = make([]LogProcessor, 0)
@@ -158,7 +253,7 @@ func (srv *Server) RegisterLogID(logID [32]byte, controllingKey [33]byte) error
 	srv.logIDToPubKeyLock.Unlock()
 
 	if ok {
-		return fmt.Errorf("Duplicate log ID created: [%x]", logID)
+		return wire.NewError(wire.ErrorCodeDuplicate, "Duplicate log ID created: [%x]", logID)
 	}
 	srv.logIDToPubKeyLock.Lock()
 	srv.logIDToPubKey[logID] = controllingKey
@@ -183,10 +278,44 @@ func (srv *Server) GetPubKeyForLogID(logID [32]byte) ([33]byte, error) {
 	srv.logIDToPubKeyLock.Unlock()
 
 	if !ok {
-		return [33]byte{}, fmt.Errorf("LogID not found")
+		return [33]byte{}, wire.NewError(wire.ErrorCodeUnknownLog, "LogID not found")
 	}
 	return pk, nil
 }
+
+// RegisterLogMetadata stores the metadata the log was created with
+func (srv *Server) RegisterLogMetadata(logID [32]byte, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	srv.logIDToPubKeyLock.Lock()
+	srv.logIDMetadata[logID] = metadata
+	srv.logIDToPubKeyLock.Unlock()
+
+	if srv.Full {
+		// Persist the metadata
+		var buf bytes.Buffer
+		wire.WriteCreateLogExtension(&buf, nil, metadata)
+		err := srv.commitmentDb.Update(func(tx *buntdb.Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("meta-%x", logID), buf.String(), nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLogMetadata returns the metadata the log was created with, which is nil
+// when there was none
+func (srv *Server) GetLogMetadata(logID [32]byte) map[string]string {
+	srv.logIDToPubKeyLock.Lock()
+	defer srv.logIDToPubKeyLock.Unlock()
+	return srv.logIDMetadata[logID]
+}
+
 func (srv *Server) GetNextLogIndex(logID [32]byte) uint64 {
 	srv.logIDIndexLock.Lock()
 	idx, ok := srv.logIDIndex[logID]
@@ -197,23 +326,251 @@ func (srv *Server) GetNextLogIndex(logID [32]byte) uint64 {
 	return idx + 1
 }
 
+// RegisterDelegation allows the delegate key in d to append to the log
+// identified by d.LogID. The caller is responsible for checking the
+// delegation was signed by the log's controlling key.
+func (srv *Server) RegisterDelegation(d *wire.Delegation) error {
+	_, err := srv.GetPubKeyForLogID(d.LogID)
+	if err != nil {
+		return err
+	}
+
+	// Without a wallet we don't know the block height, so we could never
+	// tell that the delegation expired
+	if d.ExpiryHeight != 0 && !srv.Full {
+		return wire.NewError(wire.ErrorCodeInvalidRequest, "Delegation expiry heights are only supported by full servers")
+	}
+
+	hash := d.Hash()
+	srv.delegationsLock.Lock()
+	_, revoked := srv.revokedDelegations[hash]
+	if revoked {
+		srv.delegationsLock.Unlock()
+		return wire.NewError(wire.ErrorCodeInvalidRequest, "Delegation [%x] has been revoked", hash)
+	}
+	for _, ed := range srv.logIDDelegations[d.LogID] {
+		if ed.Hash() == hash {
+			srv.delegationsLock.Unlock()
+			return wire.NewError(wire.ErrorCodeDuplicate, "Duplicate delegation created: [%x]", hash)
+		}
+	}
+	srv.logIDDelegations[d.LogID] = append(srv.logIDDelegations[d.LogID], d)
+	srv.delegationsLock.Unlock()
+
+	if srv.Full {
+		// Persist the delegation
+		err := srv.commitmentDb.Update(func(tx *buntdb.Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("delegation-%x", hash), string(d.Bytes()), nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeDelegation withdraws the delegation with the given hash from the log.
+// The caller is responsible for checking the revocation was signed by the
+// log's controlling key, so only delegations of that log can be revoked.
+func (srv *Server) RevokeDelegation(logID [32]byte, delegationHash [32]byte) error {
+	srv.delegationsLock.Lock()
+	delegations := srv.logIDDelegations[logID]
+	found := false
+	for i, d := range delegations {
+		if d.Hash() == delegationHash {
+			srv.logIDDelegations[logID] = append(delegations[:i], delegations[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		srv.delegationsLock.Unlock()
+		return wire.NewError(wire.ErrorCodeNotFound, "Log [%x] has no delegation [%x]", logID, delegationHash)
+	}
+	srv.revokedDelegations[delegationHash] = struct{}{}
+	srv.delegationsLock.Unlock()
+
+	if srv.Full {
+		// Persist the revocation
+		err := srv.commitmentDb.Update(func(tx *buntdb.Tx) error {
+			tx.Delete(fmt.Sprintf("delegation-%x", delegationHash))
+			_, _, err := tx.Set(fmt.Sprintf("revoked-%x", delegationHash), "1", nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDelegationsForLogID returns the delegations that are currently
+// registered for the log
+func (srv *Server) GetDelegationsForLogID(logID [32]byte) []*wire.Delegation {
+	srv.delegationsLock.Lock()
+	defer srv.delegationsLock.Unlock()
+	return append([]*wire.Delegation{}, srv.logIDDelegations[logID]...)
+}
+
+// RegisterBatch appends the statements to their logs atomically: either all
+// of them end up in the tree, or none of them do. The statements must be for
+// distinct logs, and witnesses holds the value to write for each of them.
+func (srv *Server) RegisterBatch(statements []*wire.LogStatement, witnesses [][]byte) error {
+	if len(statements) != len(witnesses) {
+		return wire.NewError(wire.ErrorCodeInvalidRequest, "Expected %d witnesses, got %d", len(statements), len(witnesses))
+	}
+
+	// Hold the index lock until the statements are in the tree, so nothing
+	// can be appended to these logs in the meantime
+	srv.logIDIndexLock.Lock()
+	defer srv.logIDIndexLock.Unlock()
+
+	seen := map[[32]byte]struct{}{}
+	for _, s := range statements {
+		_, ok := seen[s.LogID]
+		if ok {
+			return wire.NewError(wire.ErrorCodeInvalidRequest, "Log [%x] appears more than once in the batch", s.LogID)
+		}
+		seen[s.LogID] = struct{}{}
+
+		sealedIdx, sealed := srv.sealedLogs[s.LogID]
+		if sealed {
+			return wire.NewError(wire.ErrorCodeLogSealed, "Log [%x] was sealed at index %d", s.LogID, sealedIdx)
+		}
+		idx, ok := srv.logIDIndex[s.LogID]
+		if !ok {
+			return wire.NewError(wire.ErrorCodeUnknownLog, "LogID not found")
+		}
+		if s.Index != idx+1 {
+			return wire.NewError(wire.ErrorCodeIndexMismatch, "Unexpected log index %d - expected %d", s.Index, idx+1)
+		}
+	}
+
+	if srv.Full {
+		// Persist the indexes
+		err := srv.commitmentDb.Update(func(tx *buntdb.Tx) error {
+			for _, s := range statements {
+				_, _, err := tx.Set(fmt.Sprintf("idx-%x", s.LogID), fmt.Sprintf("%d", s.Index), nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	srv.mptLock.Lock()
+	for i, s := range statements {
+		srv.logIDIndex[s.LogID] = s.Index
+		logIdClean := make([]byte, 32)
+		copy(logIdClean, s.LogID[:])
+		srv.fullmpt.Insert(logIdClean, witnesses[i])
+		srv.uncommittedLogs[s.LogID] = s.Index
+	}
+	srv.mptLock.Unlock()
+
+	return nil
+}
+
+// SetSignatureDomain sets the network and server identifier that clients
+// have to sign their statements for
+func (srv *Server) SetSignatureDomain(network, serverID [32]byte) {
+	srv.signatureDomain = wire.NewSignatureDomain(network, serverID)
+}
+
+// SignatureDomain returns the domain clients sign their statements in
+func (srv *Server) SignatureDomain() *wire.SignatureDomain {
+	return srv.signatureDomain
+}
+
+// Height returns the current block height known to the server's wallet. When
+// not running as a full server there is no wallet, and it returns 0.
+func (srv *Server) Height() int {
+	if !srv.Full {
+		return 0
+	}
+	return srv.wallet.Height()
+}
+
+// GetSealedIndex returns the index of the statement that sealed the log, and
+// false if the log has not been sealed
+func (srv *Server) GetSealedIndex(logID [32]byte) (uint64, bool) {
+	srv.logIDIndexLock.Lock()
+	idx, ok := srv.sealedLogs[logID]
+	srv.logIDIndexLock.Unlock()
+	return idx, ok
+}
+
+// GetLogStatus returns the state of a log: the index of the next statement,
+// its controlling key, the value witnessed for its last statement and the last
+// commitment that included it
+func (srv *Server) GetLogStatus(logID [32]byte) (*wire.LogStatusMessage, error) {
+	pk, err := srv.GetPubKeyForLogID(logID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(wire.LogStatusMessage)
+	msg.LogID = logID
+	msg.ControllingKey = pk
+	msg.NextIndex = srv.GetNextLogIndex(logID)
+	_, msg.Sealed = srv.GetSealedIndex(logID)
+
+	srv.mptLock.Lock()
+	copy(msg.LastValue[:], srv.fullmpt.Get(logID[:]))
+	lc, ok := srv.logCommitments[logID]
+	srv.mptLock.Unlock()
+	if ok {
+		msg.Committed = true
+		msg.Commitment = lc.commitment
+		msg.CommittedIndex = lc.index
+	}
+	return msg, nil
+}
+
 func (srv *Server) RegisterLogStatement(logID [32]byte, index uint64, statement []byte) error {
+	return srv.registerLogStatement(logID, index, statement, false)
+}
+
+// SealLog registers the final statement of a log. After this, the server will
+// reject any further statements for the log.
+func (srv *Server) SealLog(logID [32]byte, index uint64, statement []byte) error {
+	return srv.registerLogStatement(logID, index, statement, true)
+}
+
+func (srv *Server) registerLogStatement(logID [32]byte, index uint64, statement []byte, seal bool) error {
 	srv.logIDIndexLock.Lock()
+	sealedIdx, sealed := srv.sealedLogs[logID]
+	if sealed {
+		srv.logIDIndexLock.Unlock()
+		return wire.NewError(wire.ErrorCodeLogSealed, "Log [%x] was sealed at index %d", logID, sealedIdx)
+	}
 	idx, ok := srv.logIDIndex[logID]
-	srv.logIDIndexLock.Unlock()
 	if !ok && index != uint64(0) {
-		return fmt.Errorf("Unexpected log index %d - expected 0", index)
+		srv.logIDIndexLock.Unlock()
+		return wire.NewError(wire.ErrorCodeIndexMismatch, "Unexpected log index %d - expected 0", index)
 	} else if ok && index != idx+1 {
-		return fmt.Errorf("Unexpected log index %d - expected %d", index, idx+1)
+		srv.logIDIndexLock.Unlock()
+		return wire.NewError(wire.ErrorCodeIndexMismatch, "Unexpected log index %d - expected %d", index, idx+1)
 	}
-	srv.logIDIndexLock.Lock()
 	srv.logIDIndex[logID] = index
+	if seal {
+		srv.sealedLogs[logID] = index
+	}
 	srv.logIDIndexLock.Unlock()
 
 	if srv.Full {
 		// Persist the index
 		err := srv.commitmentDb.Update(func(tx *buntdb.Tx) error {
 			_, _, err := tx.Set(fmt.Sprintf("idx-%x", logID), fmt.Sprintf("%d", index), nil)
+			if err != nil || !seal {
+				return err
+			}
+			_, _, err = tx.Set(fmt.Sprintf("sealed-%x", logID), fmt.Sprintf("%d", index), nil)
 			return err
 		})
 		if err != nil {
@@ -226,6 +583,7 @@ func (srv *Server) RegisterLogStatement(logID [32]byte, index uint64, statement
 	copy(logIdClean, logID[:])
 	srv.fullmpt.Insert(logIdClean, statement)
 	logIdClean = nil
+	srv.uncommittedLogs[logID] = index
 	srv.mptLock.Unlock()
 
 	return nil
@@ -242,6 +600,14 @@ func (srv *Server) Run() error {
 		return err
 	}
 
+	if srv.SecureTransport && srv.TransportKey == nil {
+		err = srv.loadTransportKey()
+		if err != nil {
+			return err
+		}
+		logging.Infof("Secure transport enabled, clients can pin server key %x", srv.TransportKey.PubKey().SerializeCompressed())
+	}
+
 	if srv.Full {
 		os.MkdirAll(utils.DataDirectory(), 0700)
 
@@ -251,28 +617,45 @@ func (srv *Server) Run() error {
 		logging.SetLogFile(logFile)
 
 		params := &chaincfg.RegressionNetParams
+		p2pParams := &coinparam.RegressionNetParams
 		if utils.GetEnvOrDefault("BITCOINNET", "regtest") == "testnet" {
 			params = &chaincfg.TestNet3Params
+			p2pParams = &coinparam.TestNet3Params
 		} else if utils.GetEnvOrDefault("BITCOINNET", "regtest") == "mainnet" {
 			params = &chaincfg.MainNetParams
+			p2pParams = &coinparam.BitcoinParams
 		}
 
-		srv.wallet, err = wallet.NewWallet(params, srv.RescanBlocks)
+		if srv.ChainBackend == nil {
+			srv.ChainBackend, err = newChainBackend(p2pParams)
+			if err != nil {
+				return err
+			}
+		}
+
+		srv.wallet, err = wallet.NewWallet(params, srv.ChainBackend, srv.RescanBlocks)
 		if err != nil {
 			return err
 		}
+		if srv.BlockPollInterval > 0 {
+			srv.wallet.PollInterval = srv.BlockPollInterval
+		}
+
+		// Our wallet key identifies us in the signature domain
+		srv.SetSignatureDomain([32]byte(*params.GenesisHash), fastsha256.Sum256(srv.wallet.PubKey()))
 
 		srv.commitmentDb, err = buntdb.Open(path.Join(utils.DataDirectory(), "commitment.db"))
 		if err != nil {
 			return err
 		}
 
-		newBlockChan := make(chan *btcwire.MsgBlock, 100)
-		srv.wallet.AddNewBlockListener(newBlockChan)
-		go srv.blockWatcher(newBlockChan)
+		blockChan := make(chan wallet.BlockEvent, 100)
+		srv.wallet.AddBlockListener(blockChan)
+		go srv.blockWatcher(blockChan)
 		srv.loadState()
 		srv.loadCommitments()
 		srv.loadLogs()
+		srv.wallet.Start()
 
 		// After everything is loaded, we should touch our "special log" to trigger new
 		// commitments, even if clients don't change anything. We did that after the last
@@ -331,6 +714,13 @@ func (srv *Server) Run() error {
 		}
 	}
 
+	if srv.WebSocketAddr != "" {
+		err = srv.runWebSocket()
+		if err != nil {
+			return err
+		}
+	}
+
 	srv.isReady = true
 
 	select {
@@ -348,22 +738,157 @@ func (srv *Server) Run() error {
 				continue
 			}
 		}
+		if srv.SecureTransport {
+			// Don't hold up accepting other clients while doing the handshake
+			go srv.acceptSecure(conn)
+			continue
+		}
 		proc := NewLogProcessor(conn, srv)
-		srv.allProcessors = append(srv.allProcessors, proc)
 		go proc.Process()
 	}
 
 	return nil
 }
 
-func (srv *Server) blockWatcher(wc chan *btcwire.MsgBlock) {
+// newChainBackend returns the chain backend configured by environment
+// variables
+func newChainBackend(p2pParams *coinparam.Params) (wallet.ChainBackend, error) {
+	var backend wallet.ChainBackend
+	var err error
+	switch kind := utils.GetEnvOrDefault("BITCOINBACKEND", "rpc"); kind {
+	case "rpc":
+		backend, err = wallet.NewRPCBackend(
+			utils.GetEnvOrDefault("BITCOINRPC", "localhost:18443"),
+			utils.GetEnvOrDefault("BITCOINRPCUSER", "bverify"),
+			utils.GetEnvOrDefault("BITCOINRPCPASSWORD", "bverify"))
+	case "websocket":
+		var certs []byte
+		if certFile := utils.GetEnvOrDefault("BITCOINRPCCERT", ""); certFile != "" {
+			certs, err = ioutil.ReadFile(certFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		backend, err = wallet.NewWebsocketRPCBackend(
+			utils.GetEnvOrDefault("BITCOINRPC", "localhost:18443"),
+			utils.GetEnvOrDefault("BITCOINRPCUSER", "bverify"),
+			utils.GetEnvOrDefault("BITCOINRPCPASSWORD", "bverify"),
+			certs)
+	case "p2p":
+		backend, err = wallet.NewP2PBackend(p2pParams,
+			utils.GetEnvOrDefault("BITCOINPEER", "localhost:"+p2pParams.DefaultPort),
+			path.Join(utils.DataDirectory(), "headers.bin"))
+	default:
+		return nil, fmt.Errorf("Unknown chain backend %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// runWebSocket starts accepting WebSocket connections on WebSocketAddr. Every
+// connection is handled by a log processor, just like TCP connections.
+func (srv *Server) runWebSocket() error {
+	listener, err := net.Listen("tcp", srv.WebSocketAddr)
+	if err != nil {
+		return err
+	}
+
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: srv.HandshakeTimeout,
+		// Dashboards are served from other origins, and there are no cookies
+		// or other ambient credentials to protect
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logging.Warnf("WebSocket upgrade from %s failed: %s", r.RemoteAddr, err.Error())
+			return
+		}
+		proc := NewLogProcessor(wire.NewWebSocketConn(ws), srv)
+		proc.Process()
+	})
+
+	srv.webSocketServer = &http.Server{Handler: mux}
+	go srv.webSocketServer.Serve(listener)
+	return nil
+}
+
+// acceptSecure performs the secure transport handshake with a newly connected
+// client before processing its messages
+func (srv *Server) acceptSecure(conn net.Conn) {
+	// A peer that connects and sends nothing must not hold on to the
+	// connection forever
+	if srv.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+	}
+	sc, err := wire.NewSecureServerConn(conn, srv.TransportKey)
+	if err != nil {
+		logging.Warnf("Secure transport handshake with %s failed: %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	proc := NewLogProcessor(sc, srv)
+	proc.Process()
+}
+
+// loadTransportKey reads the static transport key from the data directory of
+// a full server, generating it when it does not exist yet. Other servers get
+// a new key every time they start.
+func (srv *Server) loadTransportKey() error {
+	key32 := [32]byte{}
+	keyFile := path.Join(utils.DataDirectory(), "transport.hex")
+	if !srv.Full {
+		rand.Read(key32[:])
+	} else if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		os.MkdirAll(utils.DataDirectory(), 0700)
+		rand.Read(key32[:])
+		err = ioutil.WriteFile(keyFile, key32[:], 0600)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		copy(key32[:], key)
+	}
+	srv.TransportKey, _ = btcec.PrivKeyFromBytes(btcec.S256(), key32[:])
+	return nil
+}
+
+// TransportPubKey returns the public key clients can pin when connecting over
+// the secure transport
+func (srv *Server) TransportPubKey() [33]byte {
+	var pk [33]byte
+	if srv.TransportKey != nil {
+		copy(pk[:], srv.TransportKey.PubKey().SerializeCompressed())
+	}
+	return pk
+}
+
+func (srv *Server) blockWatcher(wc chan wallet.BlockEvent) {
 	for {
-		block := <-wc
+		ev := <-wc
+
+		if ev.Disconnected {
+			logging.Debugf("Block %s was disconnected in blockwatcher", ev.Hash.String())
+			srv.processDisconnectedBlock(ev.Hash)
+			continue
+		}
 
 		logging.Debugf("Received new block in blockwatcher")
 
 		// check if our last commit is in here
-		err := srv.processMerkleProofs(block)
+		err := srv.processMerkleProofs(ev.Block)
 		if err != nil {
 			logging.Errorf("Error getting merkle proofs from block: %s", err.Error())
 		}
@@ -371,8 +896,10 @@ func (srv *Server) blockWatcher(wc chan *btcwire.MsgBlock) {
 		blocksSince := srv.wallet.Height() - srv.LastCommitHeight
 		if blocksSince >= srv.CommitEveryNBlocks {
 			logging.Debugf("Reached commit threshold. Committing to chain")
+			// We build commitments on top of our pending ones, up to
+			// the depth the wallet allows
 			pending := srv.getPendingCommitments()
-			if len(pending) == 0 {
+			if len(pending) < srv.wallet.MaxPendingCommitments {
 				if srv.isReady {
 					err := srv.Commit()
 					if err != nil {
@@ -382,7 +909,7 @@ func (srv *Server) blockWatcher(wc chan *btcwire.MsgBlock) {
 					logging.Warnf("Server not ready, not committing")
 				}
 			} else {
-				logging.Debugf("We still have a pending commitment, waiting for it to be mined before committing again")
+				logging.Debugf("We have %d pending commitments, waiting for them to be mined before committing again", len(pending))
 			}
 		} else {
 			logging.Debugf("Got new block, %d since last commit (commit every %d) - waiting", blocksSince, srv.CommitEveryNBlocks)
@@ -393,11 +920,17 @@ func (srv *Server) blockWatcher(wc chan *btcwire.MsgBlock) {
 func (srv *Server) loadCommitments() {
 	srv.commitments = make([]*wire.Commitment, 0)
 	err := srv.commitmentDb.View(func(tx *buntdb.Tx) error {
+		var decodeErr error
 		tx.AscendRange("", "commitment-", "commitmenu-", func(key, value string) bool {
-			srv.commitments = append(srv.commitments, wire.CommitmentFromBytes([]byte(value)))
+			c, err := wire.CommitmentFromBytes([]byte(value))
+			if err != nil {
+				decodeErr = fmt.Errorf("Could not read %s: %s", key, err.Error())
+				return false
+			}
+			srv.commitments = append(srv.commitments, c)
 			return true
 		})
-		return nil
+		return decodeErr
 	})
 	if err != nil {
 		logging.Errorf("[Server] Error loading commitments: %s", err.Error())
@@ -450,8 +983,10 @@ func (srv *Server) loadCommitments() {
 }
 
 func (srv *Server) loadLogs() {
+	logCommitments := map[[32]byte]logCommitment{}
 	srv.logIDToPubKeyLock.Lock()
 	srv.logIDIndexLock.Lock()
+	srv.delegationsLock.Lock()
 	err := srv.commitmentDb.View(func(tx *buntdb.Tx) error {
 		tx.AscendRange("", "key-", "key.", func(key, value string) bool {
 			logID, _ := hex.DecodeString(key[4:])
@@ -464,6 +999,17 @@ func (srv *Server) loadLogs() {
 			return true
 		})
 
+		tx.AscendRange("", "meta-", "meta.", func(key, value string) bool {
+			logID, _ := hex.DecodeString(key[5:])
+			logID32 := [32]byte{}
+			copy(logID32[:], logID)
+			_, metadata, err := wire.ReadCreateLogExtension(bytes.NewBufferString(value))
+			if err == nil {
+				srv.logIDMetadata[logID32] = metadata
+			}
+			return true
+		})
+
 		tx.AscendRange("", "idx-", "idx.", func(key, value string) bool {
 			logID, _ := hex.DecodeString(key[4:])
 			logID32 := [32]byte{}
@@ -473,16 +1019,87 @@ func (srv *Server) loadLogs() {
 			srv.logIDIndex[logID32] = idx
 			return true
 		})
+
+		tx.AscendRange("", "sealed-", "sealed.", func(key, value string) bool {
+			logID, _ := hex.DecodeString(key[7:])
+			logID32 := [32]byte{}
+			copy(logID32[:], logID)
+			idx, _ := strconv.ParseUint(value, 10, 64)
+
+			srv.sealedLogs[logID32] = idx
+			return true
+		})
+
+		tx.AscendRange("", "delegation-", "delegation.", func(key, value string) bool {
+			d, err := wire.NewDelegationFromBytes([]byte(value))
+			if err == nil {
+				srv.logIDDelegations[d.LogID] = append(srv.logIDDelegations[d.LogID], d)
+			}
+			return true
+		})
+
+		tx.AscendRange("", "logcommitment-", "logcommitment.", func(key, value string) bool {
+			logID, _ := hex.DecodeString(key[14:])
+			logID32 := [32]byte{}
+			copy(logID32[:], logID)
+			var lc logCommitment
+			var commitment []byte
+			_, err := fmt.Sscanf(value, "%x-%d", &commitment, &lc.index)
+			if err == nil {
+				copy(lc.commitment[:], commitment)
+				logCommitments[logID32] = lc
+			}
+			return true
+		})
+
+		tx.AscendRange("", "revoked-", "revoked.", func(key, value string) bool {
+			hash, _ := hex.DecodeString(key[8:])
+			hash32 := [32]byte{}
+			copy(hash32[:], hash)
+			srv.revokedDelegations[hash32] = struct{}{}
+			return true
+		})
 		return nil
 	})
 
 	srv.logIDToPubKeyLock.Unlock()
 	srv.logIDIndexLock.Unlock()
+	srv.delegationsLock.Unlock()
 
 	if err != nil {
 		logging.Errorf("[Server] Error loading logs: %s", err.Error())
 		return
 	}
+
+	srv.mptLock.Lock()
+	srv.logCommitments = logCommitments
+	srv.mptLock.Unlock()
+}
+
+// logCommitment is the last commitment that included a statement of a log,
+// and the index of that statement
+type logCommitment struct {
+	commitment [32]byte
+	index      uint64
+}
+
+// saveLogCommitments persists that the statements at the given indexes of
+// each log were included in the commitment
+func (srv *Server) saveLogCommitments(commitment [32]byte, included map[[32]byte]uint64) {
+	err := srv.commitmentDb.Update(func(dtx *buntdb.Tx) error {
+		for logID, idx := range included {
+			key := fmt.Sprintf("logcommitment-%x", logID)
+			value := fmt.Sprintf("%x-%d", commitment, idx)
+			_, _, err := dtx.Set(key, value, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("[Server] Error saving log commitments: %s", err.Error())
+	}
 }
 
 func (srv *Server) saveCommitment(c *wire.Commitment) {
@@ -522,6 +1139,20 @@ func (srv *Server) getPendingCommitments() []*wire.Commitment {
 	return r
 }
 
+// processDisconnectedBlock makes the commitments that were in a block that was
+// reorged out of the chain pending again, until processMerkleProofs finds them
+// in a block of the new chain
+func (srv *Server) processDisconnectedBlock(blockHash chainhash.Hash) {
+	for _, c := range srv.commitments {
+		if c.IncludedInBlock != nil && c.IncludedInBlock.IsEqual(&blockHash) {
+			logging.Warnf("Commitment %x was in block %s, which was reorged out of the chain", c.Commitment, blockHash.String())
+			c.IncludedInBlock = nil
+			c.MerkleProof = utils.MerkleProof{}
+			srv.saveCommitment(c)
+		}
+	}
+}
+
 func (srv *Server) processMerkleProofs(block *btcwire.MsgBlock) error {
 	logging.Debugf("Processing block %s for commitments", block.BlockHash().String())
 	pending := srv.getPendingCommitments()
@@ -534,10 +1165,23 @@ func (srv *Server) processMerkleProofs(block *btcwire.MsgBlock) error {
 				commitmentInBlock = true
 				break
 			}
+
+			// The wallet may have replaced the commitment transaction to
+			// bump its fee, and any version can be mined
+			if srv.wallet.SameCommitment(&hash, c.TxHash) {
+				logging.Debugf("Commitment %x was mined as replacement %s of %s", c.Commitment, hash.String(), c.TxHash.String())
+				var buf bytes.Buffer
+				tx.Serialize(&buf)
+				c.TxHash = &hash
+				c.RawTx = buf.Bytes()
+				commitmentInBlock = true
+				break
+			}
 		}
 
 		if commitmentInBlock {
 			blockHash := block.BlockHash()
+			newlyIncluded := c.IncludedInBlock == nil || !c.IncludedInBlock.IsEqual(&blockHash)
 			if c.IncludedInBlock != nil && !c.IncludedInBlock.IsEqual(&blockHash) {
 				logging.Debugf("Commitment %x was in block %s, now %s", c.Commitment, c.IncludedInBlock.String(), blockHash.String())
 			} else {
@@ -569,12 +1213,13 @@ func (srv *Server) processMerkleProofs(block *btcwire.MsgBlock) error {
 			c.MerkleProof = proof
 			c.IncludedInBlock = &blockHash
 
-			if bytes.Equal(srv.lastCommitment[:], c.Commitment[:]) {
-				srv.LastConfirmedCommitMpt, _ = srv.LastCommitMpt.Copy()
-				srv.commitState()
-			}
+			srv.confirmCommitMpt(c.Commitment)
 
 			srv.saveCommitment(c)
+
+			if newlyIncluded {
+				srv.notifyCommitment(c.Commitment)
+			}
 		}
 	}
 
@@ -586,32 +1231,113 @@ func (srv *Server) processMerkleProofs(block *btcwire.MsgBlock) error {
 	return nil
 }
 
+// confirmCommitMpt makes the state of the MPT of a mined commitment the one
+// we give proofs from. Commitments are mined in the order we made them, so
+// we no longer need the state of the ones before it.
+func (srv *Server) confirmCommitMpt(commitment [32]byte) {
+	srv.mptLock.Lock()
+	defer srv.mptLock.Unlock()
+
+	commitMpt, ok := srv.pendingCommitMpts[commitment]
+	if !ok {
+		// We don't keep the state of pending commitments across restarts,
+		// but do have the state of the last one
+		if !bytes.Equal(srv.lastCommitment[:], commitment[:]) {
+			return
+		}
+		commitMpt = srv.LastCommitMpt
+	}
+	srv.LastConfirmedCommitMpt, _ = commitMpt.Copy()
+
+	for _, c := range srv.commitments {
+		if c.Commitment == commitment {
+			break
+		}
+		if m, ok := srv.pendingCommitMpts[c.Commitment]; ok {
+			m.Dispose()
+			delete(srv.pendingCommitMpts, c.Commitment)
+		}
+	}
+	srv.commitState()
+}
+
+// notifyCommitment tells the connected clients that a commitment was included
+// in a block, so they can verify it right away
+func (srv *Server) notifyCommitment(commitment [32]byte) {
+	srv.processorsLock.Lock()
+	all := make([]LogProcessor, len(srv.allProcessors))
+	copy(all, srv.allProcessors)
+	srv.processorsLock.Unlock()
+
+	for _, p := range all {
+		lp, ok := p.(*ServerLogProcessor)
+		if ok {
+			go lp.NotifyCommitment(commitment)
+		}
+	}
+}
+
 func (srv *Server) registerProcessor(p LogProcessor) {
+	srv.processorsLock.Lock()
+	srv.processors = append(srv.processors, p)
+	srv.allProcessors = append(srv.allProcessors, p)
+	srv.processorsLock.Unlock()
+}
+
+// registerSession registers the processor of a logical session, which receives
+// proof updates like a connection does. The connection it belongs to is
+// already registered.
+func (srv *Server) registerSession(p LogProcessor) {
 	srv.processorsLock.Lock()
 	srv.processors = append(srv.processors, p)
 	srv.processorsLock.Unlock()
 }
 
+// unregisterProcessor forgets about a processor whose connection or session is
+// gone
 func (srv *Server) unregisterProcessor(p LogProcessor) {
 	srv.processorsLock.Lock()
+	srv.processors = removeProcessor(srv.processors, p)
+	srv.allProcessors = removeProcessor(srv.allProcessors, p)
+	srv.processorsLock.Unlock()
+}
+
+func removeProcessor(processors []LogProcessor, p LogProcessor) []LogProcessor {
 	removeIdx := -1
-	for i, pp := range srv.processors {
+	for i, pp := range processors {
 		if pp == p {
 			removeIdx = i
 		}
 	}
 	if removeIdx != -1 {
-		srv.processors = append(srv.processors[:removeIdx], srv.processors[removeIdx+1:]...)
+		processors = append(processors[:removeIdx], processors[removeIdx+1:]...)
 	}
-	srv.processorsLock.Unlock()
+	return processors
+}
+
+// ProcessorCount returns the number of connected clients
+func (srv *Server) ProcessorCount() int {
+	srv.processorsLock.Lock()
+	defer srv.processorsLock.Unlock()
+	return len(srv.allProcessors)
 }
 
 func (srv *Server) Stop() {
-	for _, p := range srv.allProcessors {
+	srv.processorsLock.Lock()
+	all := make([]LogProcessor, len(srv.allProcessors))
+	copy(all, srv.allProcessors)
+	srv.processorsLock.Unlock()
+	for _, p := range all {
 		p.Stop()
 	}
 	srv.stop <- true
 	srv.listener.Close()
+	if srv.wallet != nil {
+		srv.wallet.Stop()
+	}
+	if srv.webSocketServer != nil {
+		srv.webSocketServer.Close()
+	}
 }
 
 func (srv *Server) Commitment() []byte {
@@ -641,6 +1367,7 @@ func (srv *Server) Commit() error {
 	var err error
 	// Retain the full MPT at the time of commitment to be able to serve
 	// proofs
+	prevCommitment := srv.lastCommitment
 	copy(srv.lastCommitment[:], commitment[:])
 
 	if srv.KeepCommitmentTree {
@@ -659,6 +1386,18 @@ func (srv *Server) Commit() error {
 
 	srv.lastDelta, _ = mpt.NewDeltaMPT(srv.fullmpt)
 
+	// Every log that changed since the last commitment is included in this
+	// one. A full server only records that once the commitment is broadcast.
+	comm32 := [32]byte{}
+	copy(comm32[:], commitment)
+	included := make(map[[32]byte]uint64, len(srv.uncommittedLogs))
+	for logID, idx := range srv.uncommittedLogs {
+		included[logID] = idx
+	}
+	if !srv.Full {
+		srv.markCommitted(comm32, included)
+	}
+
 	srv.processorsLock.Lock()
 	var wg sync.WaitGroup
 	for _, pr := range srv.processors {
@@ -679,25 +1418,56 @@ func (srv *Server) Commit() error {
 	if srv.Full {
 		txID, rawTx, err := srv.wallet.Commit(commitment[:])
 		if err != nil {
+			// Nothing was broadcast, so the next commitment has to include
+			// these logs again, even if nothing changes until then
+			srv.mptLock.Lock()
+			if srv.lastCommitment == comm32 {
+				srv.lastCommitment = prevCommitment
+			}
+			srv.mptLock.Unlock()
 			return err
 		}
+		srv.mptLock.Lock()
+		srv.markCommitted(comm32, included)
+		srv.mptLock.Unlock()
 
-		comm32 := [32]byte{}
-		copy(comm32[:], commitment)
 		c := wire.NewCommitment(comm32, txID, rawTx, srv.wallet.Height())
 		srv.saveCommitment(c)
 		logging.Debugf("Committed to chain: %s", txID.String())
 
+		// Keep the state of this commitment to give proofs from once it's
+		// mined, since we may commit again before that
+		srv.mptLock.Lock()
+		srv.pendingCommitMpts[comm32], err = srv.LastCommitMpt.Copy()
+		srv.mptLock.Unlock()
+		if err != nil {
+			return err
+		}
+
 		srv.commitState()
+		srv.saveLogCommitments(comm32, included)
 
-		// change something in the tree to force a commitment next time around
+		// change something in the tree to force a commitment next time around.
+		// The commitment is the root's hash in the tree, so we insert a copy.
 		nextIdx := srv.GetNextLogIndex([32]byte{})
-		srv.RegisterLogStatement([32]byte{}, nextIdx, commitment)
+		srv.RegisterLogStatement([32]byte{}, nextIdx, comm32[:])
 	}
 	commitment = nil
 	return nil
 }
 
+// markCommitted records that the logs were included in the commitment at the
+// given indexes. Logs appended to since then stay uncommitted. The caller
+// holds mptLock.
+func (srv *Server) markCommitted(commitment [32]byte, included map[[32]byte]uint64) {
+	for logID, idx := range included {
+		srv.logCommitments[logID] = logCommitment{commitment: commitment, index: idx}
+		if cur, ok := srv.uncommittedLogs[logID]; ok && cur == idx {
+			delete(srv.uncommittedLogs, logID)
+		}
+	}
+}
+
 func (srv *Server) commitState() error {
 	commitState := ServerState{}
 	commitState.LastCommitmentTree = srv.LastCommitMpt.Bytes()
@@ -753,12 +1523,12 @@ func (srv *Server) loadState() error {
 func (srv *Server) GetProofForKeys(keys [][]byte) (*mpt.PartialMPT, error) {
 	if srv.Full {
 		if srv.LastConfirmedCommitMpt == nil {
-			return nil, fmt.Errorf("There has not yet been a confirmed commitment, please try again later")
+			return nil, wire.NewError(wire.ErrorCodeNotReady, "There has not yet been a confirmed commitment, please try again later")
 		}
 		return mpt.NewPartialMPTIncludingKeys(srv.LastConfirmedCommitMpt, keys)
 	} else {
 		if srv.LastCommitMpt == nil {
-			return nil, fmt.Errorf("There has not yet been a confirmed commitment, please try again later")
+			return nil, wire.NewError(wire.ErrorCodeNotReady, "There has not yet been a confirmed commitment, please try again later")
 		}
 		return mpt.NewPartialMPTIncludingKeys(srv.LastCommitMpt, keys)
 	}
@@ -777,10 +1547,10 @@ func (srv *Server) GetCommitmentDetails(commitment [32]byte) (*wire.Commitment,
 	for _, c := range srv.commitments {
 		if bytes.Equal(c.Commitment[:], commitment[:]) {
 			// Return a clone
-			return wire.CommitmentFromBytes(c.Bytes()), nil
+			return wire.CommitmentFromBytes(c.Bytes())
 		}
 	}
-	return nil, fmt.Errorf("Commitment not found")
+	return nil, wire.NewError(wire.ErrorCodeNotFound, "Commitment not found")
 }
 
 func (srv *Server) GetCommitmentHistory(sinceCommitment [32]byte) []*wire.Commitment {
@@ -806,14 +1576,19 @@ func (srv *Server) GetCommitmentHistory(sinceCommitment [32]byte) []*wire.Commit
 			// Clone each commitment into the array we return
 			// We don't want the caller to mess anything up to our
 			// in-memory array.
-			comm := wire.CommitmentFromBytes(c.Bytes())
-			if comm.IncludedInBlock != nil {
-				// Only include mined commitments
-				commitments = append(commitments, comm)
-			} else {
-				logging.Debugf("Skipping commitment %x since it's not included in a block yet", comm.Commitment)
+			comm, err := wire.CommitmentFromBytes(c.Bytes())
+			if err != nil {
+				logging.Errorf("Could not clone commitment %x: %s", c.Commitment, err.Error())
+				continue
 			}
-
+			if comm.IncludedInBlock == nil {
+				// Only include mined commitments. Each commitment spends
+				// the previous one, so the ones after this one can't be
+				// mined either, and clients verify them in order.
+				logging.Debugf("Stopping at commitment %x since it's not included in a block yet", comm.Commitment)
+				break
+			}
+			commitments = append(commitments, comm)
 		}
 	}
 	return commitments
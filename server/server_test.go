@@ -5,11 +5,23 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/mit-dci/go-bverify/bitcoin/btcutil"
+	"github.com/mit-dci/go-bverify/bitcoin/chaincfg"
+	btcwire "github.com/mit-dci/go-bverify/bitcoin/wire"
+	"github.com/mit-dci/go-bverify/crypto/btcec"
 	"github.com/mit-dci/go-bverify/server/mocks"
+	"github.com/mit-dci/go-bverify/utils"
+	"github.com/mit-dci/go-bverify/wallet"
+	"github.com/mit-dci/go-bverify/wire"
+	"github.com/tidwall/buntdb"
 )
 
 func TestRegisterGetLogKey(t *testing.T) {
@@ -183,3 +195,294 @@ func TestServerConnectivity(t *testing.T) {
 	srv.Stop()
 
 }
+
+func TestSecureTransport(t *testing.T) {
+	srv, err := NewServer(":56198", 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	srv.SecureTransport = true
+	srv.TransportKey, _ = btcec.NewPrivateKey(btcec.S256())
+	srv.HandshakeTimeout = 200 * time.Millisecond
+	pk := srv.TransportPubKey()
+
+	go func() {
+		err := srv.Run()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-srv.ready
+	defer srv.Stop()
+
+	// A client pinning another key refuses to talk to the server
+	conn, err := net.Dial("tcp", "127.0.0.1:56198")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = wire.NewSecureClientConn(conn, &[33]byte{0x02})
+	conn.Close()
+	if err == nil {
+		t.Error("Expected handshake with the wrong pinned key to fail")
+		return
+	}
+
+	conn, err = net.Dial("tcp", "127.0.0.1:56198")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sc, err := wire.NewSecureClientConn(conn, &pk)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c := wire.NewConnection(sc)
+	defer c.Close()
+
+	// The handshake deadline no longer applies once it is done
+	time.Sleep(2 * srv.HandshakeTimeout)
+
+	msg := wire.NewVersionMessage(wire.SupportedFeatures, [32]byte{}, [32]byte{})
+	if !sendMessageTest("Version over secure transport", c, wire.MessageTypeVersion, wire.MessageTypeVersionAck, msg.Bytes(), t) {
+		return
+	}
+
+	// A peer that never starts the handshake is disconnected
+	conn, err = net.Dial("tcp", "127.0.0.1:56198")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("Expected the server to close a connection without handshake")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Error("Server did not close a connection without handshake")
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	srv, err := NewServer(":56197", 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	srv.WebSocketAddr = "127.0.0.1:56196"
+
+	go func() {
+		err := srv.Run()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-srv.ready
+	defer srv.Stop()
+
+	ws, err := wire.DialWebSocket("ws://127.0.0.1:56196/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	c := wire.NewConnection(ws)
+	defer c.Close()
+
+	msg := wire.NewVersionMessage(wire.SupportedFeatures, [32]byte{}, [32]byte{})
+	if !sendMessageTest("Version over WebSocket", c, wire.MessageTypeVersion, wire.MessageTypeVersionAck, msg.Bytes(), t) {
+		return
+	}
+	c.EnableRequestIDs()
+
+	req := wire.NewRequestCommitmentHistoryMessage([32]byte{})
+	if !sendMessageTest("Commitment history over WebSocket", c, wire.MessageTypeRequestCommitmentHistory, wire.MessageTypeCommitmentHistory, req.Bytes(), t) {
+		return
+	}
+}
+
+// waitFor polls cond until it's true, and fails the test when that takes too
+// long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFullServerOnSimChain(t *testing.T) {
+	home, err := ioutil.TempDir("", "bverify-full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+
+	// Fund the wallet key the server will load
+	os.MkdirAll(utils.DataDirectory(), 0700)
+	key := make([]byte, 32)
+	rand.Read(key)
+	err = ioutil.WriteFile(path.Join(utils.DataDirectory(), "privkey.hex"), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pubKey := btcec.PrivKeyFromBytes(btcec.S256(), key)
+	var pkh [20]byte
+	copy(pkh[:], btcutil.Hash160(pubKey.SerializeCompressed()))
+
+	chain := wallet.NewSimChain(&chaincfg.RegressionNetParams)
+	chain.Fund(utils.DirectWPKHScriptFromPKH(pkh), 100000000)
+	chain.Mine()
+
+	srv, err := NewServer("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Full = true
+	srv.ChainBackend = chain
+	srv.BlockPollInterval = 10 * time.Millisecond
+
+	go func() {
+		err := srv.Run()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-srv.ready
+	defer srv.Stop()
+
+	mined := func(n int) func() bool {
+		return func() bool {
+			return len(srv.GetCommitmentHistory([32]byte{})) >= n
+		}
+	}
+	mempool := func(n int) func() bool {
+		return func() bool {
+			return len(chain.Mempool()) == n
+		}
+	}
+
+	// The maiden commitment
+	waitFor(t, "the maiden commitment", mempool(1))
+	chain.Mine()
+	waitFor(t, "the maiden commitment to be mined", mined(1))
+
+	// Each block makes the server commit again. When the commitment is not
+	// mined, the next one builds on it.
+	waitFor(t, "the second commitment", mempool(1))
+	chain.MineEmpty()
+	waitFor(t, "the third commitment", mempool(2))
+	pending := chain.Mempool()
+	second := pending[0].TxHash()
+	if pending[1].TxIn[0].PreviousOutPoint != *btcwire.NewOutPoint(&second, 1) {
+		t.Fatalf("Third commitment does not spend the change of the second")
+	}
+
+	chain.Mine()
+	waitFor(t, "the pending commitments to be mined", mined(3))
+
+	history := srv.GetCommitmentHistory([32]byte{})
+	for i, c := range history {
+		if c.IncludedInBlock == nil {
+			t.Fatalf("Commitment %d is not mined", i)
+		}
+		tx := btcwire.NewMsgTx(1)
+		err = tx.Deserialize(bytes.NewReader(c.RawTx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx.TxOut[0].PkScript[2:], c.Commitment[:]) {
+			t.Errorf("Commitment %d has OP_RETURN %x, expected %x", i, tx.TxOut[0].PkScript, c.Commitment)
+		}
+		if i > 0 && tx.TxIn[0].PreviousOutPoint != *btcwire.NewOutPoint(history[i-1].TxHash, 1) {
+			t.Errorf("Commitment %d does not spend the change of the one before", i)
+		}
+	}
+
+	// Proofs come from the last mined commitment
+	waitFor(t, "the proofs of the last mined commitment", func() bool {
+		srv.mptLock.Lock()
+		defer srv.mptLock.Unlock()
+		return srv.LastConfirmedCommitMpt != nil &&
+			bytes.Equal(srv.LastConfirmedCommitMpt.Commitment(), history[len(history)-1].Commitment[:])
+	})
+}
+
+func TestCommitBroadcastFails(t *testing.T) {
+	home, err := ioutil.TempDir("", "bverify-full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+	os.MkdirAll(utils.DataDirectory(), 0700)
+
+	// The wallet has nothing to pay a commitment with yet
+	chain := wallet.NewSimChain(&chaincfg.RegressionNetParams)
+	srv, err := NewServer("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Full = true
+	srv.wallet, err = wallet.NewWallet(&chaincfg.RegressionNetParams, chain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.wallet.PollInterval = 10 * time.Millisecond
+	srv.commitmentDb, err = buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.commitmentDb.Close()
+	srv.wallet.Start()
+	defer srv.wallet.Stop()
+
+	logID := [32]byte{0x01}
+	srv.RegisterLogStatement(logID, 0, []byte("first"))
+	err = srv.Commit()
+	if err == nil {
+		t.Fatal("Expected the commitment to fail without balance")
+	}
+	srv.mptLock.Lock()
+	_, committed := srv.logCommitments[logID]
+	lastCommitment := srv.lastCommitment
+	srv.mptLock.Unlock()
+	if committed {
+		t.Fatal("Log recorded as committed although nothing was broadcast")
+	}
+	if lastCommitment != [32]byte{} {
+		t.Fatalf("Last commitment is %x after the failed commitment", lastCommitment)
+	}
+
+	// Once funded, the same state is committed
+	var pkh [20]byte
+	copy(pkh[:], btcutil.Hash160(srv.wallet.PubKey()))
+	chain.Fund(utils.DirectWPKHScriptFromPKH(pkh), 100000000)
+	chain.Mine()
+	waitFor(t, "the wallet to be funded", func() bool {
+		return srv.wallet.Balance() > 0
+	})
+	err = srv.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain.Mempool()) != 1 {
+		t.Fatalf("Expected the commitment in the mempool, got %d transactions", len(chain.Mempool()))
+	}
+	srv.mptLock.Lock()
+	lc, committed := srv.logCommitments[logID]
+	_, uncommitted := srv.uncommittedLogs[logID]
+	lastCommitment = srv.lastCommitment
+	srv.mptLock.Unlock()
+	if !committed || uncommitted {
+		t.Fatal("Log not recorded as committed")
+	}
+	if lc.index != 0 || lc.commitment != lastCommitment {
+		t.Fatalf("Log recorded as committed at index %d in %x, expected index 0 in %x", lc.index, lc.commitment, lastCommitment)
+	}
+}
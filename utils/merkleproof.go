@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
 )
@@ -46,20 +47,27 @@ func NewMerkleProof(merkleTree []*chainhash.Hash, idx uint64) MerkleProof {
 	return proof
 }
 
+// MaxMerkleProofHashes is the maximum number of hashes in a merkle proof,
+// which is more than enough for the transaction tree of any block
+const MaxMerkleProofHashes = 32
+
 // NewMerkleProofFromBytes will deserialize a merkle proof from a byte slice
-func NewMerkleProofFromBytes(b []byte) MerkleProof {
+func NewMerkleProofFromBytes(b []byte) (MerkleProof, error) {
 	m := MerkleProof{}
+	if len(b) < 8 || (len(b)-8)%32 != 0 {
+		return m, fmt.Errorf("Unexpected length of merkle proof: %d", len(b))
+	}
+	if (len(b)-8)/32 > MaxMerkleProofHashes {
+		return m, fmt.Errorf("Merkle proof has too many hashes: %d", (len(b)-8)/32)
+	}
 	buf := bytes.NewBuffer(b)
-	binary.Read(buf, binary.BigEndian, &m.Position)
-	m.Hashes = make([]*chainhash.Hash, 0)
-	for {
-		if buf.Len() < 32 {
-			break
-		}
+	m.Position = binary.BigEndian.Uint64(buf.Next(8))
+	m.Hashes = make([]*chainhash.Hash, 0, buf.Len()/32)
+	for buf.Len() > 0 {
 		hash, _ := chainhash.NewHash(buf.Next(32))
 		m.Hashes = append(m.Hashes, hash)
 	}
-	return m
+	return m, nil
 }
 
 // Check will validate a merkle proof given the hash of the element to prove (hash)
@@ -32,12 +32,27 @@ func TestMerkleProof(t *testing.T) {
 	}
 
 	// Serialize and Deserialize the proof
-	proof = utils.NewMerkleProofFromBytes(proof.Bytes())
+	proof, err := utils.NewMerkleProofFromBytes(proof.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
 	// Verify if the proof still verifies
 	if !proof.Check(txs[1].Hash(), &(b.MsgBlock().Header.MerkleRoot)) {
 		t.Error("De- and reserialized proof does not validate")
 	}
+
+	// Truncated proofs and proofs with too many hashes can't be deserialized
+	b2 := proof.Bytes()
+	_, err = utils.NewMerkleProofFromBytes(b2[:len(b2)-1])
+	if err == nil {
+		t.Error("Expected error deserializing truncated proof, got none")
+	}
+	_, err = utils.NewMerkleProofFromBytes(make([]byte, 8+32*(utils.MaxMerkleProofHashes+1)))
+	if err == nil {
+		t.Error("Expected error deserializing oversized proof, got none")
+	}
 }
 
 // Block100000 defines block 100,000 of the block chain.  It is used to
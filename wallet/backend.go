@@ -0,0 +1,292 @@
+package wallet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/go-bverify/bitcoin/btcjson"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/coinparam"
+	"github.com/mit-dci/go-bverify/bitcoin/rpcclient"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
+	"github.com/mit-dci/go-bverify/client/uspv"
+)
+
+// ChainBackend is what the wallet follows the chain through and gets its
+// transactions mined with
+type ChainBackend interface {
+	GetBestBlockHash() (*chainhash.Hash, error)
+	GetBlockHeader(blockHash *chainhash.Hash) (*wire.BlockHeader, error)
+	GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error)
+	SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error)
+	EstimateSmartFee(confTarget int64, mode *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult, error)
+}
+
+// BlockNotifier is a ChainBackend that tells us when its best chain changes,
+// so we don't have to poll it
+type BlockNotifier interface {
+	// SubscribeBlocks makes the backend send on notify when blocks are
+	// connected or disconnected. It doesn't block when notify is full.
+	SubscribeBlocks(notify chan<- struct{}) error
+}
+
+// BatchBackend is a ChainBackend that fetches many blocks without waiting for
+// each one before asking for the next
+type BatchBackend interface {
+	// GetBlockHashes returns the hashes of up to count blocks of the best
+	// chain, starting at height start. It returns fewer at the tip.
+	GetBlockHashes(start int32, count int) ([]*chainhash.Hash, error)
+
+	// GetBlocks returns the blocks with the given hashes, in order
+	GetBlocks(hashes []*chainhash.Hash) ([]*wire.MsgBlock, error)
+}
+
+// RPCBackend is a ChainBackend talking to the RPC interface of bitcoind or
+// btcd. Over a websocket connection, which btcd supports, it notifies us of
+// blocks.
+type RPCBackend struct {
+	*rpcclient.Client
+
+	websocket  bool
+	notifyLock sync.Mutex
+	notify     []chan<- struct{}
+}
+
+var _ ChainBackend = (*RPCBackend)(nil)
+var _ BlockNotifier = (*RPCBackend)(nil)
+var _ BatchBackend = (*RPCBackend)(nil)
+
+// NewRPCBackend connects to the RPC interface at host over HTTP
+func NewRPCBackend(host, user, pass string) (*RPCBackend, error) {
+	connCfg := &rpcclient.ConnConfig{
+		Host:         host,
+		User:         user,
+		Pass:         pass,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}
+	return newRPCBackend(connCfg)
+}
+
+// NewWebsocketRPCBackend connects to the RPC interface at host over a
+// websocket, with TLS when certs has the server's certificate chain
+func NewWebsocketRPCBackend(host, user, pass string, certs []byte) (*RPCBackend, error) {
+	connCfg := &rpcclient.ConnConfig{
+		Host:         host,
+		Endpoint:     "ws",
+		User:         user,
+		Pass:         pass,
+		Certificates: certs,
+		DisableTLS:   len(certs) == 0,
+	}
+	return newRPCBackend(connCfg)
+}
+
+func newRPCBackend(connCfg *rpcclient.ConnConfig) (*RPCBackend, error) {
+	b := &RPCBackend{websocket: !connCfg.HTTPPostMode}
+
+	var handlers *rpcclient.NotificationHandlers
+	if b.websocket {
+		handlers = &rpcclient.NotificationHandlers{
+			OnBlockConnected: func(hash *chainhash.Hash, height int32, t time.Time) {
+				b.blocksChanged()
+			},
+			OnBlockDisconnected: func(hash *chainhash.Hash, height int32, t time.Time) {
+				b.blocksChanged()
+			},
+		}
+	}
+
+	var err error
+	b.Client, err = rpcclient.New(connCfg, handlers)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SubscribeBlocks asks the node to notify us of blocks. That needs a
+// websocket connection.
+func (b *RPCBackend) SubscribeBlocks(notify chan<- struct{}) error {
+	if !b.websocket {
+		return fmt.Errorf("Block notifications need a websocket connection")
+	}
+	b.notifyLock.Lock()
+	b.notify = append(b.notify, notify)
+	b.notifyLock.Unlock()
+	return b.Client.NotifyBlocks()
+}
+
+func (b *RPCBackend) blocksChanged() {
+	b.notifyLock.Lock()
+	defer b.notifyLock.Unlock()
+	for _, n := range b.notify {
+		select {
+		case n <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// GetBlockHashes sends all requests before it waits for the responses
+func (b *RPCBackend) GetBlockHashes(start int32, count int) ([]*chainhash.Hash, error) {
+	tip, err := b.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+
+	futures := make([]rpcclient.FutureGetBlockHashResult, 0)
+	for height := int64(start); height <= tip && len(futures) < count; height++ {
+		futures = append(futures, b.GetBlockHashAsync(height))
+	}
+	hashes := make([]*chainhash.Hash, len(futures))
+	for i, f := range futures {
+		hashes[i], err = f.Receive()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// GetBlocks sends all requests before it waits for the responses
+func (b *RPCBackend) GetBlocks(hashes []*chainhash.Hash) ([]*wire.MsgBlock, error) {
+	futures := make([]rpcclient.FutureGetBlockResult, len(hashes))
+	for i, hash := range hashes {
+		futures[i] = b.GetBlockAsync(hash)
+	}
+	blocks := make([]*wire.MsgBlock, len(futures))
+	var err error
+	for i, f := range futures {
+		blocks[i], err = f.Receive()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// P2PBackend is a ChainBackend talking to a node over the peer-to-peer
+// protocol. It keeps the headers of the chain in a file, and fetches blocks
+// when the wallet asks for them.
+type P2PBackend struct {
+	spv *uspv.SPVCon
+
+	// We ask for one block at a time, and it arrives in blocks
+	blockLock sync.Mutex
+	blocks    chan *wire.MsgBlock
+
+	notifyLock sync.Mutex
+	notify     []chan<- struct{}
+
+	// How long we wait for a block we asked for
+	BlockTimeout time.Duration
+}
+
+var _ ChainBackend = (*P2PBackend)(nil)
+var _ BlockNotifier = (*P2PBackend)(nil)
+
+// NewP2PBackend connects to the node at remoteNode, or to nodes from the DNS
+// seeds when it's empty, and starts syncing headers into headerFilePath
+func NewP2PBackend(params *coinparam.Params, remoteNode string, headerFilePath string) (*P2PBackend, error) {
+	b := &P2PBackend{
+		spv:          new(uspv.SPVCon),
+		blocks:       make(chan *wire.MsgBlock, 1),
+		BlockTimeout: time.Second * 30,
+	}
+	b.spv.RemoteNode = remoteNode
+	b.spv.OnBlock = func(block *wire.MsgBlock) {
+		select {
+		case b.blocks <- block:
+		default:
+		}
+	}
+	b.spv.OnHeaders = b.blocksChanged
+
+	err := b.spv.StartWithHeaderFile(params, headerFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetBestBlockHash returns the tip of the headers we have. It also asks the
+// node for new headers, which the next call returns.
+func (b *P2PBackend) GetBestBlockHash() (*chainhash.Hash, error) {
+	if b.spv.Synced {
+		err := b.spv.AskForHeaders()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := b.spv.GetHeaderAtHeight(b.spv.GetHeaderTipHeight())
+	if err != nil {
+		return nil, err
+	}
+	hash := header.BlockHash()
+	return &hash, nil
+}
+
+// SubscribeBlocks asks the node to announce new blocks with their headers,
+// and notifies us when headers arrive
+func (b *P2PBackend) SubscribeBlocks(notify chan<- struct{}) error {
+	b.notifyLock.Lock()
+	b.notify = append(b.notify, notify)
+	b.notifyLock.Unlock()
+	b.spv.SendHeaders()
+	return nil
+}
+
+func (b *P2PBackend) blocksChanged() {
+	b.notifyLock.Lock()
+	defer b.notifyLock.Unlock()
+	for _, n := range b.notify {
+		select {
+		case n <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *P2PBackend) GetBlockHeader(blockHash *chainhash.Hash) (*wire.BlockHeader, error) {
+	return b.spv.GetHeaderByBlockHash(blockHash)
+}
+
+func (b *P2PBackend) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	b.blockLock.Lock()
+	defer b.blockLock.Unlock()
+
+	err := b.spv.AskForBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(b.BlockTimeout)
+	for {
+		select {
+		case block := <-b.blocks:
+			hash := block.BlockHash()
+			if hash.IsEqual(blockHash) {
+				return block, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("Node did not send block %s", blockHash.String())
+		}
+	}
+}
+
+// SendRawTransaction relays tx to the node. The node doesn't tell us whether
+// it accepted it.
+func (b *P2PBackend) SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error) {
+	b.spv.SendTx(tx)
+	txid := tx.TxHash()
+	return &txid, nil
+}
+
+// EstimateSmartFee is not available over the peer-to-peer protocol, so the
+// wallet uses its fallback fee rate
+func (b *P2PBackend) EstimateSmartFee(confTarget int64, mode *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult, error) {
+	return nil, fmt.Errorf("Fee estimation is not available over P2P")
+}
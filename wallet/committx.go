@@ -0,0 +1,424 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/go-bverify/bitcoin/btcjson"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
+	"github.com/mit-dci/go-bverify/logging"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// MINFEE is the least we pay for a commitment transaction
+	MINFEE uint64 = 1000
+
+	// The fee rate in satoshi per vbyte we use when our node can't estimate
+	// one, which is usually the case on regtest
+	fallbackFeeRate uint64 = 5
+)
+
+// pendingCommitment is a commitment transaction we made that is not mined
+// yet. When we bump its fee, tx is the latest version.
+type pendingCommitment struct {
+	tx *wire.MsgTx
+
+	// The fee tx pays, in satoshi
+	fee uint64
+
+	// Our block height when we broadcast this version, or last bumped the
+	// fee of the commitments building on it
+	height int
+}
+
+func (p *pendingCommitment) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, p.fee)
+	binary.Write(&buf, binary.BigEndian, int32(p.height))
+	p.tx.Serialize(&buf)
+	return buf.Bytes()
+}
+
+func pendingCommitmentFromBytes(b []byte) (*pendingCommitment, error) {
+	buf := bytes.NewBuffer(b)
+	p := &pendingCommitment{tx: wire.NewMsgTx(1)}
+	var height int32
+	binary.Read(buf, binary.BigEndian, &p.fee)
+	err := binary.Read(buf, binary.BigEndian, &height)
+	if err != nil {
+		return nil, err
+	}
+	p.height = int(height)
+	err = p.tx.Deserialize(buf)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pendingCommitmentsBytes serializes a list of pending commitments
+func pendingCommitmentsBytes(pending []*pendingCommitment) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(pending)))
+	for _, p := range pending {
+		b := p.Bytes()
+		binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func pendingCommitmentsFromBytes(b []byte) ([]*pendingCommitment, error) {
+	buf := bytes.NewBuffer(b)
+	var count uint32
+	err := binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*pendingCommitment, 0)
+	for i := uint32(0); i < count; i++ {
+		var l uint32
+		err = binary.Read(buf, binary.BigEndian, &l)
+		if err != nil {
+			return nil, err
+		}
+		if int(l) > buf.Len() {
+			return nil, fmt.Errorf("Unexpected length of pending commitment: %d", l)
+		}
+		p, err := pendingCommitmentFromBytes(buf.Next(int(l)))
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, nil
+}
+
+// commitmentTxVSize estimates the virtual size of a commitment transaction
+// spending the given number of P2WPKH inputs
+func commitmentTxVSize(inputs int) uint64 {
+	// Version, locktime, counts and segwit marker, the OP_RETURN with 32
+	// bytes and the P2WPKH change output
+	return 11 + 43 + 31 + 68*uint64(inputs)
+}
+
+// estimateFeeRate asks our node for the fee rate in satoshi per vbyte that
+// gets a transaction mined within FeeConfTarget blocks
+func (w *Wallet) estimateFeeRate() uint64 {
+	res, err := w.chain.EstimateSmartFee(w.FeeConfTarget, &btcjson.EstimateModeConservative)
+	if err != nil {
+		logging.Debugf("Could not estimate fee rate, using %d sat/vbyte: %s", fallbackFeeRate, err.Error())
+		return fallbackFeeRate
+	}
+	if res.FeeRate == nil {
+		logging.Debugf("Node has no fee estimate, using %d sat/vbyte: %v", fallbackFeeRate, res.Errors)
+		return fallbackFeeRate
+	}
+
+	// The node returns BTC per 1000 vbytes
+	rate := uint64(*res.FeeRate * 1e5)
+	if rate < 1 {
+		rate = 1
+	}
+	if rate > w.MaxFeeRate {
+		rate = w.MaxFeeRate
+	}
+	return rate
+}
+
+// commitmentFee returns the fee for a commitment transaction of the given
+// size building on the pending commitments. When they pay less than the fee
+// rate, it pays what they lack so miners mine them together (CPFP).
+func (w *Wallet) commitmentFee(rate, vsize uint64, ancestors []*pendingCommitment) uint64 {
+	fee := rate * vsize
+	for _, p := range ancestors {
+		want := rate * commitmentTxVSize(len(p.tx.TxIn))
+		if p.fee < want {
+			fee += want - p.fee
+		}
+	}
+	if fee < MINFEE {
+		fee = MINFEE
+	}
+	return fee
+}
+
+// PendingCommitments returns the number of commitment transactions we made
+// that are not mined yet
+func (w *Wallet) PendingCommitments() int {
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+	return len(w.pending)
+}
+
+// maintainCommitments rebroadcasts our pending commitment transactions every
+// RebroadcastInterval, in case they were evicted from the mempool. When the
+// oldest was not mined within BumpAfterBlocks blocks, we replace the newest
+// with one paying a higher fee, which pays for all of them.
+func (w *Wallet) maintainCommitments() {
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+
+	if len(w.pending) == 0 {
+		return
+	}
+
+	if w.Height()-w.pending[0].height >= w.BumpAfterBlocks {
+		tip := w.pending[len(w.pending)-1]
+		err := w.bumpFee()
+		if err != nil {
+			logging.Warnf("Could not bump the fee of commitment %s: %s", tip.tx.TxHash().String(), err.Error())
+		}
+		// Wait another BumpAfterBlocks blocks before we bump again
+		w.pending[0].height = w.Height()
+		w.savePending()
+		if err == nil {
+			return
+		}
+	}
+
+	if time.Since(w.rebroadcast) < w.RebroadcastInterval {
+		return
+	}
+	w.rebroadcast = time.Now()
+	for _, p := range w.pending {
+		_, err := w.chain.SendRawTransaction(p.tx, false)
+		if err != nil {
+			// Usually because the node still has it
+			logging.Debugf("Rebroadcast of commitment %s: %s", p.tx.TxHash().String(), err.Error())
+		}
+	}
+}
+
+// bumpFee replaces the newest pending commitment transaction with one paying
+// a higher fee (BIP 125). We can't replace the older ones, since the newer
+// ones spend their change. The replacement spends the same inputs, so it still
+// continues the chain of commitments, and has the same OP_RETURN. The higher
+// fee comes out of the change. The caller holds commitLock.
+func (w *Wallet) bumpFee() error {
+	tip := w.pending[len(w.pending)-1]
+	vsize := commitmentTxVSize(len(tip.tx.TxIn))
+	fee := w.commitmentFee(w.estimateFeeRate(), vsize, w.pending[:len(w.pending)-1])
+
+	// A replacement has to pay for its own relay on top of the fee of the
+	// transaction it replaces, and we increase by at least a quarter to not
+	// have to do this too often
+	oldFee := tip.fee
+	if fee < oldFee+oldFee/4 {
+		fee = oldFee + oldFee/4
+	}
+	if fee < oldFee+vsize {
+		fee = oldFee + vsize
+	}
+	maxFee := w.MaxFeeRate * vsize
+	if oldFee+vsize > maxFee {
+		return fmt.Errorf("Commitment pays %d, a replacement can't pay enough more within the maximum fee of %d", oldFee, maxFee)
+	}
+	if fee > maxFee {
+		fee = maxFee
+	}
+
+	tx := tip.tx.Copy()
+	extra := fee - oldFee
+	if len(tx.TxOut) < 2 || uint64(tx.TxOut[1].Value) < extra+MINOUTPUT {
+		return fmt.Errorf("Not enough change to pay %d more fee", extra)
+	}
+	tx.TxOut[1].Value -= int64(extra)
+	for _, in := range tx.TxIn {
+		in.Witness = nil
+	}
+	err := w.SignMyInputs(tx)
+	if err != nil {
+		return err
+	}
+
+	txid, err := w.chain.SendRawTransaction(tx, false)
+	if err != nil {
+		return err
+	}
+	logging.Infof("Replaced commitment %s with %s, paying %d instead of %d satoshi fee", tip.tx.TxHash().String(), txid.String(), fee, oldFee)
+
+	oldTxid := tip.tx.TxHash()
+	err = w.addCommitmentVersion(txid, &oldTxid)
+	if err != nil {
+		return err
+	}
+	w.pending[len(w.pending)-1] = &pendingCommitment{tx: tx, fee: fee, height: w.Height()}
+	w.setLastCommitment(txid)
+	return nil
+}
+
+// SameCommitment returns true when both transactions are versions of the same
+// commitment transaction, because we replaced one with the other to bump its
+// fee. Any of the versions can end up mined.
+func (w *Wallet) SameCommitment(a, b *chainhash.Hash) bool {
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+	return w.commitmentRoot(a).IsEqual(w.commitmentRoot(b))
+}
+
+// commitmentRoot returns the first version of a commitment transaction. The
+// caller holds commitLock.
+func (w *Wallet) commitmentRoot(txid *chainhash.Hash) *chainhash.Hash {
+	root, ok := w.commitVersions[*txid]
+	if !ok {
+		return txid
+	}
+	return &root
+}
+
+// addCommitmentVersion remembers txid is a new version of the commitment
+// transaction prev. The caller holds commitLock.
+func (w *Wallet) addCommitmentVersion(txid, prev *chainhash.Hash) error {
+	root := *w.commitmentRoot(prev)
+	w.commitVersions[*txid] = root
+	return w.db.Update(func(dtx *buntdb.Tx) error {
+		key := fmt.Sprintf("commitversion-%s", txid.String())
+		_, _, err := dtx.Set(key, string(root[:]), nil)
+		return err
+	})
+}
+
+// minedCommitment checks if a transaction in a block we connect is a version
+// of one of our pending commitments. If so, it is no longer pending and we
+// return what we tracked about it, for the undo data of the block. When an
+// older version than the one we replaced it with was mined, the commitments
+// building on the replacement can never be mined, so we stop tracking them
+// too and return them along with it. When nothing is left pending, the
+// version that was mined is what the next commitment spends. The caller holds
+// commitLock.
+func (w *Wallet) minedCommitment(tx *wire.MsgTx) []*pendingCommitment {
+	txid := tx.TxHash()
+	for i, p := range w.pending {
+		pendingTxid := p.tx.TxHash()
+		if !w.commitmentRoot(&txid).IsEqual(w.commitmentRoot(&pendingTxid)) {
+			continue
+		}
+
+		logging.Debugf("Commitment %s was mined", txid.String())
+		gone := []*pendingCommitment{p}
+		rest := append(w.pending[:i:i], w.pending[i+1:]...)
+		w.pending = rest[:0]
+		dead := map[chainhash.Hash]bool{}
+		if txid != pendingTxid {
+			dead[pendingTxid] = true
+		}
+		for _, later := range rest {
+			if spendsAny(later.tx, dead) {
+				laterTxid := later.tx.TxHash()
+				logging.Warnf("Commitment %s built on %s, which was replaced by the mined %s", laterTxid.String(), pendingTxid.String(), txid.String())
+				dead[laterTxid] = true
+				gone = append(gone, later)
+				continue
+			}
+			w.pending = append(w.pending, later)
+		}
+
+		if len(w.pending) == 0 {
+			w.setLastCommitment(&txid)
+		} else if len(gone) > 1 {
+			tip := w.pending[len(w.pending)-1].tx.TxHash()
+			w.setLastCommitment(&tip)
+		}
+		w.savePending()
+		return gone
+	}
+	return nil
+}
+
+// spendsAny returns true if tx spends an output of one of the transactions
+func spendsAny(tx *wire.MsgTx, txids map[chainhash.Hash]bool) bool {
+	for _, in := range tx.TxIn {
+		if txids[in.PreviousOutPoint.Hash] {
+			return true
+		}
+	}
+	return false
+}
+
+// restorePending makes the commitments that were mined in a block we
+// disconnect pending again. They come before the ones still pending. The
+// caller holds commitLock.
+func (w *Wallet) restorePending(b []byte) error {
+	restored, err := pendingCommitmentsFromBytes(b)
+	if err != nil {
+		return err
+	}
+	for _, p := range restored {
+		logging.Debugf("Commitment %s is pending again", p.tx.TxHash().String())
+	}
+	w.pending = append(restored, w.pending...)
+	if len(w.pending) > 0 {
+		txid := w.pending[len(w.pending)-1].tx.TxHash()
+		w.setLastCommitment(&txid)
+	}
+	w.savePending()
+	return nil
+}
+
+// spendableOutputs returns our confirmed outputs that none of our pending
+// commitments spend, and the change of the newest pending commitment, which
+// the next commitment spends to continue the chain. The caller holds
+// commitLock.
+func (w *Wallet) spendableOutputs() []Utxo {
+	spent := map[wire.OutPoint]bool{}
+	for _, p := range w.pending {
+		for _, in := range p.tx.TxIn {
+			spent[in.PreviousOutPoint] = true
+		}
+	}
+
+	utxos := make([]Utxo, 0)
+	for _, u := range w.utxos {
+		if !spent[wire.OutPoint{Hash: u.TxHash, Index: u.Outpoint}] {
+			utxos = append(utxos, u)
+		}
+	}
+	if len(w.pending) > 0 {
+		if change, ok := w.pendingOutput(w.pending[len(w.pending)-1].tx.TxHash(), 1); ok {
+			utxos = append(utxos, change)
+		}
+	}
+	return utxos
+}
+
+// pendingOutput returns an output of one of our pending commitments. The
+// caller holds commitLock.
+func (w *Wallet) pendingOutput(txid chainhash.Hash, idx uint32) (Utxo, bool) {
+	for _, p := range w.pending {
+		if p.tx.TxHash() != txid || int(idx) >= len(p.tx.TxOut) {
+			continue
+		}
+		out := p.tx.TxOut[idx]
+		return Utxo{TxHash: txid, Outpoint: idx, Value: uint64(out.Value), PkScript: out.PkScript}, true
+	}
+	return Utxo{}, false
+}
+
+// setLastCommitment sets the transaction the next commitment has to spend the
+// change of. The caller holds commitLock.
+func (w *Wallet) setLastCommitment(txid *chainhash.Hash) {
+	w.lastCommitmentTxId = txid[:]
+	err := w.db.Update(func(dtx *buntdb.Tx) error {
+		_, _, err := dtx.Set("lastcommit-txid", string(txid[:]), nil)
+		return err
+	})
+	if err != nil {
+		logging.Errorf("[Wallet] Error saving lastcommit txid: %s", err.Error())
+	}
+}
+
+// savePending persists the pending commitments. The caller holds commitLock.
+func (w *Wallet) savePending() {
+	err := w.db.Update(func(dtx *buntdb.Tx) error {
+		_, _, err := dtx.Set("lastcommit-pending", string(pendingCommitmentsBytes(w.pending)), nil)
+		return err
+	})
+	if err != nil {
+		logging.Errorf("[Wallet] Error saving pending commitment: %s", err.Error())
+	}
+}
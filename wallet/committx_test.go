@@ -0,0 +1,209 @@
+package wallet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mit-dci/go-bverify/bitcoin/chaincfg"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
+)
+
+// mempoolTx returns the transaction with the given hash from the mempool of
+// chain, or nil if it's not there
+func mempoolTx(chain *SimChain, txid *chainhash.Hash) *wire.MsgTx {
+	for _, tx := range chain.Mempool() {
+		if tx.TxHash() == *txid {
+			return tx
+		}
+	}
+	return nil
+}
+
+// newFundedWallet returns a synced wallet with a single mined output of
+// 1000000 satoshi
+func newFundedWallet(t *testing.T, feeRate float64) (*SimChain, *Wallet) {
+	chain := NewSimChain(&chaincfg.RegressionNetParams)
+	chain.FeeRate = feeRate
+	w := newTestWallet(t, chain)
+	chain.Fund(ourScript(w), 1000000)
+	chain.Mine()
+	syncWallet(t, w)
+	return chain, w
+}
+
+func TestCommitmentFee(t *testing.T) {
+	tests := []struct {
+		title   string
+		feeRate float64
+		fee     int64
+	}{
+		{"Estimate", 0.0002, 20 * 153},
+		{"No estimate", 0, int64(MINFEE)},
+		{"Capped", 1, 500 * 153},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			chain, w := newFundedWallet(t, tt.feeRate)
+			txid, _, err := w.Commit(make([]byte, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx := mempoolTx(chain, txid)
+			if tx == nil {
+				t.Fatal("Commitment not in the mempool")
+			}
+			fee := 1000000 - tx.TxOut[1].Value
+			if fee != tt.fee {
+				t.Fatalf("Expected a fee of %d, got %d", tt.fee, fee)
+			}
+		})
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	chain, w := newFundedWallet(t, 0.0002)
+	commitment := bytes.Repeat([]byte{0xAB}, 32)
+	txid, _, err := w.Commit(commitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mempoolTx(chain, txid)
+
+	// Not bumped before BumpAfterBlocks blocks passed
+	for i := 0; i < w.BumpAfterBlocks; i++ {
+		if mempoolTx(chain, txid) == nil {
+			t.Fatalf("Commitment replaced after %d blocks", i)
+		}
+		chain.MineEmpty()
+		syncWallet(t, w)
+	}
+
+	mempool := chain.Mempool()
+	if len(mempool) != 1 {
+		t.Fatalf("Expected only the replacement in the mempool, got %d transactions", len(mempool))
+	}
+	replacement := mempool[0]
+	newTxid := replacement.TxHash()
+	if newTxid.IsEqual(txid) {
+		t.Fatal("Commitment was not replaced")
+	}
+	if !bytes.Equal(replacement.TxOut[0].PkScript, old.TxOut[0].PkScript) {
+		t.Fatal("Replacement commits to something else")
+	}
+	if len(replacement.TxIn) != len(old.TxIn) {
+		t.Fatalf("Replacement spends %d inputs instead of %d", len(replacement.TxIn), len(old.TxIn))
+	}
+	for i := range old.TxIn {
+		if replacement.TxIn[i].PreviousOutPoint != old.TxIn[i].PreviousOutPoint {
+			t.Fatalf("Replacement spends %s instead of %s", replacement.TxIn[i].PreviousOutPoint.String(), old.TxIn[i].PreviousOutPoint.String())
+		}
+	}
+	// A quarter more than the 3060 satoshi it paid
+	fee := 1000000 - replacement.TxOut[1].Value
+	if fee != 3825 {
+		t.Fatalf("Expected the replacement to pay 3825 satoshi, got %d", fee)
+	}
+	if !w.SameCommitment(txid, &newTxid) {
+		t.Fatal("Replacement is not a version of the same commitment")
+	}
+	lastTxid, _ := chainhash.NewHash(w.lastCommitmentTxId)
+	if !lastTxid.IsEqual(&newTxid) {
+		t.Fatal("Next commitment would not build on the replacement")
+	}
+
+	chain.Mine()
+	syncWallet(t, w)
+	if w.PendingCommitments() != 0 {
+		t.Fatalf("Expected the replacement to be mined, %d pending", w.PendingCommitments())
+	}
+}
+
+func TestBumpFeeAtMaximum(t *testing.T) {
+	tests := []struct {
+		title      string
+		feeRate    float64
+		maxFeeRate uint64
+	}{
+		// Paying the maximum fee already
+		{"At maximum", 1, 500},
+		// Pays the minimum fee of 1000, and the maximum of 7 * 153 leaves
+		// less than the 153 satoshi a replacement has to pay more
+		{"Below maximum", 0, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			chain, w := newFundedWallet(t, tt.feeRate)
+			txid, _, err := w.Commit(make([]byte, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.MaxFeeRate = tt.maxFeeRate
+			for i := 0; i < w.BumpAfterBlocks; i++ {
+				chain.MineEmpty()
+				syncWallet(t, w)
+			}
+
+			mempool := chain.Mempool()
+			if len(mempool) != 1 || mempool[0].TxHash() != *txid {
+				t.Fatal("Expected the commitment not to be replaced")
+			}
+			if w.PendingCommitments() != 1 {
+				t.Fatalf("Expected the commitment to stay pending, %d pending", w.PendingCommitments())
+			}
+		})
+	}
+}
+
+func TestMinedReplacedCommitment(t *testing.T) {
+	chain, w := newFundedWallet(t, 0.0002)
+	txid, _, err := w.Commit(bytes.Repeat([]byte{0xAB}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := mempoolTx(chain, txid)
+	for i := 0; i < w.BumpAfterBlocks; i++ {
+		chain.MineEmpty()
+		syncWallet(t, w)
+	}
+	replacement := chain.Mempool()[0].TxHash()
+	if replacement.IsEqual(txid) {
+		t.Fatal("Commitment was not replaced")
+	}
+
+	// The next commitment builds on the replacement
+	childTxid, _, err := w.Commit(bytes.Repeat([]byte{0xCD}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := mempoolTx(chain, childTxid)
+	if child.TxIn[0].PreviousOutPoint != *wire.NewOutPoint(&replacement, 1) {
+		t.Fatal("Commitment does not build on the replacement")
+	}
+
+	// The original version is mined after all, which the child can't build on
+	_, err = chain.SendRawTransaction(original, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine()
+	syncWallet(t, w)
+	if w.PendingCommitments() != 0 {
+		t.Fatalf("Expected nothing pending after the original was mined, %d pending", w.PendingCommitments())
+	}
+	lastTxid, _ := chainhash.NewHash(w.lastCommitmentTxId)
+	if !lastTxid.IsEqual(txid) {
+		t.Fatalf("Next commitment would build on %s instead of the mined %s", lastTxid.String(), txid.String())
+	}
+
+	nextTxid, _, err := w.Commit(bytes.Repeat([]byte{0xEF}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := mempoolTx(chain, nextTxid)
+	if next.TxIn[0].PreviousOutPoint != *wire.NewOutPoint(txid, 1) {
+		t.Fatalf("Commitment spends %s instead of the change of the mined version", next.TxIn[0].PreviousOutPoint.String())
+	}
+}
@@ -0,0 +1,265 @@
+package wallet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/go-bverify/bitcoin/blockchain"
+	"github.com/mit-dci/go-bverify/bitcoin/btcjson"
+	"github.com/mit-dci/go-bverify/bitcoin/btcutil"
+	"github.com/mit-dci/go-bverify/bitcoin/chaincfg"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
+)
+
+// SimChain is an in-memory chain for tests. Transactions sent to it wait in
+// its mempool until Mine puts them in a block. It does not check scripts or
+// proof of work.
+type SimChain struct {
+	lock    sync.Mutex
+	params  *chaincfg.Params
+	chain   []*wire.MsgBlock
+	blocks  map[chainhash.Hash]*wire.MsgBlock
+	mempool []*wire.MsgTx
+	notify  []chan<- struct{}
+
+	// The fee rate in BTC per 1000 vbytes EstimateSmartFee returns. When
+	// zero, there is no estimate.
+	FeeRate float64
+}
+
+var _ ChainBackend = (*SimChain)(nil)
+var _ BlockNotifier = (*SimChain)(nil)
+var _ BatchBackend = (*SimChain)(nil)
+
+// NewSimChain returns a chain with only the genesis block of params
+func NewSimChain(params *chaincfg.Params) *SimChain {
+	c := &SimChain{params: params, blocks: map[chainhash.Hash]*wire.MsgBlock{}}
+	c.chain = []*wire.MsgBlock{params.GenesisBlock}
+	c.blocks[*params.GenesisHash] = params.GenesisBlock
+	return c
+}
+
+// Height returns the height of the tip
+func (c *SimChain) Height() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.chain) - 1
+}
+
+// Mempool returns the transactions that are not mined yet
+func (c *SimChain) Mempool() []*wire.MsgTx {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	txs := make([]*wire.MsgTx, len(c.mempool))
+	copy(txs, c.mempool)
+	return txs
+}
+
+// Fund adds a transaction paying value to pkScript to the mempool
+func (c *SimChain) Fund(pkScript []byte, value int64) *wire.MsgTx {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Spend an output that doesn't exist, which makes the transaction unique
+	tx := wire.NewMsgTx(1)
+	prev := chainhash.DoubleHashH([]byte(fmt.Sprintf("fund-%d-%d", len(c.chain), len(c.mempool))))
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(value, pkScript))
+	c.mempool = append(c.mempool, tx)
+	return tx
+}
+
+// Mine puts all transactions in the mempool in a new block on top of the tip
+func (c *SimChain) Mine() *chainhash.Hash {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	txs := c.mempool
+	c.mempool = nil
+	return c.mine(len(c.chain)-1, txs)
+}
+
+// MineEmpty adds a block without the transactions in the mempool, as if
+// they pay too little fee
+func (c *SimChain) MineEmpty() *chainhash.Hash {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.mine(len(c.chain)-1, nil)
+}
+
+// Reorg replaces the top depth blocks with depth+1 new blocks. The
+// transactions of the replaced blocks return to the mempool, and the last of
+// the new blocks mines them again when mineAgain is set.
+func (c *SimChain) Reorg(depth int, mineAgain bool) *chainhash.Hash {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	orphaned := make([]*wire.MsgTx, 0)
+	for _, block := range c.chain[len(c.chain)-depth:] {
+		orphaned = append(orphaned, block.Transactions[1:]...)
+	}
+	c.mempool = append(orphaned, c.mempool...)
+
+	fork := len(c.chain) - depth - 1
+	var hash *chainhash.Hash
+	for i := 0; i <= depth; i++ {
+		var txs []*wire.MsgTx
+		if i == depth && mineAgain {
+			txs = c.mempool
+			c.mempool = nil
+		}
+		hash = c.mine(fork+i, txs)
+	}
+	return hash
+}
+
+// mine adds a block with txs on top of the block at height and makes it the
+// tip. The caller holds lock.
+func (c *SimChain) mine(height int, txs []*wire.MsgTx) *chainhash.Hash {
+	prev := c.chain[height]
+
+	// The height in the coinbase makes each block unique
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		[]byte(fmt.Sprintf("sim-%d-%d", height+1, len(c.blocks))), nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{0x51}))
+
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   4,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Header.Timestamp.Add(time.Minute * 10),
+		Bits:      c.params.PowLimitBits,
+	})
+	block.AddTransaction(coinbase)
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
+
+	utxs := make([]*btcutil.Tx, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		utxs[i] = btcutil.NewTx(tx)
+	}
+	merkles := blockchain.BuildMerkleTreeStore(utxs, false)
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+
+	hash := block.BlockHash()
+	c.blocks[hash] = block
+	c.chain = append(c.chain[:height+1], block)
+	for _, n := range c.notify {
+		select {
+		case n <- struct{}{}:
+		default:
+		}
+	}
+	return &hash
+}
+
+// SubscribeBlocks makes us send on notify when we mine a block
+func (c *SimChain) SubscribeBlocks(notify chan<- struct{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.notify = append(c.notify, notify)
+	return nil
+}
+
+func (c *SimChain) GetBestBlockHash() (*chainhash.Hash, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	hash := c.chain[len(c.chain)-1].BlockHash()
+	return &hash, nil
+}
+
+func (c *SimChain) GetBlockHeader(blockHash *chainhash.Hash) (*wire.BlockHeader, error) {
+	block, err := c.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	header := block.Header
+	return &header, nil
+}
+
+func (c *SimChain) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	block, ok := c.blocks[*blockHash]
+	if !ok {
+		return nil, fmt.Errorf("Block %s not found", blockHash.String())
+	}
+	return block, nil
+}
+
+func (c *SimChain) GetBlockHashes(start int32, count int) ([]*chainhash.Hash, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	hashes := make([]*chainhash.Hash, 0)
+	for height := int(start); height < len(c.chain) && len(hashes) < count; height++ {
+		hash := c.chain[height].BlockHash()
+		hashes = append(hashes, &hash)
+	}
+	return hashes, nil
+}
+
+func (c *SimChain) GetBlocks(hashes []*chainhash.Hash) ([]*wire.MsgBlock, error) {
+	blocks := make([]*wire.MsgBlock, len(hashes))
+	for i, hash := range hashes {
+		block, err := c.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = block
+	}
+	return blocks, nil
+}
+
+// SendRawTransaction adds tx to the mempool. Transactions in the mempool
+// spending the same outputs are replaced, together with the ones spending
+// their outputs.
+func (c *SimChain) SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	txid := tx.TxHash()
+	for _, mtx := range c.mempool {
+		if mtx.TxHash() == txid {
+			return nil, fmt.Errorf("Transaction %s already in mempool", txid.String())
+		}
+	}
+
+	conflicts := map[chainhash.Hash]bool{}
+	spends := map[wire.OutPoint]bool{}
+	for _, in := range tx.TxIn {
+		spends[in.PreviousOutPoint] = true
+	}
+	mempool := make([]*wire.MsgTx, 0, len(c.mempool)+1)
+	for _, mtx := range c.mempool {
+		conflict := false
+		for _, in := range mtx.TxIn {
+			if spends[in.PreviousOutPoint] || conflicts[in.PreviousOutPoint.Hash] {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			conflicts[mtx.TxHash()] = true
+			continue
+		}
+		mempool = append(mempool, mtx)
+	}
+	c.mempool = append(mempool, tx)
+	return &txid, nil
+}
+
+func (c *SimChain) EstimateSmartFee(confTarget int64, mode *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res := &btcjson.EstimateSmartFeeResult{Blocks: confTarget}
+	if c.FeeRate > 0 {
+		rate := c.FeeRate
+		res.FeeRate = &rate
+	} else {
+		res.Errors = []string{"Insufficient data or no feerate found"}
+	}
+	return res, nil
+}
@@ -3,8 +3,10 @@ package wallet
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
 )
 
 type Utxo struct {
@@ -46,3 +48,91 @@ func (activeChain ChainIndex) FindBlock(hash *chainhash.Hash) int {
 
 	return -1
 }
+
+// BlockEvent tells a block listener that a block was connected to our chain,
+// or disconnected from it in a reorg. Disconnects come in from the tip down,
+// before the blocks of the new chain are connected.
+type BlockEvent struct {
+	Hash         chainhash.Hash
+	Block        *wire.MsgBlock
+	Disconnected bool
+}
+
+// BlockUndo is what we need to disconnect a block from our chain: the outputs
+// to us it created, and our outputs it spent. When the block mined our pending
+// commitment transactions, Pending has what we tracked about them.
+type BlockUndo struct {
+	Created []wire.OutPoint
+	Spent   []Utxo
+	Pending []byte
+}
+
+func (u BlockUndo) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(u.Created)))
+	for _, op := range u.Created {
+		buf.Write(op.Hash[:])
+		binary.Write(&buf, binary.BigEndian, op.Index)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(u.Spent)))
+	for _, utxo := range u.Spent {
+		b := utxo.Bytes()
+		binary.Write(&buf, binary.BigEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(u.Pending)))
+	buf.Write(u.Pending)
+	return buf.Bytes()
+}
+
+func BlockUndoFromBytes(b []byte) (BlockUndo, error) {
+	buf := bytes.NewBuffer(b)
+	u := BlockUndo{}
+
+	var count uint32
+	err := binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return u, err
+	}
+	if uint64(count)*36 > uint64(buf.Len()) {
+		return u, fmt.Errorf("Undo data has %d created outputs, but only %d bytes", count, buf.Len())
+	}
+	u.Created = make([]wire.OutPoint, count)
+	for i := range u.Created {
+		copy(u.Created[i].Hash[:], buf.Next(32))
+		binary.Read(buf, binary.BigEndian, &u.Created[i].Index)
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return u, err
+	}
+	u.Spent = make([]Utxo, 0)
+	for i := uint32(0); i < count; i++ {
+		var l uint32
+		err = binary.Read(buf, binary.BigEndian, &l)
+		if err != nil {
+			return u, err
+		}
+		if l < 44 || int(l) > buf.Len() {
+			return u, fmt.Errorf("Unexpected length of spent output in undo data: %d", l)
+		}
+		u.Spent = append(u.Spent, UtxoFromBytes(buf.Next(int(l))))
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return u, err
+	}
+	if int(count) > buf.Len() {
+		return u, fmt.Errorf("Unexpected length of pending commitments in undo data: %d", count)
+	}
+	if count > 0 {
+		u.Pending = make([]byte, count)
+		copy(u.Pending, buf.Next(int(count)))
+	}
+	if buf.Len() > 0 {
+		return u, fmt.Errorf("Undo data has %d trailing bytes", buf.Len())
+	}
+	return u, nil
+}
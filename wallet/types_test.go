@@ -0,0 +1,45 @@
+package wallet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
+)
+
+func TestBlockUndoBytes(t *testing.T) {
+	undo := BlockUndo{
+		Created: []wire.OutPoint{
+			{Hash: chainhash.DoubleHashH([]byte("created 1")), Index: 1},
+			{Hash: chainhash.DoubleHashH([]byte("created 2")), Index: 0},
+		},
+		Spent: []Utxo{
+			{TxHash: chainhash.DoubleHashH([]byte("spent 1")), Outpoint: 1, Value: 100000, PkScript: []byte{0x00, 0x14, 0x01}},
+			{TxHash: chainhash.DoubleHashH([]byte("spent 2")), Outpoint: 3, Value: 2000, PkScript: []byte{0x00, 0x14, 0x02}},
+		},
+		Pending: []byte{0x01, 0x02, 0x03},
+	}
+
+	b := undo.Bytes()
+	decoded, err := BlockUndoFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(undo, decoded) {
+		t.Fatalf("Decoded undo data %v differs from %v", decoded, undo)
+	}
+
+	// Every truncation of the record has to be rejected
+	for n := 0; n < len(b); n++ {
+		_, err = BlockUndoFromBytes(b[:n])
+		if err == nil {
+			t.Fatalf("Expected undo data truncated to %d of %d bytes to be rejected", n, len(b))
+		}
+	}
+
+	_, err = BlockUndoFromBytes(append(b, 0x00))
+	if err == nil {
+		t.Fatal("Expected undo data with trailing bytes to be rejected")
+	}
+}
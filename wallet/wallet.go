@@ -7,13 +7,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mit-dci/go-bverify/bitcoin/bech32"
 	"github.com/mit-dci/go-bverify/bitcoin/btcutil"
 	"github.com/mit-dci/go-bverify/bitcoin/chaincfg"
 	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
-	"github.com/mit-dci/go-bverify/bitcoin/rpcclient"
 	"github.com/mit-dci/go-bverify/bitcoin/txscript"
 	"github.com/mit-dci/go-bverify/bitcoin/wire"
 	"github.com/mit-dci/go-bverify/crypto/btcec"
@@ -31,19 +33,76 @@ type Wallet struct {
 	pubKeyHash         [20]byte
 	utxos              []Utxo
 	db                 *buntdb.DB
-	rpcClient          *rpcclient.Client
+	chain              ChainBackend
 	activeChain        ChainIndex
-	newBlockListeners  []chan *wire.MsgBlock
+	blockListeners     []chan BlockEvent
 	params             *chaincfg.Params
-	synced             bool
+	synced             int32
 	lastCommitmentTxId []byte
+
+	// Our commitment transactions that are not mined yet, oldest first, and
+	// the versions of our commitment transactions we replaced to bump their
+	// fee. commitLock also guards our UTXOs, which BlockLoop changes while
+	// commitments spend them.
+	pending        []*pendingCommitment
+	commitVersions map[chainhash.Hash]chainhash.Hash
+	commitLock     sync.Mutex
+	rebroadcast    time.Time
+
+	// We pay the fee our node estimates for a commitment to be mined within
+	// FeeConfTarget blocks, up to MaxFeeRate satoshi per vbyte. A commitment
+	// that is not mined is broadcast again every RebroadcastInterval, and
+	// its fee is bumped every BumpAfterBlocks blocks. We build up to
+	// MaxPendingCommitments commitments on top of each other before the
+	// first one is mined.
+	FeeConfTarget         int64
+	MaxFeeRate            uint64
+	RebroadcastInterval   time.Duration
+	BumpAfterBlocks       int
+	MaxPendingCommitments int
+
+	// Deposits to us below DustThreshold satoshi are ignored. When the fee
+	// rate is at most ConsolidateFeeRate satoshi per vbyte, a commitment
+	// also spends up to MaxConsolidateInputs of our smallest outputs.
+	DustThreshold        uint64
+	ConsolidateFeeRate   uint64
+	MaxConsolidateInputs int
+
+	// How often we ask the chain backend for a new best block. When the
+	// backend notifies us of blocks, we only ask every NotifiedPollInterval
+	// in case a notification got lost.
+	PollInterval         time.Duration
+	NotifiedPollInterval time.Duration
+
+	// How many blocks we fetch at once when the backend can batch
+	BlockBatchSize int
+
+	// Closed to stop BlockLoop, and closed by Start when it stopped
+	quit     chan bool
+	loopDone chan bool
 }
 
-func NewWallet(params *chaincfg.Params, rescanBlocks int) (*Wallet, error) {
+// NewWallet loads the wallet in our data directory, which follows the chain
+// through backend. It processes blocks once Start is called.
+func NewWallet(params *chaincfg.Params, backend ChainBackend, rescanBlocks int) (*Wallet, error) {
 	var err error
 	w := new(Wallet)
 	w.params = params
+	w.chain = backend
 	w.activeChain = ChainIndex{w.params.GenesisHash}
+	w.commitVersions = map[chainhash.Hash]chainhash.Hash{}
+	w.FeeConfTarget = 6
+	w.MaxFeeRate = 500
+	w.RebroadcastInterval = time.Minute * 10
+	w.BumpAfterBlocks = 3
+	w.MaxPendingCommitments = 3
+	w.DustThreshold = 10000
+	w.ConsolidateFeeRate = 5
+	w.MaxConsolidateInputs = 50
+	w.PollInterval = time.Second * 5
+	w.NotifiedPollInterval = time.Minute
+	w.BlockBatchSize = 100
+	w.quit = make(chan bool)
 	keyFile := path.Join(utils.DataDirectory(), "privkey.hex")
 	key32 := [32]byte{}
 	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
@@ -77,29 +136,39 @@ func NewWallet(params *chaincfg.Params, rescanBlocks int) (*Wallet, error) {
 		w.activeChain = w.activeChain[:len(w.activeChain)-rescanBlocks]
 	}
 
-	w.newBlockListeners = make([]chan *wire.MsgBlock, 0)
+	w.blockListeners = make([]chan BlockEvent, 0)
 	logging.Debugf("Wallet initialized. At height %d - Balance %d - Address is: %s\n", len(w.activeChain), w.Balance(), w.address())
-	w.synced = false
-	go w.BlockLoop()
-
-	// TODO: make this configurable
-	connCfg := &rpcclient.ConnConfig{
-		Host:         utils.GetEnvOrDefault("BITCOINRPC", "localhost:18443"),
-		User:         utils.GetEnvOrDefault("BITCOINRPCUSER", "bverify"),
-		Pass:         utils.GetEnvOrDefault("BITCOINRPCPASSWORD", "bverify"),
-		HTTPPostMode: true,
-		DisableTLS:   true,
-	}
-	w.rpcClient, err = rpcclient.New(connCfg, nil)
-	if err != nil {
-		return nil, err
-	}
 
 	return w, nil
 }
 
-func (w *Wallet) AddNewBlockListener(blockChan chan *wire.MsgBlock) {
-	w.newBlockListeners = append(w.newBlockListeners, blockChan)
+// Start makes the wallet follow the chain
+func (w *Wallet) Start() {
+	w.loopDone = make(chan bool)
+	go func() {
+		w.BlockLoop()
+		close(w.loopDone)
+	}()
+}
+
+// Stop stops following the chain and closes the wallet's database
+func (w *Wallet) Stop() {
+	close(w.quit)
+	if w.loopDone != nil {
+		<-w.loopDone
+	}
+	w.db.Close()
+}
+
+// AddBlockListener makes the wallet tell blockChan about blocks connected to
+// and disconnected from its chain, in the order it processes them
+func (w *Wallet) AddBlockListener(blockChan chan BlockEvent) {
+	w.blockListeners = append(w.blockListeners, blockChan)
+}
+
+// PubKey returns the compressed public key the wallet commits with
+func (w *Wallet) PubKey() []byte {
+	return w.pubKey.SerializeCompressed()
 }
 
 func (w *Wallet) address() string {
@@ -114,6 +183,24 @@ func (w *Wallet) loadStuff() error {
 			return true
 		})
 
+		tx.AscendRange("", "commitversion-", "commitversion.", func(key, value string) bool {
+			txid, err := chainhash.NewHashFromStr(key[14:])
+			if err == nil {
+				root := chainhash.Hash{}
+				copy(root[:], value)
+				w.commitVersions[*txid] = root
+			}
+			return true
+		})
+
+		pending, err := tx.Get("lastcommit-pending")
+		if err == nil {
+			w.pending, err = pendingCommitmentsFromBytes([]byte(pending))
+			if err != nil {
+				logging.Errorf("[Wallet] Could not read pending commitments: %s", err.Error())
+			}
+		}
+
 		txidString, err := tx.Get("lastcommit-txid", false)
 		if err != nil {
 			return err
@@ -128,125 +215,302 @@ func (w *Wallet) HeightOfBlock(blockHash chainhash.Hash) int {
 	return w.activeChain.FindBlock(&blockHash)
 }
 
+// BlockLoop follows the best chain of our chain backend until Stop is called.
+// When the backend notifies us of blocks we sync as soon as one arrives,
+// otherwise we poll it every PollInterval.
 func (w *Wallet) BlockLoop() {
-	for {
-		time.Sleep(time.Second * 5)
-		w.synced = false
-		bestHash, err := w.rpcClient.GetBestBlockHash()
+	interval := w.PollInterval
+	blocks := make(chan struct{}, 1)
+	if notifier, ok := w.chain.(BlockNotifier); ok {
+		err := notifier.SubscribeBlocks(blocks)
 		if err != nil {
-			logging.Errorf("Error getting best blockhash: %s\n", err.Error())
-			continue
+			logging.Warnf("Chain backend can't notify us of blocks, polling instead: %s", err.Error())
+		} else {
+			interval = w.NotifiedPollInterval
 		}
+	}
 
-		if bestHash.IsEqual(w.activeChain[len(w.activeChain)-1]) {
-			w.synced = true
-			continue
+	for {
+		w.syncChain()
+		select {
+		case <-w.quit:
+			return
+		case <-blocks:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// syncChain brings our active chain to the best chain of the backend
+func (w *Wallet) syncChain() {
+	atomic.StoreInt32(&w.synced, 0)
+
+	// When the backend can batch, we fetch the blocks after our tip by
+	// height instead of walking back their headers one by one. That only
+	// fails on a reorg, where we find the fork point below.
+	if bb, ok := w.chain.(BatchBackend); ok {
+		synced, err := w.syncBatched(bb)
+		if err != nil {
+			logging.Errorf("Error syncing blocks: %s\n", err.Error())
+			return
+		}
+		if synced {
+			atomic.StoreInt32(&w.synced, 1)
+			w.maintainCommitments()
+			return
 		}
+	}
+
+	bestHash, err := w.chain.GetBestBlockHash()
+	if err != nil {
+		logging.Errorf("Error getting best blockhash: %s\n", err.Error())
+		return
+	}
+
+	if bestHash.IsEqual(w.activeChain[len(w.activeChain)-1]) {
+		atomic.StoreInt32(&w.synced, 1)
+		w.maintainCommitments()
+		return
+	}
+
+	logging.Debugf("Found new best hash, trying to attach to known chain")
+
+	pendingBlockHashes, forkIdx, err := w.findForkPoint(bestHash)
+	if err != nil {
+		logging.Errorf("Error getting block header: %s\n", err.Error())
+		return
+	}
+
+	// Undo the blocks that are no longer in the best chain, from the
+	// tip down, before we connect the blocks of the new chain
+	err = w.disconnectBlocks(forkIdx)
+	if err != nil {
+		logging.Errorf("Error disconnecting blocks: %s\n", err.Error())
+		return
+	}
+
+	err = w.connectBlocks(pendingBlockHashes)
+	if err != nil {
+		logging.Errorf("Error connecting blocks: %s\n", err.Error())
+		return
+	}
+
+	atomic.StoreInt32(&w.synced, 1)
+	w.maintainCommitments()
+}
 
-		logging.Debugf("Found new best hash, trying to attach to known chain")
+// syncBatched connects the blocks the backend has above our tip, a batch at a
+// time. It returns false when the best chain doesn't build on our tip.
+func (w *Wallet) syncBatched(bb BatchBackend) (bool, error) {
+	for {
+		hashes, err := bb.GetBlockHashes(int32(len(w.activeChain)), w.BlockBatchSize)
+		if err != nil {
+			return false, err
+		}
 
-		hash, _ := chainhash.NewHash(bestHash.CloneBytes())
-		pendingBlockHashes := make([]*chainhash.Hash, 0)
-		startIndex := 0
-		for {
-			header, err := w.rpcClient.GetBlockHeader(hash)
+		if len(hashes) == 0 {
+			// The best chain is no longer than ours, so it's ours unless
+			// a reorg replaced our tip
+			bestHash, err := w.chain.GetBestBlockHash()
 			if err != nil {
-				logging.Errorf("Error getting block header: %s\n", err.Error())
-				continue
+				return false, err
 			}
+			return bestHash.IsEqual(w.activeChain[len(w.activeChain)-1]), nil
+		}
 
-			newHash, _ := chainhash.NewHash(hash.CloneBytes())
-			pendingBlockHashes = append([]*chainhash.Hash{newHash}, pendingBlockHashes...)
-			hash = &header.PrevBlock
-			idx := w.activeChain.FindBlock(&header.PrevBlock)
-			if idx > -1 {
-				idx++
-				// We found a way to connect to our activeChain
-				// Remove all blocks after idx, if any
-				newChain := w.activeChain[:idx]
-				newChain = append(newChain, pendingBlockHashes...)
-				w.activeChain = newChain
-				startIndex = idx
-				break
-			}
-			if len(pendingBlockHashes)%1000 == 0 {
-				logging.Debugf("Pending hashes: %d", len(pendingBlockHashes))
-			}
+		blocks, err := bb.GetBlocks(hashes)
+		if err != nil {
+			return false, err
 		}
 
-		for _, hash := range w.activeChain[startIndex:] {
-			block, err := w.rpcClient.GetBlock(hash)
-			if err != nil {
-				logging.Errorf("Error getting block: %s\n", err.Error())
-				continue
+		for i, block := range blocks {
+			// When the best chain changed since we got the hashes, we may
+			// not get the blocks we asked for
+			if block.BlockHash() != *hashes[i] || !block.Header.PrevBlock.IsEqual(w.activeChain[len(w.activeChain)-1]) {
+				w.persistChainState()
+				return false, nil
 			}
 
-			err = w.processBlock(block)
+			err = w.connectBlock(block)
 			if err != nil {
-				logging.Errorf("Error processing block: %s\n", err.Error())
-				continue
+				return false, err
 			}
+			w.activeChain = append(w.activeChain, hashes[i])
 		}
+		w.persistChainState()
+	}
+}
 
-		w.synced = true
+// findForkPoint walks back from hash until it finds a block in our active
+// chain. It returns the hashes of the blocks after that block, and the index
+// in our active chain the first of them goes.
+func (w *Wallet) findForkPoint(hash *chainhash.Hash) ([]*chainhash.Hash, int, error) {
+	hash, _ = chainhash.NewHash(hash.CloneBytes())
+	pendingBlockHashes := make([]*chainhash.Hash, 0)
+	for {
+		header, err := w.chain.GetBlockHeader(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		newHash, _ := chainhash.NewHash(hash.CloneBytes())
+		pendingBlockHashes = append([]*chainhash.Hash{newHash}, pendingBlockHashes...)
+		hash = &header.PrevBlock
+		idx := w.activeChain.FindBlock(&header.PrevBlock)
+		if idx > -1 {
+			// We found a way to connect to our activeChain
+			return pendingBlockHashes, idx + 1, nil
+		}
+		if len(pendingBlockHashes)%1000 == 0 {
+			logging.Debugf("Pending hashes: %d", len(pendingBlockHashes))
+		}
+	}
+}
+
+// disconnectBlocks disconnects all blocks from our active chain from index
+// idx on, starting at the tip
+func (w *Wallet) disconnectBlocks(idx int) error {
+	for len(w.activeChain) > idx {
+		hash := w.activeChain[len(w.activeChain)-1]
+		err := w.disconnectBlock(hash)
+		if err != nil {
+			return err
+		}
+		w.activeChain = w.activeChain[:len(w.activeChain)-1]
 		w.persistChainState()
 	}
+	return nil
+}
+
+// connectBlocks fetches and connects the given blocks to the tip of our
+// active chain, BlockBatchSize at a time
+func (w *Wallet) connectBlocks(hashes []*chainhash.Hash) error {
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > w.BlockBatchSize {
+			n = w.BlockBatchSize
+		}
+
+		blocks, err := w.getBlocks(hashes[:n])
+		if err != nil {
+			return err
+		}
+
+		for i, block := range blocks {
+			err = w.connectBlock(block)
+			if err != nil {
+				return err
+			}
+			w.activeChain = append(w.activeChain, hashes[i])
+		}
+		w.persistChainState()
+		hashes = hashes[n:]
+	}
+	return nil
+}
+
+// getBlocks fetches the given blocks, in one batch when the backend can
+func (w *Wallet) getBlocks(hashes []*chainhash.Hash) ([]*wire.MsgBlock, error) {
+	if bb, ok := w.chain.(BatchBackend); ok {
+		return bb.GetBlocks(hashes)
+	}
+
+	blocks := make([]*wire.MsgBlock, len(hashes))
+	for i, hash := range hashes {
+		block, err := w.chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = block
+	}
+	return blocks, nil
 }
 
 func (w *Wallet) IsSynced() bool {
-	return w.synced
+	return atomic.LoadInt32(&w.synced) == 1
 }
 
-func (w *Wallet) AddInputsAndChange(tx *wire.MsgTx, totalValueNeeded uint64) error {
-	valueAdded := uint64(0)
-	utxosToAdd := []Utxo{}
-	// This may seem weird, but we're adding _all_ inputs always. Why? Because we
-	// want to prevent polluting the UTXO set. If someone donates to our server's
-	// wallet (or we do ourselves), we immediately consolidate the coins in the
-	// next commitment. The OP_RETURN will still be the 0th output, and the previous
-	// commitment should be the first txin to ensure we form a chain.
-	//
-	// So, first find the index of the last commitment's TX output 1
-
-	lastOutputIdx := -1
-	for i, utxo := range w.utxos {
-		if utxo.Outpoint == 1 && bytes.Equal(utxo.TxHash[:], w.lastCommitmentTxId) {
-			lastOutputIdx = i
-			break
+// AddInputsAndChange adds the inputs of a commitment transaction paying the
+// given fee rate to tx, and our change. The first input is the change of our
+// last commitment, which continues the chain of commitments. We add as few of
+// our other outputs as we need to pay the fee, largest first, and when the fee
+// rate is at most ConsolidateFeeRate we also spend up to MaxConsolidateInputs
+// of our smallest outputs, so we don't need to spend them when fees are high.
+// It returns the fee, which includes what our pending commitments lack. The
+// caller holds commitLock.
+func (w *Wallet) AddInputsAndChange(tx *wire.MsgTx, feeRate uint64) (uint64, error) {
+	utxos := w.spendableOutputs()
+
+	// So, first find the last commitment's TX output 1. When the last
+	// commitment is not mined yet, we spend its unconfirmed change.
+	inputs := make([]Utxo, 0)
+	others := make([]Utxo, 0)
+	for _, utxo := range utxos {
+		if utxo.Outpoint == 1 && bytes.Equal(utxo.TxHash[:], w.lastCommitmentTxId) && len(inputs) == 0 {
+			inputs = append(inputs, utxo)
+		} else if utxo.Value >= w.DustThreshold {
+			// Outputs below the dust threshold are not worth spending
+			others = append(others, utxo)
 		}
 	}
 
-	if lastOutputIdx == -1 {
-		logging.Warnf("Did not find last commitment's output in the UTXOs. This is fine when we are a fresh server. Otherwise, there's something wrong")
-	} else {
-		valueAdded += w.utxos[lastOutputIdx].Value
-		utxosToAdd = append(utxosToAdd, w.utxos[lastOutputIdx])
+	if len(inputs) == 0 {
+		// Without it, the commitment would not continue the chain of our
+		// commitments. This happens when the last commitment was reorged
+		// out of the chain and is not mined again yet.
+		if len(w.lastCommitmentTxId) > 0 {
+			return 0, fmt.Errorf("The change of the last commitment is not in our UTXOs")
+		}
+		logging.Warnf("Did not find last commitment's output in the UTXOs. This is fine when we are a fresh server.")
 	}
 
-	for i, utxo := range w.utxos {
-		if i != lastOutputIdx {
-			valueAdded += utxo.Value
-			utxosToAdd = append(utxosToAdd, utxo)
+	if feeRate <= w.ConsolidateFeeRate {
+		sort.Slice(others, func(i, j int) bool { return others[i].Value < others[j].Value })
+		n := len(others)
+		if n > w.MaxConsolidateInputs {
+			n = w.MaxConsolidateInputs
+		}
+		if n > 0 {
+			logging.Debugf("Consolidating %d outputs at %d sat/vbyte", n, feeRate)
 		}
+		inputs = append(inputs, others[:n]...)
+		others = others[n:]
 	}
 
-	if valueAdded < totalValueNeeded {
-		return fmt.Errorf("Insufficient balance")
+	valueAdded := uint64(0)
+	for _, utxo := range inputs {
+		valueAdded += utxo.Value
 	}
 
-	for _, utxo := range utxosToAdd {
-		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{utxo.TxHash, utxo.Outpoint}, nil, nil))
+	// We need a change output to continue the chain
+	sort.Slice(others, func(i, j int) bool { return others[i].Value > others[j].Value })
+	fee := w.commitmentFee(feeRate, commitmentTxVSize(len(inputs)), w.pending)
+	for valueAdded < fee+MINOUTPUT+1 || len(inputs) == 0 {
+		if len(others) == 0 {
+			return 0, fmt.Errorf("Insufficient balance")
+		}
+		inputs = append(inputs, others[0])
+		valueAdded += others[0].Value
+		others = others[1:]
+		fee = w.commitmentFee(feeRate, commitmentTxVSize(len(inputs)), w.pending)
 	}
 
-	// Add change output when there's more than dust left, otherwise give to miners
-	if valueAdded-totalValueNeeded > MINOUTPUT {
-		tx.AddTxOut(wire.NewTxOut(int64(valueAdded-totalValueNeeded), utils.DirectWPKHScriptFromPKH(w.pubKeyHash)))
+	for _, utxo := range inputs {
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{utxo.TxHash, utxo.Outpoint}, nil, nil))
 	}
+	tx.AddTxOut(wire.NewTxOut(int64(valueAdded-fee), utils.DirectWPKHScriptFromPKH(w.pubKeyHash)))
 
-	return nil
+	return fee, nil
 }
 
 func (w *Wallet) Balance() uint64 {
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+	return w.balance()
+}
+
+// balance returns the value of our UTXOs. The caller holds commitLock.
+func (w *Wallet) balance() uint64 {
 	value := uint64(0)
 	for _, u := range w.utxos {
 		value += u.Value
@@ -254,18 +518,98 @@ func (w *Wallet) Balance() uint64 {
 	return value
 }
 
-func (w *Wallet) processBlock(block *wire.MsgBlock) error {
-	for _, nbl := range w.newBlockListeners {
-		nbl <- block
-	}
-
-	balBefore := w.Balance()
+// connectBlock processes the transactions in a block that is connected to the
+// tip of our chain, and stores what we need to disconnect it again
+func (w *Wallet) connectBlock(block *wire.MsgBlock) error {
+	w.commitLock.Lock()
+	balBefore := w.balance()
+	undo := BlockUndo{Created: make([]wire.OutPoint, 0), Spent: make([]Utxo, 0)}
+	mined := make([]*pendingCommitment, 0)
 	for _, tx := range block.Transactions {
-		w.processTransaction(tx)
+		created, spent := w.processTransaction(tx)
+		undo.Created = append(undo.Created, created...)
+		undo.Spent = append(undo.Spent, spent...)
+		mined = append(mined, w.minedCommitment(tx)...)
 	}
-	balAfter := w.Balance()
+	if len(mined) > 0 {
+		undo.Pending = pendingCommitmentsBytes(mined)
+	}
+	balAfter := w.balance()
+	w.commitLock.Unlock()
 	if balAfter != balBefore {
-		logging.Debugf("Our balance is now %d", w.Balance())
+		logging.Debugf("Our balance is now %d", balAfter)
+	}
+
+	blockHash := block.BlockHash()
+	err := w.db.Update(func(dtx *buntdb.Tx) error {
+		key := fmt.Sprintf("undo-%s", blockHash.String())
+		_, _, err := dtx.Set(key, string(undo.Bytes()), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, bl := range w.blockListeners {
+		bl <- BlockEvent{Hash: blockHash, Block: block}
+	}
+	return nil
+}
+
+// disconnectBlock undoes what connecting the block at the tip of our chain
+// did to our UTXOs. Blocks we connected before we kept undo data have none,
+// and are disconnected without changing our UTXOs.
+func (w *Wallet) disconnectBlock(blockHash *chainhash.Hash) error {
+	key := fmt.Sprintf("undo-%s", blockHash.String())
+	var undo BlockUndo
+	err := w.db.View(func(dtx *buntdb.Tx) error {
+		b, err := dtx.Get(key)
+		if err != nil {
+			return err
+		}
+		undo, err = BlockUndoFromBytes([]byte(b))
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		logging.Warnf("No undo data for block %s, our UTXOs may be wrong", blockHash.String())
+	} else if err != nil {
+		return err
+	}
+	logging.Debugf("Disconnecting block %s", blockHash.String())
+
+	// Outputs created and spent in the same block have to end up removed,
+	// so we restore the spent ones first
+	w.commitLock.Lock()
+	for _, utxo := range undo.Spent {
+		w.registerUtxo(utxo)
+	}
+	for _, op := range undo.Created {
+		w.removeUtxo(op)
+	}
+	if len(undo.Pending) > 0 {
+		err = w.restorePending(undo.Pending)
+		if err != nil {
+			w.commitLock.Unlock()
+			return err
+		}
+	}
+	balance := w.balance()
+	w.commitLock.Unlock()
+
+	err = w.db.Update(func(dtx *buntdb.Tx) error {
+		_, err := dtx.Delete(key)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	logging.Debugf("Our balance is now %d", balance)
+	for _, bl := range w.blockListeners {
+		bl <- BlockEvent{Hash: *blockHash, Disconnected: true}
 	}
 	return nil
 }
@@ -274,23 +618,48 @@ func (w *Wallet) Height() int {
 	return len(w.activeChain) - 1
 }
 
-func (w *Wallet) processTransaction(tx *wire.MsgTx) {
+// processTransaction registers the outputs of a transaction that pay to us
+// and removes the outputs it spends. It returns both, so they can be undone.
+// Outputs of other transactions below DustThreshold are ignored, so nobody
+// can make our commitments more expensive by sending us dust. The caller holds
+// commitLock.
+func (w *Wallet) processTransaction(tx *wire.MsgTx) ([]wire.OutPoint, []Utxo) {
+	created := make([]wire.OutPoint, 0)
+	ours := w.spendsOurOutputs(tx)
 	for i, out := range tx.TxOut {
 		keyHash := utils.KeyHashFromPkScript(out.PkScript)
 		if bytes.Equal(keyHash, w.pubKeyHash[:]) {
+			if !ours && uint64(out.Value) < w.DustThreshold {
+				logging.Debugf("Ignoring dust output %s:%d of %d satoshi", tx.TxHash().String(), i, out.Value)
+				continue
+			}
 			w.registerUtxo(Utxo{
 				TxHash:   tx.TxHash(),
 				Outpoint: uint32(i),
 				Value:    uint64(out.Value),
 				PkScript: out.PkScript,
 			})
+			created = append(created, wire.OutPoint{Hash: tx.TxHash(), Index: uint32(i)})
 		}
 	}
 
-	w.markTxInputsAsSpent(tx)
+	return created, w.markTxInputsAsSpent(tx)
+}
+
+// spendsOurOutputs returns true if tx spends any of our outputs, so we made it
+func (w *Wallet) spendsOurOutputs(tx *wire.MsgTx) bool {
+	for _, in := range tx.TxIn {
+		for _, out := range w.utxos {
+			if in.PreviousOutPoint.Hash.IsEqual(&out.TxHash) && in.PreviousOutPoint.Index == out.Outpoint {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (w *Wallet) markTxInputsAsSpent(tx *wire.MsgTx) {
+func (w *Wallet) markTxInputsAsSpent(tx *wire.MsgTx) []Utxo {
+	spent := make([]Utxo, 0)
 	for _, in := range tx.TxIn {
 		removeIndex := -1
 		for j, out := range w.utxos {
@@ -301,13 +670,24 @@ func (w *Wallet) markTxInputsAsSpent(tx *wire.MsgTx) {
 			}
 		}
 		if removeIndex >= 0 {
+			spent = append(spent, w.utxos[removeIndex])
+			w.removeUtxo(in.PreviousOutPoint)
+		}
+	}
+	return spent
+}
+
+// removeUtxo removes an output from our UTXOs, if we have it
+func (w *Wallet) removeUtxo(op wire.OutPoint) {
+	for i, u := range w.utxos {
+		if op.Hash.IsEqual(&u.TxHash) && op.Index == u.Outpoint {
 			w.db.Update(func(dtx *buntdb.Tx) error {
-				key := fmt.Sprintf("utxo-%s-%d", w.utxos[removeIndex].TxHash.String(), w.utxos[removeIndex].Outpoint)
+				key := fmt.Sprintf("utxo-%s-%d", u.TxHash.String(), u.Outpoint)
 				_, err := dtx.Delete(key)
 				return err
 			})
-			w.utxos = append(w.utxos[:removeIndex], w.utxos[removeIndex+1:]...)
-
+			w.utxos = append(w.utxos[:i], w.utxos[i+1:]...)
+			return
 		}
 	}
 }
@@ -368,12 +748,17 @@ func (w *Wallet) readChainState() {
 	w.activeChain = readIndex
 }
 
+// FindUtxoFromTxIn returns our output txi spends, which can be the change of
+// one of our pending commitments. The caller holds commitLock.
 func (w *Wallet) FindUtxoFromTxIn(txi *wire.TxIn) (Utxo, error) {
 	for _, out := range w.utxos {
 		if txi.PreviousOutPoint.Hash.IsEqual(&out.TxHash) && txi.PreviousOutPoint.Index == out.Outpoint {
 			return out, nil
 		}
 	}
+	if out, ok := w.pendingOutput(txi.PreviousOutPoint.Hash, txi.PreviousOutPoint.Index); ok {
+		return out, nil
+	}
 	return Utxo{}, fmt.Errorf("Utxo not found")
 }
 
@@ -408,37 +793,46 @@ func (w *Wallet) SignMyInputs(tx *wire.MsgTx) error {
 	return nil
 }
 
+// Commit creates and broadcasts a transaction committing to commitment. It
+// spends the change of our last commitment, also when that is not mined yet,
+// and pays the fee our node estimates for it and the pending commitments it
+// builds on. BlockLoop rebroadcasts it and bumps its fee until it is mined.
 func (w *Wallet) Commit(commitment []byte) (*chainhash.Hash, []byte, error) {
-	tx := wire.NewMsgTx(1)
-	neededInputs := uint64(1000) // minfee
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
 
+	if len(w.pending) >= w.MaxPendingCommitments {
+		return nil, nil, fmt.Errorf("We already have %d pending commitments", len(w.pending))
+	}
+
+	tx := wire.NewMsgTx(1)
 	tx.AddTxOut(wire.NewTxOut(0, append([]byte{0x6A, byte(len(commitment))}, commitment...)))
 
-	err := w.AddInputsAndChange(tx, neededInputs)
+	fee, err := w.AddInputsAndChange(tx, w.estimateFeeRate())
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// Signal the transaction can be replaced, so we can bump its fee
+	for _, in := range tx.TxIn {
+		in.Sequence = wire.MaxTxInSequenceNum - 2
+	}
+
 	err = w.SignMyInputs(tx)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	txid, err := w.rpcClient.SendRawTransaction(tx, false)
+	txid, err := w.chain.SendRawTransaction(tx, false)
 	if err != nil {
 		return nil, nil, err
 	}
 	var buf bytes.Buffer
 	tx.Serialize(&buf)
 
-	w.lastCommitmentTxId = txid[:]
-	err = w.db.Update(func(dtx *buntdb.Tx) error {
-		_, _, err := dtx.Set("lastcommit-txid", string(txid[:]), nil)
-		return err
-	})
-	if err != nil {
-		logging.Errorf("[Wallet] Error saving lastcommit txid: %s", err.Error())
-	}
+	w.setLastCommitment(txid)
+	w.pending = append(w.pending, &pendingCommitment{tx: tx, fee: fee, height: w.Height()})
+	w.savePending()
 
 	return txid, buf.Bytes(), nil
 }
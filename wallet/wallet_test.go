@@ -0,0 +1,478 @@
+package wallet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/go-bverify/bitcoin/chaincfg"
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/bitcoin/wire"
+	"github.com/mit-dci/go-bverify/utils"
+)
+
+// newTestWallet creates a wallet with a new key in a new data directory,
+// which follows chain when syncWallet is called
+func newTestWallet(t *testing.T, chain ChainBackend) *Wallet {
+	home, err := ioutil.TempDir("", "bverify-wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+	t.Setenv("HOME", home)
+	os.MkdirAll(utils.DataDirectory(), 0700)
+
+	w, err := NewWallet(&chaincfg.RegressionNetParams, chain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Stop)
+	return w
+}
+
+// syncWallet brings the wallet to the tip of its chain
+func syncWallet(t *testing.T, w *Wallet) {
+	w.syncChain()
+	if !w.IsSynced() {
+		t.Fatal("Wallet did not sync")
+	}
+}
+
+func ourScript(w *Wallet) []byte {
+	return utils.DirectWPKHScriptFromPKH(w.pubKeyHash)
+}
+
+// ourOutputs returns the value of each of our outputs
+func ourOutputs(w *Wallet) map[wire.OutPoint]uint64 {
+	outputs := map[wire.OutPoint]uint64{}
+	for _, u := range w.utxos {
+		outputs[wire.OutPoint{Hash: u.TxHash, Index: u.Outpoint}] = u.Value
+	}
+	return outputs
+}
+
+func checkOutputs(t *testing.T, title string, w *Wallet, expected map[wire.OutPoint]uint64) {
+	outputs := ourOutputs(w)
+	if len(outputs) != len(expected) {
+		t.Fatalf("%s: Expected %d outputs, got %d: %v", title, len(expected), len(outputs), outputs)
+	}
+	for op, value := range expected {
+		if outputs[op] != value {
+			t.Fatalf("%s: Expected output %s of %d satoshi, got %d", title, op.String(), value, outputs[op])
+		}
+	}
+}
+
+// spendTx spends op, paying toUs to script and the rest of value elsewhere
+func spendTx(op wire.OutPoint, value int64, script []byte, toUs int64) *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(toUs, script))
+	tx.AddTxOut(wire.NewTxOut(value-toUs-1000, []byte{0x51}))
+	return tx
+}
+
+func TestReorgRestoresOutputs(t *testing.T) {
+	for _, depth := range []int{1, 2} {
+		t.Run(fmt.Sprintf("Depth %d", depth), func(t *testing.T) {
+			chain := NewSimChain(&chaincfg.RegressionNetParams)
+			w := newTestWallet(t, chain)
+
+			a := chain.Fund(ourScript(w), 1000000)
+			b := chain.Fund(ourScript(w), 2000000)
+			chain.Mine()
+			syncWallet(t, w)
+			opA := wire.OutPoint{Hash: a.TxHash(), Index: 0}
+			opB := wire.OutPoint{Hash: b.TxHash(), Index: 0}
+			before := map[wire.OutPoint]uint64{opA: 1000000, opB: 2000000}
+			checkOutputs(t, "Funded", w, before)
+
+			// Spend a in the first block. With two blocks, the second spends
+			// what the first created.
+			tx1 := spendTx(opA, 1000000, ourScript(w), 400000)
+			chain.SendRawTransaction(tx1, false)
+			chain.Mine()
+			after := map[wire.OutPoint]uint64{opB: 2000000, {Hash: tx1.TxHash(), Index: 0}: 400000}
+			if depth == 2 {
+				tx2 := spendTx(wire.OutPoint{Hash: tx1.TxHash(), Index: 0}, 400000, ourScript(w), 300000)
+				chain.SendRawTransaction(tx2, false)
+				chain.Mine()
+				after = map[wire.OutPoint]uint64{opB: 2000000, {Hash: tx2.TxHash(), Index: 0}: 300000}
+			}
+			syncWallet(t, w)
+			checkOutputs(t, "Spent", w, after)
+
+			chain.Reorg(depth, false)
+			syncWallet(t, w)
+			checkOutputs(t, "After reorg", w, before)
+			if w.Height() != chain.Height() {
+				t.Fatalf("Wallet at height %d, chain at %d", w.Height(), chain.Height())
+			}
+
+			// Mining the transactions again spends the outputs again
+			chain.Mine()
+			syncWallet(t, w)
+			checkOutputs(t, "Mined again", w, after)
+		})
+	}
+}
+
+func TestReorgMakesCommitmentPending(t *testing.T) {
+	chain := NewSimChain(&chaincfg.RegressionNetParams)
+	w := newTestWallet(t, chain)
+
+	fund := chain.Fund(ourScript(w), 1000000)
+	chain.Mine()
+	syncWallet(t, w)
+
+	txid, _, err := w.Commit(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine()
+	syncWallet(t, w)
+	if w.PendingCommitments() != 0 {
+		t.Fatalf("Expected the commitment to be mined, %d pending", w.PendingCommitments())
+	}
+	change := wire.OutPoint{Hash: *txid, Index: 1}
+	if _, ok := ourOutputs(w)[change]; !ok {
+		t.Fatal("Expected the change of the mined commitment in our outputs")
+	}
+
+	chain.Reorg(1, false)
+	syncWallet(t, w)
+	if w.PendingCommitments() != 1 {
+		t.Fatalf("Expected the commitment to be pending again, %d pending", w.PendingCommitments())
+	}
+	lastTxid, _ := chainhash.NewHash(w.lastCommitmentTxId)
+	if !lastTxid.IsEqual(txid) {
+		t.Fatalf("Expected the next commitment to build on %s, not %s", txid.String(), lastTxid.String())
+	}
+	checkOutputs(t, "After reorg", w, map[wire.OutPoint]uint64{{Hash: fund.TxHash(), Index: 0}: 1000000})
+
+	// The next commitment spends the change of the pending one
+	found := false
+	for _, u := range w.spendableOutputs() {
+		if u.TxHash.IsEqual(txid) && u.Outpoint == 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expected the change of the pending commitment to be spendable")
+	}
+
+	chain.Mine()
+	syncWallet(t, w)
+	if w.PendingCommitments() != 0 {
+		t.Fatalf("Expected the commitment to be mined again, %d pending", w.PendingCommitments())
+	}
+	if _, ok := ourOutputs(w)[change]; !ok {
+		t.Fatal("Expected the change of the commitment mined again in our outputs")
+	}
+}
+
+// addInputs has the wallet fund a commitment at feeRate. It returns the
+// value of each input, the fee and the transaction.
+func addInputs(t *testing.T, w *Wallet, feeRate uint64) ([]uint64, uint64, *wire.MsgTx, error) {
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+
+	values := map[wire.OutPoint]uint64{}
+	for _, u := range w.spendableOutputs() {
+		values[wire.OutPoint{Hash: u.TxHash, Index: u.Outpoint}] = u.Value
+	}
+
+	tx := wire.NewMsgTx(1)
+	tx.AddTxOut(wire.NewTxOut(0, append([]byte{0x6A, 32}, make([]byte, 32)...)))
+	fee, err := w.AddInputsAndChange(tx, feeRate)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	inputs := make([]uint64, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		value, ok := values[in.PreviousOutPoint]
+		if !ok {
+			t.Fatalf("Input %s is not one of our outputs", in.PreviousOutPoint.String())
+		}
+		inputs[i] = value
+	}
+	return inputs, fee, tx, nil
+}
+
+func checkInputs(t *testing.T, inputs []uint64, expected []uint64) {
+	if len(inputs) != len(expected) {
+		t.Fatalf("Expected inputs %v, got %v", expected, inputs)
+	}
+	for i := range expected {
+		if inputs[i] != expected[i] {
+			t.Fatalf("Expected inputs %v, got %v", expected, inputs)
+		}
+	}
+}
+
+func TestAddInputsAndChange(t *testing.T) {
+	tests := []struct {
+		title          string
+		outputs        []int64
+		feeRate        uint64
+		maxConsolidate int
+		inputs         []uint64
+		fee            uint64
+	}{
+		{"Largest covers the fee", []int64{12000, 50000, 20000}, 20, 50, []uint64{50000}, 20 * 153},
+		{"Largest first", []int64{11000, 15000, 12000}, 100, 50, []uint64{15000, 12000}, 100 * 221},
+		{"Minimum fee above consolidation rate", []int64{12000, 50000, 20000}, 6, 50, []uint64{50000}, MINFEE},
+		{"Consolidate at consolidation rate", []int64{12000, 50000, 20000}, 5, 50, []uint64{12000, 20000, 50000}, 5 * 289},
+		{"Consolidate up to maximum", []int64{12000, 50000, 20000}, 5, 2, []uint64{12000, 20000}, 5 * 221},
+		{"Insufficient balance", []int64{11000, 12000}, 100, 50, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			chain := NewSimChain(&chaincfg.RegressionNetParams)
+			w := newTestWallet(t, chain)
+			w.MaxConsolidateInputs = tt.maxConsolidate
+			for _, value := range tt.outputs {
+				chain.Fund(ourScript(w), value)
+			}
+			chain.Mine()
+			syncWallet(t, w)
+
+			inputs, fee, tx, err := addInputs(t, w, tt.feeRate)
+			if tt.inputs == nil {
+				if err == nil {
+					t.Fatalf("Expected insufficient balance, got inputs %v", inputs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInputs(t, inputs, tt.inputs)
+			if fee != tt.fee {
+				t.Fatalf("Expected a fee of %d, got %d", tt.fee, fee)
+			}
+			total := uint64(0)
+			for _, value := range inputs {
+				total += value
+			}
+			if change := uint64(tx.TxOut[1].Value); change != total-fee {
+				t.Fatalf("Expected %d change, got %d", total-fee, change)
+			}
+		})
+	}
+}
+
+func TestAddInputsAndChangeContinuity(t *testing.T) {
+	tests := []struct {
+		title   string
+		mined   bool
+		feeRate uint64
+		inputs  []uint64
+	}{
+		// The change of the first commitment is 2000000 - 20 * 153
+		{"Pending, without top up", false, 100, []uint64{1996940}},
+		{"Mined, without top up", true, 100, []uint64{1996940}},
+		{"Mined, consolidating", true, 5, []uint64{1996940, 15000, 3000000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			chain := NewSimChain(&chaincfg.RegressionNetParams)
+			chain.FeeRate = 0.0002
+			w := newTestWallet(t, chain)
+			chain.Fund(ourScript(w), 2000000)
+			chain.Mine()
+			syncWallet(t, w)
+			_, _, err := w.Commit(make([]byte, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.mined {
+				chain.Mine()
+			}
+
+			// Larger and smaller outputs don't come before the change
+			chain.Fund(ourScript(w), 3000000)
+			chain.Fund(ourScript(w), 15000)
+			chain.Mine()
+			syncWallet(t, w)
+
+			inputs, _, _, err := addInputs(t, w, tt.feeRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInputs(t, inputs, tt.inputs)
+		})
+	}
+}
+
+func TestProcessTransactionDust(t *testing.T) {
+	tests := []struct {
+		title   string
+		fromUs  bool
+		outputs []int64
+		kept    []int64
+	}{
+		{"Deposit", false, []int64{20000}, []int64{20000}},
+		{"Deposit at threshold", false, []int64{10000}, []int64{10000}},
+		{"Dust deposit", false, []int64{5000}, []int64{}},
+		{"Several outputs", false, []int64{20000, 5000, 15000, 9999}, []int64{20000, 15000}},
+		{"Our own change", true, []int64{5000}, []int64{5000}},
+		{"Several outputs of our own", true, []int64{20000, 5000}, []int64{20000, 5000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			chain := NewSimChain(&chaincfg.RegressionNetParams)
+			w := newTestWallet(t, chain)
+
+			var prev wire.OutPoint
+			if tt.fromUs {
+				fund := chain.Fund(ourScript(w), 1000000)
+				chain.Mine()
+				syncWallet(t, w)
+				prev = wire.OutPoint{Hash: fund.TxHash(), Index: 0}
+			} else {
+				prev = wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("someone else")), Index: 0}
+			}
+
+			tx := wire.NewMsgTx(1)
+			tx.AddTxIn(wire.NewTxIn(&prev, nil, nil))
+			for _, value := range tt.outputs {
+				tx.AddTxOut(wire.NewTxOut(value, ourScript(w)))
+			}
+			chain.SendRawTransaction(tx, false)
+			chain.Mine()
+			syncWallet(t, w)
+
+			expected := map[wire.OutPoint]uint64{}
+			for i, value := range tt.outputs {
+				for _, kept := range tt.kept {
+					if kept == value {
+						expected[wire.OutPoint{Hash: tx.TxHash(), Index: uint32(i)}] = uint64(value)
+					}
+				}
+			}
+			checkOutputs(t, "Processed", w, expected)
+		})
+	}
+}
+
+// plainChain hides that a SimChain can batch, so the wallet fetches blocks
+// one by one
+type plainChain struct {
+	ChainBackend
+}
+
+// reorgingChain is a BatchBackend whose best chain switches to next between
+// GetBlockHashes and GetBlocks. It then returns the blocks at the heights it
+// was asked for, like a backend looking them up by height would.
+type reorgingChain struct {
+	*SimChain
+	next  *SimChain
+	start int32
+}
+
+func (c *reorgingChain) GetBlockHashes(start int32, count int) ([]*chainhash.Hash, error) {
+	c.start = start
+	return c.SimChain.GetBlockHashes(start, count)
+}
+
+func (c *reorgingChain) GetBlocks(hashes []*chainhash.Hash) ([]*wire.MsgBlock, error) {
+	if c.next == nil {
+		return c.SimChain.GetBlocks(hashes)
+	}
+	c.SimChain = c.next
+	c.next = nil
+	hashes, err := c.SimChain.GetBlockHashes(c.start, len(hashes))
+	if err != nil {
+		return nil, err
+	}
+	return c.SimChain.GetBlocks(hashes)
+}
+
+func checkActiveChain(t *testing.T, w *Wallet, chain *SimChain) {
+	hashes, _ := chain.GetBlockHashes(0, chain.Height()+1)
+	if len(w.activeChain) != len(hashes) {
+		t.Fatalf("Wallet has %d blocks, chain has %d", len(w.activeChain), len(hashes))
+	}
+	for i, hash := range hashes {
+		if !w.activeChain[i].IsEqual(hash) {
+			t.Fatalf("Wallet has block %s at height %d, chain has %s", w.activeChain[i].String(), i, hash.String())
+		}
+	}
+}
+
+func TestSyncReorg(t *testing.T) {
+	tests := []struct {
+		title   string
+		backend func(*SimChain) ChainBackend
+	}{
+		{"Batched", func(c *SimChain) ChainBackend { return c }},
+		{"Not batched", func(c *SimChain) ChainBackend { return plainChain{c} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			chain := NewSimChain(&chaincfg.RegressionNetParams)
+			w := newTestWallet(t, tt.backend(chain))
+			w.BlockBatchSize = 2
+
+			fund := chain.Fund(ourScript(w), 1000000)
+			chain.Mine()
+			for i := 0; i < 4; i++ {
+				chain.MineEmpty()
+			}
+			op := wire.OutPoint{Hash: fund.TxHash(), Index: 0}
+			tx := spendTx(op, 1000000, ourScript(w), 400000)
+			chain.SendRawTransaction(tx, false)
+			chain.Mine()
+			syncWallet(t, w)
+			checkActiveChain(t, w, chain)
+			spent := map[wire.OutPoint]uint64{{Hash: tx.TxHash(), Index: 0}: 400000}
+			checkOutputs(t, "Synced", w, spent)
+
+			// The new chain mines the transaction again
+			chain.Reorg(2, true)
+			syncWallet(t, w)
+			checkActiveChain(t, w, chain)
+			checkOutputs(t, "Mined again", w, spent)
+
+			chain.Reorg(1, false)
+			syncWallet(t, w)
+			checkActiveChain(t, w, chain)
+			checkOutputs(t, "Reorged out", w, map[wire.OutPoint]uint64{op: 1000000})
+		})
+	}
+}
+
+func TestSyncBatchedChainChanged(t *testing.T) {
+	// Both chains are the same up to the output we get
+	chain := NewSimChain(&chaincfg.RegressionNetParams)
+	next := NewSimChain(&chaincfg.RegressionNetParams)
+	backend := &reorgingChain{SimChain: chain}
+	w := newTestWallet(t, backend)
+	fund := chain.Fund(ourScript(w), 1000000)
+	next.Fund(ourScript(w), 1000000)
+	chain.Mine()
+	next.Mine()
+	syncWallet(t, w)
+	op := wire.OutPoint{Hash: fund.TxHash(), Index: 0}
+
+	// On the chain we sync to, the block at the same height spends it
+	chain.MineEmpty()
+	next.SendRawTransaction(spendTx(op, 1000000, []byte{0x51}, 500000), false)
+	next.Mine()
+	backend.next = next
+	syncWallet(t, w)
+	checkActiveChain(t, w, next)
+	checkOutputs(t, "Spent", w, map[wire.OutPoint]uint64{})
+
+	// We kept what we need to undo the block we got
+	next.Reorg(1, false)
+	syncWallet(t, w)
+	checkActiveChain(t, w, next)
+	checkOutputs(t, "Reorged out", w, map[wire.OutPoint]uint64{op: 1000000})
+}
@@ -0,0 +1,156 @@
+package wire
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+)
+
+// BatchLogPrefix is prepended when hashing a batch and when calculating the
+// witness of a statement in a batch, so that they can never be mistaken for
+// a regular append
+var BatchLogPrefix = []byte("b_verify batch")
+
+// MaxBatchSize is the maximum number of statements in a single batch
+const MaxBatchSize = 16
+
+// BatchLogStatement is an unsigned set of statements on different logs that
+// the server has to append atomically
+type BatchLogStatement struct {
+	Statements []*LogStatement
+}
+
+// SignedBatchLogStatement is a batch including, for every statement, the
+// signature of the controlling key of its log over the batch hash
+type SignedBatchLogStatement struct {
+	Batch      *BatchLogStatement
+	Signatures [][64]byte
+}
+
+// NewBatchLogStatement is a convenience function for creating a new
+// BatchLogStatement from a set of statements
+func NewBatchLogStatement(statements []*LogStatement) *BatchLogStatement {
+	return &BatchLogStatement{Statements: statements}
+}
+
+// NewSignedBatchLogStatement is a convenience function for creating a new
+// SignedBatchLogStatement without the signatures filled in
+func NewSignedBatchLogStatement(batch *BatchLogStatement) *SignedBatchLogStatement {
+	return &SignedBatchLogStatement{Batch: batch, Signatures: make([][64]byte, len(batch.Statements))}
+}
+
+// Bytes serializes a BatchLogStatement to a byte slice
+func (b *BatchLogStatement) Bytes() []byte {
+	var buf bytes.Buffer
+	WriteVarInt(&buf, uint64(len(b.Statements)))
+	for _, s := range b.Statements {
+		WriteVarBytes(&buf, s.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// Hash returns the hash of the batch, which is what the controlling keys of
+// the logs in the batch sign
+func (b *BatchLogStatement) Hash() [32]byte {
+	var buf bytes.Buffer
+	buf.Write(BatchLogPrefix)
+	buf.Write(b.Bytes())
+	return fastsha256.Sum256(buf.Bytes())
+}
+
+// Witness returns the value the server writes to the leaf of the log at
+// position in the batch, given that log's signature. It commits to the whole
+// batch, which allows a follower of the log to prove the statement was
+// appended as part of it.
+func (b *BatchLogStatement) Witness(position int, signature [64]byte) [32]byte {
+	var buf bytes.Buffer
+	hash := b.Hash()
+	buf.Write(BatchLogPrefix)
+	buf.Write(hash[:])
+	WriteVarInt(&buf, uint64(position))
+	buf.Write(signature[:])
+	return fastsha256.Sum256(buf.Bytes())
+}
+
+// VerifySignature will verify if signature is a valid signature over the
+// batch hash by pubKey in signature domain d
+func (b *BatchLogStatement) VerifySignature(signature [64]byte, pubKey [33]byte, d *SignatureDomain) error {
+	hash := b.Hash()
+	return d.verifySig(hash[:], pubKey, signature)
+}
+
+// Bytes serializes a SignedBatchLogStatement to a byte slice
+func (sb *SignedBatchLogStatement) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(sb.Batch.Bytes())
+	for _, sig := range sb.Signatures {
+		buf.Write(sig[:])
+	}
+	return buf.Bytes()
+}
+
+// NewBatchLogStatementFromBytes deserializes a byte slice into a
+// BatchLogStatement
+func NewBatchLogStatementFromBytes(b []byte) (*BatchLogStatement, error) {
+	batch, rest, err := readBatchLogStatement(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("Unexpected trailing bytes after batch")
+	}
+	return batch, nil
+}
+
+// NewSignedBatchLogStatementFromBytes deserializes a byte slice into a
+// SignedBatchLogStatement
+func NewSignedBatchLogStatementFromBytes(b []byte) (*SignedBatchLogStatement, error) {
+	batch, rest, err := readBatchLogStatement(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 64*len(batch.Statements) {
+		return nil, fmt.Errorf("Unexpected length of batch signatures: %d", len(rest))
+	}
+	sb := NewSignedBatchLogStatement(batch)
+	for i := range sb.Signatures {
+		copy(sb.Signatures[i][:], rest[i*64:])
+	}
+	return sb, nil
+}
+
+func readBatchLogStatement(b []byte) (*BatchLogStatement, []byte, error) {
+	buf := bytes.NewBuffer(b)
+	count, err := ReadVarInt(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if count == 0 || count > MaxBatchSize {
+		return nil, nil, fmt.Errorf("Invalid number of statements in batch: %d", count)
+	}
+
+	batch := &BatchLogStatement{Statements: make([]*LogStatement, count)}
+	for i := range batch.Statements {
+		sb, err := ReadVarBytes(buf, 32+9+9+MaxStatementLength, "batch statement")
+		if err != nil {
+			return nil, nil, err
+		}
+		batch.Statements[i], err = NewLogStatementFromBytes(sb)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return batch, buf.Bytes(), nil
+}
+
+// Position returns the position of the statement for logID in the batch, or
+// -1 if the batch has no statement for it
+func (b *BatchLogStatement) Position(logID [32]byte) int {
+	for i, s := range b.Statements {
+		if s.LogID == logID {
+			return i
+		}
+	}
+	return -1
+}
@@ -6,15 +6,31 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mit-dci/go-bverify/logging"
 )
 
+// MaxMessageSize is the largest payload a frame may carry. Frames announcing a
+// larger payload are rejected before anything is allocated for them.
+const MaxMessageSize = 32 * 1024 * 1024
+
 // Connection is a wrapper around the raw net.Conn and allows to easily read
 // and write messages from/to the wire
 type Connection struct {
 	conn      net.Conn
 	writeLock sync.Mutex
+
+	// When requestIDs is set to 1, every frame carries the ID of the request
+	// it belongs to, between the type and the length. It is only set while
+	// holding writeLock, so no frame is written half in the old format.
+	requestIDs int32
+
+	// The maximum time to wait for the next message, and for a message to be
+	// written. Zero means no timeout.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
 // NewConnection creates a new Connection with the given net.Conn as underlying
@@ -28,33 +44,81 @@ func (c *Connection) Close() error {
 	return c.conn.Close()
 }
 
+// EnableRequestIDs switches the connection to frames that carry a request ID.
+// Both sides have to do this at the same point in the conversation, which is
+// right after the version handshake when FeatureRequestIDs was negotiated.
+func (c *Connection) EnableRequestIDs() {
+	c.writeLock.Lock()
+	atomic.StoreInt32(&c.requestIDs, 1)
+	c.writeLock.Unlock()
+}
+
+// SetTimeouts sets how long ReadNextMessage waits for the next message to come
+// in, and how long WriteMessage may take, before failing. Since a connection
+// that is idle for longer than the read timeout fails, the other side has to
+// send pings more often than that. Zero means no timeout.
+func (c *Connection) SetTimeouts(read, write time.Duration) {
+	c.readTimeout = read
+	c.writeTimeout = write
+}
+
+// RequestIDs returns true if the frames on this connection carry request IDs
+func (c *Connection) RequestIDs() bool {
+	return atomic.LoadInt32(&c.requestIDs) == 1
+}
+
 // ReadNextMessage reads a type, length and then payload from the transport and
 // returns the message type and payload to the caller.
 func (c *Connection) ReadNextMessage() (MessageType, []byte, error) {
+	t, _, m, err := c.ReadNextFrame()
+	return t, m, err
+}
+
+// ReadNextFrame reads the next message from the transport like ReadNextMessage
+// does, but also returns the request ID it carries. The ID is always 0 when
+// request IDs are not enabled on the connection.
+func (c *Connection) ReadNextFrame() (MessageType, uint32, []byte, error) {
 	bType := make([]byte, 1)
 	bLen := make([]byte, 4)
+	var id uint32
+
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
 
 	//logging.Debugf("[%p] Reading type", c)
 
 	n, err := io.ReadFull(c.conn, bType)
 	if err != nil {
-		return 0x00, nil, err
+		return 0x00, 0, nil, err
 	}
 	if n != 1 {
-		return 0x00, nil, fmt.Errorf("Wrong length read for type : expected 1, got %d", n)
+		return 0x00, 0, nil, fmt.Errorf("Wrong length read for type : expected 1, got %d", n)
 	}
 	//logging.Debugf("[%p] Read Type %x", c, bType)
 
+	if c.RequestIDs() {
+		bID := make([]byte, 4)
+		_, err = io.ReadFull(c.conn, bID)
+		if err != nil {
+			return 0x00, 0, nil, err
+		}
+		id = binary.BigEndian.Uint32(bID)
+	}
+
 	//logging.Debugf("[%p] Reading len", c)
 	n, err = io.ReadFull(c.conn, bLen)
 	if err != nil {
-		return 0x00, nil, err
+		return 0x00, 0, nil, err
 	}
 	if n != 4 {
-		return 0x00, nil, fmt.Errorf("Wrong length read for length : expected 4, got %d", n)
+		return 0x00, 0, nil, fmt.Errorf("Wrong length read for length : expected 4, got %d", n)
 	}
 
 	l := binary.BigEndian.Uint32(bLen)
+	if l > MaxMessageSize {
+		return 0x00, 0, nil, fmt.Errorf("Message length %d exceeds the maximum of %d", l, MaxMessageSize)
+	}
 
 	//logging.Debugf("[%p] Read Len %d", c, l)
 
@@ -64,28 +128,51 @@ func (c *Connection) ReadNextMessage() (MessageType, []byte, error) {
 
 		n, err = io.ReadFull(c.conn, bMsg)
 		if err != nil {
-			return 0x00, nil, err
+			return 0x00, 0, nil, err
 		}
 		if n != int(l) {
-			return 0x00, nil, fmt.Errorf("Wrong length read for body : expected %d, got %d", l, n)
+			return 0x00, 0, nil, fmt.Errorf("Wrong length read for body : expected %d, got %d", l, n)
 		}
 
 	}
 
-	return MessageType(bType[0]), bMsg, nil
+	return MessageType(bType[0]), id, bMsg, nil
 }
 
 // WriteMessage writes a message to the transport of the given type t and payload m
 // it uses a  Mutex to prevent two threads writing at the same time.
 func (c *Connection) WriteMessage(t MessageType, m []byte) error {
+	return c.WriteFrame(t, 0, m)
+}
+
+// WriteFrame writes a message like WriteMessage does, tagged with request ID
+// id. Responses carry the ID of the request they answer, messages the server
+// sends on its own accord use ID 0. The ID is not written when request IDs
+// are not enabled on the connection.
+func (c *Connection) WriteFrame(t MessageType, id uint32, m []byte) error {
+	if len(m) > MaxMessageSize {
+		return fmt.Errorf("Message length %d exceeds the maximum of %d", len(m), MaxMessageSize)
+	}
+
+	c.writeLock.Lock()
+	requestIDs := c.RequestIDs()
+	hdrLen := 5
+	if requestIDs {
+		hdrLen = 9
+	}
 
-	bMsg := make([]byte, 5+len(m))
+	bMsg := make([]byte, hdrLen+len(m))
 	bMsg[0] = byte(t)
-	binary.BigEndian.PutUint32(bMsg[1:], uint32(len(m)))
+	if requestIDs {
+		binary.BigEndian.PutUint32(bMsg[1:], id)
+	}
+	binary.BigEndian.PutUint32(bMsg[hdrLen-4:], uint32(len(m)))
 	if len(m) > 0 {
-		copy(bMsg[5:], m)
+		copy(bMsg[hdrLen:], m)
+	}
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
 	}
-	c.writeLock.Lock()
 	n, err := c.conn.Write(bMsg)
 	if err != nil {
 		logging.Errorf("[%p] Error writing message: %s", c, err.Error())
@@ -3,6 +3,7 @@ package wire
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"net"
 	"testing"
 )
@@ -29,6 +30,28 @@ func TestConnectionSimple(t *testing.T) {
 	}
 }
 
+func TestConnectionRequestIDs(t *testing.T) {
+	c, s := net.Pipe()
+	client, server := NewConnection(c), NewConnection(s)
+	client.EnableRequestIDs()
+	server.EnableRequestIDs()
+
+	go server.WriteFrame(MessageTypeAck, 0xdeadbeef, []byte{0x01, 0x02})
+	mt, id, p, err := client.ReadNextFrame()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if mt != MessageTypeAck || id != 0xdeadbeef {
+		t.Errorf("Expected Ack for request deadbeef, received %x for request %x", byte(mt), id)
+		return
+	}
+	if !bytes.Equal([]byte{0x01, 0x02}, p) {
+		t.Errorf("Message sent is not the one received.")
+		return
+	}
+}
+
 func TestConnectionDisconnect(t *testing.T) {
 	c, s := net.Pipe()
 	client, server := NewConnection(c), NewConnection(s)
@@ -85,3 +108,26 @@ func TestConnectionSendToClosedConnection(t *testing.T) {
 		return
 	}
 }
+
+func TestConnectionOversizedFrame(t *testing.T) {
+	c, s := net.Pipe()
+	client := NewConnection(c)
+	defer s.Close()
+
+	// Only the header is sent, the payload it announces never arrives
+	header := make([]byte, 5)
+	header[0] = byte(MessageTypeAck)
+	binary.BigEndian.PutUint32(header[1:], 0xffffffff)
+	go s.Write(header)
+
+	_, _, err := client.ReadNextMessage()
+	if err == nil {
+		t.Error("Expected a frame larger than MaxMessageSize to be rejected")
+		return
+	}
+
+	err = client.WriteMessage(MessageTypeAck, make([]byte, MaxMessageSize+1))
+	if err == nil {
+		t.Error("Expected writing a frame larger than MaxMessageSize to fail")
+	}
+}
@@ -0,0 +1,474 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/mit-dci/go-bverify/bitcoin/chainhash"
+	"github.com/mit-dci/go-bverify/mpt"
+	"github.com/mit-dci/go-bverify/utils"
+)
+
+func newCommitmentForTest(r *rand.Rand) *Commitment {
+	c := &Commitment{TriggeredAtBlockHeight: r.Intn(600000)}
+	r.Read(c.Commitment[:])
+	c.TxHash = new(chainhash.Hash)
+	r.Read(c.TxHash[:])
+	c.IncludedInBlock = new(chainhash.Hash)
+	r.Read(c.IncludedInBlock[:])
+	c.MerkleProof = utils.MerkleProof{Position: uint64(r.Intn(1000))}
+	for i := 0; i < 10; i++ {
+		h := new(chainhash.Hash)
+		r.Read(h[:])
+		c.MerkleProof.Hashes = append(c.MerkleProof.Hashes, h)
+	}
+	c.RawTx = make([]byte, 250)
+	r.Read(c.RawTx)
+	return c
+}
+
+func newForeignStatementForTest(r *rand.Rand) (*ForeignStatement, error) {
+	full, err := mpt.NewFullMPT()
+	if err != nil {
+		return nil, err
+	}
+	var logID [32]byte
+	for i := 0; i < 20; i++ {
+		var value [32]byte
+		r.Read(logID[:])
+		r.Read(value[:])
+		full.Insert(logID[:], value[:])
+	}
+	proof, err := mpt.NewPartialMPTIncludingKey(full, logID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	batch := NewBatchLogStatement([]*LogStatement{
+		NewSignedLogStatement(3, logID, []byte("Hello world")).Statement,
+		NewSignedLogStatement(7, [32]byte{0x01}, []byte("Hello again")).Statement,
+	})
+
+	fs := &ForeignStatement{
+		LogID:             logID,
+		Index:             3,
+		StatementPreimage: "Hello world",
+		Proof:             proof,
+		SignatureDomain:   NewSignatureDomain([32]byte{0x02}, [32]byte{0x03}),
+		Metadata:          map[string]string{MetadataKeyName: "test"},
+		Nonce:             []byte{0x04, 0x05},
+		Batch:             batch,
+		BatchPosition:     0,
+	}
+	r.Read(fs.Signature[:])
+	r.Read(fs.PubKey[:])
+	return fs, nil
+}
+
+func TestCommitmentRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	c := newCommitmentForTest(r)
+	b := c.Bytes()
+
+	c2, err := CommitmentFromBytes(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(c2.Bytes(), b) {
+		t.Error("Deserialized and serialized commitment not equal")
+		return
+	}
+
+	// Commitments that weren't mined yet have no hashes
+	c3, err := CommitmentFromBytes(NewCommitment(c.Commitment, nil, nil, 100).Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if c3.TxHash != nil || c3.IncludedInBlock != nil || c3.TriggeredAtBlockHeight != 100 {
+		t.Error("Deserialized unmined commitment has unexpected fields")
+		return
+	}
+
+	// Every truncation that cuts into the fields before the raw transaction
+	// must fail
+	for i := 0; i < len(b)-len(c.RawTx); i++ {
+		_, err = CommitmentFromBytes(b[:i])
+		if err == nil {
+			t.Errorf("Expected error deserializing commitment truncated to %d bytes", i)
+			return
+		}
+	}
+
+	// A merkle proof length beyond the end of the buffer must fail
+	hostile := make([]byte, len(b))
+	copy(hostile, b)
+	binary.BigEndian.PutUint32(hostile[100:], 0xffffffff)
+	_, err = CommitmentFromBytes(hostile)
+	if err == nil {
+		t.Error("Expected error deserializing commitment with hostile proof length")
+		return
+	}
+}
+
+func TestCommitmentHistoryMessageRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	msg := NewCommitmentHistoryMessage([]*Commitment{newCommitmentForTest(r), newCommitmentForTest(r)})
+	b := msg.Bytes()
+
+	msg2, err := NewCommitmentHistoryMessageFromBytes(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(msg2.Bytes(), b) {
+		t.Error("Deserialized and serialized commitment history not equal")
+		return
+	}
+
+	for i := 0; i < len(b); i++ {
+		_, err = NewCommitmentHistoryMessageFromBytes(b[:i])
+		if err == nil {
+			t.Errorf("Expected error deserializing commitment history truncated to %d bytes", i)
+			return
+		}
+	}
+
+	// A huge count of commitments must not cause a huge allocation
+	hostile := []byte{0x7f, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00}
+	_, err = NewCommitmentHistoryMessageFromBytes(hostile)
+	if err == nil {
+		t.Error("Expected error deserializing commitment history with hostile count")
+		return
+	}
+}
+
+func TestForeignStatementRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	fs, err := newForeignStatementForTest(r)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b := fs.Bytes()
+
+	fs2, err := ForeignStatementFromBytes(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(fs2.Bytes(), b) {
+		t.Error("Deserialized and serialized foreign statement not equal")
+		return
+	}
+	if !bytes.Equal(fs2.Proof.Commitment(), fs.Proof.Commitment()) {
+		t.Error("Proof of foreign statement did not survive serialization")
+		return
+	}
+
+	// Truncations must never panic, and must fail when they cut into the
+	// fixed fields, the statement or the proof
+	fixed := minForeignStatementSize + len(fs.StatementPreimage) + fs.Proof.ByteSize()
+	for i := 0; i < len(b); i++ {
+		_, err = ForeignStatementFromBytes(b[:i])
+		if err == nil && i < fixed {
+			t.Errorf("Expected error deserializing foreign statement truncated to %d bytes", i)
+			return
+		}
+	}
+
+	// A batch position outside of the batch must fail
+	fs.BatchPosition = 2
+	_, err = ForeignStatementFromBytes(fs.Bytes())
+	if err == nil {
+		t.Error("Expected error deserializing foreign statement with batch position out of range")
+		return
+	}
+	fs.BatchPosition = 0
+
+	// A statement longer than the maximum must fail
+	fs.StatementPreimage = string(make([]byte, MaxStatementLength+1))
+	_, err = ForeignStatementFromBytes(fs.Bytes())
+	if err == nil {
+		t.Error("Expected error deserializing foreign statement with oversized statement")
+		return
+	}
+}
+
+func TestReadVarBytesMaxAllowed(t *testing.T) {
+	var buf bytes.Buffer
+	WriteVarBytes(&buf, make([]byte, 33))
+	b := buf.Bytes()
+
+	_, err := ReadVarBytes(bytes.NewBuffer(b), 33, "test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = ReadVarBytes(bytes.NewBuffer(b), 32, "test")
+	if err == nil {
+		t.Error("Expected error reading byte array larger than allowed")
+		return
+	}
+
+	// A hostile length must be refused before allocating
+	hostile := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	_, err = ReadVarBytes(bytes.NewBuffer(hostile), 32, "test")
+	if err == nil {
+		t.Error("Expected error reading byte array with hostile length")
+		return
+	}
+}
+
+// decodersForTest returns every decoder in this package together with a
+// valid serialization to mutate
+func decodersForTest(r *rand.Rand) (map[string]func([]byte) error, map[string][]byte, error) {
+	fs, err := newForeignStatementForTest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := NewSignedDelegation([32]byte{0x01}, [33]byte{0x02}, 1, 10, 0)
+	rev := NewSignedDelegationRevocation([32]byte{0x01}, d.Delegation.Hash())
+	create := NewSignedCreateLogStatementWithMetadata([33]byte{0x02}, []byte("Hello world"), []byte{0x01}, map[string]string{"a": "b"})
+	batch := NewSignedBatchLogStatement(fs.Batch)
+
+	decoders := map[string]func([]byte) error{
+		"Commitment": func(b []byte) error {
+			_, err := CommitmentFromBytes(b)
+			return err
+		},
+		"ForeignStatement": func(b []byte) error {
+			_, err := ForeignStatementFromBytes(b)
+			return err
+		},
+		"LogStatement": func(b []byte) error {
+			_, err := NewLogStatementFromBytes(b)
+			return err
+		},
+		"SignedLogStatement": func(b []byte) error {
+			_, err := NewSignedLogStatementFromBytes(b)
+			return err
+		},
+		"SignedCreateLogStatement": func(b []byte) error {
+			_, err := NewSignedCreateLogStatementFromBytes(b)
+			return err
+		},
+		"SignedBatchLogStatement": func(b []byte) error {
+			_, err := NewSignedBatchLogStatementFromBytes(b)
+			return err
+		},
+		"SignedDelegation": func(b []byte) error {
+			_, err := NewSignedDelegationFromBytes(b)
+			return err
+		},
+		"SignedDelegationRevocation": func(b []byte) error {
+			_, err := NewSignedDelegationRevocationFromBytes(b)
+			return err
+		},
+		"SignatureDomainMessage": func(b []byte) error {
+			_, err := NewSignatureDomainMessageFromBytes(b)
+			return err
+		},
+		"RequestProofMessage": func(b []byte) error {
+			_, err := NewRequestProofMessageFromBytes(b)
+			return err
+		},
+		"RequestCommitmentDetailsMessage": func(b []byte) error {
+			_, err := NewRequestCommitmentDetailsMessageFromBytes(b)
+			return err
+		},
+		"RequestCommitmentHistoryMessage": func(b []byte) error {
+			_, err := NewRequestCommitmentHistoryMessageFromBytes(b)
+			return err
+		},
+		"CommitmentDetailsMessage": func(b []byte) error {
+			_, err := NewCommitmentDetailsMessageFromBytes(b)
+			return err
+		},
+		"CommitmentHistoryMessage": func(b []byte) error {
+			_, err := NewCommitmentHistoryMessageFromBytes(b)
+			return err
+		},
+		"RequestLogStatusMessage": func(b []byte) error {
+			_, err := NewRequestLogStatusMessageFromBytes(b)
+			return err
+		},
+		"LogStatusMessage": func(b []byte) error {
+			_, err := NewLogStatusMessageFromBytes(b)
+			return err
+		},
+		"WatchLogsMessage": func(b []byte) error {
+			_, err := NewWatchLogsMessageFromBytes(b)
+			return err
+		},
+		"SessionMessage": func(b []byte) error {
+			_, err := NewSessionMessageFromBytes(b)
+			return err
+		},
+		"CloseSessionMessage": func(b []byte) error {
+			_, err := NewCloseSessionMessageFromBytes(b)
+			return err
+		},
+		"NewCommitmentMessage": func(b []byte) error {
+			_, err := NewNewCommitmentMessageFromBytes(b)
+			return err
+		},
+		"LogInfoMessage": func(b []byte) error {
+			_, err := NewLogInfoMessageFromBytes(b)
+			return err
+		},
+		"VersionMessage": func(b []byte) error {
+			_, err := NewVersionMessageFromBytes(b)
+			return err
+		},
+		"ErrorMessage": func(b []byte) error {
+			_, err := NewErrorMessageFromBytes(b)
+			return err
+		},
+		"MerkleProof": func(b []byte) error {
+			_, err := utils.NewMerkleProofFromBytes(b)
+			return err
+		},
+		"CreateExtension": func(b []byte) error {
+			_, _, err := ReadCreateLogExtension(bytes.NewBuffer(b))
+			return err
+		},
+	}
+
+	commitment := newCommitmentForTest(r)
+	status := &LogStatusMessage{LogID: fs.LogID, NextIndex: 4, ControllingKey: fs.PubKey, Sealed: true,
+		Committed: true, Commitment: commitment.Commitment, CommittedIndex: 3}
+	samples := map[string][]byte{
+		"Commitment":                      commitment.Bytes(),
+		"ForeignStatement":                fs.Bytes(),
+		"LogStatement":                    fs.Batch.Statements[0].Bytes(),
+		"SignedLogStatement":              NewSignedLogStatement(1, fs.LogID, []byte("Hello world")).Bytes(),
+		"SignedCreateLogStatement":        create.Bytes(),
+		"SignedBatchLogStatement":         batch.Bytes(),
+		"SignedDelegation":                d.Bytes(),
+		"SignedDelegationRevocation":      rev.Bytes(),
+		"SignatureDomainMessage":          NewSignatureDomainMessage(fs.SignatureDomain, true).Bytes(),
+		"RequestProofMessage":             NewRequestProofMessage([][32]byte{fs.LogID, {0x01}}).Bytes(),
+		"RequestCommitmentDetailsMessage": NewRequestCommitmentDetailsMessage(commitment.Commitment).Bytes(),
+		"RequestCommitmentHistoryMessage": NewRequestCommitmentHistoryMessage(commitment.Commitment).Bytes(),
+		"CommitmentDetailsMessage":        NewCommitmentDetailsMessage(commitment).Bytes(),
+		"CommitmentHistoryMessage":        NewCommitmentHistoryMessage([]*Commitment{commitment}).Bytes(),
+		"RequestLogStatusMessage":         NewRequestLogStatusMessage(fs.LogID).Bytes(),
+		"LogStatusMessage":                status.Bytes(),
+		"WatchLogsMessage":                NewWatchLogsMessage([][32]byte{fs.LogID, {0x01}}).Bytes(),
+		"SessionMessage":                  NewSessionMessage(7, MessageTypeAppendLog, []byte{0x01, 0x02}).Bytes(),
+		"CloseSessionMessage":             NewCloseSessionMessage(7).Bytes(),
+		"NewCommitmentMessage":            NewNewCommitmentMessage(commitment.Commitment).Bytes(),
+		"LogInfoMessage":                  NewLogInfoMessage(fs.LogID, fs.PubKey, fs.Metadata).Bytes(),
+		"VersionMessage":                  NewVersionMessage(SupportedFeatures, [32]byte{0x01}, [32]byte{0x02}).Bytes(),
+		"ErrorMessage":                    NewErrorMessage(ErrorCodeNotFound, 1, "Not found").Bytes(),
+		"MerkleProof":                     commitment.MerkleProof.Bytes(),
+	}
+	var ext bytes.Buffer
+	WriteCreateLogExtension(&ext, fs.Nonce, fs.Metadata)
+	samples["CreateExtension"] = ext.Bytes()
+
+	return decoders, samples, nil
+}
+
+// decodeWithoutPanic runs decode on b, and turns a panic into an error
+func decodeWithoutPanic(decode func([]byte) error, b []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	decode(b)
+	return nil
+}
+
+func TestDecodersRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	decoders, samples, err := decodersForTest(r)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for name, decode := range decoders {
+		sample, ok := samples[name]
+		if !ok {
+			t.Errorf("No sample for decoder %s", name)
+			continue
+		}
+		err = decode(sample)
+		if err != nil {
+			t.Errorf("Could not decode valid %s: %s", name, err.Error())
+		}
+	}
+}
+
+func TestDecodersFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	decoders, samples, err := decodersForTest(r)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for name, decode := range decoders {
+		sample := samples[name]
+
+		for i := 0; i < 2000; i++ {
+			var b []byte
+			switch i % 4 {
+			case 0:
+				// Random garbage
+				b = make([]byte, r.Intn(2*len(sample)+1))
+				r.Read(b)
+			case 1:
+				// Truncated sample
+				b = sample[:r.Intn(len(sample)+1)]
+			case 2:
+				// Sample with a few bytes flipped
+				b = make([]byte, len(sample))
+				copy(b, sample)
+				for j := 0; j < 1+r.Intn(4); j++ {
+					b[r.Intn(len(b))] ^= byte(1 + r.Intn(255))
+				}
+			case 3:
+				// Sample with a length prefix sized 0xff.. somewhere
+				b = make([]byte, len(sample))
+				copy(b, sample)
+				pos := r.Intn(len(b))
+				for j := pos; j < pos+4 && j < len(b); j++ {
+					b[j] = 0xff
+				}
+			}
+
+			err = decodeWithoutPanic(decode, b)
+			if err != nil {
+				t.Errorf("Decoding %s from %x: %s", name, b, err.Error())
+				return
+			}
+		}
+	}
+}
+
+func TestLogStatusMessage(t *testing.T) {
+	msg := &LogStatusMessage{NextIndex: 4, Sealed: true, Committed: true, CommittedIndex: 3}
+	msg.LogID[0] = 0x01
+	msg.ControllingKey[0] = 0x02
+	msg.LastValue[0] = 0x03
+	msg.Commitment[0] = 0x04
+
+	msg2, err := NewLogStatusMessageFromBytes(msg.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *msg2 != *msg {
+		t.Errorf("Deserialized and serialized log status not equal: %v vs %v", msg2, msg)
+		return
+	}
+}
@@ -0,0 +1,234 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+)
+
+// Delegation is an unsigned statement by which the controlling key of a log
+// authorizes another key to append statements to that log
+type Delegation struct {
+	LogID       [32]byte
+	DelegateKey [33]byte
+
+	// The range of log indexes the delegate is allowed to append. A LastIndex
+	// of 0 means there is no upper bound.
+	FirstIndex uint64
+	LastIndex  uint64
+
+	// The block height from which the delegation is no longer valid. An
+	// ExpiryHeight of 0 means the delegation never expires.
+	ExpiryHeight uint64
+}
+
+// SignedDelegation is a delegation including the signature of the log's
+// controlling key
+type SignedDelegation struct {
+	Signature  [64]byte
+	Delegation *Delegation
+}
+
+// DelegationRevocation is an unsigned statement that revokes an earlier
+// delegation, identified by the hash of that delegation
+type DelegationRevocation struct {
+	LogID          [32]byte
+	DelegationHash [32]byte
+}
+
+// SignedDelegationRevocation is a delegation revocation including the
+// signature of the log's controlling key
+type SignedDelegationRevocation struct {
+	Signature  [64]byte
+	Revocation *DelegationRevocation
+}
+
+// NewSignedDelegation is a convenience function for creating a new
+// SignedDelegation without the signature filled in
+func NewSignedDelegation(logID [32]byte, delegateKey [33]byte, firstIndex, lastIndex, expiryHeight uint64) *SignedDelegation {
+	ret := new(SignedDelegation)
+	ret.Delegation = new(Delegation)
+	ret.Delegation.LogID = logID
+	ret.Delegation.DelegateKey = delegateKey
+	ret.Delegation.FirstIndex = firstIndex
+	ret.Delegation.LastIndex = lastIndex
+	ret.Delegation.ExpiryHeight = expiryHeight
+	return ret
+}
+
+// NewSignedDelegationRevocation is a convenience function for creating a new
+// SignedDelegationRevocation without the signature filled in
+func NewSignedDelegationRevocation(logID [32]byte, delegationHash [32]byte) *SignedDelegationRevocation {
+	ret := new(SignedDelegationRevocation)
+	ret.Revocation = new(DelegationRevocation)
+	ret.Revocation.LogID = logID
+	ret.Revocation.DelegationHash = delegationHash
+	return ret
+}
+
+// Bytes serializes a Delegation to a byte slice
+func (d *Delegation) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(d.LogID[:])
+	buf.Write(d.DelegateKey[:])
+	binary.Write(&buf, binary.BigEndian, d.FirstIndex)
+	binary.Write(&buf, binary.BigEndian, d.LastIndex)
+	binary.Write(&buf, binary.BigEndian, d.ExpiryHeight)
+	return buf.Bytes()
+}
+
+// Hash returns the hash identifying this delegation, which is used to revoke
+// it later on
+func (d *Delegation) Hash() [32]byte {
+	return fastsha256.Sum256(d.Bytes())
+}
+
+// Covers returns true if the delegation allows appending the statement at
+// index when the chain is at the given block height
+func (d *Delegation) Covers(index, height uint64) bool {
+	if index < d.FirstIndex {
+		return false
+	}
+	if d.LastIndex != 0 && index > d.LastIndex {
+		return false
+	}
+	if d.ExpiryHeight != 0 && height >= d.ExpiryHeight {
+		return false
+	}
+	return true
+}
+
+// Bytes serializes a SignedDelegation to a byte slice
+func (sd *SignedDelegation) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(sd.Signature[:])
+	buf.Write(sd.Delegation.Bytes())
+	return buf.Bytes()
+}
+
+// Bytes serializes a DelegationRevocation to a byte slice
+func (dr *DelegationRevocation) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(dr.LogID[:])
+	buf.Write(dr.DelegationHash[:])
+	return buf.Bytes()
+}
+
+// Bytes serializes a SignedDelegationRevocation to a byte slice
+func (sdr *SignedDelegationRevocation) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(sdr.Signature[:])
+	buf.Write(sdr.Revocation.Bytes())
+	return buf.Bytes()
+}
+
+// NewDelegationFromBytes deserializes a byte slice into a Delegation
+func NewDelegationFromBytes(b []byte) (*Delegation, error) {
+	if len(b) != 32+33+8+8+8 {
+		return nil, fmt.Errorf("Unexpected length of delegation: %d", len(b))
+	}
+	buf := bytes.NewBuffer(b)
+	d := new(Delegation)
+	copy(d.LogID[:], buf.Next(32))
+	copy(d.DelegateKey[:], buf.Next(33))
+	binary.Read(buf, binary.BigEndian, &d.FirstIndex)
+	binary.Read(buf, binary.BigEndian, &d.LastIndex)
+	binary.Read(buf, binary.BigEndian, &d.ExpiryHeight)
+	return d, nil
+}
+
+// NewSignedDelegationFromBytes deserializes a byte slice into a
+// SignedDelegation
+func NewSignedDelegationFromBytes(b []byte) (*SignedDelegation, error) {
+	buf := bytes.NewBuffer(b)
+	sd := new(SignedDelegation)
+	n, err := buf.Read(sd.Signature[:])
+	if err != nil {
+		return nil, err
+	}
+	if n < 64 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
+	sd.Delegation, err = NewDelegationFromBytes(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return sd, nil
+}
+
+// NewDelegationRevocationFromBytes deserializes a byte slice into a
+// DelegationRevocation
+func NewDelegationRevocationFromBytes(b []byte) (*DelegationRevocation, error) {
+	if len(b) != 64 {
+		return nil, fmt.Errorf("Unexpected length of delegation revocation: %d", len(b))
+	}
+	dr := new(DelegationRevocation)
+	copy(dr.LogID[:], b[:32])
+	copy(dr.DelegationHash[:], b[32:])
+	return dr, nil
+}
+
+// NewSignedDelegationRevocationFromBytes deserializes a byte slice into a
+// SignedDelegationRevocation
+func NewSignedDelegationRevocationFromBytes(b []byte) (*SignedDelegationRevocation, error) {
+	buf := bytes.NewBuffer(b)
+	sdr := new(SignedDelegationRevocation)
+	n, err := buf.Read(sdr.Signature[:])
+	if err != nil {
+		return nil, err
+	}
+	if n < 64 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
+	sdr.Revocation, err = NewDelegationRevocationFromBytes(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return sdr, nil
+}
+
+// VerifySignature will verify if the signature in this SignedDelegation
+// is a valid legacy signature
+func (sd *SignedDelegation) VerifySignature(controllingPubKey [33]byte) error {
+	return sd.VerifySignatureInDomain(controllingPubKey, nil)
+}
+
+// VerifySignatureInDomain will verify if the signature in this
+// SignedDelegation is valid for the given signature domain
+func (sd *SignedDelegation) VerifySignatureInDomain(controllingPubKey [33]byte, d *SignatureDomain) error {
+	return d.verifySig(sd.Delegation.Bytes(), controllingPubKey, sd.Signature)
+}
+
+// VerifySignature will verify if the signature in this
+// SignedDelegationRevocation is a valid legacy signature
+func (sdr *SignedDelegationRevocation) VerifySignature(controllingPubKey [33]byte) error {
+	return sdr.VerifySignatureInDomain(controllingPubKey, nil)
+}
+
+// VerifySignatureInDomain will verify if the signature in this
+// SignedDelegationRevocation is valid for the given signature domain
+func (sdr *SignedDelegationRevocation) VerifySignatureInDomain(controllingPubKey [33]byte, d *SignatureDomain) error {
+	return d.verifySig(sdr.Revocation.Bytes(), controllingPubKey, sdr.Signature)
+}
+
+// VerifyDelegatedSignature will verify if the SignedLogStatement was signed
+// by the delegate in the passed SignedDelegation, and that the delegation was
+// signed by controllingPubKey and covers the statement's index. Both
+// signatures are checked in signature domain d, which is nil for legacy
+// signatures. Since the height at which the server accepted the statement is
+// unknown here, the expiry of the delegation is not checked.
+func (sls *SignedLogStatement) VerifyDelegatedSignature(controllingPubKey [33]byte, sd *SignedDelegation, d *SignatureDomain) error {
+	if !bytes.Equal(sd.Delegation.LogID[:], sls.Statement.LogID[:]) {
+		return fmt.Errorf("Delegation is for a different log")
+	}
+	if !sd.Delegation.Covers(sls.Statement.Index, 0) {
+		return fmt.Errorf("Delegation does not cover index %d", sls.Statement.Index)
+	}
+	err := sd.VerifySignatureInDomain(controllingPubKey, d)
+	if err != nil {
+		return err
+	}
+	return sls.VerifySignatureInDomain(sd.Delegation.DelegateKey, d)
+}
@@ -0,0 +1,131 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/mit-dci/go-bverify/crypto/btcec"
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+	"github.com/mit-dci/go-bverify/crypto/sig64"
+)
+
+func signForTest(priv *btcec.PrivateKey, b []byte) [64]byte {
+	hash := fastsha256.Sum256(b)
+	sig, _ := priv.Sign(hash[:])
+	csig, _ := sig64.SigCompress(sig.Serialize())
+	return csig
+}
+
+func newKeyForTest() (*btcec.PrivateKey, [33]byte) {
+	key := [32]byte{}
+	rand.Read(key[:])
+	priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), key[:])
+	var pk [33]byte
+	copy(pk[:], pub.SerializeCompressed())
+	return priv, pk
+}
+
+func TestSignedDelegation(t *testing.T) {
+	ownerPriv, ownerPk := newKeyForTest()
+	_, devicePk := newKeyForTest()
+
+	logId := [32]byte{}
+	rand.Read(logId[:])
+	d := NewSignedDelegation(logId, devicePk, 5, 10, 1000)
+	d.Signature = signForTest(ownerPriv, d.Delegation.Bytes())
+
+	d2, err := NewSignedDelegationFromBytes(d.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(d.Bytes(), d2.Bytes()) {
+		t.Errorf("Deserialized and serialized delegation not equal")
+		return
+	}
+
+	err = d2.VerifySignature(ownerPk)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = d2.VerifySignature(devicePk)
+	if err == nil {
+		t.Error("Expected signature verification to fail, but it succeeded")
+		return
+	}
+
+	coverage := []struct {
+		index, height uint64
+		expected      bool
+	}{
+		{4, 0, false},
+		{5, 0, true},
+		{10, 999, true},
+		{11, 0, false},
+		{7, 1000, false},
+	}
+	for _, c := range coverage {
+		if d2.Delegation.Covers(c.index, c.height) != c.expected {
+			t.Errorf("Expected coverage of index %d at height %d to be %v", c.index, c.height, c.expected)
+		}
+	}
+
+	_, err = NewSignedDelegationFromBytes(d.Bytes()[:100]) // Invalid, expect error
+	if err == nil {
+		t.Error("Expected deserialization error but got none")
+		return
+	}
+}
+
+func TestForeignStatementDelegation(t *testing.T) {
+	ownerPriv, ownerPk := newKeyForTest()
+	devicePriv, devicePk := newKeyForTest()
+
+	logId := [32]byte{}
+	rand.Read(logId[:])
+	d := NewSignedDelegation(logId, devicePk, 1, 0, 0)
+	d.Signature = signForTest(ownerPriv, d.Delegation.Bytes())
+
+	sls := NewSignedLogStatement(1, logId, []byte("Hello world"))
+	sls.Signature = signForTest(devicePriv, sls.Statement.Bytes())
+
+	fs := &ForeignStatement{LogID: logId, Index: 1, PubKey: ownerPk, Signature: sls.Signature, StatementPreimage: "Hello world", Delegation: d}
+	fs2, err := ForeignStatementFromBytes(fs.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fs2.Delegation == nil || !bytes.Equal(fs2.Delegation.Bytes(), d.Bytes()) {
+		t.Error("Deserialized and serialized delegation not equal")
+		return
+	}
+
+	err = sls.VerifyDelegatedSignature(fs2.PubKey, fs2.Delegation, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sls.VerifyDelegatedSignature(devicePk, fs2.Delegation, nil)
+	if err == nil {
+		t.Error("Expected delegation signed by the wrong key to fail, but it succeeded")
+		return
+	}
+
+	// Statements serialized without a delegation should still deserialize
+	fs.Delegation = nil
+	b := fs.Bytes()
+	fs3, err := ForeignStatementFromBytes(b[:len(b)-4])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fs3.Delegation != nil || fs3.Index != 1 || fs3.StatementPreimage != "Hello world" {
+		t.Error("Could not deserialize foreign statement without delegation")
+		return
+	}
+}
@@ -0,0 +1,131 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrorCode tells a client why the server could not process its request
+type ErrorCode uint16
+
+const (
+	// ErrorCodeUnknown is used for errors the server did not classify. It is
+	// fatal, since the server can't tell whether the connection is still in
+	// a usable state.
+	ErrorCodeUnknown ErrorCode = 0x0000
+
+	// ErrorCodeProtocol is a violation of the protocol, such as skipping the
+	// handshake or using a feature that was not negotiated. It is fatal.
+	ErrorCodeProtocol ErrorCode = 0x0001
+
+	// ErrorCodeInvalidSignature means a statement was not signed by a key
+	// that is allowed to sign it
+	ErrorCodeInvalidSignature ErrorCode = 0x0002
+
+	// ErrorCodeUnknownLog means the request referred to a log the server does
+	// not know
+	ErrorCodeUnknownLog ErrorCode = 0x0003
+
+	// ErrorCodeIndexMismatch means a statement was not for the next index in
+	// its log. The client should resync the log.
+	ErrorCodeIndexMismatch ErrorCode = 0x0004
+
+	// ErrorCodeDuplicate means the log or delegation already exists
+	ErrorCodeDuplicate ErrorCode = 0x0005
+
+	// ErrorCodeLogSealed means a statement was sent to a sealed log
+	ErrorCodeLogSealed ErrorCode = 0x0006
+
+	// ErrorCodeInvalidRequest is used for other requests the server refuses
+	ErrorCodeInvalidRequest ErrorCode = 0x0007
+
+	// ErrorCodeNotFound means the requested commitment does not exist
+	ErrorCodeNotFound ErrorCode = 0x0008
+
+	// ErrorCodeNotReady means the server can't answer the request yet, for
+	// instance because there is no confirmed commitment. The client can retry
+	// later.
+	ErrorCodeNotReady ErrorCode = 0x0009
+)
+
+// Fatal returns true if the server closes the connection after an error with
+// this code
+func (c ErrorCode) Fatal() bool {
+	return c == ErrorCodeUnknown || c == ErrorCodeProtocol
+}
+
+// Error is an error with a code that is reported to the client
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// NewError creates an Error with the given code and a message formatted like
+// fmt.Errorf does
+func NewError(code ErrorCode, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCodeOf returns the code of err when it is an Error, and
+// ErrorCodeUnknown otherwise
+func ErrorCodeOf(err error) ErrorCode {
+	e, ok := err.(*Error)
+	if !ok {
+		return ErrorCodeUnknown
+	}
+	return e.Code
+}
+
+const errorMessageFlagFatal = 0x01
+
+// ErrorMessage is the payload to a MessageTypeError when FeatureErrorCodes was
+// negotiated
+type ErrorMessage struct {
+	Code ErrorCode
+
+	// Fatal is set when the server closes the connection after sending the
+	// error
+	Fatal bool
+
+	// RequestID is the ID of the request that caused the error
+	RequestID uint32
+
+	Message string
+}
+
+// NewErrorMessage is a convenience function for creating a new ErrorMessage
+func NewErrorMessage(code ErrorCode, requestID uint32, message string) *ErrorMessage {
+	return &ErrorMessage{Code: code, Fatal: code.Fatal(), RequestID: requestID, Message: message}
+}
+
+// Bytes serializes an ErrorMessage to a byte slice
+func (m *ErrorMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(m.Code))
+	flags := byte(0)
+	if m.Fatal {
+		flags |= errorMessageFlagFatal
+	}
+	buf.Write([]byte{flags})
+	binary.Write(&buf, binary.BigEndian, m.RequestID)
+	buf.Write([]byte(m.Message))
+	return buf.Bytes()
+}
+
+// NewErrorMessageFromBytes deserializes a byte slice into an ErrorMessage
+func NewErrorMessageFromBytes(b []byte) (*ErrorMessage, error) {
+	if len(b) < 7 {
+		return nil, fmt.Errorf("Unexpected length of error message: %d", len(b))
+	}
+	m := new(ErrorMessage)
+	m.Code = ErrorCode(binary.BigEndian.Uint16(b[0:2]))
+	m.Fatal = b[2]&errorMessageFlagFatal != 0
+	m.RequestID = binary.BigEndian.Uint32(b[3:7])
+	m.Message = string(b[7:])
+	return m, nil
+}
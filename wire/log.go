@@ -3,8 +3,35 @@ package wire
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"sort"
 
-	"github.com/mit-dci/go-bverify/crypto"
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+)
+
+// SealLogPrefix is prepended to a LogStatement when signing or witnessing a
+// seal, so that a seal can never be mistaken for a regular append
+var SealLogPrefix = []byte("b_verify seal")
+
+// Well-known keys in the metadata of a log
+const (
+	MetadataKeyName        = "name"
+	MetadataKeyContentType = "content-type"
+	MetadataKeyRetention   = "retention"
+)
+
+const (
+	// The maximum length of a statement in a log
+	MaxStatementLength = 256
+
+	// The maximum length of a log creation nonce
+	MaxCreateLogNonceLength = 32
+
+	// The maximum number of entries in the metadata of a log, and the maximum
+	// lengths of its keys and values
+	MaxLogMetadataEntries     = 16
+	MaxLogMetadataKeyLength   = 64
+	MaxLogMetadataValueLength = 256
 )
 
 // SignedCreateLogStatement is a log creation message including a signature
@@ -17,6 +44,14 @@ type SignedCreateLogStatement struct {
 type CreateLogStatement struct {
 	ControllingKey   [33]byte
 	InitialStatement []byte
+
+	// Nonce is optional, and allows the same key to create more than one log
+	// with the same initial statement
+	Nonce []byte
+
+	// Metadata is optional, and describes the log using the MetadataKey*
+	// constants or any other keys
+	Metadata map[string]string
 }
 
 // SignedLogStatement is a log append message including a signature
@@ -25,6 +60,14 @@ type SignedLogStatement struct {
 	Statement *LogStatement
 }
 
+// SignedSealLogStatement is a message that closes a log, including a
+// signature. The statement is the final one in the log, after which the
+// server will not accept any appends.
+type SignedSealLogStatement struct {
+	Signature [64]byte
+	Statement *LogStatement
+}
+
 // LogStatement is an unsigned log append message
 type LogStatement struct {
 	LogID     [32]byte
@@ -42,6 +85,16 @@ func NewSignedCreateLogStatement(controllingKey [33]byte, initialStatement []byt
 	return ret
 }
 
+// NewSignedCreateLogStatementWithMetadata is a convenience function for
+// creating a new SignedCreateLogStatement with a nonce and metadata, without
+// the signature filled in
+func NewSignedCreateLogStatementWithMetadata(controllingKey [33]byte, initialStatement []byte, nonce []byte, metadata map[string]string) *SignedCreateLogStatement {
+	ret := NewSignedCreateLogStatement(controllingKey, initialStatement)
+	ret.CreateStatement.Nonce = nonce
+	ret.CreateStatement.Metadata = metadata
+	return ret
+}
+
 // NewSignedLogStatement is a convenience function for creating a new
 // SignedLogStatement without the signature filled in
 func NewSignedLogStatement(index uint64, logID [32]byte, statement []byte) *SignedLogStatement {
@@ -53,6 +106,17 @@ func NewSignedLogStatement(index uint64, logID [32]byte, statement []byte) *Sign
 	return ret
 }
 
+// NewSignedSealLogStatement is a convenience function for creating a new
+// SignedSealLogStatement without the signature filled in
+func NewSignedSealLogStatement(index uint64, logID [32]byte, statement []byte) *SignedSealLogStatement {
+	ret := new(SignedSealLogStatement)
+	ret.Statement = new(LogStatement)
+	ret.Statement.Index = index
+	ret.Statement.LogID = logID
+	ret.Statement.Statement = statement
+	return ret
+}
+
 // Bytes serializes a LogStatement to a byte slice
 func (ls *LogStatement) Bytes() []byte {
 	var buf bytes.Buffer
@@ -70,14 +134,123 @@ func (sls *SignedLogStatement) Bytes() []byte {
 	return buf.Bytes()
 }
 
-// Bytes serializes a CreateLogStatement to a byte slice
+// SealBytes serializes a LogStatement to the byte slice that is signed when
+// it is used to seal the log
+func (ls *LogStatement) SealBytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(SealLogPrefix)
+	buf.Write(ls.Bytes())
+	return buf.Bytes()
+}
+
+// Bytes serializes a SignedSealLogStatement to a byte slice
+func (ssls *SignedSealLogStatement) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(ssls.Signature[:])
+	buf.Write(ssls.Statement.Bytes())
+	return buf.Bytes()
+}
+
+// Witness returns the value the server writes to the log's leaf for this
+// seal. It is domain separated from the witness of a regular append.
+func (ssls *SignedSealLogStatement) Witness() [32]byte {
+	var buf bytes.Buffer
+	buf.Write(SealLogPrefix)
+	buf.Write(ssls.Bytes())
+	return fastsha256.Sum256(buf.Bytes())
+}
+
+// Bytes serializes a CreateLogStatement to a byte slice. Statements without a
+// nonce or metadata serialize exactly as they did before these existed, so
+// their log IDs do not change.
 func (cls *CreateLogStatement) Bytes() []byte {
 	var buf bytes.Buffer
 	buf.Write(cls.ControllingKey[:])
 	WriteVarBytes(&buf, cls.InitialStatement)
+	if len(cls.Nonce) > 0 || len(cls.Metadata) > 0 {
+		WriteCreateLogExtension(&buf, cls.Nonce, cls.Metadata)
+	}
 	return buf.Bytes()
 }
 
+// WriteCreateLogExtension serializes the nonce and metadata of a log. The
+// metadata is written in order of its keys, so the serialization is
+// deterministic.
+func WriteCreateLogExtension(w io.Writer, nonce []byte, metadata map[string]string) error {
+	err := WriteVarBytes(w, nonce)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	err = WriteVarInt(w, uint64(len(keys)))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = WriteVarBytes(w, []byte(k))
+		if err != nil {
+			return err
+		}
+		err = WriteVarBytes(w, []byte(metadata[k]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadCreateLogExtension deserializes the nonce and metadata of a log written
+// by WriteCreateLogExtension. The keys have to be in order without duplicates,
+// so there is only one serialization of the same metadata.
+func ReadCreateLogExtension(r io.Reader) ([]byte, map[string]string, error) {
+	nonce, err := ReadVarBytes(r, MaxCreateLogNonceLength, "nonce")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nonce) > MaxCreateLogNonceLength {
+		return nil, nil, fmt.Errorf("Nonce too long: %d", len(nonce))
+	}
+
+	count, err := ReadVarInt(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if count > MaxLogMetadataEntries {
+		return nil, nil, fmt.Errorf("Too many metadata entries: %d", count)
+	}
+
+	var metadata map[string]string
+	if count > 0 {
+		metadata = make(map[string]string, count)
+	}
+	prev := ""
+	for i := uint64(0); i < count; i++ {
+		k, err := ReadVarBytes(r, MaxLogMetadataKeyLength, "metadata key")
+		if err != nil {
+			return nil, nil, err
+		}
+		if i > 0 && string(k) <= prev {
+			return nil, nil, fmt.Errorf("Metadata keys out of order")
+		}
+		prev = string(k)
+		v, err := ReadVarBytes(r, MaxLogMetadataValueLength, "metadata value")
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(k) > MaxLogMetadataKeyLength || len(v) > MaxLogMetadataValueLength {
+			return nil, nil, fmt.Errorf("Metadata entry too long")
+		}
+		metadata[string(k)] = string(v)
+	}
+	return nonce, metadata, nil
+}
+
 // Bytes serializes a SignedCreateLogStatement to a byte slice
 func (scls *SignedCreateLogStatement) Bytes() []byte {
 	var buf bytes.Buffer
@@ -89,17 +262,23 @@ func (scls *SignedCreateLogStatement) Bytes() []byte {
 // NewLogStatementFromBytes deserializes a byte slice into a
 // LogStatement
 func NewLogStatementFromBytes(b []byte) (*LogStatement, error) {
+	if len(b) < 32 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
 	buf := bytes.NewBuffer(b)
 	ls := new(LogStatement)
-	buf.Read(ls.LogID[:])
+	copy(ls.LogID[:], buf.Next(32))
 	idx, err := ReadVarInt(buf)
 	if err != nil {
 		return nil, err
 	}
-	statement, err := ReadVarBytes(buf, 256, "statement")
+	statement, err := ReadVarBytes(buf, MaxStatementLength, "statement")
 	if err != nil {
 		return nil, err
 	}
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("Unexpected trailing bytes after statement")
+	}
 	ls.Index = idx
 	ls.Statement = statement
 	return ls, nil
@@ -125,6 +304,16 @@ func NewSignedLogStatementFromBytes(b []byte) (*SignedLogStatement, error) {
 	return sls, nil
 }
 
+// NewSignedSealLogStatementFromBytes deserializes a byte slice into a
+// SignedSealLogStatement
+func NewSignedSealLogStatementFromBytes(b []byte) (*SignedSealLogStatement, error) {
+	sls, err := NewSignedLogStatementFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedSealLogStatement{Signature: sls.Signature, Statement: sls.Statement}, nil
+}
+
 // NewCreateLogStatementFromBytes deserializes a byte slice into a
 // CreateLogStatement
 func NewCreateLogStatementFromBytes(b []byte) (*CreateLogStatement, error) {
@@ -137,11 +326,25 @@ func NewCreateLogStatementFromBytes(b []byte) (*CreateLogStatement, error) {
 	if n < 33 {
 		return nil, fmt.Errorf("Unexpected end of buffer")
 	}
-	statement, err := ReadVarBytes(buf, 256, "statement")
+	statement, err := ReadVarBytes(buf, MaxStatementLength, "statement")
 	if err != nil {
 		return nil, err
 	}
 	cls.InitialStatement = statement
+	if buf.Len() > 0 {
+		cls.Nonce, cls.Metadata, err = ReadCreateLogExtension(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Bytes leaves out an empty extension, so the signature would not
+		// be over what we received
+		if len(cls.Nonce) == 0 && len(cls.Metadata) == 0 {
+			return nil, fmt.Errorf("Empty nonce and metadata")
+		}
+		if buf.Len() > 0 {
+			return nil, fmt.Errorf("Unexpected trailing bytes after statement")
+		}
+	}
 	return cls, nil
 }
 
@@ -165,13 +368,37 @@ func NewSignedCreateLogStatementFromBytes(b []byte) (*SignedCreateLogStatement,
 }
 
 // VerifySignature will verify if the signature in this SignedCreateLogStatement
-// is valid
+// is a valid legacy signature
 func (scls *SignedCreateLogStatement) VerifySignature() error {
-	return crypto.VerifySig(scls.CreateStatement.Bytes(), scls.CreateStatement.ControllingKey, scls.Signature)
+	return scls.VerifySignatureInDomain(nil)
+}
+
+// VerifySignatureInDomain will verify if the signature in this
+// SignedCreateLogStatement is valid for the given signature domain
+func (scls *SignedCreateLogStatement) VerifySignatureInDomain(d *SignatureDomain) error {
+	return d.verifySig(scls.CreateStatement.Bytes(), scls.CreateStatement.ControllingKey, scls.Signature)
 }
 
 // VerifySignature will verify if the signature in this SignedLogStatement
-// is valid
+// is a valid legacy signature
 func (sls *SignedLogStatement) VerifySignature(controllingPubKey [33]byte) error {
-	return crypto.VerifySig(sls.Statement.Bytes(), controllingPubKey, sls.Signature)
+	return sls.VerifySignatureInDomain(controllingPubKey, nil)
+}
+
+// VerifySignatureInDomain will verify if the signature in this
+// SignedLogStatement is valid for the given signature domain
+func (sls *SignedLogStatement) VerifySignatureInDomain(controllingPubKey [33]byte, d *SignatureDomain) error {
+	return d.verifySig(sls.Statement.Bytes(), controllingPubKey, sls.Signature)
+}
+
+// VerifySignature will verify if the signature in this SignedSealLogStatement
+// is a valid legacy signature
+func (ssls *SignedSealLogStatement) VerifySignature(controllingPubKey [33]byte) error {
+	return ssls.VerifySignatureInDomain(controllingPubKey, nil)
+}
+
+// VerifySignatureInDomain will verify if the signature in this
+// SignedSealLogStatement is valid for the given signature domain
+func (ssls *SignedSealLogStatement) VerifySignatureInDomain(controllingPubKey [33]byte, d *SignatureDomain) error {
+	return d.verifySig(ssls.Statement.SealBytes(), controllingPubKey, ssls.Signature)
 }
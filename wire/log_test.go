@@ -2,7 +2,10 @@ package wire
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/hex"
+
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
 )
 
 import (
@@ -118,3 +121,244 @@ func TestSignedLogStatement(t *testing.T) {
 		return
 	}
 }
+
+func TestSignedSealLogStatement(t *testing.T) {
+	priv, pk := newKeyForTest()
+	logID := [32]byte{}
+	rand.Read(logID[:])
+
+	s := NewSignedSealLogStatement(3, logID, []byte("Goodbye World"))
+	s.Signature = signForTest(priv, s.Statement.SealBytes())
+
+	s2, err := NewSignedSealLogStatementFromBytes(s.Bytes())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !bytes.Equal(s.Bytes(), s2.Bytes()) {
+		t.Errorf("Deserialized and serialized seal not equal")
+		return
+	}
+
+	err = s2.VerifySignature(pk)
+	if err != nil {
+		t.Errorf("Expected seal signature to verify: %s", err.Error())
+		return
+	}
+
+	// The same statement signed as a regular append must not be a valid seal,
+	// and must produce a different witness
+	sls := NewSignedLogStatement(3, logID, []byte("Goodbye World"))
+	sls.Signature = signForTest(priv, sls.Statement.Bytes())
+	s.Signature = sls.Signature
+	err = s.VerifySignature(pk)
+	if err == nil {
+		t.Error("Expected append signature to be rejected for a seal")
+		return
+	}
+	if s.Witness() == fastsha256.Sum256(sls.Bytes()) {
+		t.Error("Expected seal witness to differ from append witness")
+		return
+	}
+
+	fs := &ForeignStatement{LogID: logID, Index: 3, Sealed: true}
+	fs2, err := ForeignStatementFromBytes(fs.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !fs2.Sealed || fs2.InitialStatement || fs2.Index != 3 {
+		t.Errorf("Sealed flag of foreign statement did not survive serialization")
+		return
+	}
+}
+
+func TestSignatureDomain(t *testing.T) {
+	priv, pk := newKeyForTest()
+
+	d := NewSignatureDomain([32]byte{0x01}, [32]byte{0x02})
+	d2, err := NewSignatureDomainFromBytes(d.Bytes())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !d.Equal(d2) {
+		t.Error("Deserialized and serialized signature domain not equal")
+		return
+	}
+
+	l := NewSignedCreateLogStatement(pk, []byte("Hello World"))
+	l.Signature = signForTest(priv, d.SigningPayload(l.CreateStatement.Bytes()))
+	err = l.VerifySignatureInDomain(d)
+	if err != nil {
+		t.Errorf("Expected signature in domain to verify: %s", err.Error())
+		return
+	}
+
+	err = l.VerifySignature()
+	if err == nil {
+		t.Error("Expected domain signature to be rejected as legacy signature")
+		return
+	}
+
+	err = l.VerifySignatureInDomain(NewSignatureDomain([32]byte{0x01}, [32]byte{0x03}))
+	if err == nil {
+		t.Error("Expected signature to be rejected in another domain")
+		return
+	}
+
+	fs := &ForeignStatement{PubKey: pk, Signature: l.Signature, SignatureDomain: d}
+	fs2, err := ForeignStatementFromBytes(fs.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !fs2.SignatureDomain.Equal(d) {
+		t.Error("Signature domain of foreign statement did not survive serialization")
+		return
+	}
+
+	_, err = NewSignatureDomainFromBytes(d.Bytes()[:10])
+	if err == nil {
+		t.Error("Expected deserialization error but got none")
+		return
+	}
+}
+
+func TestCreateLogStatementMetadata(t *testing.T) {
+	_, pk := newKeyForTest()
+
+	legacy := NewSignedCreateLogStatement(pk, []byte("Hello World"))
+	empty := NewSignedCreateLogStatementWithMetadata(pk, []byte("Hello World"), nil, map[string]string{})
+	if !bytes.Equal(legacy.CreateStatement.Bytes(), empty.CreateStatement.Bytes()) {
+		t.Error("Expected statement without nonce and metadata to serialize as before")
+		return
+	}
+
+	metadata := map[string]string{MetadataKeyName: "Test", MetadataKeyRetention: "30d", MetadataKeyContentType: "text/plain"}
+	l := NewSignedCreateLogStatementWithMetadata(pk, []byte("Hello World"), []byte{0x01, 0x02}, metadata)
+	l2, err := NewSignedCreateLogStatementFromBytes(l.Bytes())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !bytes.Equal(l.Bytes(), l2.Bytes()) {
+		t.Error("Deserialized and serialized create statement not equal")
+		return
+	}
+	if !bytes.Equal(l2.CreateStatement.Nonce, []byte{0x01, 0x02}) || l2.CreateStatement.Metadata[MetadataKeyRetention] != "30d" {
+		t.Errorf("Nonce or metadata did not survive serialization: %v", l2.CreateStatement)
+		return
+	}
+
+	// Every statement we accept has to serialize to the bytes we received,
+	// since the signature is checked over the serialization
+	var ext bytes.Buffer
+	WriteCreateLogExtension(&ext, nil, nil)
+	emptyExt := append(legacy.Bytes(), ext.Bytes()...)
+	_, err = NewSignedCreateLogStatementFromBytes(emptyExt)
+	if err == nil {
+		t.Error("Expected statement with an empty extension to be rejected")
+		return
+	}
+	ext.Reset()
+	ext.Write([]byte{0x00, 0x02})
+	WriteVarBytes(&ext, []byte(MetadataKeyRetention))
+	WriteVarBytes(&ext, []byte("30d"))
+	WriteVarBytes(&ext, []byte(MetadataKeyName))
+	WriteVarBytes(&ext, []byte("Test"))
+	unordered := append(legacy.Bytes(), ext.Bytes()...)
+	_, err = NewSignedCreateLogStatementFromBytes(unordered)
+	if err == nil {
+		t.Error("Expected statement with metadata keys out of order to be rejected")
+		return
+	}
+	for _, b := range [][]byte{legacy.Bytes(), l.Bytes(), NewSignedCreateLogStatementWithMetadata(pk, []byte("Hello World"), []byte{0x01}, nil).Bytes()} {
+		decoded, err := NewSignedCreateLogStatementFromBytes(b)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if !bytes.Equal(decoded.Bytes(), b) {
+			t.Errorf("Create statement %x serialized as %x", b, decoded.Bytes())
+			return
+		}
+	}
+
+	other := NewSignedCreateLogStatementWithMetadata(pk, []byte("Hello World"), []byte{0x03}, metadata)
+	if bytes.Equal(l.CreateStatement.Bytes(), other.CreateStatement.Bytes()) {
+		t.Error("Expected a different nonce to result in a different log ID")
+		return
+	}
+
+	info := NewLogInfoMessage([32]byte{0x01}, pk, metadata)
+	info2, err := NewLogInfoMessageFromBytes(info.Bytes())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if info2.ControllingKey != pk || info2.Metadata[MetadataKeyName] != "Test" {
+		t.Errorf("Log info did not survive serialization: %v", info2)
+		return
+	}
+}
+
+func TestBatchLogStatement(t *testing.T) {
+	priv, pk := newKeyForTest()
+	logID := [32]byte{0x01}
+
+	batch := NewBatchLogStatement([]*LogStatement{
+		NewSignedLogStatement(1, logID, []byte("Sent 1 coin")).Statement,
+		NewSignedLogStatement(5, [32]byte{0x02}, []byte("Received 1 coin")).Statement,
+	})
+	hash := batch.Hash()
+	sb := NewSignedBatchLogStatement(batch)
+	sb.Signatures[0] = signForTest(priv, hash[:])
+
+	sb2, err := NewSignedBatchLogStatementFromBytes(sb.Bytes())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !bytes.Equal(sb.Bytes(), sb2.Bytes()) {
+		t.Error("Deserialized and serialized batch not equal")
+		return
+	}
+
+	err = sb2.Batch.VerifySignature(sb2.Signatures[0], pk, nil)
+	if err != nil {
+		t.Errorf("Expected batch signature to verify: %s", err.Error())
+		return
+	}
+	if sb2.Batch.Position(logID) != 0 || sb2.Batch.Position([32]byte{0x03}) != -1 {
+		t.Error("Unexpected position of log in batch")
+		return
+	}
+	if batch.Witness(0, sb.Signatures[0]) == batch.Witness(1, sb.Signatures[0]) {
+		t.Error("Expected witnesses to differ per position")
+		return
+	}
+
+	fs := &ForeignStatement{LogID: logID, Index: 1, Batch: batch, BatchPosition: 1}
+	fs2, err := ForeignStatementFromBytes(fs.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fs2.Batch == nil || fs2.BatchPosition != 1 || fs2.Batch.Hash() != hash {
+		t.Error("Batch of foreign statement did not survive serialization")
+		return
+	}
+
+	_, err = NewSignedBatchLogStatementFromBytes(sb.Bytes()[:len(sb.Bytes())-1])
+	if err == nil {
+		t.Error("Expected deserialization error but got none")
+		return
+	}
+
+	_, err = NewBatchLogStatementFromBytes([]byte{0x00})
+	if err == nil {
+		t.Error("Expected empty batch to be rejected")
+		return
+	}
+}
@@ -3,6 +3,7 @@ package wire
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 )
 
 type MessageType byte
@@ -71,6 +72,90 @@ const (
 	// [S > C]     MessageTypeCommitmentDetails is sent to the client in response to the
 	//             MessageTypeRequestCommitmentDetails containing the commitment details
 	MessageTypeCommitmentDetails MessageType = 0x0F
+
+	// [C > S]     MessageTypeDelegateLog is sent to the server to authorize
+	//             another key to append to a log, signed by the log's
+	//             controlling key
+	MessageTypeDelegateLog MessageType = 0x10
+
+	// [C > S]     MessageTypeRevokeDelegation is sent to the server to revoke
+	//             an earlier delegation, signed by the log's controlling key
+	MessageTypeRevokeDelegation MessageType = 0x11
+
+	// [C > S]     MessageTypeSealLog is sent to the server to append a final
+	//             statement to a log, after which no more appends are accepted
+	MessageTypeSealLog MessageType = 0x12
+
+	// [C > S]     MessageTypeRequestSignatureDomain is sent to the server to
+	//             learn the domain clients should sign statements in
+	MessageTypeRequestSignatureDomain MessageType = 0x13
+
+	// [S > C]     MessageTypeSignatureDomain is sent to the client in response
+	//             to the MessageTypeRequestSignatureDomain containing the domain
+	//             and whether the server still accepts legacy signatures
+	MessageTypeSignatureDomain MessageType = 0x14
+
+	// [C > S]     MessageTypeRequestLogInfo is sent to the server to request
+	//             the controlling key and metadata of a log
+	MessageTypeRequestLogInfo MessageType = 0x15
+
+	// [S > C]     MessageTypeLogInfo is sent to the client in response to the
+	//             MessageTypeRequestLogInfo containing the log's details
+	MessageTypeLogInfo MessageType = 0x16
+
+	// [C > S]     MessageTypeBatchAppendLog is sent to the server to append
+	//             statements to several logs atomically
+	MessageTypeBatchAppendLog MessageType = 0x17
+
+	// [C > S]     MessageTypeVersion is the first message a client sends after
+	//             connecting, containing its protocol version and features.
+	//             The server will not process any other message before it.
+	MessageTypeVersion MessageType = 0x18
+
+	// [S > C]     MessageTypeVersionAck is sent to the client in response to
+	//             the MessageTypeVersion containing the negotiated features,
+	//             the network and the server's identity
+	MessageTypeVersionAck MessageType = 0x19
+
+	// [C > S > C] MessageTypePing is sent to check if the other side is still
+	//             there. It has to be answered with a MessageTypePong
+	//             carrying the same payload.
+	MessageTypePing MessageType = 0x1A
+
+	// [S > C > S] MessageTypePong is the response to a MessageTypePing
+	MessageTypePong MessageType = 0x1B
+
+	// [C > S]     MessageTypeRequestLogStatus is sent to the server to request
+	//             the state of a log as the server knows it
+	MessageTypeRequestLogStatus MessageType = 0x1C
+
+	// [S > C]     MessageTypeLogStatus is sent to the client in response to
+	//             the MessageTypeRequestLogStatus containing the next index,
+	//             controlling key, last value and last commitment of the log
+	MessageTypeLogStatus MessageType = 0x1D
+
+	// [C > S]     MessageTypeWatchLogs is sent to the server to receive the
+	//             changes to a set of logs in every MessageTypeProofUpdate,
+	//             including logs that were written by other clients
+	MessageTypeWatchLogs MessageType = 0x1E
+
+	// [C > S]     MessageTypeUnwatchLogs is sent to the server to stop
+	//             receiving changes to a set of watched logs
+	MessageTypeUnwatchLogs MessageType = 0x1F
+
+	// [C <> S]    MessageTypeSession carries a message that belongs to one of
+	//             the logical sessions on a connection. Every session has its
+	//             own subscriptions and receives its own proof updates.
+	MessageTypeSession MessageType = 0x20
+
+	// [C > S]     MessageTypeCloseSession ends a logical session, after which
+	//             the server forgets about its subscriptions
+	MessageTypeCloseSession MessageType = 0x21
+
+	// [S > C]     MessageTypeNewCommitment is sent by the server when one of its
+	//             commitments was included in a block, and can be fetched
+	//             with MessageTypeRequestCommitmentHistory
+	MessageTypeNewCommitment MessageType = 0x22
 )
 
 // RequestProofMessage is the payload to a MessageTypeRequestProof
@@ -99,6 +184,9 @@ func NewRequestProofMessage(logIDs [][32]byte) *RequestProofMessage {
 // NewRequestProofMessageFromBytes deserializes a byte slice into a
 // RequestProofMessage
 func NewRequestProofMessageFromBytes(b []byte) (*RequestProofMessage, error) {
+	if len(b)%32 != 0 {
+		return nil, fmt.Errorf("Unexpected length of proof request: %d", len(b))
+	}
 	msg := new(RequestProofMessage)
 	msg.LogIDs = make([][32]byte, 0)
 	buf := bytes.NewBuffer(b)
@@ -132,6 +220,9 @@ func NewRequestCommitmentDetailsMessage(commitment [32]byte) *RequestCommitmentD
 // NewRequestCommitmentDetailsMessageFromBytes deserializes a byte slice into a
 // RequestCommitmentDetailsMessage
 func NewRequestCommitmentDetailsMessageFromBytes(b []byte) (*RequestCommitmentDetailsMessage, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Unexpected length of commitment details request: %d", len(b))
+	}
 	msg := new(RequestCommitmentDetailsMessage)
 	copy(msg.Commitment[:], b[:])
 	return msg, nil
@@ -159,6 +250,9 @@ func NewRequestCommitmentHistoryMessage(sinceCommitment [32]byte) *RequestCommit
 // NewRequestCommitmentHistoryMessageFromBytes deserializes a byte slice into a
 // RequestCommitmentHistoryMessage
 func NewRequestCommitmentHistoryMessageFromBytes(b []byte) (*RequestCommitmentHistoryMessage, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Unexpected length of commitment history request: %d", len(b))
+	}
 	msg := new(RequestCommitmentHistoryMessage)
 	copy(msg.SinceCommitment[:], b[:])
 	return msg, nil
@@ -186,8 +280,12 @@ func NewCommitmentDetailsMessage(c *Commitment) *CommitmentDetailsMessage {
 // NewCommitmentDetailsMessageFromBytes deserializes a byte slice into a
 // CommitmentDetailsMessage
 func NewCommitmentDetailsMessageFromBytes(b []byte) (*CommitmentDetailsMessage, error) {
+	c, err := CommitmentFromBytes(b)
+	if err != nil {
+		return nil, err
+	}
 	msg := new(CommitmentDetailsMessage)
-	msg.Commitment = CommitmentFromBytes(b)
+	msg.Commitment = c
 	return msg, nil
 }
 
@@ -222,17 +320,327 @@ func NewCommitmentHistoryMessage(c []*Commitment) *CommitmentHistoryMessage {
 // NewCommitmentHistoryMessageFromBytes deserializes a byte slice into a
 // CommitmentHistoryMessage
 func NewCommitmentHistoryMessageFromBytes(b []byte) (*CommitmentHistoryMessage, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
 	msg := new(CommitmentHistoryMessage)
 	buf := bytes.NewBuffer(b)
 
-	numCommitments := int32(0)
-	binary.Read(buf, binary.BigEndian, &numCommitments)
+	// Every commitment takes at least its length prefix and the fixed size
+	// fields, so the count can't be more than what fits in the buffer
+	numCommitments := binary.BigEndian.Uint32(buf.Next(4))
+	if uint64(numCommitments)*(4+minCommitmentSize) > uint64(buf.Len()) {
+		return nil, fmt.Errorf("Commitment history claims %d commitments in %d bytes", numCommitments, buf.Len())
+	}
 
 	msg.Commitments = make([]*Commitment, numCommitments)
 	for i := range msg.Commitments {
-		commitmentLength := int32(0)
-		binary.Read(buf, binary.BigEndian, &commitmentLength)
-		msg.Commitments[i] = CommitmentFromBytes(buf.Next(int(commitmentLength)))
+		if buf.Len() < 4 {
+			return nil, fmt.Errorf("Unexpected end of buffer")
+		}
+		commitmentLength := binary.BigEndian.Uint32(buf.Next(4))
+		if commitmentLength > uint32(buf.Len()) {
+			return nil, fmt.Errorf("Commitment length %d exceeds remaining %d bytes", commitmentLength, buf.Len())
+		}
+		c, err := CommitmentFromBytes(buf.Next(int(commitmentLength)))
+		if err != nil {
+			return nil, err
+		}
+		msg.Commitments[i] = c
+	}
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("Unexpected trailing bytes after commitment history")
+	}
+	return msg, nil
+}
+
+// SignatureDomainMessage is the payload to a MessageTypeSignatureDomain
+type SignatureDomainMessage struct {
+	// The domain the server expects statements to be signed in
+	Domain *SignatureDomain
+
+	// Whether the server still accepts signatures without domain separation
+	AcceptsLegacy bool
+}
+
+// Bytes serializes a SignatureDomainMessage to a byte slice
+func (m *SignatureDomainMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	if m.AcceptsLegacy {
+		buf.Write([]byte{0x01})
+	} else {
+		buf.Write([]byte{0x00})
+	}
+	buf.Write(m.Domain.Bytes())
+	return buf.Bytes()
+}
+
+// NewSignatureDomainMessage is a convenience function for creating a new
+// SignatureDomainMessage
+func NewSignatureDomainMessage(d *SignatureDomain, acceptsLegacy bool) *SignatureDomainMessage {
+	msg := new(SignatureDomainMessage)
+	msg.Domain = d
+	msg.AcceptsLegacy = acceptsLegacy
+	return msg
+}
+
+// NewSignatureDomainMessageFromBytes deserializes a byte slice into a
+// SignatureDomainMessage
+func NewSignatureDomainMessageFromBytes(b []byte) (*SignatureDomainMessage, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
+	var err error
+	msg := new(SignatureDomainMessage)
+	msg.AcceptsLegacy = b[0] == 0x01
+	msg.Domain, err = NewSignatureDomainFromBytes(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// RequestLogInfoMessage is the payload to a MessageTypeRequestLogInfo
+type RequestLogInfoMessage struct {
+	LogID [32]byte
+}
+
+// Bytes serializes a RequestLogInfoMessage to a byte slice
+func (m *RequestLogInfoMessage) Bytes() []byte {
+	return m.LogID[:]
+}
+
+// NewRequestLogInfoMessage is a convenience function for creating a new
+// RequestLogInfoMessage for a single log
+func NewRequestLogInfoMessage(logID [32]byte) *RequestLogInfoMessage {
+	msg := new(RequestLogInfoMessage)
+	msg.LogID = logID
+	return msg
+}
+
+// NewRequestLogInfoMessageFromBytes deserializes a byte slice into a
+// RequestLogInfoMessage
+func NewRequestLogInfoMessageFromBytes(b []byte) (*RequestLogInfoMessage, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Unexpected length of log info request: %d", len(b))
+	}
+	msg := new(RequestLogInfoMessage)
+	copy(msg.LogID[:], b)
+	return msg, nil
+}
+
+// LogInfoMessage is the payload to a MessageTypeLogInfo
+type LogInfoMessage struct {
+	LogID          [32]byte
+	ControllingKey [33]byte
+	Metadata       map[string]string
+}
+
+// Bytes serializes a LogInfoMessage to a byte slice
+func (m *LogInfoMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(m.LogID[:])
+	buf.Write(m.ControllingKey[:])
+	// The nonce is of no use to the client, so it is left out
+	WriteCreateLogExtension(&buf, nil, m.Metadata)
+	return buf.Bytes()
+}
+
+// NewLogInfoMessage is a convenience function for creating a new
+// LogInfoMessage
+func NewLogInfoMessage(logID [32]byte, controllingKey [33]byte, metadata map[string]string) *LogInfoMessage {
+	msg := new(LogInfoMessage)
+	msg.LogID = logID
+	msg.ControllingKey = controllingKey
+	msg.Metadata = metadata
+	return msg
+}
+
+// NewLogInfoMessageFromBytes deserializes a byte slice into a LogInfoMessage
+func NewLogInfoMessageFromBytes(b []byte) (*LogInfoMessage, error) {
+	if len(b) < 32+33 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
+	var err error
+	msg := new(LogInfoMessage)
+	copy(msg.LogID[:], b[:32])
+	copy(msg.ControllingKey[:], b[32:65])
+	_, msg.Metadata, err = ReadCreateLogExtension(bytes.NewBuffer(b[65:]))
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// RequestLogStatusMessage is the payload to a MessageTypeRequestLogStatus
+type RequestLogStatusMessage struct {
+	LogID [32]byte
+}
+
+// Bytes serializes a RequestLogStatusMessage to a byte slice
+func (m *RequestLogStatusMessage) Bytes() []byte {
+	return m.LogID[:]
+}
+
+// NewRequestLogStatusMessage is a convenience function for creating a new
+// RequestLogStatusMessage for a single log
+func NewRequestLogStatusMessage(logID [32]byte) *RequestLogStatusMessage {
+	msg := new(RequestLogStatusMessage)
+	msg.LogID = logID
+	return msg
+}
+
+// NewRequestLogStatusMessageFromBytes deserializes a byte slice into a
+// RequestLogStatusMessage
+func NewRequestLogStatusMessageFromBytes(b []byte) (*RequestLogStatusMessage, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Unexpected length of log status request: %d", len(b))
+	}
+	msg := new(RequestLogStatusMessage)
+	copy(msg.LogID[:], b)
+	return msg, nil
+}
+
+const (
+	// Flags in a serialized LogStatusMessage
+	logStatusFlagSealed    byte = 0x01
+	logStatusFlagCommitted byte = 0x02
+
+	logStatusMessageSize = 32 + 8 + 33 + 32 + 1 + 32 + 8
+)
+
+// LogStatusMessage is the payload to a MessageTypeLogStatus
+type LogStatusMessage struct {
+	LogID [32]byte
+
+	// NextIndex is the index the server expects the next statement at
+	NextIndex uint64
+
+	ControllingKey [33]byte
+
+	// LastValue is what the server witnessed for the statement at
+	// NextIndex-1, which is the hash of the signed statement
+	LastValue [32]byte
+
+	// Sealed is set when the last statement sealed the log
+	Sealed bool
+
+	// Committed is set when a statement of the log was included in a
+	// commitment. Commitment is the last commitment that did, and
+	// CommittedIndex the index of the statement it included.
+	Committed      bool
+	Commitment     [32]byte
+	CommittedIndex uint64
+}
+
+// Bytes serializes a LogStatusMessage to a byte slice
+func (m *LogStatusMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(m.LogID[:])
+	binary.Write(&buf, binary.BigEndian, m.NextIndex)
+	buf.Write(m.ControllingKey[:])
+	buf.Write(m.LastValue[:])
+	flags := byte(0x00)
+	if m.Sealed {
+		flags |= logStatusFlagSealed
+	}
+	if m.Committed {
+		flags |= logStatusFlagCommitted
+	}
+	buf.Write([]byte{flags})
+	buf.Write(m.Commitment[:])
+	binary.Write(&buf, binary.BigEndian, m.CommittedIndex)
+	return buf.Bytes()
+}
+
+// NewLogStatusMessageFromBytes deserializes a byte slice into a
+// LogStatusMessage
+func NewLogStatusMessageFromBytes(b []byte) (*LogStatusMessage, error) {
+	if len(b) != logStatusMessageSize {
+		return nil, fmt.Errorf("Unexpected length of log status: %d", len(b))
+	}
+	msg := new(LogStatusMessage)
+	buf := bytes.NewBuffer(b)
+	copy(msg.LogID[:], buf.Next(32))
+	msg.NextIndex = binary.BigEndian.Uint64(buf.Next(8))
+	copy(msg.ControllingKey[:], buf.Next(33))
+	copy(msg.LastValue[:], buf.Next(32))
+	flags := buf.Next(1)[0]
+	msg.Sealed = flags&logStatusFlagSealed != 0
+	msg.Committed = flags&logStatusFlagCommitted != 0
+	copy(msg.Commitment[:], buf.Next(32))
+	msg.CommittedIndex = binary.BigEndian.Uint64(buf.Next(8))
+	return msg, nil
+}
+
+// MaxWatchLogIDs is the maximum number of logs in a single WatchLogsMessage
+const MaxWatchLogIDs = 1024
+
+// WatchLogsMessage is the payload to a MessageTypeWatchLogs and a
+// MessageTypeUnwatchLogs
+type WatchLogsMessage struct {
+	LogIDs [][32]byte
+}
+
+// Bytes serializes a WatchLogsMessage to a byte slice
+func (m *WatchLogsMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, logID := range m.LogIDs {
+		buf.Write(logID[:])
+	}
+	return buf.Bytes()
+}
+
+// NewWatchLogsMessage is a convenience function for creating a new
+// WatchLogsMessage from an array of logIDs
+func NewWatchLogsMessage(logIDs [][32]byte) *WatchLogsMessage {
+	msg := new(WatchLogsMessage)
+	msg.LogIDs = logIDs
+	return msg
+}
+
+// NewWatchLogsMessageFromBytes deserializes a byte slice into a
+// WatchLogsMessage
+func NewWatchLogsMessageFromBytes(b []byte) (*WatchLogsMessage, error) {
+	if len(b) == 0 || len(b)%32 != 0 {
+		return nil, fmt.Errorf("Unexpected length of watch message: %d", len(b))
+	}
+	if len(b)/32 > MaxWatchLogIDs {
+		return nil, fmt.Errorf("Too many logs in watch message: %d", len(b)/32)
+	}
+	msg := new(WatchLogsMessage)
+	msg.LogIDs = make([][32]byte, len(b)/32)
+	for i := range msg.LogIDs {
+		copy(msg.LogIDs[i][:], b[i*32:])
+	}
+	return msg, nil
+}
+
+// NewCommitmentMessage is the payload to a MessageTypeNewCommitment
+type NewCommitmentMessage struct {
+	Commitment [32]byte
+}
+
+// Bytes serializes a NewCommitmentMessage to a byte slice
+func (m *NewCommitmentMessage) Bytes() []byte {
+	return m.Commitment[:]
+}
+
+// NewNewCommitmentMessage is a convenience function for creating a new
+// NewCommitmentMessage
+func NewNewCommitmentMessage(commitment [32]byte) *NewCommitmentMessage {
+	msg := new(NewCommitmentMessage)
+	msg.Commitment = commitment
+	return msg
+}
+
+// NewNewCommitmentMessageFromBytes deserializes a byte slice into a
+// NewCommitmentMessage
+func NewNewCommitmentMessageFromBytes(b []byte) (*NewCommitmentMessage, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Unexpected length of new commitment message: %d", len(b))
 	}
+	msg := new(NewCommitmentMessage)
+	copy(msg.Commitment[:], b)
 	return msg, nil
 }
@@ -0,0 +1,270 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/mit-dci/go-bverify/crypto"
+	"github.com/mit-dci/go-bverify/crypto/btcec"
+	"github.com/mit-dci/go-bverify/crypto/fastsha256"
+	"github.com/mit-dci/go-bverify/crypto/sig64"
+)
+
+// SecureHandshakeTag is prepended to the transcript of the secure transport
+// handshake, so that the server's signature over it can't be used elsewhere
+var SecureHandshakeTag = []byte("b_verify secure transport v1")
+
+// MaxSecureRecordSize is the maximum number of plaintext bytes sent in a
+// single encrypted record. Larger writes are split over multiple records.
+const MaxSecureRecordSize = 65535
+
+// SecureConn is a net.Conn that encrypts and authenticates everything sent
+// over the underlying connection. Both sides exchange ephemeral keys, and the
+// server signs the handshake with its static key, which a client can pin.
+// Since it is a net.Conn, it can be passed to NewConnection like any other
+// transport.
+type SecureConn struct {
+	net.Conn
+
+	sendCipher cipher.AEAD
+	recvCipher cipher.AEAD
+	sendNonce  uint64
+	recvNonce  uint64
+
+	// Decrypted bytes from the last record not yet returned by Read
+	readBuf []byte
+
+	writeLock sync.Mutex
+	readLock  sync.Mutex
+
+	// The static key of the server we're talking to
+	remoteKey [33]byte
+}
+
+// NewSecureClientConn performs the client side of the secure transport
+// handshake over c. When serverKey is not nil, the handshake fails unless the
+// server proves it holds the private key to it. Otherwise, any server key is
+// accepted and can be read with RemoteKey.
+func NewSecureClientConn(c net.Conn, serverKey *[33]byte) (*SecureConn, error) {
+	eph, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	var ephPub [33]byte
+	copy(ephPub[:], eph.PubKey().SerializeCompressed())
+
+	_, err = c.Write(ephPub[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The server replies with its ephemeral key, its static key and its
+	// signature over the transcript
+	b := make([]byte, 33+33+64)
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		return nil, err
+	}
+	var remoteEph, remoteKey [33]byte
+	var sig [64]byte
+	copy(remoteEph[:], b[0:33])
+	copy(remoteKey[:], b[33:66])
+	copy(sig[:], b[66:])
+
+	if serverKey != nil && *serverKey != remoteKey {
+		return nil, fmt.Errorf("Server key [%x] does not match the pinned key [%x]", remoteKey, *serverKey)
+	}
+
+	transcript := secureTranscript(ephPub, remoteEph, remoteKey)
+	err = crypto.VerifySig(transcript, remoteKey, sig)
+	if err != nil {
+		return nil, fmt.Errorf("Server did not prove it holds key [%x]: %s", remoteKey, err.Error())
+	}
+
+	sc := &SecureConn{Conn: c, remoteKey: remoteKey}
+	err = sc.deriveCiphers(eph, remoteEph, transcript, true)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// NewSecureServerConn performs the server side of the secure transport
+// handshake over c, proving to the client that we hold the static key key
+func NewSecureServerConn(c net.Conn, key *btcec.PrivateKey) (*SecureConn, error) {
+	b := make([]byte, 33)
+	_, err := io.ReadFull(c, b)
+	if err != nil {
+		return nil, err
+	}
+	var remoteEph [33]byte
+	copy(remoteEph[:], b)
+
+	eph, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	var ephPub, staticPub [33]byte
+	copy(ephPub[:], eph.PubKey().SerializeCompressed())
+	copy(staticPub[:], key.PubKey().SerializeCompressed())
+
+	transcript := secureTranscript(remoteEph, ephPub, staticPub)
+	hash := fastsha256.Sum256(transcript)
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	csig, err := sig64.SigCompress(sig.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(ephPub[:])
+	buf.Write(staticPub[:])
+	buf.Write(csig[:])
+	_, err = c.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SecureConn{Conn: c, remoteKey: remoteEph}
+	err = sc.deriveCiphers(eph, remoteEph, transcript, false)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// secureTranscript returns the bytes the server signs during the handshake,
+// which commit to both ephemeral keys and the server's static key
+func secureTranscript(clientEph, serverEph, serverKey [33]byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(SecureHandshakeTag)
+	buf.Write(clientEph[:])
+	buf.Write(serverEph[:])
+	buf.Write(serverKey[:])
+	return buf.Bytes()
+}
+
+// deriveCiphers calculates the shared secret between our ephemeral key and
+// the remote one, and derives a key for each direction from it
+func (sc *SecureConn) deriveCiphers(eph *btcec.PrivateKey, remoteEph [33]byte, transcript []byte, client bool) error {
+	pub, err := btcec.ParsePubKey(remoteEph[:], btcec.S256())
+	if err != nil {
+		return err
+	}
+	secret := btcec.GenerateSharedSecret(eph, pub)
+	transcriptHash := fastsha256.Sum256(transcript)
+
+	newCipher := func(direction string) (cipher.AEAD, error) {
+		var buf bytes.Buffer
+		buf.Write(secret)
+		buf.Write(transcriptHash[:])
+		buf.Write([]byte(direction))
+		key := fastsha256.Sum256(buf.Bytes())
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+
+	c2s, err := newCipher("c2s")
+	if err != nil {
+		return err
+	}
+	s2c, err := newCipher("s2c")
+	if err != nil {
+		return err
+	}
+
+	if client {
+		sc.sendCipher, sc.recvCipher = c2s, s2c
+	} else {
+		sc.sendCipher, sc.recvCipher = s2c, c2s
+	}
+	return nil
+}
+
+// RemoteKey returns the static key the server proved to hold. On the server
+// side of the connection, this is the client's ephemeral key.
+func (sc *SecureConn) RemoteKey() [33]byte {
+	return sc.remoteKey
+}
+
+func secureNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+// Write encrypts b and sends it over the underlying connection as one or more
+// records
+func (sc *SecureConn) Write(b []byte) (int, error) {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+
+	written := 0
+	for written < len(b) {
+		end := written + MaxSecureRecordSize
+		if end > len(b) {
+			end = len(b)
+		}
+
+		ct := sc.sendCipher.Seal(nil, secureNonce(sc.sendNonce), b[written:end], nil)
+		sc.sendNonce++
+
+		record := make([]byte, 4+len(ct))
+		binary.BigEndian.PutUint32(record, uint32(len(ct)))
+		copy(record[4:], ct)
+		_, err := sc.Conn.Write(record)
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Read returns decrypted bytes from the underlying connection. Records that
+// fail to authenticate return an error, after which the connection should be
+// closed.
+func (sc *SecureConn) Read(b []byte) (int, error) {
+	sc.readLock.Lock()
+	defer sc.readLock.Unlock()
+
+	if len(sc.readBuf) == 0 {
+		bLen := make([]byte, 4)
+		_, err := io.ReadFull(sc.Conn, bLen)
+		if err != nil {
+			return 0, err
+		}
+		l := binary.BigEndian.Uint32(bLen)
+		if l > MaxSecureRecordSize+uint32(sc.recvCipher.Overhead()) {
+			return 0, fmt.Errorf("Encrypted record too large: %d", l)
+		}
+
+		ct := make([]byte, l)
+		_, err = io.ReadFull(sc.Conn, ct)
+		if err != nil {
+			return 0, err
+		}
+
+		sc.readBuf, err = sc.recvCipher.Open(nil, secureNonce(sc.recvNonce), ct, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Could not authenticate record: %s", err.Error())
+		}
+		sc.recvNonce++
+	}
+
+	n := copy(b, sc.readBuf)
+	sc.readBuf = sc.readBuf[n:]
+	return n, nil
+}
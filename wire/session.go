@@ -0,0 +1,70 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SessionMessage is the payload to a MessageTypeSession. It wraps a message of
+// any other type that belongs to the session with the given ID. Sessions are
+// opened by the first message sent in them, and the version handshake of the
+// connection applies to all of them.
+type SessionMessage struct {
+	SessionID uint32
+	Type      MessageType
+	Payload   []byte
+}
+
+// NewSessionMessage is a convenience function for wrapping a message of type t
+// with payload m in a SessionMessage
+func NewSessionMessage(sessionID uint32, t MessageType, m []byte) *SessionMessage {
+	return &SessionMessage{SessionID: sessionID, Type: t, Payload: m}
+}
+
+// Bytes serializes a SessionMessage to a byte slice
+func (m *SessionMessage) Bytes() []byte {
+	b := make([]byte, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(b[0:4], m.SessionID)
+	b[4] = byte(m.Type)
+	copy(b[5:], m.Payload)
+	return b
+}
+
+// NewSessionMessageFromBytes deserializes a byte slice into a SessionMessage
+func NewSessionMessageFromBytes(b []byte) (*SessionMessage, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("Unexpected length of session message: %d", len(b))
+	}
+	m := new(SessionMessage)
+	m.SessionID = binary.BigEndian.Uint32(b[0:4])
+	m.Type = MessageType(b[4])
+	m.Payload = b[5:]
+	return m, nil
+}
+
+// CloseSessionMessage is the payload to a MessageTypeCloseSession
+type CloseSessionMessage struct {
+	SessionID uint32
+}
+
+// NewCloseSessionMessage is a convenience function for creating a new
+// CloseSessionMessage
+func NewCloseSessionMessage(sessionID uint32) *CloseSessionMessage {
+	return &CloseSessionMessage{SessionID: sessionID}
+}
+
+// Bytes serializes a CloseSessionMessage to a byte slice
+func (m *CloseSessionMessage) Bytes() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, m.SessionID)
+	return b
+}
+
+// NewCloseSessionMessageFromBytes deserializes a byte slice into a
+// CloseSessionMessage
+func NewCloseSessionMessageFromBytes(b []byte) (*CloseSessionMessage, error) {
+	if len(b) != 4 {
+		return nil, fmt.Errorf("Unexpected length of close session message: %d", len(b))
+	}
+	return &CloseSessionMessage{SessionID: binary.BigEndian.Uint32(b)}, nil
+}
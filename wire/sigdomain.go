@@ -0,0 +1,91 @@
+package wire
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mit-dci/go-bverify/crypto"
+)
+
+const (
+	// SignatureVersionLegacy signatures are made over the bare statement,
+	// without any domain separation. They can be replayed against any server.
+	SignatureVersionLegacy byte = 0x00
+
+	// SignatureVersion1 signatures are made over the statement prefixed with
+	// SignatureDomainTag, the version, the network and the server identifier
+	SignatureVersion1 byte = 0x01
+)
+
+// SignatureDomainTag is prepended to every domain-separated signing payload
+var SignatureDomainTag = []byte("b_verify signature")
+
+// SignatureDomain binds signatures to a particular server on a particular
+// network, so that signed statements cannot be replayed elsewhere
+type SignatureDomain struct {
+	Version byte
+
+	// Network identifies the chain the server commits to, which is the hash
+	// of its genesis block
+	Network [32]byte
+
+	// ServerID identifies the server the statement was signed for
+	ServerID [32]byte
+}
+
+// NewSignatureDomain is a convenience function for creating a new
+// SignatureDomain at the current signature version
+func NewSignatureDomain(network, serverID [32]byte) *SignatureDomain {
+	return &SignatureDomain{Version: SignatureVersion1, Network: network, ServerID: serverID}
+}
+
+// Bytes serializes a SignatureDomain to a byte slice
+func (d *SignatureDomain) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{d.Version})
+	buf.Write(d.Network[:])
+	buf.Write(d.ServerID[:])
+	return buf.Bytes()
+}
+
+// NewSignatureDomainFromBytes deserializes a byte slice into a
+// SignatureDomain
+func NewSignatureDomainFromBytes(b []byte) (*SignatureDomain, error) {
+	if len(b) != 1+32+32 {
+		return nil, fmt.Errorf("Unexpected length of signature domain: %d", len(b))
+	}
+	d := new(SignatureDomain)
+	d.Version = b[0]
+	if d.Version != SignatureVersion1 {
+		return nil, fmt.Errorf("Unsupported signature version %d", d.Version)
+	}
+	copy(d.Network[:], b[1:33])
+	copy(d.ServerID[:], b[33:])
+	return d, nil
+}
+
+// Equal returns true if both domains are the same. A nil domain is the
+// legacy domain.
+func (d *SignatureDomain) Equal(o *SignatureDomain) bool {
+	if d == nil || o == nil {
+		return d == nil && o == nil
+	}
+	return bytes.Equal(d.Bytes(), o.Bytes())
+}
+
+// SigningPayload returns the byte slice that is signed for message msg in
+// this domain. A nil domain returns msg itself, which is the legacy payload.
+func (d *SignatureDomain) SigningPayload(msg []byte) []byte {
+	if d == nil {
+		return msg
+	}
+	var buf bytes.Buffer
+	buf.Write(SignatureDomainTag)
+	buf.Write(d.Bytes())
+	buf.Write(msg)
+	return buf.Bytes()
+}
+
+func (d *SignatureDomain) verifySig(msg []byte, pubKey [33]byte, sig [64]byte) error {
+	return crypto.VerifySig(d.SigningPayload(msg), pubKey, sig)
+}
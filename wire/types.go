@@ -3,6 +3,7 @@ package wire
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/mit-dci/go-bverify/mpt"
 
@@ -52,29 +53,49 @@ func (c *Commitment) Bytes() []byte {
 	return b.Bytes()
 }
 
+const (
+	// The size of the fixed fields of a serialized commitment: the
+	// commitment, transaction hash, trigger height, block hash and the length
+	// of the merkle proof
+	minCommitmentSize = 32 + 32 + 4 + 32 + 4
+
+	// MaxCommitmentTxSize is the maximum size of the raw transaction in a
+	// commitment, which is the maximum size of a standard transaction
+	MaxCommitmentTxSize = 100000
+)
+
 // CommitmentFromBytes deserializes a byte slice into a commitment object
-func CommitmentFromBytes(b []byte) *Commitment {
+func CommitmentFromBytes(b []byte) (*Commitment, error) {
+	if len(b) < minCommitmentSize {
+		return nil, fmt.Errorf("Unexpected length of commitment: %d", len(b))
+	}
 	c := Commitment{}
 	buf := bytes.NewBuffer(b)
 	copy(c.Commitment[:], buf.Next(32))
 	nullBytes := make([]byte, 32)
-	txhash := make([]byte, 32)
-	copy(txhash, buf.Next(32))
+	txhash := buf.Next(32)
 	if !bytes.Equal(nullBytes, txhash) {
 		c.TxHash, _ = chainhash.NewHash(txhash)
 	}
-	var i int32
-	binary.Read(buf, binary.BigEndian, &i)
-	c.TriggeredAtBlockHeight = int(i)
-	includedInBlock := make([]byte, 32)
-	copy(includedInBlock, buf.Next(32))
+	c.TriggeredAtBlockHeight = int(int32(binary.BigEndian.Uint32(buf.Next(4))))
+	includedInBlock := buf.Next(32)
 	if !bytes.Equal(nullBytes, includedInBlock) {
 		c.IncludedInBlock, _ = chainhash.NewHash(includedInBlock)
 	}
-	binary.Read(buf, binary.BigEndian, &i)
-	c.MerkleProof = utils.NewMerkleProofFromBytes(buf.Next(int(i)))
+	proofLength := binary.BigEndian.Uint32(buf.Next(4))
+	if proofLength > uint32(buf.Len()) {
+		return nil, fmt.Errorf("Merkle proof length %d exceeds remaining %d bytes", proofLength, buf.Len())
+	}
+	var err error
+	c.MerkleProof, err = utils.NewMerkleProofFromBytes(buf.Next(int(proofLength)))
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() > MaxCommitmentTxSize {
+		return nil, fmt.Errorf("Commitment transaction too large: %d", buf.Len())
+	}
 	c.RawTx = buf.Bytes()
-	return &c
+	return &c, nil
 }
 
 // NewCommitment is a convenience function for creating a new commitment that isn't
@@ -83,6 +104,12 @@ func NewCommitment(c [32]byte, txhash *chainhash.Hash, rawTx []byte, triggerHeig
 	return &Commitment{Commitment: c, TxHash: txhash, RawTx: rawTx, TriggeredAtBlockHeight: triggerHeight}
 }
 
+const (
+	// Flags in the first byte of a serialized ForeignStatement
+	foreignStatementFlagInitial byte = 0x01
+	foreignStatementFlagSealed  byte = 0x02
+)
+
 // ForeignStatement describes the parameters we need to know to follow an arbitrary
 // outside statement that's being witnessed on our connected server.
 type ForeignStatement struct {
@@ -90,6 +117,10 @@ type ForeignStatement struct {
 	// differs.
 	InitialStatement bool
 
+	// Was this the statement that sealed the log? If so, the signature and
+	// hash calculation differ, and it is the final statement of the log.
+	Sealed bool
+
 	// The Log's ID - needed to fetch the proof from the server
 	LogID [32]byte
 
@@ -99,7 +130,8 @@ type ForeignStatement struct {
 	// This is the signature on the statement
 	Signature [64]byte
 
-	// This is the public key that signed the statement
+	// This is the public key that signed the statement, or the controlling
+	// key that delegated the signing when Delegation is set
 	PubKey [33]byte
 
 	// Index is the sequential index of the statement in the log
@@ -108,17 +140,39 @@ type ForeignStatement struct {
 	// Proof is optional, used for historic proofs (we can fetch the current
 	// proof from the server if it's meant to keep live).
 	Proof *mpt.PartialMPT
+
+	// Delegation is optional, used when the statement was signed by a
+	// delegate of the controlling key rather than the controlling key itself
+	Delegation *SignedDelegation
+
+	// SignatureDomain is the domain the signatures were made in, or nil for
+	// legacy signatures without domain separation
+	SignatureDomain *SignatureDomain
+
+	// Nonce and Metadata are part of the initial statement of a log, and are
+	// needed to recalculate its LogID
+	Nonce    []byte
+	Metadata map[string]string
+
+	// Batch is optional, used when the statement was appended atomically with
+	// statements on other logs. The statement is at BatchPosition in the
+	// batch, and Signature is over the batch hash.
+	Batch         *BatchLogStatement
+	BatchPosition int
 }
 
 // Bytes serializes a ForeignStatement object into a byte slice
 func (f *ForeignStatement) Bytes() []byte {
 	var b bytes.Buffer
 
+	flags := byte(0x00)
 	if f.InitialStatement {
-		b.Write([]byte{0x01})
-	} else {
-		b.Write([]byte{0x00})
+		flags |= foreignStatementFlagInitial
+	}
+	if f.Sealed {
+		flags |= foreignStatementFlagSealed
 	}
+	b.Write([]byte{flags})
 
 	b.Write(f.LogID[:])
 	b.Write(f.Signature[:])
@@ -132,30 +186,188 @@ func (f *ForeignStatement) Bytes() []byte {
 		binary.Write(&b, binary.BigEndian, uint32(f.Proof.ByteSize()))
 		f.Proof.Serialize(&b)
 	}
+	if f.Delegation == nil {
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	} else {
+		delegationBytes := f.Delegation.Bytes()
+		binary.Write(&b, binary.BigEndian, uint32(len(delegationBytes)))
+		b.Write(delegationBytes)
+	}
+	if f.SignatureDomain == nil {
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	} else {
+		domainBytes := f.SignatureDomain.Bytes()
+		binary.Write(&b, binary.BigEndian, uint32(len(domainBytes)))
+		b.Write(domainBytes)
+	}
+	if len(f.Nonce) == 0 && len(f.Metadata) == 0 {
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	} else {
+		var ext bytes.Buffer
+		WriteCreateLogExtension(&ext, f.Nonce, f.Metadata)
+		binary.Write(&b, binary.BigEndian, uint32(ext.Len()))
+		b.Write(ext.Bytes())
+	}
+	if f.Batch == nil {
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	} else {
+		var batch bytes.Buffer
+		WriteVarInt(&batch, uint64(f.BatchPosition))
+		batch.Write(f.Batch.Bytes())
+		binary.Write(&b, binary.BigEndian, uint32(batch.Len()))
+		b.Write(batch.Bytes())
+	}
 
 	return b.Bytes()
 }
 
-// ForeignStatementFromBytes deserializes a byte slice into a commitment object
-func ForeignStatementFromBytes(b []byte) *ForeignStatement {
+const (
+	// The size of the fixed fields of a serialized ForeignStatement, up to
+	// and including the length of the proof
+	minForeignStatementSize = 1 + 32 + 64 + 33 + 8 + 4 + 4
+
+	// The maximum sizes of the proof and of the optional sections that
+	// follow it in a serialized ForeignStatement
+	maxForeignStatementProofSize   = 1 << 20
+	maxForeignStatementSectionSize = 1 << 16
+
+	// MaxForeignStatementSize is the maximum size of a serialized
+	// ForeignStatement
+	MaxForeignStatementSize = minForeignStatementSize + MaxStatementLength +
+		maxForeignStatementProofSize + 4*(4+maxForeignStatementSectionSize)
+)
+
+// readForeignStatementSection reads a length prefixed section of a serialized
+// ForeignStatement. It returns nil without an error when the statement ends
+// before the section, since statements exported by older versions lack the
+// sections that were added later.
+func readForeignStatementSection(buf *bytes.Buffer, max uint32) ([]byte, error) {
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	if buf.Len() < 4 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
+	l := binary.BigEndian.Uint32(buf.Next(4))
+	if l > max {
+		return nil, fmt.Errorf("Section of foreign statement too large: %d", l)
+	}
+	if l > uint32(buf.Len()) {
+		return nil, fmt.Errorf("Section length %d exceeds remaining %d bytes", l, buf.Len())
+	}
+	return buf.Next(int(l)), nil
+}
+
+// ForeignStatementFromBytes deserializes a byte slice into a ForeignStatement
+func ForeignStatementFromBytes(b []byte) (*ForeignStatement, error) {
+	if len(b) < minForeignStatementSize {
+		return nil, fmt.Errorf("Unexpected length of foreign statement: %d", len(b))
+	}
+	if len(b) > MaxForeignStatementSize {
+		return nil, fmt.Errorf("Foreign statement too large: %d", len(b))
+	}
+
 	f := ForeignStatement{}
 	buf := bytes.NewBuffer(b)
 
-	f.InitialStatement = bytes.Equal(buf.Next(1), []byte{0x01})
+	flags := buf.Next(1)[0]
+	f.InitialStatement = flags&foreignStatementFlagInitial != 0
+	f.Sealed = flags&foreignStatementFlagSealed != 0
 	copy(f.LogID[:], buf.Next(32))
 	copy(f.Signature[:], buf.Next(64))
 	copy(f.PubKey[:], buf.Next(33))
+	f.Index = binary.BigEndian.Uint64(buf.Next(8))
+
+	statement, err := readForeignStatementSection(buf, MaxStatementLength)
+	if err != nil {
+		return nil, err
+	}
+	f.StatementPreimage = string(statement)
+
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("Unexpected end of buffer")
+	}
+	proof, err := readForeignStatementSection(buf, maxForeignStatementProofSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(proof) > 0 {
+		r := bytes.NewReader(proof)
+		f.Proof, err = mpt.DeserializeNewPartialMPT(r)
+		if err != nil {
+			return nil, err
+		}
+		if r.Len() > 0 {
+			return nil, fmt.Errorf("Unexpected trailing bytes after proof")
+		}
+	}
+
+	// Statements exported before delegations existed end here
+	delegation, err := readForeignStatementSection(buf, maxForeignStatementSectionSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(delegation) > 0 {
+		f.Delegation, err = NewSignedDelegationFromBytes(delegation)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	binary.Read(buf, binary.BigEndian, &f.Index)
+	// Statements exported before signature domains existed end here
+	domain, err := readForeignStatementSection(buf, maxForeignStatementSectionSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(domain) > 0 {
+		f.SignatureDomain, err = NewSignatureDomainFromBytes(domain)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	iLen := uint32(0)
-	binary.Read(buf, binary.BigEndian, &iLen)
-	f.StatementPreimage = string(buf.Next(int(iLen)))
+	// Statements exported before log metadata existed end here
+	ext, err := readForeignStatementSection(buf, maxForeignStatementSectionSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(ext) > 0 {
+		extBuf := bytes.NewBuffer(ext)
+		f.Nonce, f.Metadata, err = ReadCreateLogExtension(extBuf)
+		if err != nil {
+			return nil, err
+		}
+		if len(f.Nonce) == 0 && len(f.Metadata) == 0 {
+			return nil, fmt.Errorf("Empty nonce and metadata")
+		}
+		if extBuf.Len() > 0 {
+			return nil, fmt.Errorf("Unexpected trailing bytes after log metadata")
+		}
+	}
 
-	binary.Read(buf, binary.BigEndian, &iLen)
-	if iLen > 0 {
-		f.Proof, _ = mpt.DeserializeNewPartialMPT(buf)
+	// Statements exported before batches existed end here
+	batch, err := readForeignStatementSection(buf, maxForeignStatementSectionSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(batch) > 0 {
+		batchBuf := bytes.NewBuffer(batch)
+		position, err := ReadVarInt(batchBuf)
+		if err != nil {
+			return nil, err
+		}
+		f.Batch, err = NewBatchLogStatementFromBytes(batchBuf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if position >= uint64(len(f.Batch.Statements)) {
+			return nil, fmt.Errorf("Batch position %d out of range", position)
+		}
+		f.BatchPosition = int(position)
 	}
 
-	return &f
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("Unexpected trailing bytes after foreign statement")
+	}
+	return &f, nil
 }
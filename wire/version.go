@@ -0,0 +1,153 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the wire protocol implemented by this
+// package
+const ProtocolVersion uint32 = 1
+
+// MinProtocolVersion is the oldest version of the wire protocol we still
+// talk to
+const MinProtocolVersion uint32 = 1
+
+// FeatureFlags is a bitfield of optional protocol features. Only the features
+// both sides support are used on a connection.
+type FeatureFlags uint64
+
+const (
+	// FeatureDelegation allows MessageTypeDelegateLog and
+	// MessageTypeRevokeDelegation
+	FeatureDelegation FeatureFlags = 1 << iota
+
+	// FeatureSealing allows MessageTypeSealLog
+	FeatureSealing
+
+	// FeatureSignatureDomain allows MessageTypeRequestSignatureDomain and
+	// MessageTypeSignatureDomain
+	FeatureSignatureDomain
+
+	// FeatureLogMetadata allows MessageTypeRequestLogInfo and
+	// MessageTypeLogInfo
+	FeatureLogMetadata
+
+	// FeatureBatchAppend allows MessageTypeBatchAppendLog
+	FeatureBatchAppend
+
+	// FeatureRequestIDs makes every frame after the handshake carry the ID
+	// of the request it belongs to, so that a client can have many requests
+	// in flight at once
+	FeatureRequestIDs
+
+	// FeatureKeepalive allows MessageTypePing and MessageTypePong
+	FeatureKeepalive
+
+	// FeatureErrorCodes makes the server send an ErrorMessage instead of
+	// plain text in a MessageTypeError, and keep the connection open after
+	// errors that are not fatal
+	FeatureErrorCodes
+
+	// FeatureLogStatus allows MessageTypeRequestLogStatus and
+	// MessageTypeLogStatus
+	FeatureLogStatus
+
+	// FeatureWatchLogs allows MessageTypeWatchLogs and
+	// MessageTypeUnwatchLogs
+	FeatureWatchLogs
+
+	// FeatureSessions allows MessageTypeSession and MessageTypeCloseSession,
+	// which multiplex many logical sessions over one connection
+	FeatureSessions
+
+	// FeatureCommitmentNotify makes the server send a
+	// MessageTypeNewCommitment when one of its commitments is included in
+	// a block
+	FeatureCommitmentNotify
+)
+
+// SupportedFeatures are the features implemented by this package
+const SupportedFeatures = FeatureDelegation | FeatureSealing | FeatureSignatureDomain |
+	FeatureLogMetadata | FeatureBatchAppend | FeatureRequestIDs | FeatureKeepalive |
+	FeatureErrorCodes | FeatureLogStatus | FeatureWatchLogs | FeatureSessions |
+	FeatureCommitmentNotify
+
+// messageFeatures maps the message types that are not part of the base
+// protocol to the feature that has to be negotiated to use them
+var messageFeatures = map[MessageType]FeatureFlags{
+	MessageTypeDelegateLog:            FeatureDelegation,
+	MessageTypeRevokeDelegation:       FeatureDelegation,
+	MessageTypeSealLog:                FeatureSealing,
+	MessageTypeRequestSignatureDomain: FeatureSignatureDomain,
+	MessageTypeSignatureDomain:        FeatureSignatureDomain,
+	MessageTypeRequestLogInfo:         FeatureLogMetadata,
+	MessageTypeLogInfo:                FeatureLogMetadata,
+	MessageTypeBatchAppendLog:         FeatureBatchAppend,
+	MessageTypePing:                   FeatureKeepalive,
+	MessageTypePong:                   FeatureKeepalive,
+	MessageTypeRequestLogStatus:       FeatureLogStatus,
+	MessageTypeLogStatus:              FeatureLogStatus,
+	MessageTypeWatchLogs:              FeatureWatchLogs,
+	MessageTypeUnwatchLogs:            FeatureWatchLogs,
+	MessageTypeSession:                FeatureSessions,
+	MessageTypeCloseSession:           FeatureSessions,
+	MessageTypeNewCommitment:          FeatureCommitmentNotify,
+}
+
+// Has returns true if all features in o are set
+func (f FeatureFlags) Has(o FeatureFlags) bool {
+	return f&o == o
+}
+
+// Allows returns true if message type t can be used with these features
+func (f FeatureFlags) Allows(t MessageType) bool {
+	required, ok := messageFeatures[t]
+	return !ok || f.Has(required)
+}
+
+// VersionMessage is the payload to a MessageTypeVersion and a
+// MessageTypeVersionAck
+type VersionMessage struct {
+	ProtocolVersion uint32
+	Features        FeatureFlags
+
+	// Network is the hash of the genesis block of the chain the server
+	// commits to. A client can leave it empty to accept any network.
+	Network [32]byte
+
+	// ServerID is the identity of the server. It is empty when sent by a
+	// client.
+	ServerID [32]byte
+}
+
+// NewVersionMessage is a convenience function for creating a new
+// VersionMessage at the current protocol version
+func NewVersionMessage(features FeatureFlags, network, serverID [32]byte) *VersionMessage {
+	return &VersionMessage{ProtocolVersion: ProtocolVersion, Features: features, Network: network, ServerID: serverID}
+}
+
+// Bytes serializes a VersionMessage to a byte slice
+func (m *VersionMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, m.ProtocolVersion)
+	binary.Write(&buf, binary.BigEndian, uint64(m.Features))
+	buf.Write(m.Network[:])
+	buf.Write(m.ServerID[:])
+	return buf.Bytes()
+}
+
+// NewVersionMessageFromBytes deserializes a byte slice into a VersionMessage.
+// Later protocol versions may append fields, which are ignored.
+func NewVersionMessageFromBytes(b []byte) (*VersionMessage, error) {
+	if len(b) < 4+8+32+32 {
+		return nil, fmt.Errorf("Unexpected length of version message: %d", len(b))
+	}
+	m := new(VersionMessage)
+	m.ProtocolVersion = binary.BigEndian.Uint32(b[0:4])
+	m.Features = FeatureFlags(binary.BigEndian.Uint64(b[4:12]))
+	copy(m.Network[:], b[12:44])
+	copy(m.ServerID[:], b[44:76])
+	return m, nil
+}
@@ -0,0 +1,67 @@
+package wire
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestVersionMessage(t *testing.T) {
+	m := NewVersionMessage(FeatureSealing|FeatureBatchAppend, [32]byte{0x01}, [32]byte{0x02})
+	m2, err := NewVersionMessageFromBytes(m.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *m != *m2 {
+		t.Error("Version message did not survive serialization")
+		return
+	}
+
+	// Fields appended by later versions are ignored
+	_, err = NewVersionMessageFromBytes(append(m.Bytes(), 0x00))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = NewVersionMessageFromBytes(m.Bytes()[:20])
+	if err == nil {
+		t.Error("Expected truncated version message to fail")
+		return
+	}
+
+	if !m.Features.Allows(MessageTypeSealLog) || m.Features.Allows(MessageTypeDelegateLog) {
+		t.Error("Features allow the wrong message types")
+		return
+	}
+	if !FeatureFlags(0).Allows(MessageTypeAppendLog) {
+		t.Error("Base message types should always be allowed")
+		return
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	m := NewErrorMessage(ErrorCodeIndexMismatch, 42, "Unexpected log index")
+	m2, err := NewErrorMessageFromBytes(m.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *m != *m2 {
+		t.Error("Error message did not survive serialization")
+		return
+	}
+	if m2.Fatal || !NewErrorMessage(ErrorCodeProtocol, 0, "").Fatal {
+		t.Error("Wrong errors are fatal")
+		return
+	}
+
+	if ErrorCodeOf(NewError(ErrorCodeUnknownLog, "LogID not found")) != ErrorCodeUnknownLog {
+		t.Error("Error code got lost")
+		return
+	}
+	if ErrorCodeOf(fmt.Errorf("Something else")) != ErrorCodeUnknown {
+		t.Error("Expected plain errors to have unknown code")
+		return
+	}
+}
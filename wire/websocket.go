@@ -0,0 +1,111 @@
+package wire
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/go-bverify/bitcoin/websocket"
+)
+
+// WebSocketConn is a net.Conn that carries frames over a WebSocket
+// connection, so browsers can talk to the server without a proxy. Every write
+// is sent as a single binary message, and reads continue across message
+// boundaries like on a raw TCP connection.
+type WebSocketConn struct {
+	ws *websocket.Conn
+
+	// The message we're currently reading from
+	reader   io.Reader
+	readLock sync.Mutex
+}
+
+// NewWebSocketConn wraps an established WebSocket connection
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{ws: ws}
+}
+
+// DialWebSocket connects to the WebSocket endpoint of a server at url, for
+// instance ws://localhost:9101/
+func DialWebSocket(url string) (*WebSocketConn, error) {
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebSocketConn(ws), nil
+}
+
+// Read reads from the current binary message, moving on to the next message
+// when it is exhausted. Other message types are skipped.
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for {
+		if c.reader == nil {
+			mt, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends b as a single binary message
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	err := c.ws.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying connection
+func (c *WebSocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// LocalAddr returns the local network address
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// SetDeadline sets both the read and write deadline
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying connection
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}